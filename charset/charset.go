@@ -0,0 +1,281 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package charset decodes text in the encodings common in source files
+// to UTF-8: UTF-16, recognized by its byte order mark, and the single-byte
+// encodings Latin-1 and Windows-1252.
+package charset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// An Encoding is a character encoding.
+type Encoding int
+
+const (
+	// Auto decodes UTF-16 text that begins with a byte order mark,
+	// and Windows-1252 text whose start is not valid UTF-8 but looks
+	// like text, as described for Sniff. It passes other text through
+	// unchanged. A UTF-8 byte order mark is removed.
+	Auto Encoding = iota
+
+	UTF8        // UTF-8, passed through unchanged
+	UTF16       // UTF-16, little-endian unless a byte order mark says otherwise
+	UTF16LE     // UTF-16, little-endian
+	UTF16BE     // UTF-16, big-endian
+	Latin1      // ISO 8859-1
+	Windows1252 // Windows code page 1252, Latin-1 with printable 0x80-0x9F
+)
+
+var names = []string{
+	Auto:        "auto",
+	UTF8:        "utf-8",
+	UTF16:       "utf-16",
+	UTF16LE:     "utf-16le",
+	UTF16BE:     "utf-16be",
+	Latin1:      "latin1",
+	Windows1252: "windows-1252",
+}
+
+// String returns the name of the encoding, as accepted by Set.
+func (e Encoding) String() string {
+	if e < 0 || int(e) >= len(names) {
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+	return names[e]
+}
+
+// Set sets the encoding from its name, for use as a flag.Value.
+// It also accepts the names utf8, utf16, utf16le, utf16be,
+// iso-8859-1, and cp1252.
+func (e *Encoding) Set(s string) error {
+	switch s {
+	case "utf8":
+		s = "utf-8"
+	case "utf16", "utf16le", "utf16be":
+		s = "utf-" + s[3:]
+	case "iso-8859-1":
+		s = "latin1"
+	case "cp1252":
+		s = "windows-1252"
+	}
+	for i, name := range names {
+		if s == name {
+			*e = Encoding(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown encoding %q; want auto, utf-8, utf-16, utf-16le, utf-16be, latin1, or windows-1252", s)
+}
+
+// Byte order marks.
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// Detect returns the encoding indicated by the byte order mark at the
+// start of data, and the length of the mark. Without a mark, it returns
+// UTF8 and 0.
+func Detect(data []byte) (Encoding, int) {
+	switch {
+	case bytes.HasPrefix(data, bomUTF8):
+		return UTF8, len(bomUTF8)
+	case bytes.HasPrefix(data, bomUTF16LE):
+		return UTF16LE, len(bomUTF16LE)
+	case bytes.HasPrefix(data, bomUTF16BE):
+		return UTF16BE, len(bomUTF16BE)
+	}
+	return UTF8, 0
+}
+
+// SniffLen is the number of bytes at the start of a text that
+// Sniff examines.
+const SniffLen = 4096
+
+// Sniff returns the encoding of the text beginning with data, which
+// holds its first SniffLen bytes or, if shorter, all of it. A byte
+// order mark says the encoding. Otherwise, data that is valid UTF-8
+// is UTF8, and data that is not but has no control characters other
+// than tab, newline, vertical tab, form feed, and carriage return
+// is Windows1252, a superset of the printable characters of Latin-1.
+// Anything else, such as binary data, is UTF8.
+func Sniff(data []byte) Encoding {
+	if e, size := Detect(data); size > 0 {
+		return e
+	}
+	if len(data) >= SniffLen {
+		// Ignore a rune cut off by the end of data.
+		for k := 1; k <= utf8.UTFMax && k <= len(data); k++ {
+			if utf8.RuneStart(data[len(data)-k]) {
+				if !utf8.FullRune(data[len(data)-k:]) {
+					data = data[:len(data)-k]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(data) {
+		return UTF8
+	}
+	for _, c := range data {
+		if c < 0x20 && (c < '\t' || c > '\r') || c == 0x7F {
+			return UTF8
+		}
+	}
+	return Windows1252
+}
+
+// NewReader returns a reader of the text read from r, in the encoding
+// e, decoded to UTF-8. Invalid input decodes to utf8.RuneError.
+func NewReader(r io.Reader, e Encoding) (io.Reader, error) {
+	if e == UTF8 {
+		return r, nil
+	}
+	if e == Auto || e == UTF16 {
+		// Look for a byte order mark or, for Auto, sniff the text.
+		n := len(bomUTF8)
+		if e == Auto {
+			n = SniffLen
+		}
+		head := make([]byte, n)
+		n, err := io.ReadFull(r, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		head = head[:n]
+		bom, size := Detect(head)
+		r = io.MultiReader(bytes.NewReader(head[size:]), r)
+		switch {
+		case size > 0:
+			e = bom
+		case e == UTF16:
+			e = UTF16LE
+		default:
+			e = Sniff(head)
+		}
+	}
+	switch e {
+	case UTF8:
+		return r, nil
+	case UTF16LE:
+		return &decoder{r: r, decode: decodeUTF16(binary.LittleEndian)}, nil
+	case UTF16BE:
+		return &decoder{r: r, decode: decodeUTF16(binary.BigEndian)}, nil
+	case Latin1:
+		return &decoder{r: r, decode: decodeLatin1}, nil
+	case Windows1252:
+		return &decoder{r: r, decode: decodeWindows1252}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %v", e)
+}
+
+// A decoder is a reader decoding text read from r to UTF-8.
+type decoder struct {
+	r   io.Reader
+	in  [4096]byte
+	n   int    // bytes of input held in in
+	out []byte // decoded text not yet read
+	buf []byte // storage for out
+	err error
+
+	// decode appends to out the decoded form of in and returns the
+	// number of bytes of in decoded. If eof is false, it may leave
+	// an incomplete character at the end of in undecoded.
+	decode func(out, in []byte, eof bool) ([]byte, int)
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 && d.err == nil {
+		n, err := d.r.Read(d.in[d.n:])
+		d.n += n
+		d.err = err
+		var used int
+		d.out, used = d.decode(d.buf[:0], d.in[:d.n], err != nil)
+		d.buf = d.out
+		d.n = copy(d.in[:], d.in[used:d.n])
+	}
+	if len(d.out) == 0 {
+		return 0, d.err
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// decodeUTF16 returns a decode function for UTF-16 in the byte order.
+func decodeUTF16(order binary.ByteOrder) func(out, in []byte, eof bool) ([]byte, int) {
+	return func(out, in []byte, eof bool) ([]byte, int) {
+		i := 0
+		for i+2 <= len(in) {
+			r := rune(order.Uint16(in[i:]))
+			size := 2
+			if utf16.IsSurrogate(r) {
+				if i+4 > len(in) && !eof {
+					break
+				}
+				if i+4 <= len(in) {
+					if r2 := utf16.DecodeRune(r, rune(order.Uint16(in[i+2:]))); r2 != utf8.RuneError {
+						r, size = r2, 4
+					}
+				}
+				if size == 2 {
+					r = utf8.RuneError
+				}
+			}
+			out = appendRune(out, r)
+			i += size
+		}
+		if eof && i < len(in) {
+			// A trailing odd byte.
+			out = appendRune(out, utf8.RuneError)
+			i = len(in)
+		}
+		return out, i
+	}
+}
+
+// decodeLatin1 decodes ISO 8859-1, in which each byte is the
+// code point of the same value.
+func decodeLatin1(out, in []byte, eof bool) ([]byte, int) {
+	for _, c := range in {
+		out = appendRune(out, rune(c))
+	}
+	return out, len(in)
+}
+
+// windows1252 maps the bytes 0x80 through 0x9F of Windows-1252 to
+// their code points. The five bytes the code page leaves undefined
+// map to the same code points as in Latin-1.
+var windows1252 = [32]rune{
+	'\u20AC', '\u0081', '\u201A', '\u0192', '\u201E', '\u2026', '\u2020', '\u2021',
+	'\u02C6', '\u2030', '\u0160', '\u2039', '\u0152', '\u008D', '\u017D', '\u008F',
+	'\u0090', '\u2018', '\u2019', '\u201C', '\u201D', '\u2022', '\u2013', '\u2014',
+	'\u02DC', '\u2122', '\u0161', '\u203A', '\u0153', '\u009D', '\u017E', '\u0178',
+}
+
+// decodeWindows1252 decodes Windows code page 1252.
+func decodeWindows1252(out, in []byte, eof bool) ([]byte, int) {
+	for _, c := range in {
+		r := rune(c)
+		if 0x80 <= c && c < 0xA0 {
+			r = windows1252[c-0x80]
+		}
+		out = appendRune(out, r)
+	}
+	return out, len(in)
+}
+
+func appendRune(out []byte, r rune) []byte {
+	var b [utf8.UTFMax]byte
+	n := utf8.EncodeRune(b[:], r)
+	return append(out, b[:n]...)
+}
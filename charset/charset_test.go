@@ -0,0 +1,103 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package charset
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var decodeTests = []struct {
+	enc Encoding
+	in  string
+	out string
+}{
+	{Auto, "hello\n", "hello\n"},
+	{Auto, "\xef\xbb\xbfhello", "hello"},
+	{Auto, "\xff\xfeh\x00i\x00", "hi"},
+	{Auto, "\xfe\xff\x00h\x00i", "hi"},
+	{Auto, "h\x00i\x00", "h\x00i\x00"},
+	{Auto, "", ""},
+	{Auto, "a", "a"},
+	{UTF8, "\xff\xfeh\x00", "\xff\xfeh\x00"},
+	{UTF16, "h\x00i\x00", "hi"},
+	{UTF16, "\xfe\xff\x00h\x00i", "hi"},
+	{UTF16LE, "\xe9\x00=\xd8\x00\xde", "é😀"},
+	{UTF16BE, "\x00\xe9\xd8=\xde\x00", "é😀"},
+	{UTF16LE, "=\xd8a\x00", "�a"},
+	{UTF16LE, "\x00\xdea\x00", "�a"},
+	{UTF16LE, "=\xd8", "�"},
+	{UTF16LE, "a\x00b", "a�"},
+	{Latin1, "caf\xe9 \xff", "café ÿ"},
+	{Latin1, "\x93q\x94", "\u0093q\u0094"},
+	{Windows1252, "\x93q\x94 \x80\x81", "“q” €\u0081"},
+	{Auto, "caf\xe9\r\n", "café\r\n"},
+	{Auto, "caf\xe9\x00", "caf\xe9\x00"},
+	{Auto, strings.Repeat("x", SniffLen) + "\xe9", strings.Repeat("x", SniffLen) + "\xe9"},
+}
+
+func TestNewReader(t *testing.T) {
+	for _, tt := range decodeTests {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = strings.NewReader(tt.in)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			r, err := NewReader(r, tt.enc)
+			if err != nil {
+				t.Errorf("NewReader(%q, %v): %v", tt.in, tt.enc, err)
+				continue
+			}
+			out, err := io.ReadAll(r)
+			if err != nil || string(out) != tt.out {
+				t.Errorf("decode %v %q (one byte %v) = %q, %v, want %q", tt.enc, tt.in, oneByte, out, err, tt.out)
+			}
+		}
+	}
+}
+
+var sniffTests = []struct {
+	in  string
+	enc Encoding
+}{
+	{"", UTF8},
+	{"hello\n", UTF8},
+	{"héllo\n", UTF8},
+	{"\xff\xfeh\x00", UTF16LE},
+	{"\xfe\xff\x00h", UTF16BE},
+	{"\xef\xbb\xbfh", UTF8},
+	{"h\xe9llo\tw\xf6rld\f\r\n", Windows1252},
+	{"\x93quoted\x94", Windows1252},
+	{"h\xe9llo\x00", UTF8},
+	{"h\xe9llo\x1b[0m", UTF8},
+	{strings.Repeat("x", SniffLen-1) + "\xc3", UTF8},
+	{strings.Repeat("x", SniffLen-2) + "\xc3", Windows1252},
+}
+
+func TestSniff(t *testing.T) {
+	for _, tt := range sniffTests {
+		if enc := Sniff([]byte(tt.in)); enc != tt.enc {
+			t.Errorf("Sniff(%.20q) = %v, want %v", tt.in, enc, tt.enc)
+		}
+	}
+}
+
+func TestEncodingFlag(t *testing.T) {
+	for e := Auto; e <= Windows1252; e++ {
+		var e2 Encoding = -1
+		if err := e2.Set(e.String()); err != nil || e2 != e {
+			t.Errorf("Set(%q) = %v, %v, want %v", e.String(), e2, err, e)
+		}
+	}
+	var e Encoding
+	if err := e.Set("utf16be"); err != nil || e != UTF16BE {
+		t.Errorf("Set(utf16be) = %v, %v, want utf-16be", e, err)
+	}
+	if err := e.Set("ebcdic"); err == nil {
+		t.Error("Set(ebcdic) succeeded")
+	}
+}
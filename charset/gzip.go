@@ -0,0 +1,63 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package charset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// ErrTruncatedGzip is the error reading a gzip stream that ends early.
+// Readers returned by Gunzip report it in place of io.ErrUnexpectedEOF,
+// which callers reading with io.ReadFull would take for the end of the
+// data.
+var ErrTruncatedGzip = errors.New("gzip: unexpected end of data")
+
+// gzipMagic begins every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// IsGzip reports whether data begins with the gzip magic number.
+func IsGzip(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic)
+}
+
+// Gunzip returns a reader of the data read from r, decompressed if it
+// is gzip-compressed, as recognized by its magic number, and reports
+// whether it is. Like zcat, it decompresses concatenated gzip streams
+// as one. Data not compressed is passed through unchanged.
+func Gunzip(r io.Reader) (io.Reader, bool, error) {
+	head := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	r = io.MultiReader(bytes.NewReader(head[:n]), r)
+	if !IsGzip(head[:n]) {
+		return r, false, nil
+	}
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrTruncatedGzip
+		}
+		return nil, false, err
+	}
+	return &gzipReader{z}, true, nil
+}
+
+// A gzipReader is a gzip.Reader reporting ErrTruncatedGzip.
+type gzipReader struct {
+	z *gzip.Reader
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	n, err := r.z.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = ErrTruncatedGzip
+	}
+	return n, err
+}
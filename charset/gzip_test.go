@@ -0,0 +1,66 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package charset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func gzipped(t *testing.T, s string) string {
+	var b bytes.Buffer
+	z := gzip.NewWriter(&b)
+	if _, err := z.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestGunzip(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		out  string
+		gzip bool
+	}{
+		{"", "", false},
+		{"\x1f", "\x1f", false},
+		{"hello\n", "hello\n", false},
+		{gzipped(t, "hello\n"), "hello\n", true},
+		{gzipped(t, "hello, ") + gzipped(t, "world\n"), "hello, world\n", true},
+	} {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = strings.NewReader(tt.in)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			r, gz, err := Gunzip(r)
+			if err != nil {
+				t.Errorf("Gunzip(%q): %v", tt.in, err)
+				continue
+			}
+			out, err := io.ReadAll(r)
+			if err != nil || string(out) != tt.out || gz != tt.gzip {
+				t.Errorf("Gunzip(%q) (one byte %v) = %q, %v, %v, want %q, %v", tt.in, oneByte, out, gz, err, tt.out, tt.gzip)
+			}
+		}
+	}
+
+	// A stream cut short is an error.
+	bad := gzipped(t, "hello\n")
+	r, _, err := Gunzip(strings.NewReader(bad[:len(bad)-4]))
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if err != ErrTruncatedGzip {
+		t.Errorf("Gunzip of truncated stream: %v, want %v", err, ErrTruncatedGzip)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andrewarchi/codesearch/index"
+	"github.com/andrewarchi/codesearch/internal/cli"
+	"github.com/andrewarchi/codesearch/regexp"
+)
+
+var usageMessage = `usage: cbench [-index path] [-i] [-runs n] [-json] [-f queryfile] [-loglevel level] [regexp...]
+
+cbench measures how well an index built by cindex serves a set of
+searches. It runs each regexp given as an argument, or each line of
+the file named by -f, twice: through the index, as csearch does, and
+by brute force, reading every indexed file, as csearch -brute does.
+It then prints a line for each search and a summary.
+
+The columns are the candidate files found by the index; the files
+that match; the precision of the index, which is the share of
+candidates that match; the files that match but were missed by the
+index, which should be none; the times taken by the phases of the
+indexed search: evaluating the posting query, looking up the names of
+the candidates, and reading them; the total times of the indexed and
+brute-force searches; the speedup of the index over brute force; and
+the search. The summary gives the total times and their ratio.
+
+A precision near 1 means the index narrows searches well. A low one,
+for searches that should be selective, suggests a search for text
+too common to narrow, or an index without quadgrams that would help
+(see cindex -quadgrams). Missed files mean the index is out of date:
+they were modified since indexing, and cindex should be run again.
+
+Each search is run -runs times, 1 by default, and the fastest run of
+each kind is reported, so that later runs show the speed with a warm
+cache. The -i flag makes the searches case-insensitive. The -json flag
+prints a JSON object for each search instead, with the times in
+nanoseconds. The -index flag names the index, by default the one
+csearch would use.
+`
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var (
+	indexFlag = flag.String("index", "", "path to the index")
+	iFlag     = flag.Bool("i", false, "case-insensitive search")
+	runsFlag  = flag.Int("runs", 1, "run each search `n` times, reporting the fastest")
+	jsonFlag  = flag.Bool("json", false, "print a JSON object for each search")
+	fileFlag  = flag.String("f", "", "read searches from `file`, one regexp per line")
+)
+
+// logLevelFlag is the level set by the -loglevel flag.
+var logLevelFlag = cli.LogLevel()
+
+// A result is the outcome of benchmarking a search.
+type result struct {
+	Query      string        `json:"query"`
+	Candidates int           `json:"candidates"` // files found by the index
+	Matches    int           `json:"matches"`    // files matching, by brute force
+	Missed     int           `json:"missed"`     // matching files not found by the index
+	Precision  float64       `json:"precision"`  // share of candidates matching
+	Plan       time.Duration `json:"plan"`       // compiling the regexp and query
+	PostQuery  time.Duration `json:"postquery"`  // evaluating the posting query
+	Names      time.Duration `json:"names"`      // looking up candidate names
+	Grep       time.Duration `json:"grep"`       // reading the candidates
+	Indexed    time.Duration `json:"indexed"`    // the whole indexed search
+	Brute      time.Duration `json:"brute"`      // the whole brute-force search
+	Speedup    float64       `json:"speedup"`    // Brute / Indexed
+}
+
+func main() {
+	log.SetPrefix("cbench: ")
+	log.SetFlags(0)
+	flag.Usage = usage
+	flag.Parse()
+	slog.SetLogLoggerLevel(*logLevelFlag)
+	queries := flag.Args()
+	if *fileFlag != "" {
+		qs, err := readQueries(*fileFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		queries = append(queries, qs...)
+	}
+	if len(queries) == 0 || *runsFlag < 1 {
+		usage()
+	}
+
+	file := *indexFlag
+	if file == "" {
+		file = index.File()
+	}
+	ix, err := index.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ix.Close()
+
+	var results []*result
+	for _, q := range queries {
+		r, err := bench(ix, q)
+		if err != nil {
+			log.Fatalf("%s: %v", q, err)
+		}
+		results = append(results, r)
+	}
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range results {
+			if err := enc.Encode(r); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	printResults(os.Stdout, results)
+}
+
+// readQueries returns the non-blank lines of the named file.
+func readQueries(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var qs []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			qs = append(qs, line)
+		}
+	}
+	return qs, s.Err()
+}
+
+// bench runs the search for the regexp expr through ix and by brute
+// force, -runs times each, and returns the result.
+func bench(ix *index.Index, expr string) (*result, error) {
+	r := &result{Query: expr}
+	gzipped, err := ix.GzippedNames()
+	if err != nil {
+		return nil, err
+	}
+	var indexed, brute map[string]bool
+	for i := 0; i < *runsFlag; i++ {
+		var run result
+		start := time.Now()
+		g, q, err := compile(ix, expr)
+		if err != nil {
+			return nil, err
+		}
+		run.Plan = time.Since(start)
+		var st index.SearchStats
+		names, err := ix.Search(q, &index.SearchOptions{Stats: &st})
+		if err != nil {
+			return nil, err
+		}
+		run.PostQuery, run.Names = st.Query, st.Names
+		grepStart := time.Now()
+		indexed = grepFiles(g, names, gzipped)
+		run.Grep = time.Since(grepStart)
+		run.Indexed = time.Since(start)
+		r.Candidates = len(names)
+
+		start = time.Now()
+		g, _, err = compile(ix, expr)
+		if err != nil {
+			return nil, err
+		}
+		all, err := ix.Search(&index.Query{Op: index.QAll}, nil)
+		if err != nil {
+			return nil, err
+		}
+		brute = grepFiles(g, all, gzipped)
+		run.Brute = time.Since(start)
+
+		if i == 0 || run.Indexed < r.Indexed {
+			r.Plan, r.PostQuery, r.Names, r.Grep, r.Indexed = run.Plan, run.PostQuery, run.Names, run.Grep, run.Indexed
+		}
+		if i == 0 || run.Brute < r.Brute {
+			r.Brute = run.Brute
+		}
+	}
+	r.Matches = len(brute)
+	for name := range brute {
+		if !indexed[name] {
+			r.Missed++
+		}
+	}
+	r.Precision = 1
+	if r.Candidates > 0 {
+		r.Precision = float64(len(indexed)) / float64(r.Candidates)
+	}
+	r.Speedup = float64(r.Brute) / float64(max(r.Indexed, 1))
+	return r, nil
+}
+
+// compile returns a Grep finding the files matching expr in ix, and
+// the index query for it, as csearch would.
+func compile(ix *index.Index, expr string) (*regexp.Grep, *index.Query, error) {
+	mode, err := ix.Normalization()
+	if err != nil {
+		return nil, nil, err
+	}
+	flags := syntax.Perl &^ syntax.OneLine
+	if *iFlag {
+		flags |= syntax.FoldCase
+	}
+	re, err := regexp.CompileFlags(mode.Normalize(expr), flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	g := &regexp.Grep{
+		Regexp:    re,
+		Stdout:    io.Discard,
+		Stderr:    io.Discard,
+		Normalize: mode,
+		Q:         true,
+	}
+	q := index.RegexpQuery(re.Syntax)
+	if ix.HasQuadgrams() {
+		q = index.RegexpQuadQuery(re.Syntax)
+	}
+	return g, q, nil
+}
+
+// grepFiles returns the set of the named files that g matches,
+// decompressing those named in gzipped, which is sorted, as they
+// were indexed.
+func grepFiles(g *regexp.Grep, names, gzipped []string) map[string]bool {
+	matched := make(map[string]bool)
+	for _, name := range names {
+		g.Match = false
+		_, g.Gunzip = slices.BinarySearch(gzipped, name)
+		g.File(name)
+		if g.Match {
+			matched[name] = true
+		}
+	}
+	return matched
+}
+
+// printResults prints results as a table, with a summary.
+func printResults(w io.Writer, results []*result) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "candidates\tmatches\tprecision\tmissed\tpostquery\tnames\tgrep\tindexed\tbrute\tspeedup\t  query\n")
+	var indexed, brute time.Duration
+	for _, r := range results {
+		fmt.Fprintf(tw, "%d\t%d\t%.2f\t%d\t%v\t%v\t%v\t%v\t%v\t%.1fx\t  %s\n",
+			r.Candidates, r.Matches, r.Precision, r.Missed,
+			round(r.PostQuery), round(r.Names), round(r.Grep), round(r.Indexed), round(r.Brute), r.Speedup, r.Query)
+		indexed += r.Indexed
+		brute += r.Brute
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "total: indexed %v, brute force %v, speedup %.1fx\n",
+		round(indexed), round(brute), float64(brute)/math.Max(float64(indexed), 1))
+}
+
+// round rounds d to three significant digits, for printing.
+func round(d time.Duration) time.Duration {
+	for unit := time.Duration(1); unit < time.Hour; unit *= 10 {
+		if d < 1000*unit {
+			return d.Round(unit)
+		}
+	}
+	return d
+}
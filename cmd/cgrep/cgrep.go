@@ -12,17 +12,91 @@ import (
 	"regexp/syntax"
 	"runtime/pprof"
 
+	"github.com/andrewarchi/codesearch/internal/cli"
 	"github.com/andrewarchi/codesearch/regexp"
 )
 
-var usageMessage = `usage: cgrep [-c] [-h] [-i] [-l] [-n] regexp [file...]
+var usageMessage = `usage: cgrep [-0] [-a] [-b] [-binary-files type] [-c] [-encoding enc] [-json] [-vimgrep] [-format tmpl] [-truncate n] [-normalize mode] [-gunzip] [-total] [-h] [-i] [-l] [-n] [-q] [-v] regexp [file...]
 
 cgrep behaves like grep, searching for regexp, an RE2 (nearly PCRE)
 regular expression.
 
-The -c, -h, -i, -l, and -n flags are as in grep, although note that as
-per Go's flag parsing convention, they cannot be combined: the option
-pair -i -n cannot be abbreviated to -in.
+The -b, -c, -h, -i, -l, -n, -q, and -v flags are as in grep, although
+note that as per Go's flag parsing convention, they cannot be combined:
+the option pair -i -n cannot be abbreviated to -in. The byte offsets
+printed by -b are those of the start of each matching line, counting
+from 0, as needed by tools for which line numbers are ambiguous. With
+-q, the search stops at the first match, reading no further files.
+
+The -0 or -null flag terminates the file names printed by -l with a
+NUL byte instead of a newline, and those printed by -c with a NUL
+byte instead of a colon, so that names containing spaces or newlines
+pass safely through pipelines such as 'xargs -0'.
+
+A file with a NUL byte near its start is binary. By default, instead
+of printing the matching lines of a binary file, which would dump
+control characters to the terminal, the search prints "Binary file
+NAME matches". The -binary-files flag sets the policy, as in grep:
+binary, the default; without-match, to skip binary files, also set
+by -I; or text, to search them like other files, also set by -a.
+
+The -encoding flag names the encoding of the files searched, which
+are decoded to UTF-8 before matching: auto, the default; utf-8;
+utf-16, little-endian unless the file begins with a byte order mark;
+utf-16le; utf-16be; latin1; or windows-1252. With auto, a file
+beginning with a UTF-16 byte order mark is decoded as UTF-16, and one
+whose first 4 kB are not valid UTF-8 but have no control characters,
+as is typical of Latin-1 text, is decoded as windows-1252; others are
+searched as UTF-8. cindex detects encodings the same way when indexing.
+Byte offsets printed by -b count bytes of the decoded text.
+
+The -normalize flag normalizes the pattern and the text searched, so
+that characters typed composed, such as é, match the same characters
+typed as a letter and combining marks, and vice versa. The mode is
+none, the default; nfc, for Unicode normalization form C; or strip,
+to also remove nonspacing marks such as accents, so that cafe matches
+café. Byte offsets printed by -b count bytes of the normalized text.
+
+The -gunzip flag searches files compressed with gzip, recognized by
+their magic number, as zgrep does: decompressed, before decoding.
+Byte offsets printed by -b count bytes of the decompressed text.
+
+The -heading flag groups the matching lines of each file under a line
+naming the file, with line numbers, and separates files by blank lines.
+It is the default when writing to a terminal; -heading=false turns it
+off.
+
+The -json flag prints each matching line as a JSON object, one per
+line, with fields path, line, offset, and text, as well as binary, set
+for a binary file, whose text is omitted; spans, listing the text and
+start and end of each match of regexp in the line; and groups, listing
+the name, text, and start and end of each named capture group
+(?P<name>re) in regexp, so that scripts can extract fields from the
+results without parsing them again. Starts and ends are given both as
+byte offsets within the line, start and end, and as offsets counting
+runes, start_column and end_column, for editors to highlight exactly
+the text matched. Later versions may add fields, but will not change
+these.
+
+The -vimgrep flag prints each match on a line of its own, as
+path:line:column:text, where column is the byte offset of the match
+in the line, counting from 1, as Vim's :vimgrep and ripgrep --vimgrep
+do. Later versions will not change this format either.
+
+The -format flag prints each matching line using a Go text/template
+applied to a github.com/andrewarchi/codesearch/regexp.Match, with the
+same fields as -json, followed by a newline. For example,
+-format '{{.Path}}:{{.Line}}: {{.Text}}' prints lines like grep -n.
+Named capture groups are in .Groups.
+
+The -total flag prints the total number of matching lines at the end,
+after the per-file counts printed by -c, if given.
+
+The -truncate flag prints at most about the given number of bytes of
+each matching line, cutting a longer line down to the text around the
+start of the match and marking the text left out with "...", so that
+matches in minified code or generated data do not flood the output.
+The -json and -format flags print lines in full.
 `
 
 func usage() {
@@ -38,11 +112,16 @@ var (
 func main() {
 	var g regexp.Grep
 	g.AddFlags()
+	flag.Var(&g.Normalize, "normalize", "normalize the pattern and text as `mode` none, nfc, or strip")
+	flag.BoolVar(&g.Gunzip, "gunzip", false, "search gzip-compressed files decompressed")
 	g.Stdout = os.Stdout
 	g.Stderr = os.Stderr
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
+	if !cli.FlagSet("heading") && cli.IsTerminal(os.Stdout) {
+		g.Heading = true
+	}
 	if len(args) == 0 {
 		flag.Usage()
 	}
@@ -61,7 +140,7 @@ func main() {
 	if *iFlag {
 		reFlags |= syntax.FoldCase
 	}
-	re, err := regexp.CompileFlags(args[0], reFlags)
+	re, err := regexp.CompileFlags(g.Normalize.Normalize(args[0]), reFlags)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -71,8 +150,14 @@ func main() {
 	} else {
 		for _, arg := range args[1:] {
 			g.File(arg)
+			if g.Q && g.Match {
+				break
+			}
 		}
 	}
+	if g.Total && !g.Q {
+		fmt.Fprintf(g.Stdout, "%d\n", g.Count)
+	}
 	if !g.Match {
 		os.Exit(1)
 	}
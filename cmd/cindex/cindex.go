@@ -5,21 +5,36 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"log/slog"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime/pprof"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/andrewarchi/codesearch/history"
 	"github.com/andrewarchi/codesearch/index"
+	"github.com/andrewarchi/codesearch/internal/cli"
+	"github.com/andrewarchi/codesearch/lang"
+	"github.com/andrewarchi/codesearch/norm"
 	"github.com/andrewarchi/codesearch/walk"
 )
 
-var usageMessage = `usage: cindex [-list] [-reset] [-index path] [path...]
+var usageMessage = `usage: cindex [-list] [-info] [-reset] [-prune] [-upgrade] [-export file] [-import file] [-sqlite file] [-verify] [-history] [-n] [-nogitignore] [-localgitignore] [-index path] [-shards n] [-parallel n] [-part i/n] [-collect dir] [-filelist file] [-include glob] [-exclude glob] [-maxdepth n] [-maxsize size] [-head] [-gunzip] [-longlines] [-classify] [-skipclass classes] [-maxline size] [-normalize mode] [-checkpoint interval] [-skip-report file] [-loglevel level] [path...]
 
 cindex prepares a trigram index for use by csearch.
 
@@ -48,11 +63,246 @@ itself is a useful command to run in a nightly cron job.
 
 The -list flag causes cindex to list the paths it has indexed and exit.
 
+The -info flag causes cindex to print the metadata recorded in the index
+and exit, one "key: value" line each: created, the time the cindex run
+that last updated the index started; hostname, the host it ran on;
+tool, the version of cindex; and flags, the flags it was run with, so
+that the provenance of a shared index can be checked.
+
 By default cindex adds the named paths to the index but preserves
 information about other paths that might already be indexed
 (the ones printed by cindex -list). The -reset flag causes cindex to
 delete the existing index before indexing the new paths.
 With no path arguments, cindex -reset removes the index.
+
+For each path inside a git repository, cindex records the name of the
+repository, which is the name of its top-level directory, and its
+checked-out branch, so that csearch -repo can limit a search to some
+repositories.
+
+The -n or -dry-run flag causes cindex to walk the paths and check the
+files as usual, but instead of indexing them, print each file it would
+index, as "index path", and each file or directory it would skip, as
+"skip path: reason". Nothing is written, so this is a cheap way to
+check which files an index would hold.
+
+The -prune flag causes cindex to remove the files that no longer exist
+from the index, without reading any files, and exit. It is a quick way
+to clean up after deleting files or directories, although a full
+reindex also notices changes to the files that remain.
+
+The -upgrade flag causes cindex to rewrite an index written in an older
+format by an earlier version of cindex in the current format, and exit.
+Like -prune, it reads no files. Older indexes remain searchable, but
+lack information that newer ones record, such as file languages.
+
+The -export flag causes cindex to write the index to the named file, or
+standard output if the name is -, as a dump: a line-oriented JSON form
+listing the indexed paths, the file names, and the files containing
+each trigram, which scripts can inspect, compare, and transform. The
+-import flag causes cindex to replace the index with one built from
+such a dump, read from the named file or standard input. Both exit
+without reading any source files; neither works with -shards.
+
+The -sqlite flag causes cindex to write the index into a new SQLite
+database with the given name, using the sqlite3 command, and exit. The
+database has tables of indexed paths, files, trigrams, and the postings
+linking them, for analysis with SQL, such as finding the most common
+trigrams or the directories with the most files. If the name is -,
+cindex writes the SQL statements to standard output instead.
+
+The -verify flag causes cindex to check the index and exit, reading no
+files. It reads every part of the index, checking that the names are
+in order and that each posting list decodes to file IDs in range, and
+checks that each indexed file still exists and has the size and
+modification time recorded when it was indexed, or, for an index that
+does not record them, has not been modified since the index was
+written. It prints each problem found, as an index
+error or as "missing path" or "changed path", logs a summary, and
+exits with status 1 if there were any problems, so that a build can
+check a shared index before publishing it. The files of a history index
+are not checked against the file system.
+
+The -history flag causes cindex to replace the index with one holding
+the history of the git repository named by the single path argument:
+every version of every file in the commits reachable from any branch
+or tag, each distinct version indexed once. csearch -at searches such
+an index as of any of those commits. Later runs of cindex with no
+arguments index the history again, picking up new commits. A history
+index cannot be sharded, pruned, or upgraded, and the filters and
+walking options below do not apply to it.
+
+Only one cindex at a time may update an index. cindex fails if another
+is already updating it, unless the -wait flag is given, in which case it
+waits for the other to finish.
+
+The -filelist flag causes cindex to index exactly the files listed in
+the named file, or on standard input if the name is -, rather than
+walking the trees named by the paths. The list holds one name per line
+or, if it contains NUL bytes, NUL-terminated names, as printed by
+'git ls-files -z'. The path arguments, the current directory by
+default, name the trees that the list covers: the index records them,
+and listed files outside them are ignored. For example, to index the
+files tracked by git:
+
+	git ls-files -z | cindex -filelist -
+
+The filters and walking options below do not apply to a file list.
+
+The -include and -exclude flags filter the files to index by glob
+patterns matched against paths relative to each path argument. The
+elements of a pattern are matched as by Go's path.Match, and an element
+** matches any number of path elements. A pattern without a slash
+matches file names anywhere in the tree. For example,
+
+	cindex -include '*.go' -exclude 'vendor/**' ~/src/project
+
+indexes only Go files, skipping the vendor directory entirely. Either
+flag may be repeated or given a comma-separated list of patterns. Only
+files matching some -include pattern are indexed, and files and
+directories matching any -exclude pattern are skipped. The index
+records the -exclude patterns, and later runs apply them again along
+with any new ones, until a -reset; -include patterns are not recorded.
+
+The -maxdepth flag limits how many levels of directories below each
+path cindex descends into, and the -maxsize flag causes it to skip
+files larger than the given size, written as a number of bytes
+optionally followed by k, M, or G. Both are applied as the tree is
+walked, so skipped directories are never read and skipped files are
+never opened.
+
+The -head flag causes cindex to index the start of each file larger
+than -maxsize, up to that size, instead of skipping it, so that large
+logs and data files can still be found by their headers. Without
+-maxsize, it applies to files over 1G, which are otherwise skipped.
+The index records which files were indexed only in part; searches may
+miss matches in the rest of them.
+
+The -gunzip flag causes cindex to index the decompressed text of files
+compressed with gzip, such as rotated logs, which it otherwise skips
+as binary. The index records which files were decompressed, and
+csearch decompresses them too when printing matches, as zgrep does.
+A file whose gzip data is corrupt is skipped.
+
+cindex skips files with a line longer than 2000 bytes as not text,
+which leaves out minified JavaScript and CSS, JSON data, and some
+generated code. The -longlines flag causes it to index such files
+instead. The -maxline flag, which implies -longlines, causes it to
+index only the first bytes of each line, up to the given size, such as
+-maxline 10k, so that the long lines of such files do not make the
+index much larger; matches later in a long line may then be missed.
+
+By default cindex skips the files and directories excluded by the
+.gitignore files in the tree and by the global and system gitignore
+files named in ~/.gitconfig and /etc/gitconfig, as well as those
+excluded by the .hgignore files of Mercurial checkouts and the
+.svnignore files holding the svn:ignore patterns of Subversion
+directories. The -localgitignore flag causes it to honor only the
+ignore files in the tree, and the -nogitignore or -no-ignore flag
+causes it to index ignored files too, such as generated code.
+
+The -classify flag causes cindex to record which files are generated,
+minified, or vendored, judging by their names and starts: files under
+a directory named vendor, node_modules, third_party, or
+bower_components are vendored; files named like x.min.js, or
+JavaScript and CSS files with very long lines, are minified; and
+protocol buffer output, lock files such as package-lock.json, and
+files with a comment near the start such as "Code generated by
+stringer; DO NOT EDIT." or "@generated" are generated. csearch leaves
+such files out of its results unless told otherwise with its
+-skipclass flag. The -skipclass flag, given a comma-separated list of
+those classes, causes cindex to skip the files of those classes
+instead, recording the classes of the others.
+
+By default cindex does not follow symbolic links. The -follow flag
+causes it to index the files and directories that links refer to,
+under the names of the links. Each directory is indexed only once,
+even if several links refer to it.
+
+When its standard error is a terminal, cindex shows a status line
+with its progress, rate, and estimated time remaining, which it bases
+on a quick scan of the files to be indexed, and then one with the
+trigrams merged into the existing index. The -noprogress flag turns
+this off. The -verbose flag also logs each step of the merge.
+
+The -skip-report flag causes cindex to write the files it skips while
+indexing to the named file, as a JSON array of objects with the fields
+path, kind, and reason, sorted by path, so that the files missing from
+an index can be audited. The kind is one of invalid-utf8, file-too-long,
+line-too-long, or too-many-trigrams, for a file that does not look like
+text; gitignore, hgignore, or svnignore, for a file or directory
+excluded by a .gitignore, .hgignore, or .svnignore file; excluded, for
+one excluded by -include, -exclude, -maxsize, or as hidden or
+temporary; class, for one skipped by -skipclass; bad-gzip, for a
+corrupt file skipped by -gunzip; permission-denied, for one cindex
+may not read; or error, for one it could not read for another reason,
+given as the reason.
+
+The -loglevel flag sets the level of the messages logged by the index
+writer: debug adds details, such as each file added, as -verbose does,
+and warn leaves out routine progress, such as the sizes of the index
+written.
+
+The -checkpoint flag causes cindex to save its progress at the given
+interval, such as -checkpoint 10m, in a file named like the index with
+.checkpoint appended. If cindex is interrupted, running it again with
+the same arguments resumes from the last checkpoint rather than
+starting over. The checkpoint refers to cindex's temporary files, so
+it is useful only as long as those have not been cleaned up.
+
+The -mem flag sets the memory cindex uses to buffer index entries,
+written as a number of bytes optionally followed by k, M, or G. When
+the buffer fills, cindex sorts it and writes it to a temporary file,
+to be merged at the end. More memory means fewer, larger temporary
+files and a faster run; less memory helps on small machines.
+
+The -tmpdir flag sets the directory for cindex's temporary files, which
+together can grow as large as the index; the default is $TMPDIR or /tmp,
+which may be a small in-memory file system. The -compresstmp flag
+causes cindex to compress the index entries it writes to temporary
+files, using less disk space at some cost in speed.
+
+The -quadgrams flag causes cindex to also index four-byte sequences,
+making searches for longer literal strings more selective at the cost
+of a larger index. This is experimental. Because merged indexes keep
+quadgrams only if both inputs have them, the flag must be given on
+every run, starting with a -reset.
+
+The -normalize flag causes cindex to normalize the text of each file
+before indexing it: none, the default, indexes the text as is; nfc
+normalizes it to Unicode NFC, composing accented letters written as a
+letter followed by combining marks; strip also removes nonspacing marks
+such as accents, so that cafe matches café. The index records the
+mode, and csearch normalizes its pattern and the files it searches the
+same way. Later runs keep the mode; changing it requires -reset.
+
+The -shards flag causes cindex to split the index into the given number
+of files, named like the index with -000, -001, and so on appended.
+Files are assigned to shards by a hash of their names. csearch searches
+all shards of a sharded index. Once an index is sharded, later runs
+keep the same number of shards; changing it, or sharding an existing
+unsharded index, requires -reset.
+
+The -part flag, given as i/n, causes cindex to index only the files in
+part i of n, 0 through n-1, chosen as for shards by a hash of their
+names, into a new index named like the index with .part-00i-of-00n
+appended, leaving the index itself alone. Run on n machines, with the
+same paths and flags, which must name the files the same way on all
+of them, it splits the indexing of a very large tree. Once the parts
+are copied into one directory, the -collect flag causes cindex to
+check that none are missing, merge them into the index as an update
+would, and exit. Neither works with -shards.
+
+To use several processors, cindex indexes with several writers at once,
+handing each the next batch of files in turn, and then merges the
+indexes they write into one, in pairs at once. The -parallel flag sets
+the number of writers, by default the number of processors, up to 8;
+-parallel 1 indexes with a single writer, with no merge.
+
+The -zstd flag causes cindex to compress the index with zstd, which
+typically makes it several times smaller at some cost in search speed.
+Later runs keep the index compressed. A compressed index can be
+decompressed with any zstd tool, such as 'zstd -d'.
 `
 
 func usage() {
@@ -62,25 +312,159 @@ func usage() {
 
 var (
 	listFlag        = flag.Bool("list", false, "list indexed paths and exit")
+	infoFlag        = flag.Bool("info", false, "print the metadata recorded in the index and exit")
 	resetFlag       = flag.Bool("reset", false, "discard existing index")
+	pruneFlag       = flag.Bool("prune", false, "remove deleted files from the index and exit")
+	upgradeFlag     = flag.Bool("upgrade", false, "rewrite the index in the current format and exit")
+	exportFlag      = flag.String("export", "", "write the index as a dump to this file, or standard output if -, and exit")
+	importFlag      = flag.String("import", "", "replace the index with one built from this dump file, or standard input if -, and exit")
+	sqliteFlag      = flag.String("sqlite", "", "write the index into a new SQLite database with this name, or SQL to standard output if -, and exit")
+	verifyFlag      = flag.Bool("verify", false, "check the index against itself and the file system and exit")
+	historyFlag     = flag.Bool("history", false, "index the history of the git repository named by the path argument")
+	dryRunFlag      = flag.Bool("n", false, "list the files that would be indexed or skipped, without indexing")
 	indexFlag       = flag.String("index", "", "path to the index")
 	noGitignoreFlag = flag.Bool("nogitignore", false, "do not skip files in .gitignore")
+	localIgnoreFlag = flag.Bool("localgitignore", false, "skip files in the .gitignore files of the tree, but not in global or system gitignore files")
 	logSkipFlag     = flag.Bool("logskip", false, "log skipped files")
+	followFlag      = flag.Bool("follow", false, "follow symbolic links")
+	fileListFlag    = flag.String("filelist", "", "index the files listed in this file, or standard input if -, instead of walking")
+	maxDepthFlag    = flag.Int("maxdepth", 0, "descend at most this many directory levels below each path")
+	classifyFlag    = flag.Bool("classify", false, "record which files are generated, minified, or vendored, for csearch -skipclass")
+	headFlag        = flag.Bool("head", false, "index the start of files larger than -maxsize, or 1G, instead of skipping them")
+	gunzipFlag      = flag.Bool("gunzip", false, "index the decompressed text of gzip-compressed files")
+	longLinesFlag   = flag.Bool("longlines", false, "index files with lines longer than 2000 bytes instead of skipping them")
 	verboseFlag     = flag.Bool("verbose", false, "print extra information")
+	quadgramsFlag   = flag.Bool("quadgrams", false, "also index quadgrams (experimental)")
+	shardsFlag      = flag.Int("shards", 0, "split the index into this many shard files")
+	parallelFlag    = flag.Int("parallel", 0, "index with this many writers at once, merging their indexes (default number of CPUs, up to 8)")
+	partFlag        = flag.String("part", "", "index only part `i/n` of the files, into a part file to be collected")
+	collectFlag     = flag.String("collect", "", "merge the index parts in this directory into the index and exit")
+	zstdFlag        = flag.Bool("zstd", false, "compress the index with zstd")
+	waitFlag        = flag.Bool("wait", false, "wait for other cindex runs on the same index to finish")
+	noProgressFlag  = flag.Bool("noprogress", false, "do not show progress on a terminal")
+	checkpointFlag  = flag.Duration("checkpoint", 0, "save progress at this interval, to resume if interrupted")
+	tmpDirFlag      = flag.String("tmpdir", "", "directory for temporary files (default $TMPDIR or /tmp)")
+	compressTmpFlag = flag.Bool("compresstmp", false, "compress temporary files")
+	skipReportFlag  = flag.String("skip-report", "", "write the files skipped while indexing, with the reasons, to this JSON file")
 	cpuProfile      = flag.String("cpuprofile", "", "write cpu profile to this file")
 )
 
+// Glob patterns named by -include and -exclude flags.
+var includeFlag, excludeFlag globList
+
+// skipClassFlag lists the classes of files skipped by the -skipclass flag.
+var skipClassFlag classList
+
+// maxSizeFlag is the file size limit set by the -maxsize flag.
+var maxSizeFlag cli.Size
+
+// maxLineFlag is the limit on the bytes of each line indexed set by
+// the -maxline flag.
+var maxLineFlag cli.Size
+
+// memFlag is the memory budget set by the -mem flag.
+var memFlag cli.Size
+
+// normalizeFlag is the normalization set by the -normalize flag.
+var normalizeFlag norm.Mode
+
+// logLevelFlag is the level set by the -loglevel flag.
+var logLevelFlag = cli.LogLevel()
+
+func init() {
+	flag.BoolVar(dryRunFlag, "dry-run", false, "same as -n")
+	flag.BoolVar(noGitignoreFlag, "no-ignore", false, "same as -nogitignore")
+	flag.Var(&normalizeFlag, "normalize", "normalize text as `mode` none, nfc, or strip before indexing")
+	flag.Var(&memFlag, "mem", "memory for buffering index entries, such as 256M or 2G (default 128M per shard)")
+	flag.Var(&maxSizeFlag, "maxsize", "skip files larger than this size, such as 100k or 10M")
+	flag.Var(&maxLineFlag, "maxline", "index only the first `size` bytes of each line, such as 10k; implies -longlines")
+	flag.Var(&includeFlag, "include", "index only files matching this glob; may be repeated or comma-separated")
+	flag.Var(&skipClassFlag, "skipclass", "skip files of these comma-separated classes: generated, minified, or vendored")
+	flag.Var(&excludeFlag, "exclude", "skip files and directories matching this glob; may be repeated or comma-separated")
+}
+
+// A globList is a flag.Value accumulating comma-separated glob patterns.
+type globList []string
+
+func (l *globList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *globList) Set(s string) error {
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern == "" {
+			continue
+		}
+		if err := walk.CheckGlob(pattern); err != nil {
+			return fmt.Errorf("%q: %v", pattern, err)
+		}
+		*l = append(*l, pattern)
+	}
+	return nil
+}
+
+// A classList is a flag.Value accumulating comma-separated file classes.
+type classList []lang.Class
+
+func (l *classList) String() string {
+	var names []string
+	for _, c := range *l {
+		names = append(names, c.String())
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *classList) Set(s string) error {
+	for _, name := range strings.Split(s, ",") {
+		if name == "" {
+			continue
+		}
+		c, ok := lang.LookupClass(name)
+		if !ok || c == lang.Normal {
+			return fmt.Errorf("unknown class %q; known classes: generated, minified, vendored", name)
+		}
+		*l = append(*l, c)
+	}
+	return nil
+}
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	slog.SetLogLoggerLevel(*logLevelFlag)
+	if maxLineFlag > 0 {
+		*longLinesFlag = true
+	}
 	args := flag.Args()
-
-	if *listFlag {
-		ix, err := index.Open(index.File())
-		if err != nil {
+	// The maintenance modes exclude each other and indexing.
+	modes := 0
+	for _, m := range []bool{*pruneFlag, *upgradeFlag, *exportFlag != "", *importFlag != "", *sqliteFlag != "", *verifyFlag, *collectFlag != ""} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 || modes == 1 && (len(args) > 0 || *resetFlag || *dryRunFlag) {
+		usage()
+	}
+	if *historyFlag && (modes > 0 || *dryRunFlag || *fileListFlag != "") {
+		usage()
+	}
+	if *skipReportFlag != "" && (modes > 0 || *dryRunFlag || *historyFlag) {
+		usage()
+	}
+	var part, nparts int
+	if *partFlag != "" {
+		if modes > 0 || *historyFlag || len(args) == 0 && *fileListFlag == "" {
+			usage()
+		}
+		var err error
+		if part, nparts, err = parsePart(*partFlag); err != nil {
 			log.Fatal(err)
 		}
-		paths, err := ix.Paths()
+	}
+
+	if *listFlag {
+		paths, err := indexPaths(index.File())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -89,6 +473,24 @@ func main() {
 		}
 		return
 	}
+	if *infoFlag {
+		printInfo(primaryIndex())
+		return
+	}
+	if *exportFlag != "" {
+		exportIndex(primaryIndex(), *exportFlag)
+		return
+	}
+	if *sqliteFlag != "" {
+		exportSQLite(primaryIndex(), *sqliteFlag)
+		return
+	}
+	if *verifyFlag {
+		if !verifyIndex(primaryIndex()) {
+			os.Exit(1)
+		}
+		return
+	}
 
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
@@ -100,16 +502,30 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if *resetFlag && len(args) == 0 {
-		os.Remove(index.File())
-		return
-	}
-	if len(args) == 0 {
-		ix, err := index.Open(index.File())
+	var fileList []string
+	if *fileListFlag != "" {
+		var err error
+		fileList, err = readFileList(*fileListFlag)
 		if err != nil {
 			log.Fatal(err)
 		}
-		paths, err := ix.Paths()
+		if len(args) == 0 {
+			args = []string{"."}
+		}
+	}
+
+	if *resetFlag && len(args) == 0 {
+		file := index.File()
+		lock, err := index.LockIndex(file, *waitFlag)
+		if err != nil {
+			log.Fatalf("%s: %v", file, err)
+		}
+		removeIndex(file)
+		lock.Unlock()
+		return
+	}
+	if len(args) == 0 && *importFlag == "" && *collectFlag == "" {
+		paths, err := indexPaths(index.File())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -133,86 +549,1130 @@ func main() {
 	for len(args) > 0 && args[0] == "" {
 		args = args[1:]
 	}
+	if fileList != nil {
+		fileList = absFileList(fileList, args)
+	}
 
-	var primary string
-	if *indexFlag != "" {
-		primary = *indexFlag
-		if fi, err := os.Stat(primary); err == nil && fi.IsDir() {
-			primary = filepath.Join(primary, ".csearchindex")
+	primary := primaryIndex()
+	if *partFlag != "" {
+		// A part is always indexed afresh.
+		primary = index.PartFile(primary, part, nparts)
+		*resetFlag = true
+	}
+	if !*dryRunFlag {
+		lock, err := index.LockIndex(primary, *waitFlag)
+		if err == index.ErrLocked {
+			log.Fatalf("index %s is being updated by another cindex; use -wait to wait for it", primary)
 		}
-	} else {
-		primary = index.File()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer lock.Unlock()
 	}
-	if fi, err := os.Stat(primary); err != nil {
+
+	shards := *shardsFlag
+	oldShards := index.NumShards(primary)
+	if shards == 0 && !*resetFlag {
+		shards = oldShards
+	}
+	if shards > 0 {
+		if oldShards == 0 {
+			if _, err := os.Stat(primary); err == nil && !*resetFlag {
+				log.Fatalf("index %s is not sharded; use -reset to replace it with %d shards", primary, shards)
+			}
+			*resetFlag = true
+		} else if oldShards != shards && !*resetFlag {
+			log.Fatalf("index %s has %d shards; use -reset to change the number of shards", primary, oldShards)
+		}
+	} else if fi, err := os.Stat(primary); err != nil {
 		// Does not exist.
 		*resetFlag = true
 	} else if fi.IsDir() {
 		log.Fatalf("index %s: path is a directory", primary)
 	}
-	file := primary
+	if *partFlag != "" && shards > 0 {
+		log.Fatalf("index %s: cannot index part of a sharded index", primary)
+	}
+	compress := *zstdFlag
+	if !*resetFlag && !compress {
+		if shards > 0 {
+			compress = index.IsCompressed(index.ShardFile(primary, 0))
+		} else {
+			compress = index.IsCompressed(primary)
+		}
+	}
+
+	// Index into one file per shard, or a single file if not sharded.
+	// Unless resetting, each file is merged with the existing one below.
+	// Either way the result is renamed into place only when complete,
+	// so that csearch never sees a partial index.
+	var primaries []string
+	if shards > 0 {
+		for i := 0; i < shards; i++ {
+			primaries = append(primaries, index.ShardFile(primary, i))
+		}
+	} else {
+		primaries = []string{primary}
+	}
+	if *pruneFlag {
+		for _, p := range primaries {
+			prune(p, compress)
+		}
+		log.Printf("done")
+		return
+	}
+	if *upgradeFlag {
+		for _, p := range primaries {
+			upgrade(p, compress)
+		}
+		log.Printf("done")
+		return
+	}
+
+	// Keep the normalization of the existing index.
 	if !*resetFlag {
-		file += "~"
+		old, err := indexNormalization(primary)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cli.FlagSet("normalize") && normalizeFlag != old {
+			log.Fatalf("index %s is normalized as %v; use -reset to change", primary, old)
+		}
+		normalizeFlag = old
+	}
+
+	// A history index is always rebuilt from the repository.
+	if !*historyFlag && !*resetFlag && shards == 0 && modes == 0 {
+		if ix, err := index.Open(primary); err == nil && ix.GitRepo() != "" {
+			if len(flag.Args()) > 0 {
+				log.Fatalf("index %s holds the history of %s; use -history or -reset", primary, ix.GitRepo())
+			}
+			*historyFlag = true
+		}
+	}
+	if *historyFlag {
+		if shards > 0 {
+			log.Fatalf("index %s: cannot index history into a sharded index", primary)
+		}
+		if len(args) != 1 {
+			log.Fatal("-history takes a single git repository")
+		}
+		indexHistory(primary, args[0], compress)
+		log.Printf("done")
+		return
+	}
+	if *importFlag != "" {
+		if shards > 0 {
+			log.Fatalf("index %s: cannot import into a sharded index", primary)
+		}
+		importIndex(primary, *importFlag, compress)
+		log.Printf("done")
+		return
+	}
+	if *collectFlag != "" {
+		if shards > 0 {
+			log.Fatalf("index %s: cannot collect parts into a sharded index", primary)
+		}
+		collectParts(primary, *collectFlag, *resetFlag, compress)
+		log.Printf("done")
+		return
 	}
 
-	ix, err := index.Create(file)
+	// Apply the exclude patterns recorded in the index along with
+	// any new ones, and record them all in the new index.
+	excludes := []string(excludeFlag)
+	if !*resetFlag {
+		old, err := indexExcludes(primary)
+		if err != nil {
+			log.Fatal(err)
+		}
+		excludes = addExcludes(old, excludes)
+	}
+
+	walkOpts := []walk.Option{walk.Filters(defaultFilter{})}
+	if *dryRunFlag {
+		walkOpts = append(walkOpts, walk.OnSkip(func(path, reason string) {
+			fmt.Printf("skip %s: %s\n", path, reason)
+		}))
+	} else if *skipReportFlag != "" {
+		skipped = newSkipReport()
+		walkOpts = append(walkOpts, walk.OnSkip(func(path, reason string) {
+			if *logSkipFlag || *verboseFlag {
+				log.Printf("skipped %s: %s", path, reason)
+			}
+			skipped.walkSkip(path, reason)
+		}))
+	}
+	if *followFlag {
+		walkOpts = append(walkOpts, walk.FollowSymlinks())
+	}
+	if *maxDepthFlag > 0 {
+		walkOpts = append(walkOpts, walk.MaxDepth(*maxDepthFlag))
+	}
+	if maxSizeFlag > 0 && !*headFlag {
+		walkOpts = append(walkOpts, walk.MaxFileSize(int64(maxSizeFlag)))
+	}
+	if len(includeFlag) > 0 {
+		walkOpts = append(walkOpts, walk.Include(includeFlag...))
+	}
+	if len(excludes) > 0 {
+		walkOpts = append(walkOpts, walk.Exclude(excludes...))
+	}
+	switch {
+	case *noGitignoreFlag:
+		walkOpts = append(walkOpts, walk.NoGitignore())
+	case *localIgnoreFlag:
+		walkOpts = append(walkOpts, walk.LocalGitignore())
+	}
+	w, err := walk.NewGitignoreWalker(walkOpts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dryRunFlag {
+		dryRun(w, args, fileList)
+		return
+	}
+
+	parallel := numWriters()
+	listHash := fileListHash(fileList)
+	cp := readCheckpoint(primary, args, listHash, shards, parallel, *resetFlag)
+	var repos []index.Repo
+	if cp == nil {
+		repos = findRepos(args)
+	}
+	// Each file has parallel writers, writing parts to be merged into it,
+	// or just one writing it directly. ixs[i*parallel+j] writes parts[i][j].
+	var files []string
+	var parts [][]string
+	var ixs []*index.Writer
+	meta := metadata(time.Now())
+	for i, p := range primaries {
+		file := p + "~"
+		files = append(files, file)
+		parts = append(parts, nil)
+		for j := 0; j < parallel; j++ {
+			part := file
+			if parallel > 1 {
+				part = fmt.Sprintf("%s%d", file, j)
+			}
+			parts[i] = append(parts[i], part)
+		}
+	}
+	for i, part := range slices.Concat(parts...) {
+		var ix *index.Writer
+		var err error
+		if cp != nil {
+			ix, err = index.Resume(part, cp.Writers[i])
+		} else {
+			ix, err = index.Create(part)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		ix.LogSkip = *logSkipFlag || *verboseFlag
+		ix.Verbose = *verboseFlag
+		ix.Metadata = meta
+		ix.LongLines = *longLinesFlag
+		ix.LongLineBytes = int(maxLineFlag)
+		ix.HeadBytes = headBytes()
+		ix.Gunzip = *gunzipFlag
+		ix.Classify = *classifyFlag
+		ix.SkipClasses = skipClassFlag
+		if skipped != nil {
+			ix.OnSkip = skipped.writerSkip
+		}
+		ix.PostMem = postMem(len(primaries) * parallel)
+		ix.TempDir = *tmpDirFlag
+		if cp == nil {
+			ix.Quadgrams = *quadgramsFlag
+			ix.Normalize = normalizeFlag
+			ix.CompressTemp = *compressTmpFlag
+			ix.AddPaths(args)
+			ix.AddExcludes(excludes)
+			ix.AddRepos(repos)
+		}
+		ixs = append(ixs, ix)
+	}
+	lastCheckpoint := time.Now()
+	eachFile := func(report bool, fn func(arg int, path string, info fs.DirEntry) error) error {
+		if *partFlag != "" {
+			// Index only the files of this part.
+			all := fn
+			fn = func(arg int, path string, info fs.DirEntry) error {
+				if index.ShardOf(path, nparts) != part {
+					return nil
+				}
+				return all(arg, path, info)
+			}
+		}
+		if fileList != nil {
+			return listFiles(fileList, cp, report, fn)
+		}
+		return walkFiles(w, args, cp, report, fn)
+	}
+	var prog *progress
+	if !*noProgressFlag && cli.IsTerminal(os.Stderr) {
+		prog = newProgress(os.Stderr)
+		log.SetOutput(prog)
+		err := eachFile(false, func(arg int, path string, info fs.DirEntry) error {
+			prog.addTotal(fileSize(info))
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Files are added in batches, so that each Writer can read ahead.
+	type pending struct {
+		arg  int
+		path string
+		size int64
+	}
+	// Each batch goes to the next of the parallel writers of its file.
+	var batch []pending
+	batches := 0
+	pool := newWriterPool(ixs)
+	addBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		names := make([][]string, len(primaries))
+		for _, p := range batch {
+			i := 0
+			if len(primaries) > 1 {
+				i = index.ShardOf(p.path, len(primaries))
+			}
+			names[i] = append(names[i], p.path)
+		}
+		j := batches % parallel
+		batches++
+		for i := range names {
+			if len(names[i]) == 0 {
+				continue
+			}
+			if err := pool.add(i*parallel+j, names[i]); err != nil {
+				return err
+			}
+		}
+		if prog != nil {
+			for _, p := range batch {
+				prog.add(p.size)
+			}
+		}
+		last := batch[len(batch)-1]
+		batch = batch[:0]
+		if *checkpointFlag > 0 && time.Since(lastCheckpoint) >= *checkpointFlag {
+			if err := pool.wait(); err != nil {
+				return err
+			}
+			lastCheckpoint = time.Now()
+			return writeCheckpoint(primary, &checkpoint{
+				Args:     args,
+				FileList: listHash,
+				Shards:   shards,
+				Parallel: parallel,
+				Reset:    *resetFlag,
+				Arg:      last.arg,
+				Last:     last.path,
+			}, ixs)
+		}
+		return nil
+	}
+	err = eachFile(true, func(arg int, path string, info fs.DirEntry) error {
+		p := pending{arg: arg, path: path}
+		if prog != nil {
+			p.size = fileSize(info)
+		}
+		batch = append(batch, p)
+		if len(batch) < addBatchSize {
+			return nil
+		}
+		return addBatch()
+	})
+	if err == nil {
+		err = addBatch()
+	}
+	if cerr := pool.close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if prog != nil {
+		prog.done()
+		log.SetOutput(os.Stderr)
+	}
+	log.Printf("flush index")
+	if err := flushAll(ixs); err != nil {
+		log.Fatal(err)
+	}
+	if parallel > 1 {
+		for i, file := range files {
+			log.Printf("merge %d parts of %s", parallel, file)
+			err := mergeWithProgress(func(opt *index.MergeOptions) error {
+				return index.MergeN(file, parts[i], opt)
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, part := range parts[i] {
+				os.Remove(part)
+			}
+		}
+	}
+	if skipped != nil {
+		if err := skipped.write(*skipReportFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for i, primary := range primaries {
+		file := files[i]
+		if *resetFlag {
+			os.Rename(file, primary)
+			continue
+		}
+		log.Printf("merge %s %s", primary, file)
+		err := mergeWithProgress(func(opt *index.MergeOptions) error {
+			return index.MergeWith(file+"~", primary, file, opt)
+		})
+		if err != nil {
+			// Leave the old index in place, without a partial merge.
+			os.Remove(file + "~")
+			log.Fatal(err)
+		}
+		os.Remove(file)
+		os.Rename(file+"~", primary)
+	}
+	removeStale(primary, shards)
+	os.Remove(checkpointFile(primary))
+	if compress {
+		for _, primary := range primaries {
+			log.Printf("compress %s", primary)
+			if err := index.Compress(primary+"~", primary); err != nil {
+				log.Fatal(err)
+			}
+			os.Rename(primary+"~", primary)
+		}
+	}
+	log.Printf("done")
+	return
+}
+
+// mergeWithProgress calls merge with the options for a merge,
+// showing its progress on a terminal, as for indexing.
+func mergeWithProgress(merge func(opt *index.MergeOptions) error) error {
+	opt := &index.MergeOptions{Verbose: *verboseFlag}
+	if *noProgressFlag || !cli.IsTerminal(os.Stderr) {
+		return merge(opt)
+	}
+	prog := newProgress(os.Stderr)
+	log.SetOutput(prog)
+	opt.Progress = prog.merged
+	err := merge(opt)
+	prog.done()
+	log.SetOutput(os.Stderr)
+	return err
+}
+
+// addBatchSize is the number of files passed to each call to AddFiles.
+const addBatchSize = 256
+
+// addFiles adds the named files to ix, logging and skipping
+// those that cannot be read for lack of permission.
+func addFiles(ix *index.Writer, names []string) error {
+	for len(names) > 0 {
+		n, err := ix.AddFiles(names)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+		log.Println(err)
+		skipped.error(names[n], err)
+		names = names[n+1:]
+	}
+	return nil
+}
+
+// headBytes returns the number of bytes of each larger file to index,
+// as set by -head and -maxsize, or 0 to index files in full.
+func headBytes() int64 {
+	switch {
+	case !*headFlag:
+		return 0
+	case maxSizeFlag > 0:
+		return int64(maxSizeFlag)
+	}
+	return 1 << 30
+}
+
+// postMem returns the memory for each of n index writers to use for
+// buffering posting entries, to keep within the -mem budget, or 0 for
+// the default. Each writer has a buffer, or two with -quadgrams, and
+// sorting a buffer takes as much memory again.
+func postMem(n int) int64 {
+	if memFlag == 0 {
+		return 0
+	}
+	buffers := n
+	if *quadgramsFlag {
+		buffers *= 2
+	}
+	return int64(memFlag) / int64(buffers+1)
+}
+
+// prune removes the files that no longer exist from the index file,
+// compressing the result if compress is set.
+func prune(file string, compress bool) {
+	log.Printf("prune %s", file)
+	n, err := index.Prune(file+"~", file, func(name string) bool {
+		_, err := os.Stat(name)
+		return !errors.Is(err, fs.ErrNotExist)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	replace(file, compress)
+	log.Printf("pruned %d files", n)
+}
+
+// upgrade rewrites the index file in the current format, compressing
+// the result if compress is set. An index already in the current
+// format is left alone.
+func upgrade(file string, compress bool) {
+	ix, err := index.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	v := ix.Version()
+	if v == index.FormatVersion {
+		log.Printf("%s: already format version %d", file, v)
+		return
+	}
+	log.Printf("upgrade %s from format version %d to %d", file, v, index.FormatVersion)
+	if err := index.Upgrade(file+"~", file); err != nil {
+		log.Fatal(err)
+	}
+	replace(file, compress)
+}
+
+// exportIndex writes the index file, which must not be sharded,
+// as a dump to the named file, or standard output if the name is -.
+func exportIndex(file, dump string) {
+	if index.NumShards(file) > 0 {
+		log.Fatalf("index %s: cannot export a sharded index", file)
+	}
+	ix, err := index.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := os.Stdout
+	if dump != "-" {
+		if w, err = os.Create(dump); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := ix.Export(w); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// verifyIndex checks the index file, which may be sharded, printing
+// each problem found and a summary, and reports whether it found none.
+func verifyIndex(file string) bool {
+	files := []string{file}
+	if n := index.NumShards(file); n > 0 {
+		files = files[:0]
+		for i := 0; i < n; i++ {
+			files = append(files, index.ShardFile(file, i))
+		}
+	}
+	var total index.VerifyStats
+	ok := true
+	missing, changed := 0, 0
+	for _, f := range files {
+		ix, err := index.Open(f)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			ok = false
+			continue
+		}
+		st, err := ix.Verify()
+		total.Files += st.Files
+		total.Trigrams += st.Trigrams
+		total.Quadgrams += st.Quadgrams
+		total.Postings += st.Postings
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			ok = false
+			continue
+		}
+		if ix.GitRepo() != "" {
+			// The files are blobs in the repository, not in the file system.
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		names, err := ix.Names()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for id, name := range names {
+			nfi, err := os.Stat(name)
+			if err != nil {
+				fmt.Printf("missing %s\n", name)
+				missing++
+				continue
+			}
+			st, err := ix.FileStat(uint32(id))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if st != nil && (nfi.Size() != st.Size || !nfi.ModTime().Equal(st.ModTime)) ||
+				st == nil && nfi.ModTime().After(fi.ModTime()) {
+				fmt.Printf("changed %s\n", name)
+				changed++
+			}
+		}
+	}
+	log.Printf("%s: %d files, %d trigrams, %d quadgrams, %d postings; %d missing, %d changed since indexed",
+		file, total.Files, total.Trigrams, total.Quadgrams, total.Postings, missing, changed)
+	return ok && missing == 0 && changed == 0
+}
+
+// exportSQLite writes the index file, which must not be sharded, into
+// a new SQLite database with the given name, or writes the SQL to
+// standard output if the name is -.
+func exportSQLite(file, db string) {
+	if index.NumShards(file) > 0 {
+		log.Fatalf("index %s: cannot export a sharded index", file)
+	}
+	ix, err := index.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if db == "-" {
+		if err := ix.ExportSQL(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Build the database under a temporary name,
+	// replacing any old one only when complete.
+	tmp := db + "~"
+	os.Remove(tmp)
+	cmd := exec.Command("sqlite3", "-bail", tmp)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("running sqlite3: %v", err)
+	}
+	err = ix.ExportSQL(w)
+	w.Close()
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("sqlite3: %v", werr)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Fatal(err)
+	}
+	if err := os.Rename(tmp, db); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// indexHistory replaces the index file with one holding the history of
+// the git repository in dir, compressing it if compress is set.
+func indexHistory(file, dir string, compress bool) {
+	repo, err := history.Open(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer repo.Close()
+	ix, err := index.Create(file + "~")
 	if err != nil {
 		log.Fatal(err)
 	}
 	ix.LogSkip = *logSkipFlag || *verboseFlag
 	ix.Verbose = *verboseFlag
-	ix.AddPaths(args)
-	var w walk.Walker
-	if *noGitignoreFlag {
-		w = walk.NewWalker()
-	} else {
-		w, err = walk.NewGitignoreWalker()
+	ix.Metadata = metadata(time.Now())
+	ix.LongLines = *longLinesFlag
+	ix.LongLineBytes = int(maxLineFlag)
+	ix.HeadBytes = headBytes()
+	ix.Gunzip = *gunzipFlag
+	ix.Classify = *classifyFlag
+	ix.SkipClasses = skipClassFlag
+	ix.PostMem = postMem(1)
+	ix.TempDir = *tmpDirFlag
+	ix.Quadgrams = *quadgramsFlag
+	ix.Normalize = normalizeFlag
+	ix.CompressTemp = *compressTmpFlag
+	log.Printf("index history of %s", repo.Dir)
+	if err := history.Index(ix, repo); err != nil {
+		os.Remove(file + "~")
+		log.Fatal(err)
+	}
+	if err := ix.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	replace(file, compress)
+}
+
+// importIndex replaces the index file with one built from the dump in
+// the named file, or standard input if the name is -, compressing it
+// if compress is set.
+func importIndex(file, dump string, compress bool) {
+	r := os.Stdin
+	if dump != "-" {
+		var err error
+		if r, err = os.Open(dump); err != nil {
+			log.Fatal(err)
+		}
+		defer r.Close()
+	}
+	log.Printf("import %s from %s", file, dump)
+	if err := index.Import(file+"~", r); err != nil {
+		log.Fatal(err)
+	}
+	replace(file, compress)
+}
+
+// parsePart parses the -part flag, i/n, returning i and n.
+func parsePart(s string) (i, n int, err error) {
+	is, ns, ok := strings.Cut(s, "/")
+	i, err1 := strconv.Atoi(is)
+	n, err2 := strconv.Atoi(ns)
+	if !ok || err1 != nil || err2 != nil || i < 0 || i >= n {
+		return 0, 0, fmt.Errorf("invalid -part %q: want i/n, with 0 <= i < n", s)
+	}
+	return i, n, nil
+}
+
+// collectParts merges the index parts in dir into the index file,
+// replacing it if reset is set or it does not exist, and compressing
+// the result if compress is set.
+func collectParts(file, dir string, reset, compress bool) {
+	parts, err := index.PartFiles(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("collect %d parts from %s", len(parts), dir)
+	merged := file + "~"
+	if !reset {
+		merged = file + "~parts"
+		defer os.Remove(merged)
+	}
+	err = mergeWithProgress(func(opt *index.MergeOptions) error {
+		return index.MergeN(merged, parts, opt)
+	})
+	if err != nil {
+		os.Remove(merged)
+		log.Fatal(err)
+	}
+	if !reset {
+		log.Printf("merge %s %s", file, merged)
+		err := mergeWithProgress(func(opt *index.MergeOptions) error {
+			return index.MergeWith(file+"~", file, merged, opt)
+		})
 		if err != nil {
+			os.Remove(file + "~")
 			log.Fatal(err)
 		}
 	}
-	for _, arg := range args {
-		log.Printf("index %s", arg)
+	replace(file, compress)
+}
+
+// replace renames the new index file+"~" onto file,
+// compressing it first if compress is set.
+func replace(file string, compress bool) {
+	if compress {
+		if err := index.Compress(file+"~~", file+"~"); err != nil {
+			log.Fatal(err)
+		}
+		os.Rename(file+"~~", file+"~")
+	}
+	if err := os.Rename(file+"~", file); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// primaryIndex returns the name of the index file, as set by the
+// -index flag or found by index.File.
+func primaryIndex() string {
+	if *indexFlag == "" {
+		return index.File()
+	}
+	file := *indexFlag
+	if fi, err := os.Stat(file); err == nil && fi.IsDir() {
+		file = filepath.Join(file, ".csearchindex")
+	}
+	return file
+}
+
+// indexPaths returns the paths indexed by the index file,
+// which may be sharded.
+func indexPaths(file string) ([]string, error) {
+	if index.NumShards(file) > 0 {
+		ix, err := index.OpenSharded(file)
+		if err != nil {
+			return nil, err
+		}
+		return ix.Paths()
+	}
+	ix, err := index.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	return ix.Paths()
+}
+
+// indexExcludes returns the exclude patterns recorded in the index
+// file, which may be sharded.
+func indexExcludes(file string) ([]string, error) {
+	if index.NumShards(file) > 0 {
+		file = index.ShardFile(file, 0)
+	}
+	ix, err := index.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	return ix.Excludes()
+}
+
+// indexNormalization returns the normalization of the text in the
+// index file, which may be sharded.
+func indexNormalization(file string) (norm.Mode, error) {
+	if index.NumShards(file) > 0 {
+		file = index.ShardFile(file, 0)
+	}
+	ix, err := index.Open(file)
+	if err != nil {
+		return norm.None, err
+	}
+	return ix.Normalization()
+}
+
+// addExcludes returns the patterns in old followed by those in new
+// that are not in old.
+func addExcludes(old, new []string) []string {
+	x := old
+	for _, p := range new {
+		found := false
+		for _, q := range old {
+			if p == q {
+				found = true
+				break
+			}
+		}
+		if !found {
+			x = append(x, p)
+		}
+	}
+	return x
+}
+
+// removeIndex removes the index file and any shards of it.
+func removeIndex(file string) {
+	removeStale(file, 0)
+	os.Remove(file)
+	os.Remove(checkpointFile(file))
+}
+
+// removeStale removes the files left over from an earlier form of the
+// index file, which now has the given number of shards (0 if unsharded).
+func removeStale(file string, shards int) {
+	if shards > 0 {
+		os.Remove(file)
+	}
+	for i := index.NumShards(file) - 1; i >= shards; i-- {
+		os.Remove(index.ShardFile(file, i))
+	}
+}
+
+// walkFiles walks the trees named by args, in order, calling fn for
+// each regular file that was not already indexed before the checkpoint
+// cp, which may be nil.
+// If report is true, walkFiles logs each tree as it starts walking it
+// and any errors it encounters.
+func walkFiles(w walk.Walker, args []string, cp *checkpoint, report bool, fn func(arg int, path string, info fs.DirEntry) error) error {
+	for argIndex, arg := range args {
+		if cp != nil && argIndex < cp.Arg {
+			continue
+		}
+		if report {
+			log.Printf("index %s", arg)
+		}
 		err := w.Walk(arg, func(path string, info fs.DirEntry, err error) error {
-			if defaultSkip(path) {
-				if info.IsDir() {
+			if cp != nil && argIndex == cp.Arg && walkedBefore(path, cp.Last) {
+				// Already indexed before the checkpoint.
+				if info != nil && info.IsDir() && !inDir(cp.Last, path) {
 					return filepath.SkipDir
 				}
 				return nil
 			}
 			if err != nil {
-				log.Printf("%s: %s", path, err)
+				if report {
+					log.Printf("%s: %s", path, err)
+					skipped.error(path, err)
+				}
 				return nil
 			}
-			// Avoid symlinks.
+			// Avoid symlinks, unless following them.
 			if info == nil || !info.Type().IsRegular() {
 				return nil
 			}
-			err = ix.AddFile(path)
-			if errors.Is(err, fs.ErrPermission) {
-				log.Println(err)
-				return nil
-			}
-			return err
+			return fn(argIndex, path, info)
 		})
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
-	log.Printf("flush index")
-	if err := ix.Flush(); err != nil {
+	return nil
+}
+
+// dryRun prints the files that cindex would index, walking the trees
+// named by args with w or reading fileList, and those that it would
+// skip, with the reason.
+func dryRun(w walk.Walker, args, fileList []string) {
+	c := index.NewChecker()
+	c.LongLines = *longLinesFlag
+	c.LongLineBytes = int(maxLineFlag)
+	c.HeadBytes = headBytes()
+	c.Gunzip = *gunzipFlag
+	c.SkipClasses = skipClassFlag
+	fn := func(arg int, path string, info fs.DirEntry) error {
+		skip, err := c.CheckFile(path)
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+		if skip != "" {
+			fmt.Printf("skip %s: %s\n", path, skip)
+		} else {
+			fmt.Printf("index %s\n", path)
+		}
+		return nil
+	}
+	var err error
+	if fileList != nil {
+		err = listFiles(fileList, nil, true, fn)
+	} else {
+		err = walkFiles(w, args, nil, true, fn)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	if !*resetFlag {
-		log.Printf("merge %s %s", primary, file)
-		if err := index.Merge(file+"~", primary, file); err != nil {
-			log.Fatal(err)
+// readFileList reads a list of file names, one per line or, if the list
+// contains a NUL byte, NUL-terminated, from the named file or, if the
+// name is "-", from standard input.
+func readFileList(name string) ([]string, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sep := "\n"
+	if strings.Contains(string(data), "\x00") {
+		sep = "\x00"
+	}
+	list := []string{}
+	for _, f := range strings.Split(string(data), sep) {
+		f = strings.TrimSuffix(f, "\r")
+		if f != "" {
+			list = append(list, f)
 		}
-		os.Remove(file)
-		os.Rename(file+"~", primary)
 	}
-	log.Printf("done")
-	return
+	return list, nil
+}
+
+// absFileList returns the sorted absolute names of the files in list,
+// dropping those not under any of the absolute paths in args.
+func absFileList(list, args []string) []string {
+	abs := []string{}
+	for _, f := range list {
+		a, err := filepath.Abs(f)
+		if err != nil {
+			log.Printf("%s: %s", f, err)
+			continue
+		}
+		under := false
+		for _, arg := range args {
+			if a == arg || inDir(a, arg) {
+				under = true
+				break
+			}
+		}
+		if !under {
+			log.Printf("%s: not under any indexed path", f)
+			continue
+		}
+		abs = append(abs, a)
+	}
+	sort.Strings(abs)
+	return abs
+}
+
+// listFiles calls fn for each regular file in list, which is sorted,
+// that sorts after the last file indexed before the checkpoint cp, which
+// may be nil. If report is true, listFiles logs files it cannot index.
+func listFiles(list []string, cp *checkpoint, report bool, fn func(arg int, path string, info fs.DirEntry) error) error {
+	for _, path := range list {
+		if cp != nil && path <= cp.Last {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			if report {
+				log.Print(err)
+				skipped.error(path, err)
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			if report {
+				log.Printf("%s: not a regular file", path)
+				skipped.add(path, "error", "not a regular file")
+			}
+			continue
+		}
+		if err := fn(0, path, fs.FileInfoToDirEntry(fi)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A checkpoint records the progress of an interrupted run.
+type checkpoint struct {
+	Args     []string
+	FileList string // hash of the -filelist names, or "" if walking
+	Shards   int
+	Parallel int // writers for each index file
+	Reset    bool
+	Arg      int    // index in Args of the path being walked
+	Last     string // last file walked
+	Writers  []*index.Checkpoint
+}
+
+// checkpointFile returns the name of the checkpoint file for the index file.
+func checkpointFile(file string) string {
+	return file + ".checkpoint"
+}
+
+// writeCheckpoint checkpoints the index writers and saves cp.
+func writeCheckpoint(file string, cp *checkpoint, ixs []*index.Writer) error {
+	for _, ix := range ixs {
+		c, err := ix.Checkpoint()
+		if err != nil {
+			return err
+		}
+		cp.Writers = append(cp.Writers, c)
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	name := checkpointFile(file)
+	if err := os.WriteFile(name+"~", data, 0666); err != nil {
+		return err
+	}
+	if *verboseFlag {
+		log.Printf("checkpoint %s", cp.Last)
+	}
+	return os.Rename(name+"~", name)
+}
+
+// fileListHash returns the hash of the sorted file list, as recorded
+// in a checkpoint, or "" for a nil list.
+func fileListHash(list []string) string {
+	if list == nil {
+		return ""
+	}
+	h := sha256.New()
+	for _, f := range list {
+		io.WriteString(h, f)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readCheckpoint returns the checkpoint saved for the index file,
+// or nil if there is none for a run with the given arguments and
+// file list hash.
+func readCheckpoint(file string, args []string, listHash string, shards, parallel int, reset bool) *checkpoint {
+	data, err := os.ReadFile(checkpointFile(file))
+	if err != nil {
+		return nil
+	}
+	cp := new(checkpoint)
+	if err := json.Unmarshal(data, cp); err != nil {
+		log.Printf("%s: %v", checkpointFile(file), err)
+		return nil
+	}
+	n := max(shards, 1) * parallel
+	if !reflect.DeepEqual(cp.Args, args) || cp.FileList != listHash || cp.Shards != shards || cp.Parallel != parallel || cp.Reset != reset || len(cp.Writers) != n {
+		log.Printf("ignoring checkpoint for a different run of cindex")
+		return nil
+	}
+	log.Printf("resume after %s", cp.Last)
+	return cp
+}
+
+// walkedBefore reports whether path is walked before or is last,
+// when both are under the same root. Walks visit the entries of a
+// directory in lexical order, so paths are ordered element by element.
+func walkedBefore(path, last string) bool {
+	p := strings.Split(path, string(filepath.Separator))
+	l := strings.Split(last, string(filepath.Separator))
+	for i := 0; i < len(p) && i < len(l); i++ {
+		if p[i] != l[i] {
+			return p[i] < l[i]
+		}
+	}
+	return len(p) <= len(l)
+}
+
+// inDir reports whether path is in the directory tree dir,
+// which may end in a separator, as the root directory does.
+func inDir(path, dir string) bool {
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return len(path) > len(dir) && strings.HasPrefix(path, dir)
+}
+
+// defaultFilter is the walk filter skipping the files and directories
+// that cindex never indexes.
+type defaultFilter struct{}
+
+func (defaultFilter) Match(path string, d fs.DirEntry) walk.Decision {
+	if defaultSkip(path) {
+		return walk.Skip
+	}
+	return walk.Continue
+}
+
+func (defaultFilter) Reason(path string, d fs.DirEntry) string {
+	return "hidden or temporary file"
 }
 
 func defaultSkip(path string) bool {
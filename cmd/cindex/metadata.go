@@ -0,0 +1,101 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+// metadata returns the provenance that cindex records in the indexes
+// it writes, as described in index.Writer.Metadata: the time it
+// started, the host, its version, and the flags it was run with.
+func metadata(start time.Time) map[string]string {
+	var flags []string
+	flag.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		if v == "" || strings.ContainsAny(v, " \t\n\"") {
+			v = strconv.Quote(v)
+		}
+		flags = append(flags, "-"+f.Name+"="+v)
+	})
+	m := map[string]string{
+		"created": start.UTC().Format(time.RFC3339),
+		"tool":    "cindex " + version(),
+		"flags":   strings.Join(flags, " "),
+	}
+	if host, err := os.Hostname(); err == nil {
+		m["hostname"] = host
+	}
+	return m
+}
+
+// version returns the version of cindex, as recorded by the go command
+// when it was built: the module version or, for a development build,
+// the revision of the source, marked as modified if it had uncommitted
+// changes.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := info.Main.Version
+	if v != "" && v != "(devel)" {
+		return v
+	}
+	var rev, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = "+modified"
+			}
+		}
+	}
+	if rev != "" {
+		v += " " + rev + modified
+	}
+	return v
+}
+
+// printInfo prints the metadata recorded in the index file, which may
+// be sharded, as lines of the form "key: value", sorted by key.
+func printInfo(file string) {
+	if index.NumShards(file) > 0 {
+		// Every shard records the same metadata.
+		file = index.ShardFile(file, 0)
+	}
+	ix, err := index.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ix.Close()
+	m, err := ix.Metadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if m == nil {
+		log.Fatalf("index %s records no metadata; rebuild it to record it", file)
+	}
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s: %s\n", k, m[k])
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+// maxWriters is the most index writers used for each index file
+// by default. More writers take more rounds to merge.
+const maxWriters = 8
+
+// numWriters returns the number of index writers to use for each
+// index file, as set by -parallel.
+func numWriters() int {
+	if *parallelFlag > 0 {
+		return *parallelFlag
+	}
+	return min(runtime.GOMAXPROCS(0), maxWriters)
+}
+
+// A writerPool adds files to index writers, each in its own goroutine,
+// so that they index at the same time.
+type writerPool struct {
+	queue []chan []string // names to add, for each writer
+	done  sync.WaitGroup  // running goroutines
+	busy  sync.WaitGroup  // batches queued or being added
+	mu    sync.Mutex      // guards err
+	err   error           // first error adding files
+}
+
+func newWriterPool(ixs []*index.Writer) *writerPool {
+	p := &writerPool{queue: make([]chan []string, len(ixs))}
+	for i, ix := range ixs {
+		q := make(chan []string, 1)
+		p.queue[i] = q
+		p.done.Add(1)
+		go func() {
+			defer p.done.Done()
+			for names := range q {
+				if p.error() == nil {
+					if err := addFiles(ix, names); err != nil {
+						p.mu.Lock()
+						if p.err == nil {
+							p.err = err
+						}
+						p.mu.Unlock()
+					}
+				}
+				p.busy.Done()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *writerPool) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// add queues the named files to be added to the i'th writer.
+// It returns the first error adding files so far, if any.
+func (p *writerPool) add(i int, names []string) error {
+	if err := p.error(); err != nil {
+		return err
+	}
+	p.busy.Add(1)
+	p.queue[i] <- names
+	return nil
+}
+
+// wait waits for the files queued so far to be added,
+// so that the writers can be checkpointed.
+func (p *writerPool) wait() error {
+	p.busy.Wait()
+	return p.error()
+}
+
+// close waits for the files queued to be added
+// and stops the goroutines.
+func (p *writerPool) close() error {
+	for _, q := range p.queue {
+		close(q)
+	}
+	p.done.Wait()
+	return p.error()
+}
+
+// flushAll flushes the index writers at the same time.
+func flushAll(ixs []*index.Writer) error {
+	errs := make([]error, len(ixs))
+	var wg sync.WaitGroup
+	for i, ix := range ixs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = ix.Flush()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
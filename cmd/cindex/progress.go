@@ -0,0 +1,147 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// A progress shows the progress of indexing, or of merging the new
+// index into the old one, in a status line on a terminal, which it
+// redraws at most every progressInterval.
+//
+// A progress is also an io.Writer that clears the status line before
+// writing and redraws it after, so that log messages written to it do
+// not get mixed up with the status line.
+type progress struct {
+	w          io.Writer
+	start      time.Time
+	last       time.Time // when the status line was last drawn
+	shown      bool      // whether the status line is on screen
+	totalFiles int64     // files to index, from a scan, or trigrams to merge
+	totalBytes int64
+	files      int64 // files indexed so far, or trigrams merged
+	bytes      int64
+	merging    bool // showing the progress of a merge
+}
+
+const progressInterval = 100 * time.Millisecond
+
+func newProgress(w io.Writer) *progress {
+	return &progress{w: w}
+}
+
+// fileSize returns the size of the file described by info,
+// or 0 if it is unknown.
+func fileSize(info fs.DirEntry) int64 {
+	fi, err := info.Info()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// addTotal adds a file of the given size to the work to be done.
+func (p *progress) addTotal(size int64) {
+	p.totalFiles++
+	p.totalBytes += size
+}
+
+// add records a file of the given size as indexed.
+func (p *progress) add(size int64) {
+	now := time.Now()
+	if p.files == 0 {
+		p.start = now
+	}
+	p.files++
+	p.bytes += size
+	if now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.draw()
+	}
+}
+
+// merged records done of total trigrams as merged,
+// for use as index.MergeOptions.Progress.
+func (p *progress) merged(done, total int) {
+	now := time.Now()
+	if !p.merging {
+		p.start = now
+		p.merging = true
+	}
+	p.files, p.totalFiles = int64(done), int64(total)
+	if now.Sub(p.last) >= progressInterval || done == total {
+		p.last = now
+		p.draw()
+	}
+}
+
+// done draws the final status line and moves past it.
+func (p *progress) done() {
+	p.draw()
+	fmt.Fprintf(p.w, "\n")
+	p.shown = false
+}
+
+func (p *progress) draw() {
+	if p.merging {
+		p.drawMerge()
+		return
+	}
+	elapsed := time.Since(p.start).Seconds()
+	line := fmt.Sprintf("%d/%d files, %s/%s", p.files, p.totalFiles, formatBytes(p.bytes), formatBytes(p.totalBytes))
+	if elapsed >= 1 {
+		rate := float64(p.bytes) / elapsed
+		line += fmt.Sprintf(", %.0f files/s, %s/s", float64(p.files)/elapsed, formatBytes(int64(rate)))
+		if rate > 0 && p.bytes < p.totalBytes {
+			eta := time.Duration(float64(p.totalBytes-p.bytes) / rate * float64(time.Second))
+			line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+		}
+	}
+	fmt.Fprintf(p.w, "\r%s\x1b[K", line)
+	p.shown = true
+}
+
+func (p *progress) drawMerge() {
+	line := fmt.Sprintf("merge: %d/%d trigrams", p.files, p.totalFiles)
+	if p.totalFiles > 0 {
+		line += fmt.Sprintf(" (%d%%)", p.files*100/p.totalFiles)
+	}
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed >= 1 && p.files > 0 && p.files < p.totalFiles {
+		rate := float64(p.files) / elapsed
+		eta := time.Duration(float64(p.totalFiles-p.files) / rate * float64(time.Second))
+		line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	fmt.Fprintf(p.w, "\r%s\x1b[K", line)
+	p.shown = true
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	if p.shown {
+		fmt.Fprintf(p.w, "\r\x1b[K")
+	}
+	n, err := p.w.Write(b)
+	if p.shown {
+		p.draw()
+	}
+	return n, err
+}
+
+// formatBytes formats n as a number of bytes for display.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f kB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+// findRepos returns the git repositories holding the paths, named by
+// their top-level directories, for csearch -repo.
+func findRepos(paths []string) []index.Repo {
+	var repos []index.Repo
+	for _, p := range paths {
+		if r, ok := findRepo(p); ok {
+			repos = append(repos, r)
+		}
+	}
+	return repos
+}
+
+// findRepo returns the git repository holding path, if any.
+// It reads the repository's files directly rather than running git,
+// which need not be installed.
+func findRepo(path string) (index.Repo, bool) {
+	for dir := path; ; {
+		gitDir := filepath.Join(dir, ".git")
+		fi, err := os.Stat(gitDir)
+		if err == nil {
+			if !fi.IsDir() {
+				// A worktree or submodule: .git names the git directory.
+				data, err := os.ReadFile(gitDir)
+				if err != nil || !strings.HasPrefix(string(data), "gitdir: ") {
+					return index.Repo{}, false
+				}
+				gitDir = strings.TrimSpace(strings.TrimPrefix(string(data), "gitdir: "))
+				if !filepath.IsAbs(gitDir) {
+					gitDir = filepath.Join(dir, gitDir)
+				}
+			}
+			r := index.Repo{Path: path, Name: filepath.Base(dir)}
+			if head, err := os.ReadFile(filepath.Join(gitDir, "HEAD")); err == nil {
+				// A detached HEAD holds a commit hash, not a branch.
+				s := strings.TrimSpace(string(head))
+				if b := strings.TrimPrefix(s, "ref: refs/heads/"); b != s {
+					r.Branch = b
+				}
+			}
+			return r, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return index.Repo{}, false
+		}
+		dir = parent
+	}
+}
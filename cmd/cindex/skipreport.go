@@ -0,0 +1,107 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/andrewarchi/codesearch/index"
+	"github.com/andrewarchi/codesearch/walk"
+)
+
+// skipped collects the files skipped while indexing, for -skip-report,
+// or is nil.
+var skipped *skipReport
+
+// A skipReport collects skipped files. Its methods do nothing if it is
+// nil.
+type skipReport struct {
+	mu    sync.Mutex
+	files map[string]skippedFile
+}
+
+// A skippedFile is an entry of the -skip-report file.
+type skippedFile struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`   // as listed in the usage message
+	Reason string `json:"reason"` // as logged by -logskip
+}
+
+// skipKinds are the kinds of the skips made by an index.Writer.
+var skipKinds = map[index.SkipKind]string{
+	index.SkipInvalidUTF8:     "invalid-utf8",
+	index.SkipFileTooLong:     "file-too-long",
+	index.SkipLineTooLong:     "line-too-long",
+	index.SkipTooManyTrigrams: "too-many-trigrams",
+	index.SkipClass:           "class",
+	index.SkipBadGzip:         "bad-gzip",
+}
+
+func newSkipReport() *skipReport {
+	return &skipReport{files: make(map[string]skippedFile)}
+}
+
+// add records that path was skipped. A path walked twice, as when
+// counting files for the progress display, is recorded once.
+func (r *skipReport) add(path, kind, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[path] = skippedFile{Path: path, Kind: kind, Reason: reason}
+}
+
+// walkSkip records a file or directory skipped by the walk filters.
+func (r *skipReport) walkSkip(path, reason string) {
+	kind := "excluded"
+	switch reason {
+	case walk.GitignoreReason:
+		kind = "gitignore"
+	case walk.HgignoreReason:
+		kind = "hgignore"
+	case walk.SvnignoreReason:
+		kind = "svnignore"
+	}
+	r.add(path, kind, reason)
+}
+
+// writerSkip records a file skipped by an index.Writer as not text,
+// for use as its OnSkip function.
+func (r *skipReport) writerSkip(name string, reason index.SkipReason) bool {
+	r.add(name, skipKinds[reason.Kind], reason.String())
+	return true
+}
+
+// error records a file that could not be read because of err.
+func (r *skipReport) error(path string, err error) {
+	kind := "error"
+	if errors.Is(err, fs.ErrPermission) {
+		kind = "permission-denied"
+	}
+	r.add(path, kind, err.Error())
+}
+
+// write writes the report to the named file, as a JSON array of the
+// skipped files sorted by path.
+func (r *skipReport) write(file string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []skippedFile{}
+	for _, f := range r.files {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0666)
+}
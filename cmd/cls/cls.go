@@ -0,0 +1,94 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/andrewarchi/codesearch/index"
+	"github.com/andrewarchi/codesearch/internal/cli"
+)
+
+var usageMessage = `usage: cls [-index path,...] [-max n] [-loglevel level]
+
+cls is a language server, speaking the Language Server Protocol on its
+standard input and output, that answers an editor's project-wide
+searches from the indexes built by cindex, so that they are instant
+even over huge trees and need no indexer specific to the language.
+
+cls answers three requests:
+
+workspace/symbol finds the definitions of the symbols whose names
+contain the query, ignoring case, by looking for the names following
+the keywords that introduce definitions in common languages, such as
+func, type, class, def, fn, struct, interface, trait, and enum. There
+is no symbol index: the trigram index narrows the search to the files
+that might hold such a definition, which cls then reads.
+
+textDocument/definition finds the definitions of the identifier under
+the cursor, the same way, matching its whole name.
+
+textDocument/references finds the uses of the identifier under the
+cursor, as whole words, in the indexed files.
+
+Only files under the root of the editor's workspace are searched, if
+it names one. The -index flag names the indexes to search; it may be
+repeated or comma-separated, and defaults to the index csearch would
+use. cls reopens an index when cindex replaces it. The -max flag sets
+the most results returned for a request.
+
+The -loglevel flag sets the level of the messages logged to standard
+error; at debug, each request is logged.
+`
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var maxFlag = flag.Int("max", 500, "return at most `n` results for a request")
+
+// indexFlag is the list of indexes named by -index flags.
+var indexFlag cli.IndexList
+
+// logLevelFlag is the level set by the -loglevel flag.
+var logLevelFlag = cli.LogLevel()
+
+func init() {
+	flag.Var(&indexFlag, "index", "path to the index; may be repeated or comma-separated")
+}
+
+func main() {
+	log.SetPrefix("cls: ")
+	log.SetFlags(0)
+	flag.Usage = usage
+	flag.Parse()
+	slog.SetLogLoggerLevel(*logLevelFlag)
+	if flag.NArg() != 0 {
+		usage()
+	}
+
+	files := []string(indexFlag)
+	if len(files) == 0 {
+		files = []string{index.File()}
+	}
+	s := &server{max: *maxFlag}
+	for _, file := range files {
+		w, err := index.Watch(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.indexes = append(s.indexes, w)
+	}
+	c := &conn{r: bufio.NewReader(os.Stdin), w: os.Stdout}
+	if err := s.serve(c); err != nil {
+		log.Fatal(err)
+	}
+}
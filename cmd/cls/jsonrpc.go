@@ -0,0 +1,103 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+)
+
+// The Language Server Protocol sends JSON-RPC 2.0 messages, each
+// preceded by a header giving its length, as in HTTP:
+//
+//	Content-Length: 52\r\n
+//	\r\n
+//	{"jsonrpc":"2.0","id":1,"method":"shutdown"}
+
+// A message is a JSON-RPC request, notification, or response.
+// A notification has no ID and gets no response.
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  any              `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+// An rpcError is the error answering a request.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// JSON-RPC error codes.
+const (
+	codeParseError     = -32700
+	codeInvalidParams  = -32602
+	codeMethodNotFound = -32601
+	codeInternalError  = -32603
+	codeNotInitialized = -32002
+)
+
+// A conn reads and writes the messages of a language server.
+type conn struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// read reads the next message. It returns io.EOF at the end of the input.
+func (c *conn) read() (*message, error) {
+	body, err := c.readBody()
+	if err != nil {
+		return nil, err
+	}
+	m := new(message)
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, &rpcError{codeParseError, err.Error()}
+	}
+	return m, nil
+}
+
+// readBody reads the body of the next message, undecoded.
+// It returns io.EOF at the end of the input.
+func (c *conn) readBody() ([]byte, error) {
+	hdr, err := textproto.NewReader(c.r).ReadMIMEHeader()
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(hdr) == 0 {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(hdr.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("bad Content-Length %q", hdr.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// write writes the message m.
+func (c *conn) write(m *message) error {
+	m.JSONRPC = "2.0"
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	stdregexp "regexp"
+	"regexp/syntax"
+	"unicode/utf8"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+// A position is a place in a text document: a line, counting from 0,
+// and a character offset in it, in UTF-16 code units, as the protocol
+// counts by default.
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type textRange struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type location struct {
+	URI   string    `json:"uri"`
+	Range textRange `json:"range"`
+}
+
+// A symbol is a SymbolInformation of the protocol.
+type symbol struct {
+	Name     string   `json:"name"`
+	Kind     int      `json:"kind"`
+	Location location `json:"location"`
+}
+
+// Symbol kinds of the protocol.
+const (
+	kindModule    = 2
+	kindClass     = 5
+	kindMethod    = 6
+	kindEnum      = 10
+	kindInterface = 11
+	kindFunction  = 12
+	kindStruct    = 23
+)
+
+// defKinds gives the kind of symbol each definition keyword introduces.
+var defKinds = map[string]int{
+	"func":      kindFunction,
+	"fn":        kindFunction,
+	"def":       kindFunction,
+	"function":  kindFunction,
+	"class":     kindClass,
+	"type":      kindClass,
+	"struct":    kindStruct,
+	"interface": kindInterface,
+	"trait":     kindInterface,
+	"enum":      kindEnum,
+	"module":    kindModule,
+}
+
+// defExpr matches a definition keyword, a Go method's receiver, if any,
+// and the start of a group matching the name defined, which defs
+// completes.
+const defExpr = `\b(func|fn|def|function|class|type|struct|interface|trait|enum|module)[ \t]+(\([^)\n]*\)[ \t]*)?(`
+
+// symbols returns the definitions of the symbols whose names contain
+// query, ignoring case.
+func (s *server) symbols(query string) ([]symbol, error) {
+	if query == "" {
+		// Every definition would do; list none.
+		return []symbol{}, nil
+	}
+	return s.defs(`\w*(?i:` + stdregexp.QuoteMeta(query) + `)\w*`)
+}
+
+// definition returns the locations of the definitions of the
+// identifier at pos in file.
+func (s *server) definition(file string, pos position) ([]location, error) {
+	locs := []location{}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	ident := identAt(data, pos)
+	if ident == "" {
+		return locs, nil
+	}
+	syms, err := s.defs(stdregexp.QuoteMeta(ident))
+	for _, sym := range syms {
+		locs = append(locs, sym.Location)
+	}
+	return locs, err
+}
+
+// defs returns the definitions of the symbols whose whole names match
+// the regular expression nameExpr.
+func (s *server) defs(nameExpr string) ([]symbol, error) {
+	syms := []symbol{}
+	expr := defExpr + nameExpr + `)\b`
+	err := s.search(expr, func(file string, data []byte, m []int) bool {
+		name := string(data[m[6]:m[7]])
+		kind := defKinds[string(data[m[2]:m[3]])]
+		if kind == kindFunction && m[4] >= 0 {
+			kind = kindMethod
+		}
+		syms = append(syms, symbol{Name: name, Kind: kind, Location: s.location(file, data, m[6], m[7])})
+		return len(syms) < s.max
+	})
+	return syms, err
+}
+
+// references returns the uses of the identifier at pos in file.
+func (s *server) references(file string, pos position) ([]location, error) {
+	locs := []location{}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	ident := identAt(data, pos)
+	if ident == "" {
+		return locs, nil
+	}
+	err = s.search(`\b`+stdregexp.QuoteMeta(ident)+`\b`, func(file string, data []byte, m []int) bool {
+		locs = append(locs, s.location(file, data, m[0], m[1]))
+		return len(locs) < s.max
+	})
+	return locs, err
+}
+
+// search calls f with the matches, as returned by FindSubmatchIndex,
+// of the regular expression expr in the indexed files under the
+// workspace root, until f returns false.
+func (s *server) search(expr string, f func(file string, data []byte, m []int) bool) error {
+	re, err := stdregexp.Compile(`(?m)` + expr)
+	if err != nil {
+		return err
+	}
+	sre, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return err
+	}
+	q := index.RegexpQuery(sre)
+	seen := make(map[string]bool)
+	for _, w := range s.indexes {
+		ix, err := w.Index()
+		if err != nil {
+			return err
+		}
+		names, err := ix.Search(q, &index.SearchOptions{Dir: s.root})
+		if err != nil {
+			return err
+		}
+		slog.Debug("search", "expr", expr, "files", len(names))
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			data, err := os.ReadFile(name)
+			if err != nil {
+				// The file has been removed since it was indexed.
+				continue
+			}
+			for _, m := range re.FindAllSubmatchIndex(data, -1) {
+				if !f(name, data, m) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// location returns the location of data[start:end] in file.
+func (s *server) location(file string, data []byte, start, end int) location {
+	return location{
+		URI:   fileURI(file),
+		Range: textRange{Start: positionOf(data, start), End: positionOf(data, end)},
+	}
+}
+
+// positionOf returns the position of the byte offset off in data.
+func positionOf(data []byte, off int) position {
+	line := bytes.Count(data[:off], []byte("\n"))
+	lineStart := bytes.LastIndexByte(data[:off], '\n') + 1
+	return position{Line: line, Character: utf16Len(data[lineStart:off])}
+}
+
+// utf16Len returns the length of the UTF-8 text b in UTF-16 code units.
+func utf16Len(b []byte) int {
+	n := 0
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r >= 0x10000 {
+			n++
+		}
+		n++
+		b = b[size:]
+	}
+	return n
+}
+
+// identAt returns the identifier in data at pos, or "" if there is none.
+func identAt(data []byte, pos position) string {
+	for i := 0; i < pos.Line; i++ {
+		j := bytes.IndexByte(data, '\n')
+		if j < 0 {
+			return ""
+		}
+		data = data[j+1:]
+	}
+	if j := bytes.IndexByte(data, '\n'); j >= 0 {
+		data = data[:j]
+	}
+	// Find the byte offset of the character.
+	off, n := 0, 0
+	for off < len(data) && n < pos.Character {
+		r, size := utf8.DecodeRune(data[off:])
+		if r >= 0x10000 {
+			n++
+		}
+		n++
+		off += size
+	}
+	start, end := off, off
+	for start > 0 && isIdentByte(data[start-1]) {
+		start--
+	}
+	for end < len(data) && isIdentByte(data[end]) {
+		end++
+	}
+	return string(data[start:end])
+}
+
+// isIdentByte reports whether c can be part of an identifier, as \w
+// matches it.
+func isIdentByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+// A server answers the requests of a language client.
+type server struct {
+	indexes     []*index.Watcher
+	max         int    // most results for a request
+	root        string // directory of the workspace, with a trailing separator, or ""
+	initialized bool
+	shutdown    bool
+}
+
+// serve answers the requests read from c until the client exits.
+func (s *server) serve(c *conn) error {
+	for {
+		m, err := c.read()
+		if err == io.EOF {
+			return nil
+		}
+		var rerr *rpcError
+		if errors.As(err, &rerr) {
+			// A malformed message cannot be answered by ID,
+			// so the error answers a null ID.
+			slog.Warn("bad message", "err", err)
+			null := json.RawMessage("null")
+			if err := c.write(&message{ID: &null, Error: rerr}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if m.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit without shutdown")
+			}
+			return nil
+		}
+		slog.Debug("request", "method", m.Method)
+		result, err := s.handle(m)
+		if m.ID == nil {
+			// A notification.
+			if err != nil {
+				slog.Warn("notification", "method", m.Method, "err", err)
+			}
+			continue
+		}
+		resp := &message{ID: m.ID}
+		switch {
+		case errors.As(err, &rerr):
+			resp.Error = rerr
+		case err != nil:
+			resp.Error = &rpcError{codeInternalError, err.Error()}
+		case result == nil:
+			resp.Result = json.RawMessage("null")
+		default:
+			resp.Result = result
+		}
+		if err := c.write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers the request or notification m.
+func (s *server) handle(m *message) (any, error) {
+	if !s.initialized && m.Method != "initialize" {
+		if m.ID == nil {
+			return nil, nil
+		}
+		return nil, &rpcError{codeNotInitialized, "server not initialized"}
+	}
+	switch m.Method {
+	case "initialize":
+		var p struct {
+			RootURI string `json:"rootUri"`
+		}
+		if err := unmarshalParams(m, &p); err != nil {
+			return nil, err
+		}
+		if p.RootURI != "" {
+			dir, err := uriPath(p.RootURI)
+			if err != nil {
+				return nil, &rpcError{codeInvalidParams, err.Error()}
+			}
+			s.root = strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+		}
+		s.initialized = true
+		return map[string]any{
+			"capabilities": map[string]any{
+				"workspaceSymbolProvider": true,
+				"definitionProvider":      true,
+				"referencesProvider":      true,
+			},
+			"serverInfo": map[string]string{"name": "cls"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "workspace/symbol":
+		var p struct {
+			Query string `json:"query"`
+		}
+		if err := unmarshalParams(m, &p); err != nil {
+			return nil, err
+		}
+		return s.symbols(p.Query)
+	case "textDocument/definition", "textDocument/references":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			Position position `json:"position"`
+		}
+		if err := unmarshalParams(m, &p); err != nil {
+			return nil, err
+		}
+		file, err := uriPath(p.TextDocument.URI)
+		if err != nil {
+			return nil, &rpcError{codeInvalidParams, err.Error()}
+		}
+		if m.Method == "textDocument/definition" {
+			return s.definition(file, p.Position)
+		}
+		return s.references(file, p.Position)
+	}
+	if m.ID == nil || strings.HasPrefix(m.Method, "$/") {
+		// Notifications such as textDocument/didOpen need no answer.
+		return nil, nil
+	}
+	return nil, &rpcError{codeMethodNotFound, "method not supported: " + m.Method}
+}
+
+func unmarshalParams(m *message, v any) error {
+	if len(m.Params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(m.Params, v); err != nil {
+		return &rpcError{codeInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+// uriPath returns the path of the file named by the file URI.
+func uriPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", errors.New("not a file URI: " + uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// fileURI returns the file URI naming the file.
+func fileURI(file string) string {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(file)}
+	return u.String()
+}
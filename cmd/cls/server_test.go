@@ -0,0 +1,92 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "a.go")
+	text := "package a\n\nfunc Hello() {}\n\nfunc main() { Hello() }\n"
+	if err := os.WriteFile(file, []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "index")
+	ix, err := index.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.AddPaths([]string{src})
+	if err := ix.AddFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := index.Watch(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client asks for the definition and the references of Hello,
+	// at its call, and sends a malformed message on the way.
+	uri := fileURI(file)
+	at := fmt.Sprintf(`{"textDocument":{"uri":%q},"position":{"line":4,"character":16}}`, uri)
+	var in bytes.Buffer
+	for _, body := range []string{
+		fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"rootUri":%q}}`, fileURI(src)),
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"textDocument/definition","params":` + at + `}`,
+		`{"jsonrpc":"2.0","id":3,"method":"textDocument/references","params":` + at + `}`,
+		`{"jsonrpc":"2.0","id":`,
+		`{"jsonrpc":"2.0","id":4,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	} {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	var resp bytes.Buffer
+	s := &server{indexes: []*index.Watcher{w}, max: 100}
+	if err := s.serve(&conn{r: bufio.NewReader(&in), w: &resp}); err != nil {
+		t.Fatal(err)
+	}
+
+	loc := func(line, start, end int) string {
+		return fmt.Sprintf(`{"uri":%q,"range":{"start":{"line":%d,"character":%d},"end":{"line":%d,"character":%d}}}`, uri, line, start, line, end)
+	}
+	want := []string{
+		`{"jsonrpc":"2.0","id":1,"result":{"capabilities":{"definitionProvider":true,"referencesProvider":true,"workspaceSymbolProvider":true},"serverInfo":{"name":"cls"}}}`,
+		`{"jsonrpc":"2.0","id":2,"result":[` + loc(2, 5, 10) + `]}`,
+		`{"jsonrpc":"2.0","id":3,"result":[` + loc(2, 5, 10) + `,` + loc(4, 14, 19) + `]}`,
+		`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"unexpected end of JSON input"}}`,
+		`{"jsonrpc":"2.0","id":4,"result":null}`,
+	}
+	c := &conn{r: bufio.NewReader(&resp)}
+	for i, want := range want {
+		got, err := c.readBody()
+		if err != nil {
+			t.Fatalf("response #%d: %v", i, err)
+		}
+		if string(got) != want {
+			t.Errorf("response #%d:\n%s\nwant:\n%s", i, got, want)
+		}
+	}
+	if body, err := c.readBody(); err != io.EOF {
+		t.Errorf("extra response %s, %v", body, err)
+	}
+}
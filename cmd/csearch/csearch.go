@@ -5,29 +5,257 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"regexp/syntax"
 	"runtime/pprof"
+	"slices"
+	"sort"
+	"strings"
 
+	"github.com/andrewarchi/codesearch/charset"
+	"github.com/andrewarchi/codesearch/history"
 	"github.com/andrewarchi/codesearch/index"
+	"github.com/andrewarchi/codesearch/internal/cli"
+	"github.com/andrewarchi/codesearch/lang"
+	"github.com/andrewarchi/codesearch/norm"
 	"github.com/andrewarchi/codesearch/regexp"
+	"github.com/andrewarchi/codesearch/trace"
 )
 
-var usageMessage = `usage: csearch [-c] [-f fileregexp] [-index path] [-h] [-i] [-l] [-n] regexp
+var usageMessage = `usage: csearch [-0] [-a] [-b] [-binary-files type] [-c] [-encoding enc] [-json] [-vimgrep] [-format tmpl] [-truncate n] [-total] [-f fileregexp] [-index path,...] [-h] [-i] [-l] [-q] [-v] [-fallback fraction] [-lang langs] [-skipclass classes] [-n] [-path dir] [-path-rewrite old=new] [-repo names] [-maxsize size] [-modified-after time] [-sort order] [-top n] [-at rev] [-layered] [-all] [-stale duration] [-refresh] [-daemon=false] [-trace] [-loglevel level] [-explain] regexp
+       csearch -all-of [flags] regexp regexp...
+       csearch -same-line [flags] regexp regexp...
+       csearch -query [flags] 'text file:re -file:re lang:langs repo:names case:yes|no|auto'
+       csearch -files [-0] [-f fileregexp] [-index path,...] [-i] [-lang langs] [-path dir] [fileregexp]
 
 csearch behaves like grep over all indexed files, searching for regexp,
 an RE2 (nearly PCRE) regular expression.
 
-The -c, -h, -i, -l, and -n flags are as in grep, although note that as
-per Go's flag parsing convention, they cannot be combined: the option
-pair -i -n cannot be abbreviated to -in.
+The -b, -c, -h, -i, -l, -n, -q, and -v flags are as in grep, although
+note that as per Go's flag parsing convention, they cannot be combined:
+the option pair -i -n cannot be abbreviated to -in. The byte offsets
+printed by -b are those of the start of each matching line, counting
+from 0, as needed by tools for which line numbers are ambiguous. With
+-q, the search stops at the first match, reading no further files.
+
+The -0 or -null flag terminates the file names printed by -l with a
+NUL byte instead of a newline, and those printed by -c with a NUL
+byte instead of a colon, so that names containing spaces or newlines
+pass safely through pipelines such as 'xargs -0'.
+
+A file with a NUL byte near its start is binary. By default, instead
+of printing the matching lines of a binary file, which would dump
+control characters to the terminal, the search prints "Binary file
+NAME matches". The -binary-files flag sets the policy, as in grep:
+binary, the default; without-match, to skip binary files, also set
+by -I; or text, to search them like other files, also set by -a.
+
+The -encoding flag names the encoding of the files searched, which
+are decoded to UTF-8 before matching: auto, the default; utf-8;
+utf-16, little-endian unless the file begins with a byte order mark;
+utf-16le; utf-16be; latin1; or windows-1252. With auto, a file
+beginning with a UTF-16 byte order mark is decoded as UTF-16, and one
+whose first 4 kB are not valid UTF-8 but have no control characters,
+as is typical of Latin-1 text, is decoded as windows-1252; others are
+searched as UTF-8. cindex detects encodings the same way when indexing.
+Byte offsets printed by -b count bytes of the decoded text.
+
+If the index was built with cindex -normalize, csearch normalizes
+regexp and the files it searches the same way, so that, for example,
+a search for café finds the word whether its é was written as a single
+character or as e followed by a combining accent. Indexes searched
+together must be normalized alike.
+
+Since almost every file has lines not matching regexp, the index
+cannot narrow a -v search: csearch reads every indexed file that
+passes the -f, -lang, -path, and -repo filters, and warns when there
+are many of them.
+
+Nor can the index narrow a search for a regexp without literal text,
+such as [a-z]+_test, and it narrows one for common text, such as func,
+very little. When the index finds more than the -fallback fraction of
+the files it holds, 0.5 by default, csearch warns if there are many
+of them, and reads them in parallel, as it does for -brute and -v
+searches, printing the results in the same order as it would reading
+them one at a time. The -fallback flag set to 0 turns this off.
+
+The -heading flag groups the matching lines of each file under a line
+naming the file, with line numbers, and separates files by blank lines.
+It is the default when writing to a terminal; -heading=false turns it
+off.
+
+The -json flag prints each matching line as a JSON object, one per
+line, with fields path, line, offset, and text, as well as binary, set
+for a binary file, whose text is omitted; spans, listing the text and
+start and end of each match of regexp in the line; and groups, listing
+the name, text, and start and end of each named capture group
+(?P<name>re) in regexp, so that scripts can extract fields from the
+results without parsing them again. Starts and ends are given both as
+byte offsets within the line, start and end, and as offsets counting
+runes, start_column and end_column, for editors to highlight exactly
+the text matched. Later versions may add fields, but will not change
+these.
+
+The -vimgrep flag prints each match on a line of its own, as
+path:line:column:text, where column is the byte offset of the match
+in the line, counting from 1, as Vim's :vimgrep and ripgrep --vimgrep
+do. Later versions will not change this format either.
+
+The -format flag prints each matching line using a Go text/template
+applied to a github.com/andrewarchi/codesearch/regexp.Match, with the
+same fields as -json, followed by a newline. For example,
+-format '{{.Path}}:{{.Line}}: {{.Text}}' prints lines like grep -n.
+Named capture groups are in .Groups.
+
+The -total flag prints the total number of matching lines at the end,
+after the per-file counts printed by -c, if given.
+
+The -truncate flag prints at most about the given number of bytes of
+each matching line, cutting a longer line down to the text around the
+start of the match and marking the text left out with "...", so that
+matches in minified code or generated data do not flood the output.
+The -json and -format flags print lines in full.
 
 The -f flag restricts the search to files whose names match the RE2
 regular expression fileregexp.
 
+The -lang flag restricts the search to files in the given
+comma-separated list of languages, such as -lang go,python. The
+language of each file is determined by cindex from the file's name,
+#! line, and Emacs or Vim modeline, such as -*- mode: python -*- or
+vim: set ft=cpp:, which overrides the name.
+
+The -skipclass flag leaves out of the search the files of the given
+comma-separated list of classes, which are generated, minified, and
+vendored, in indexes built by cindex -classify, which judges the class
+of each file. It defaults to all three; -skipclass= searches every
+file.
+
+Files compressed with gzip that cindex -gunzip indexed decompressed
+are searched decompressed too, as zgrep does, so the lines printed and
+the byte offsets printed by -b are those of the decompressed text.
+
+The -path flag restricts the search to files under the directory dir,
+or more generally to files whose absolute names begin with dir. Since
+the index stores names in sorted order, the files under a directory
+are found by binary search, which is much cheaper than an equivalent
+-f regexp.
+
+The -repo flag restricts the search to files in the given
+comma-separated list of git repositories, named by their top-level
+directories, such as -repo codesearch,go. A name of the form
+name@branch matches a repository only if that branch was checked out
+when it was indexed. cindex records the repository of each path it
+indexes; like -path, -repo is cheap, since the files of a path are
+numbered consecutively in the index.
+
+The -query flag parses the argument as a query of space-separated atoms,
+as typed into a search box, such as 'foo file:\.go$ -file:_test lang:go
+case:no repo:backend'. The atom file:re restricts the search to files
+whose names match the regexp re, and -file:re to files whose names do
+not; lang: and repo: take comma-separated lists, like -lang and -repo;
+and case: sets whether the text is matched case-sensitively: yes; no,
+like -i; or auto, the default, which ignores case unless the text has
+an upper-case letter. The other atoms are the text searched for, joined
+by single spaces into a regexp. Double quotes group text holding spaces,
+as in '"foo  bar"'. The file: and -file: regexps match the names of
+files as indexed and are applied by csearchd when it searches.
+
+The -all-of flag takes several regexps and searches only the files
+matching every one of them, printing the lines matching any of them,
+for investigations such as which files both import a package and call
+one of its functions. The index narrows the search to the files that
+might match all the regexps, and csearch reads each of those files to
+check that they do.
+
+The -same-line flag is like -all-of but prints only the lines matching
+every one of the regexps, in any order, such as 'csearch -same-line
+mutex Lock' for lines both naming a mutex and locking it.
+
+The texts of a -query combine with the operators AND, OR, and NOT, and
+parentheses, as in '(openssl OR boringssl) AND NOT vendor', which finds
+the files mentioning openssl or boringssl but not vendor. AND may be left
+out before a parenthesized group or NOT. csearch prints the lines of
+those files matching any text not under NOT. The index cannot narrow
+a search by the texts under NOT, so csearch reads each file found to
+check them.
+
+The -path-rewrite flag, given as old=new, treats the indexed files in
+the directory old as being in the directory new instead, so that an
+index still works after the indexed tree moves, or when it is searched
+on another machine or in a container that mounts the tree elsewhere.
+The flag may be repeated; the first rewrite whose old directory holds
+a file applies. Other flags, such as -f and -path, and the output all
+see the rewritten names.
+
+The -maxsize flag restricts the search to files no larger than the
+given size, written as a number of bytes optionally followed by k, M,
+or G, such as -maxsize 1M, to avoid large generated files. The
+-modified-after flag restricts it to files modified after the given
+time, written as a date such as 2024-01-01, an RFC 3339 time, or a
+duration such as 72h meaning that long ago, to find recent changes.
+Both go by the size and time that the index recorded of each file when
+it was indexed, if cindex recorded them, and otherwise look up each
+file the index identifies, dropping those that no longer exist, before
+reading any of them. A -maxsize of 0 is an error.
+
+The -files flag causes csearch to list the indexed files whose names
+match fileregexp, given as an argument or with -f, without reading the
+files at all. It answers from the index alone, which helps on network
+file systems where even opening a file is slow. The -i, -lang, -path,
+and -0 flags apply as usual.
+
+The -sort flag orders the files in the output: by path; by mtime, most
+recently modified first; by size, largest first; or by matches, the
+files with the most matching lines first. By default, files appear in
+the order of the index, which is by path within each index. Sorting
+by mtime or size looks up each candidate file, and sorting by matches
+reads each file twice, once to count and once to print.
+
+The -top flag shows only the n most relevant matching files, best
+first. Files are scored by the density of matching lines, whether
+regexp matches the file's base name, the depth of the file's directory,
+and how recently the file was modified.
+
+The -at flag searches a history index, built by cindex -history, as
+of the given git revision, such as a branch, tag, or commit hash. The
+output names the files by their paths in the repository's work tree,
+but the contents searched are those at the revision. Without -at, a
+history index is searched as of HEAD. The -top flag and sorting by
+mtime or size look at the files in the work tree, so they cannot be
+combined with -at, and neither can -maxsize or -modified-after.
+
+The -explain flag prints the trigram query plan for regexp, annotated
+with the number of indexed files containing each trigram, and exits
+without searching. It shows how selective the index is for regexp: a
+plan of "all" means that the regexp has no required trigrams and every
+file would be searched.
+
+The -trace flag prints a trace of the search to standard error when it
+finishes, showing the time spent evaluating each node of the posting
+query, filtering the files found, and reading each file searched.
+The -loglevel flag sets the level of the messages logged; debug adds
+the details printed by -verbose, such as the files each filter matched.
+
+If csearchd is running, csearch asks it to query the index, which it
+keeps open and in memory, instead of opening the index itself, which
+saves time on each search of a large index; csearch still reads the
+matching files itself. The -daemon=false flag makes csearch query the
+index directly. History indexes, indexes named by URLs, and -explain
+always query the index directly. Run csearchd -help for more.
+
+The -all flag searches every index in the registry of repositories of
+a csearchd run with -dir, which searches them all at once, in place of
+the index. Each file found is labeled by its repository, the name of
+its index in the registry's directory.
+
 csearch relies on the existence of an up-to-date index created ahead of
 time. To build or rebuild the index that csearch uses, run:
 
@@ -36,12 +264,46 @@ time. To build or rebuild the index that csearch uses, run:
 where path... is a list of directories or individual files to be
 included in the index. If no index exists, this command creates one.
 If an index already exists, cindex overwrites it. Run cindex -help for
-more.
+more. If cindex is replacing the index when csearch starts and the index
+cannot be opened, csearch waits for cindex to finish.
+
+Before searching, csearch warns about an index that may be out of
+date: one holding a path that was indexed before the path's own
+modification time, or, with -stale, such as -stale 24h, longer ago
+than the given duration. The modification time of a directory changes
+only when entries are added to or removed from the directory itself,
+so the check is cheap but does not notice every change. The -refresh
+flag makes csearch run cindex, which must be in $PATH, to reindex the
+stale paths instead of warning, keeping the other paths of the index.
+Indexes built by older versions of cindex, and history indexes, are
+not checked.
+
+The -layered flag, when neither -index nor $CSEARCHINDEX names an
+index, searches every .csearchindex in the current directory and its
+parents up to $HOME, and $HOME/.csearchindex, composing per-project
+indexes with a global one. The indexes are searched most specific
+first, and a file under a path indexed by a more specific index is
+taken only from that index, so each file appears once even if several
+indexes hold it, and a file deleted from a project but still present in
+a stale global index does not appear at all. The output is sorted by
+path and, unlike with several -index flags, not labeled by index.
 
 The path to the index is named by the -index flag or $CSEARCHINDEX
-variable. If both are empty, the current working directory and parents
+variable. The -index flag may be repeated, or given a comma-separated
+list, to search several indexes at once; each output line is then
+prefixed by the path of the index that produced it.
+
+An index may also be named by an http or https URL, in which case
+csearch reads only the parts of it that it needs, using HTTP range
+requests. The files themselves are still read from the local file
+system, so they must exist at the paths they were indexed under, or
+as rewritten by -path-rewrite. If both are empty, the current working directory and parents
 are recursively searched for a .csearchindex file. If none is found, an
 index is created at ~/.csearchindex.
+
+A local index is mapped into memory. Where that fails, as on some
+network and FUSE file systems, csearch reads the parts of the index it
+needs instead, as it does for every index if $CSEARCHNOMMAP is set.
 `
 
 func usage() {
@@ -50,14 +312,45 @@ func usage() {
 }
 
 var (
-	fFlag       = flag.String("f", "", "search only files with names matching this regexp")
-	iFlag       = flag.Bool("i", false, "case-insensitive search")
-	indexFlag   = flag.String("index", "", "path to the index")
-	verboseFlag = flag.Bool("verbose", false, "print extra information")
-	bruteFlag   = flag.Bool("brute", false, "brute force - search all files in index")
-	cpuProfile  = flag.String("cpuprofile", "", "write cpu profile to this file")
+	fFlag        = flag.String("f", "", "search only files with names matching this regexp")
+	iFlag        = flag.Bool("i", false, "case-insensitive search")
+	langFlag     = flag.String("lang", "", "search only files in these comma-separated languages")
+	classFlag    = flag.String("skipclass", "generated,minified,vendored", "leave out files of these comma-separated classes, as recorded by cindex -classify")
+	pathFlag     = flag.String("path", "", "search only files under this directory")
+	repoFlag     = flag.String("repo", "", "search only files in these comma-separated git repositories")
+	verboseFlag  = flag.Bool("verbose", false, "print extra information")
+	bruteFlag    = flag.Bool("brute", false, "brute force - search all files in index")
+	fallbackFlag = flag.Float64("fallback", 0.5, "read files in parallel when the index finds more than this `fraction` of them; 0 never does")
+	explainFlag  = flag.Bool("explain", false, "print the query plan and exit")
+	filesFlag    = flag.Bool("files", false, "list indexed files with names matching the regexp, without searching them")
+	sortFlag     = flag.String("sort", "", "order results by path, mtime, size, or matches")
+	topFlag      = flag.Int("top", 0, "show only the `n` most relevant files, best first")
+	atFlag       = flag.String("at", "", "search a history index as of this git `revision`")
+	daemonFlag   = flag.Bool("daemon", true, "use csearchd, if it is running")
+	layeredFlag  = flag.Bool("layered", false, "search every .csearchindex from the current directory up to $HOME")
+	allFlag      = flag.Bool("all", false, "search every repository in the registry of csearchd -dir")
+	staleFlag    = flag.Duration("stale", 0, "warn about indexes built longer ago than this `duration`")
+	refreshFlag  = flag.Bool("refresh", false, "run cindex to update stale indexes before searching")
+	traceFlag    = flag.Bool("trace", false, "print a trace of the search to standard error")
+	allOfFlag    = flag.Bool("all-of", false, "search only files matching every one of several regexps")
+	sameLineFlag = flag.Bool("same-line", false, "search only for lines matching every one of several regexps")
+	queryFlag    = flag.Bool("query", false, "parse the argument as a query with file:, -file:, lang:, repo:, and case: atoms")
+	cpuProfile   = flag.String("cpuprofile", "", "write cpu profile to this file")
 )
 
+// indexFlag is the list of indexes named by -index flags.
+var indexFlag cli.IndexList
+
+// logLevelFlag is the level set by the -loglevel flag.
+var logLevelFlag = cli.LogLevel()
+
+func init() {
+	flag.Var(&indexFlag, "index", "path to the index; may be repeated or comma-separated")
+	flag.Var(&maxSizeFlag, "maxsize", "search only files no larger than this size, such as 100k or 1M")
+	flag.Var(&modifiedAfterFlag, "modified-after", "search only files modified after this `time`, a date, RFC 3339 time, or duration ago")
+	flag.Var(&rewrites, "path-rewrite", "rewrite indexed paths in directory old to be in new, given as `old=new`; may be repeated")
+}
+
 func main() {
 	g := regexp.Grep{
 		Stdout: os.Stdout,
@@ -67,11 +360,61 @@ func main() {
 
 	flag.Usage = usage
 	flag.Parse()
+	slog.SetLogLoggerLevel(*logLevelFlag)
 	args := flag.Args()
+	if !cli.FlagSet("heading") && cli.IsTerminal(os.Stdout) {
+		g.Heading = true
+	}
 
-	if len(args) != 1 {
+	multi := *allOfFlag || *sameLineFlag
+	if len(args) != 1 && !(*filesFlag && len(args) == 0) && !(multi && len(args) > 1) {
 		usage()
 	}
+	if multi && (*filesFlag || *queryFlag) {
+		log.Fatal("-all-of and -same-line cannot be used with -files or -query")
+	}
+	switch *sortFlag {
+	case "", "path", "mtime", "size":
+	case "matches":
+		if *filesFlag {
+			log.Fatal("-sort matches cannot be used with -files")
+		}
+	default:
+		log.Fatalf("unknown -sort order %q; want path, mtime, size, or matches", *sortFlag)
+	}
+	if *topFlag != 0 && (*sortFlag != "" || *filesFlag) {
+		log.Fatal("-top cannot be used with -sort or -files")
+	}
+	if g.V && (*topFlag != 0 || *filesFlag) {
+		log.Fatal("-v cannot be used with -top or -files")
+	}
+	invert = g.V
+	if *queryFlag {
+		if *filesFlag {
+			log.Fatal("-query cannot be used with -files")
+		}
+		sq, err := index.ParseSearch(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if sq.Pattern == "" {
+			log.Fatal("query has no text to search for, outside NOT")
+		}
+		if sq.FoldCase() {
+			*iFlag = true
+		}
+		args[0] = sq.Pattern
+		searchQuery = sq
+	}
+	if *atFlag != "" && (*topFlag != 0 || *sortFlag == "mtime" || *sortFlag == "size") {
+		log.Fatal("-at cannot be used with -top or -sort mtime or size")
+	}
+	if cli.FlagSet("maxsize") && maxSizeFlag == 0 {
+		log.Fatal("-maxsize must be positive")
+	}
+	if *atFlag != "" && (maxSizeFlag != 0 || !modifiedAfterFlag.t.IsZero()) {
+		log.Fatal("-at cannot be used with -maxsize or -modified-after")
+	}
 
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
@@ -83,76 +426,838 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	if *traceFlag {
+		span = trace.NewWriter(os.Stderr).Start("csearch")
+		span.SetAttr("args", strings.Join(args, " "))
+		g.Trace = span
+	}
+
+	if *daemonFlag && !*explainFlag {
+		if c, err := index.DialDaemon(index.DaemonSocket()); err == nil {
+			daemon = c
+			defer daemon.Close()
+		}
+	}
+
+	var registry []index.DaemonRepo
+	if *allFlag {
+		if daemon == nil || len(indexFlag) > 0 || *layeredFlag || *atFlag != "" {
+			log.Fatal("-all searches the registry of a running csearchd, without -index, -layered, -at, or -explain")
+		}
+		var err error
+		if registry, err = daemon.Repos(); err != nil {
+			log.Fatal(err)
+		}
+		if len(registry) == 0 {
+			log.Fatal("csearchd has no repositories in its registry")
+		}
+	}
+
+	indexPaths := []string(indexFlag)
+	for _, r := range registry {
+		indexPaths = append(indexPaths, r.Index)
+	}
+	layered := false
+	if len(indexPaths) == 0 && *layeredFlag {
+		indexPaths = index.Files()
+		layered = len(indexPaths) > 1
+	}
+	if len(indexPaths) == 0 {
+		indexPaths = []string{index.File()}
+	}
+	checkStale(indexPaths)
+
 	reFlags := syntax.Perl &^ syntax.OneLine
 	if *iFlag {
 		reFlags |= syntax.FoldCase
 	}
-	re, err := regexp.CompileFlags(args[0], reFlags)
-	if err != nil {
-		log.Fatal(err)
+	var re, fre, fre2 *regexp.Regexp
+	var err error
+	if *filesFlag {
+		// The argument, if any, is another file name regexp.
+		if len(args) == 1 {
+			fre2, err = regexp.CompileFlags(args[0], reFlags)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else {
+		// Normalize the pattern as the indexed text was normalized.
+		g.Normalize, err = normalization(indexPaths)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pattern := g.Normalize.Normalize(args[0])
+		if multi {
+			// Print the lines matching any of the regexps
+			// in the files matching all of them, or for
+			// -same-line, the lines matching all of them.
+			var exprs []string
+			for _, arg := range args {
+				expr := g.Normalize.Normalize(arg)
+				r, err := regexp.CompileFlags(expr, reFlags)
+				if err != nil {
+					log.Fatal(err)
+				}
+				allOf = append(allOf, r)
+				exprs = append(exprs, expr)
+			}
+			if *sameLineFlag {
+				// Find the lines matching the first regexp,
+				// then check them against the others.
+				pattern = exprs[0]
+				g.SameLine = allOf[1:]
+			} else {
+				pattern = "(?:" + strings.Join(exprs, ")|(?:") + ")"
+				g.AllOf = allOf
+			}
+		}
+		re, err = regexp.CompileFlags(pattern, reFlags)
+		if err != nil {
+			log.Fatal(err)
+		}
+		g.Regexp = re
 	}
-	g.Regexp = re
-	var fre *regexp.Regexp
 	if *fFlag != "" {
 		fre, err = regexp.Compile(*fFlag)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
-	q := index.RegexpQuery(re.Syntax)
+	var langs []lang.ID
+	if *langFlag != "" {
+		for _, name := range strings.Split(*langFlag, ",") {
+			l, ok := lang.Lookup(strings.TrimSpace(name))
+			if !ok {
+				log.Fatalf("unknown language %q; known languages: %s", name, strings.Join(lang.Names(), ", "))
+			}
+			langs = append(langs, l)
+		}
+	}
+	if searchQuery != nil && searchQuery.Langs != nil {
+		langs = append(langs, searchQuery.Langs...)
+	}
+	for _, name := range strings.Split(*classFlag, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		c, ok := lang.LookupClass(name)
+		if !ok || c == lang.Normal {
+			log.Fatalf("unknown class %q; known classes: generated, minified, vendored", name)
+		}
+		skipClasses = append(skipClasses, c)
+	}
+
+	if *repoFlag != "" {
+		for _, name := range strings.Split(*repoFlag, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				repoNames = append(repoNames, name)
+			}
+		}
+	}
+	if searchQuery != nil {
+		repoNames = append(repoNames, searchQuery.Repos...)
+	}
+
+	prefix := ""
+	if *pathFlag != "" {
+		prefix, err = pathPrefix(*pathFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var hits []hit
+	var covered []string // roots of the indexes already searched, for -layered
+	searched := indexPaths
+	if *allFlag {
+		// csearchd searches the indexes of the registry at once.
+		searched = nil
+		hits, err = searchRegistry(registry, re, fre, fre2, langs, prefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, indexPath := range searched {
+		label := ""
+		if len(indexPaths) > 1 {
+			if !layered {
+				label = indexPath
+			}
+			if *verboseFlag || *explainFlag {
+				fmt.Printf("index %s:\n", indexPath)
+			}
+		}
+		found, err := searchFile(indexPath, re, fre, langs, prefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, h := range found {
+			if fre2 != nil && fre2.MatchString(h.name, true, true) < 0 {
+				continue
+			}
+			if layered && inRoots(h.name, covered) {
+				continue
+			}
+			h.label = label
+			hits = append(hits, h)
+		}
+		if layered {
+			roots, err := indexRoots(indexPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			covered = append(covered, roots...)
+		}
+	}
+	if layered {
+		sort.SliceStable(hits, func(i, j int) bool { return hits[i].name < hits[j].name })
+	}
+	if *explainFlag {
+		return
+	}
+	hits = statFilter(hits)
+
+	switch {
+	case g.Q:
+		// Order does not matter: stop at the first match.
+	case *topFlag > 0:
+		hits = topHits(re, hits, *topFlag)
+	default:
+		sortHits(&g, hits, *sortFlag)
+	}
+	if *filesFlag {
+		for _, h := range hits {
+			g.Label = h.label
+			printName(&g, h.name)
+			if g.Q && g.Match {
+				break
+			}
+		}
+	} else {
+		g.Parallel(grepWorkers(), len(hits), func(g *regexp.Grep, i int) {
+			g.Label = hits[i].label
+			grepHit(g, hits[i])
+		})
+	}
+	if g.Total && !g.Q {
+		fmt.Fprintf(g.Stdout, "%d\n", g.Count)
+	}
+	for _, r := range repos {
+		r.Close()
+	}
+	if span != nil {
+		span.End()
+	}
+	if !g.Match {
+		os.Exit(1)
+	}
+}
+
+// grepHit searches the file or blob of h, decompressed if h.gzip is
+// set. A file not satisfying the operators of -query is skipped.
+func grepHit(g *regexp.Grep, h hit) {
+	if g.Q && g.Match {
+		return
+	}
+	filter := searchQuery != nil && searchQuery.PostFilter()
+	if h.repo == nil && !filter {
+		g.Gunzip = h.gzip
+		g.File(h.name)
+		return
+	}
+	var data []byte
+	var err error
+	if h.repo == nil {
+		data, err = os.ReadFile(h.name)
+	} else {
+		data, err = h.repo.ReadBlob(h.blob)
+	}
+	if err != nil {
+		fmt.Fprintf(g.Stderr, "%s\n", err)
+		return
+	}
+	if h.gzip {
+		// Filter and search the text indexed, not the compressed bytes.
+		r, _, err := charset.Gunzip(bytes.NewReader(data))
+		if err == nil {
+			data, err = io.ReadAll(r)
+		}
+		if err != nil {
+			fmt.Fprintf(g.Stderr, "%s: %v\n", h.name, err)
+			return
+		}
+	}
+	if filter && !searchQuery.Match(data) {
+		return
+	}
+	g.Gunzip = false
+	g.Reader(bytes.NewReader(data), h.name)
+}
+
+// printName prints the name of a file for -files, formatted as by -l.
+func printName(g *regexp.Grep, name string) {
+	g.Match = true
+	if g.Q {
+		return
+	}
+	if g.Label != "" {
+		name = g.Label + ":" + name
+	}
+	if g.Z {
+		fmt.Fprintf(g.Stdout, "%s\x00", name)
+	} else {
+		fmt.Fprintf(g.Stdout, "%s\n", name)
+	}
+}
+
+// searchFile returns the files in the index at indexPath, which may be
+// sharded, that might match re and pass the other filters.
+func searchFile(indexPath string, re, fre *regexp.Regexp, langs []lang.ID, prefix string) ([]hit, error) {
+	if info := daemonInfo(indexPath); info != nil {
+		return searchDaemon(indexPath, info, re, fre, langs, prefix)
+	}
+	ixs, err := openIndex(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []hit
+	for i, ix := range ixs {
+		if len(ixs) > 1 && (*verboseFlag || *explainFlag) {
+			fmt.Printf("shard %d:\n", i)
+		}
+		h, err := searchIndex(ix, re, fre, langs, prefix)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, h...)
+	}
+	if len(ixs) > 1 {
+		// Shards partition files by hash, not by name.
+		sort.Slice(hits, func(i, j int) bool { return hits[i].name < hits[j].name })
+	}
+	return hits, nil
+}
+
+// normalization returns the normalization of the text in the indexes
+// at indexPaths, which must all be normalized the same way.
+func normalization(indexPaths []string) (norm.Mode, error) {
+	mode, first := norm.None, ""
+	for _, indexPath := range indexPaths {
+		var modes []norm.Mode
+		if info := daemonInfo(indexPath); info != nil {
+			modes = append(modes, info.Normalization)
+		} else {
+			ixs, err := openIndex(indexPath)
+			if err != nil {
+				return norm.None, err
+			}
+			for _, ix := range ixs {
+				m, err := ix.Normalization()
+				if err != nil {
+					return norm.None, err
+				}
+				modes = append(modes, m)
+			}
+		}
+		for _, m := range modes {
+			if first == "" {
+				mode, first = m, indexPath
+			} else if m != mode {
+				return norm.None, fmt.Errorf("index %s is normalized as %v but index %s as %v", first, mode, indexPath, m)
+			}
+		}
+	}
+	return mode, nil
+}
+
+// openIndex opens the index at indexPath, returning its shards.
+func openIndex(indexPath string) ([]*index.Index, error) {
+	if isURL(indexPath) {
+		ix, err := index.OpenURL(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		return []*index.Index{ix}, nil
+	}
+	ixs, err := openLocalIndex(indexPath)
+	if err != nil {
+		// A cindex run may have been replacing the index.
+		// Wait for it to finish and try again.
+		if index.WaitUnlocked(indexPath) == nil {
+			ixs, err = openLocalIndex(indexPath)
+		}
+	}
+	return ixs, err
+}
+
+// indexRoots returns the paths indexed by the index at indexPath,
+// after -path-rewrite: the directories and files given to cindex, or
+// the work tree of a history index.
+func indexRoots(indexPath string) ([]string, error) {
+	var paths []string
+	if info := daemonInfo(indexPath); info != nil {
+		paths = info.Paths
+	} else {
+		ixs, err := openIndex(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		if dir := ixs[0].GitRepo(); dir != "" {
+			paths = []string{dir}
+		} else if paths, err = ixs[0].Paths(); err != nil {
+			return nil, err
+		}
+	}
+	roots := make([]string, len(paths))
+	for i, p := range paths {
+		roots[i] = rewritePath(p)
+	}
+	return roots, nil
+}
+
+// inRoots reports whether name is one of roots or in one of them.
+func inRoots(name string, roots []string) bool {
+	for _, root := range roots {
+		if _, ok := cutDir(name, root); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isURL reports whether indexPath is an http or https URL.
+func isURL(indexPath string) bool {
+	return strings.HasPrefix(indexPath, "http://") || strings.HasPrefix(indexPath, "https://")
+}
+
+func openLocalIndex(indexPath string) ([]*index.Index, error) {
+	if index.NumShards(indexPath) > 0 {
+		s, err := index.OpenSharded(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		return s.Shards, nil
+	}
+	ix, err := index.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	return []*index.Index{ix}, nil
+}
+
+// searchIndex returns the files in ix that might match re and pass the
+// other filters. A nil re matches all files. With -explain, it prints
+// the query plan instead.
+func searchIndex(ix *index.Index, re, fre *regexp.Regexp, langs []lang.ID, prefix string) ([]hit, error) {
+	ix.Verbose = *verboseFlag
+	q := query(re, ix.HasQuadgrams())
+	if *explainFlag {
+		plan, err := ix.Explain(q)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("query: %s\n%s", q, plan)
+		return nil, nil
+	}
+	if ix.GitRepo() != "" {
+		return searchHistory(ix, q, fre, langs, prefix)
+	}
+	if *atFlag != "" {
+		return nil, fmt.Errorf("-at requires a history index, built by cindex -history")
+	}
+	sp := trace.Start(span, "search")
+	defer sp.End()
+	opt := searchOptions(langs, prefix)
+	if span != nil {
+		opt.Trace = sp
+	}
+	names, err := ix.Search(q, opt)
+	if err != nil {
+		return nil, err
+	}
+	noteSearch(q, len(names), ix.NumNames())
+	files := indexFiles{stats: ix.HasStats()}
+	if files.gzipped, err = ix.GzippedNames(); err != nil {
+		return nil, err
+	}
+	if files.stats {
+		if files.unstatted, err = ix.UnstattedNames(); err != nil {
+			return nil, err
+		}
+	}
+	return nameHits(names, files, fre, prefix), nil
+}
+
+// allOf are the regexps given with -all-of, all of which the files
+// searched must match.
+var allOf []*regexp.Regexp
+
+// searchQuery is the query parsed by -query, or nil.
+var searchQuery *index.SearchQuery
+
+// skipClasses are the classes of files left out by -skipclass.
+var skipClasses []lang.Class
+
+// searchOptions returns the options restricting an index search to the
+// files in langs under prefix, in the repositories named by -repo, not
+// in the classes named by -skipclass, passing -maxsize and
+// -modified-after, and matching the file: filters of -query.
+func searchOptions(langs []lang.ID, prefix string) *index.SearchOptions {
+	opt := &index.SearchOptions{
+		Langs:         langs,
+		Repos:         repoNames,
+		SkipClasses:   skipClasses,
+		MaxSize:       int64(maxSizeFlag),
+		ModifiedAfter: modifiedAfterFlag.t,
+	}
+	// A prefix ending in a separator, as pathPrefix returns for a
+	// directory, names the files under it.
+	if p := indexPrefix(prefix); strings.HasSuffix(p, string(filepath.Separator)) {
+		opt.Dir = p
+	} else {
+		opt.Prefix = p
+	}
+	if searchQuery != nil {
+		opt.Files, opt.NotFiles = searchQuery.Files, searchQuery.NotFiles
+	}
+	return opt
+}
+
+// query returns the index query for re, for the texts and operators
+// of -query, or for all the regexps of -all-of, using quadgrams if quad
+// is set. A nil re, or -brute or -v, queries all files.
+func query(re *regexp.Regexp, quad bool) *index.Query {
+	var q *index.Query
+	switch {
+	case searchQuery != nil:
+		q = searchQuery.Query(quad)
+	case allOf != nil:
+		for _, r := range allOf {
+			rq := index.RegexpQuery(r.Syntax)
+			if quad {
+				rq = index.RegexpQuadQuery(r.Syntax)
+			}
+			if q == nil {
+				q = rq
+			} else {
+				q = q.And(rq)
+			}
+		}
+	case re == nil:
+		q = &index.Query{Op: index.QAll}
+	case quad:
+		q = index.RegexpQuadQuery(re.Syntax)
+	default:
+		q = index.RegexpQuery(re.Syntax)
+	}
 	if *verboseFlag {
 		log.Printf("query: %s\n", q)
 	}
-	if *bruteFlag {
+	if *bruteFlag || invert {
 		q = &index.Query{Op: index.QAll}
 	}
+	return q
+}
 
-	indexPath := *indexFlag
-	if indexPath == "" {
-		indexPath = index.File()
+// indexFiles describes the files of an index searched, by name.
+type indexFiles struct {
+	gzipped   []string // indexed decompressed, sorted
+	stats     bool     // the index records the sizes and times of files
+	unstatted []string // the files of which it does not anyway, sorted
+}
+
+// nameHits returns the hits for the files with the given names, which
+// the index query identified in an index whose files are described by
+// files, that, after -path-rewrite, begin with prefix and match fre.
+func nameHits(names []string, files indexFiles, fre *regexp.Regexp, prefix string) []hit {
+	warnInvert(len(names))
+	sp := trace.Start(span, "filter names")
+	defer sp.End()
+	hits := make([]hit, 0, len(names))
+	for _, name := range names {
+		_, gz := slices.BinarySearch(files.gzipped, name)
+		_, unstatted := slices.BinarySearch(files.unstatted, name)
+		checked := files.stats && !unstatted
+		name = rewritePath(name)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if fre != nil && fre.MatchString(name, true, true) < 0 {
+			continue
+		}
+		hits = append(hits, hit{name: name, gzip: gz, checked: checked})
 	}
-	ix, err := index.Open(indexPath)
+	if fre != nil && *verboseFlag {
+		log.Printf("filename regexp matched %d files\n", len(hits))
+	}
+	sp.SetAttr("files", len(hits))
+	return hits
+}
+
+// span is the root span of the trace printed by -trace, or nil.
+var span trace.Span
+
+// daemon is the connection to csearchd, or nil if it is not running.
+var daemon *index.DaemonClient
+
+// daemonInfos caches the results of daemonInfo.
+var daemonInfos = make(map[string]*index.DaemonInfo)
+
+// daemonInfo returns csearchd's information about the index at
+// indexPath, or nil if the index must be searched directly: csearchd is
+// not running, -explain is given, the index is named by a URL or is a
+// history index, or csearchd cannot open it.
+func daemonInfo(indexPath string) *index.DaemonInfo {
+	if daemon == nil || *explainFlag || isURL(indexPath) {
+		return nil
+	}
+	if info, ok := daemonInfos[indexPath]; ok {
+		return info
+	}
+	info, err := daemon.Info(indexPath)
 	if err != nil {
-		log.Fatal(err)
+		if *verboseFlag {
+			log.Printf("%v; searching %s directly\n", err, indexPath)
+		}
+		info = nil
+	} else if info.History {
+		info = nil
 	}
-	ix.Verbose = *verboseFlag
-	post, err := ix.PostingQuery(q)
+	daemonInfos[indexPath] = info
+	return info
+}
+
+// searchDaemon is like searchFile but asks csearchd to search the
+// index, which info describes.
+func searchDaemon(indexPath string, info *index.DaemonInfo, re, fre *regexp.Regexp, langs []lang.ID, prefix string) ([]hit, error) {
+	if *atFlag != "" {
+		return nil, fmt.Errorf("-at requires a history index, built by cindex -history")
+	}
+	q := query(re, info.Quadgrams)
+	sp := trace.Start(span, "csearchd search")
+	sp.SetAttr("index", indexPath)
+	defer sp.End()
+	names, err := daemon.Search(indexPath, q, searchOptions(langs, prefix))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	if *verboseFlag {
-		log.Printf("post query identified %d possible files\n", len(post))
+		log.Printf("csearchd identified %d possible files\n", len(names))
 	}
+	noteSearch(q, len(names), info.NumNames)
+	return nameHits(names, daemonFiles(info), fre, prefix), nil
+}
 
-	if fre != nil {
-		filenames := make([]uint32, 0, len(post))
+// daemonFiles returns the description of the files of the index
+// that csearchd describes by info.
+func daemonFiles(info *index.DaemonInfo) indexFiles {
+	return indexFiles{gzipped: info.Gzipped, stats: info.Stats, unstatted: info.Unstatted}
+}
 
-		for _, fileID := range post {
-			name, err := ix.Name(fileID)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if fre.MatchString(name, true, true) < 0 {
+// searchRegistry is like searchDaemon but asks csearchd to search
+// all the repositories in its registry, which are listed in registry,
+// labeling the files found by their repositories. Files whose names do
+// not match fre2, if non-nil, are left out.
+func searchRegistry(registry []index.DaemonRepo, re, fre, fre2 *regexp.Regexp, langs []lang.ID, prefix string) ([]hit, error) {
+	// A quadgram query is no less selective against indexes without them.
+	quad := false
+	infos := make(map[string]*index.DaemonInfo)
+	for i, r := range registry {
+		quad = quad || r.Info.Quadgrams
+		infos[r.Name] = &registry[i].Info
+	}
+	q := query(re, quad)
+	sp := trace.Start(span, "csearchd search all")
+	sp.SetAttr("repos", len(registry))
+	defer sp.End()
+	results, err := daemon.SearchAll(q, searchOptions(langs, prefix))
+	if err != nil {
+		return nil, err
+	}
+	var hits []hit
+	for _, r := range results {
+		if r.Err != "" {
+			log.Printf("%s: %s\n", r.Repo, r.Err)
+			continue
+		}
+		if *verboseFlag {
+			log.Printf("csearchd identified %d possible files in %s\n", len(r.Names), r.Repo)
+		}
+		// A repository added since the registry was listed has no info.
+		total, files := -1, indexFiles{}
+		if info := infos[r.Repo]; info != nil {
+			total, files = info.NumNames, daemonFiles(info)
+		}
+		noteSearch(q, len(r.Names), total)
+		for _, h := range nameHits(r.Names, files, fre, prefix) {
+			if fre2 != nil && fre2.MatchString(h.name, true, true) < 0 {
 				continue
 			}
-			filenames = append(filenames, fileID)
+			h.label = r.Repo
+			hits = append(hits, h)
 		}
+	}
+	return hits, nil
+}
 
-		if *verboseFlag {
-			log.Printf("filename regexp matched %d files\n", len(filenames))
+// invert is set by -v, which selects the lines not matching the regexp.
+var invert bool
+
+// invertWarnFiles is the number of files above which a -v search,
+// which must read every file passing the filters, warns about its cost.
+const invertWarnFiles = 10000
+
+// warnInvert warns if a -v search must read n files.
+func warnInvert(n int) {
+	if invert && n >= invertWarnFiles && !*bruteFlag {
+		log.Printf("warning: -v reads all %d files passing the filters; use -f, -lang, -path, or -repo to narrow the search\n", n)
+	}
+}
+
+// repoNames are the repositories named by -repo.
+var repoNames []string
+
+// repos are the repositories of the history indexes searched,
+// closed on exit.
+var repos []*history.Repo
+
+// searchHistory returns the files in the history index ix, as of the
+// revision named by -at, that might match q and pass the other filters.
+// The files are named by their paths in the repository's work tree.
+func searchHistory(ix *index.Index, q *index.Query, fre *regexp.Regexp, langs []lang.ID, prefix string) ([]hit, error) {
+	repo, err := history.Open(rewritePath(ix.GitRepo()))
+	if err != nil {
+		return nil, err
+	}
+	repos = append(repos, repo)
+	if repoNames != nil && !matchRepo(filepath.Base(repo.Dir)) {
+		return nil, nil
+	}
+	rev := *atFlag
+	if rev == "" {
+		rev = "HEAD"
+	}
+	commit, err := repo.Resolve(rev)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ix.CommitFiles(commit)
+	if err != nil {
+		return nil, err
+	}
+	if *verboseFlag {
+		log.Printf("commit %s has %d files\n", commit, len(files))
+	}
+
+	// Restrict the query to the files in the commit that pass
+	// the name filters, noting each one's names, since the same
+	// blob may appear at several paths.
+	match, err := searchOptions(langs, prefix).NameFilter()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[uint32][]string)
+	var restrict []uint32
+	for _, f := range files {
+		name := repo.Name(f.Path)
+		if prefix != "" && !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if fre != nil && fre.MatchString(name, true, true) < 0 {
+			continue
+		}
+		if match != nil && !match(name) {
+			continue
 		}
-		post = filenames
+		if names[f.FileID] == nil {
+			restrict = append(restrict, f.FileID)
+		}
+		names[f.FileID] = append(names[f.FileID], name)
+	}
+	sort.Slice(restrict, func(i, j int) bool { return restrict[i] < restrict[j] })
+	if langs != nil {
+		byLang, err := ix.FilesByLang(langs...)
+		if err != nil {
+			return nil, err
+		}
+		restrict = intersect(restrict, byLang)
+	}
+	if len(restrict) == 0 {
+		return nil, nil
+	}
+	post, err := ix.PostingQueryRestrict(q, restrict)
+	if err != nil {
+		return nil, err
+	}
+	if *verboseFlag {
+		log.Printf("post query identified %d possible files\n", len(post))
 	}
+	warnInvert(len(post))
 
+	var hits []hit
 	for _, fileID := range post {
 		name, err := ix.Name(fileID)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+		blob, ok := repo.BlobHash(name)
+		if !ok {
+			return nil, fmt.Errorf("file %s is not from repository %s", name, repo.Dir)
+		}
+		gz, err := ix.Gzipped(fileID)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names[fileID] {
+			hits = append(hits, hit{name: name, repo: repo, blob: blob, gzip: gz})
 		}
-		g.File(name)
 	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].name < hits[j].name })
+	return hits, nil
+}
 
-	if !g.Match {
-		os.Exit(1)
+// matchRepo reports whether -repo names the repository with the given name.
+func matchRepo(name string) bool {
+	for _, n := range repoNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// intersect returns the file IDs in both sorted lists.
+func intersect(x, y []uint32) []uint32 {
+	var out []uint32
+	for len(x) > 0 && len(y) > 0 {
+		switch {
+		case x[0] < y[0]:
+			x = x[1:]
+		case x[0] > y[0]:
+			y = y[1:]
+		default:
+			out = append(out, x[0])
+			x, y = x[1:], y[1:]
+		}
+	}
+	return out
+}
+
+// pathPrefix returns the prefix of the indexed names of files under path.
+// A path naming a directory, or ending in a separator, matches only whole
+// path elements.
+func pathPrefix(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(abs, string(filepath.Separator)) {
+		return abs, nil
+	}
+	if fi, err := os.Stat(abs); (err == nil && fi.IsDir()) || os.IsPathSeparator(path[len(path)-1]) {
+		abs += string(filepath.Separator)
 	}
+	return abs, nil
 }
@@ -0,0 +1,85 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+// Low-selectivity searches.
+//
+// A regexp with no literal text, such as [a-z]+_test, gives the index
+// nothing to look for, and one with only common text, such as func,
+// finds nearly every file. Reading those files one at a time is then
+// slower than grep -r, which at least does not consult an index first.
+// Instead, when the index finds more than the -fallback fraction of the
+// files it holds, csearch warns and reads the files in parallel, as it
+// does for -brute and -v, which read every file anyway.
+
+// denseWarnFiles is the number of files above which a search that the
+// index does not narrow warns about its cost.
+const denseWarnFiles = 1000
+
+// Counts of the files found and the files indexed, over the indexes
+// searched, and whether some index query was QAll, the index being no
+// help at all.
+var (
+	foundFiles   int
+	indexedFiles int
+	unindexed    bool
+)
+
+// noteSearch records that the index query q, run against an index of
+// total files, found n of them. A total of -1 is unknown, as for a
+// repository csearchd added to its registry after csearch listed it.
+func noteSearch(q *index.Query, n, total int) {
+	if *bruteFlag || invert {
+		return
+	}
+	foundFiles += n
+	if total >= 0 {
+		indexedFiles += total
+	}
+	if q.Op == index.QAll {
+		unindexed = true
+	}
+}
+
+// dense reports whether the index did too little to narrow the search
+// to be worth reading the files found one at a time, warning about it.
+func dense() bool {
+	if *bruteFlag || invert {
+		return true
+	}
+	if *fallbackFlag <= 0 || foundFiles == 0 {
+		return false
+	}
+	switch {
+	case unindexed:
+		if foundFiles >= denseWarnFiles {
+			log.Printf("warning: the regexp has no text for the index to look for, so all %d files passing the filters are read; use -f, -lang, -path, or -repo to narrow the search\n", foundFiles)
+		}
+	case indexedFiles > 0 && float64(foundFiles) > *fallbackFlag*float64(indexedFiles):
+		if foundFiles >= denseWarnFiles {
+			log.Printf("warning: the index narrows the search only to %d of %d files; use a longer literal text, -f, -lang, -path, or -repo to narrow it\n", foundFiles, indexedFiles)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// grepWorkers returns the number of files to read at once: one, unless
+// the search is dense. Files of history indexes and files filtered by
+// the operators of -query are read one at a time regardless.
+func grepWorkers() int {
+	if !dense() || *atFlag != "" || searchQuery != nil && searchQuery.PostFilter() {
+		return 1
+	}
+	return runtime.GOMAXPROCS(0)
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A rewrite replaces the directory old at the start of a path with new,
+// for -path-rewrite.
+type rewrite struct {
+	old, new string
+}
+
+// A rewriteList is a flag.Value accumulating old=new rewrites.
+type rewriteList []rewrite
+
+func (l *rewriteList) String() string {
+	var s []string
+	for _, r := range *l {
+		s = append(s, r.old+"="+r.new)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *rewriteList) Set(s string) error {
+	old, new, ok := strings.Cut(s, "=")
+	if !ok || old == "" || new == "" {
+		return fmt.Errorf("invalid rewrite %q; want old=new", s)
+	}
+	*l = append(*l, rewrite{filepath.Clean(old), filepath.Clean(new)})
+	return nil
+}
+
+// rewrites are the rewrites given by -path-rewrite.
+var rewrites rewriteList
+
+// rewritePath returns the path name, as recorded in the index, as it
+// is on this machine, after the first rewrite that applies.
+func rewritePath(name string) string {
+	for _, r := range rewrites {
+		if rest, ok := cutDir(name, r.old); ok {
+			return r.new + rest
+		}
+	}
+	return name
+}
+
+// unrewritePath is the inverse of rewritePath, returning the path name
+// on this machine as it is recorded in the index.
+func unrewritePath(name string) string {
+	for _, r := range rewrites {
+		if rest, ok := cutDir(name, r.new); ok {
+			return r.old + rest
+		}
+	}
+	return name
+}
+
+// cutDir reports whether name is dir or a path in dir and, if so,
+// returns the rest of name after dir, which is empty or begins with
+// a separator.
+func cutDir(name, dir string) (rest string, ok bool) {
+	if !strings.HasPrefix(name, dir) {
+		return "", false
+	}
+	rest = name[len(dir):]
+	if rest == "" || os.IsPathSeparator(rest[0]) || os.IsPathSeparator(dir[len(dir)-1]) {
+		return rest, true
+	}
+	return "", false
+}
+
+// indexPrefix returns the prefix, for Index.NameRange, of the names in
+// the index of the files whose names begin with prefix after rewriting.
+// If prefix holds the new directory of a rewrite, the names have no
+// common prefix, and indexPrefix returns "", matching all names.
+func indexPrefix(prefix string) string {
+	if p := unrewritePath(prefix); p != prefix {
+		return p
+	}
+	for _, r := range rewrites {
+		if strings.HasPrefix(r.new, prefix) {
+			return ""
+		}
+	}
+	return prefix
+}
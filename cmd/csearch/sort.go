@@ -0,0 +1,98 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/andrewarchi/codesearch/history"
+	"github.com/andrewarchi/codesearch/rank"
+	"github.com/andrewarchi/codesearch/regexp"
+)
+
+// A hit is a file to be searched, found in the index named by label.
+// A hit from a history index is a blob in repo, read from the
+// repository rather than the file system. A gzip hit is compressed
+// and was indexed decompressed, so it is searched decompressed too.
+// A checked hit passed the -maxsize and -modified-after filters by the
+// size and time its index recorded, so it is not looked up again.
+type hit struct {
+	label   string
+	name    string
+	repo    *history.Repo
+	blob    string
+	gzip    bool
+	checked bool
+}
+
+// sortHits sorts hits into the given -sort order. Files that cannot
+// be examined sort last. The sort is stable, so that files that
+// compare equal stay in index order.
+func sortHits(g *regexp.Grep, hits []hit, order string) {
+	var key []int64 // larger keys first
+	switch order {
+	case "path":
+		sort.SliceStable(hits, func(i, j int) bool { return hits[i].name < hits[j].name })
+		return
+	case "mtime", "size":
+		key = make([]int64, len(hits))
+		for i, h := range hits {
+			fi, err := os.Stat(h.name)
+			switch {
+			case err != nil:
+				key[i] = -1
+			case order == "mtime":
+				key[i] = fi.ModTime().UnixNano()
+			default:
+				key[i] = fi.Size()
+			}
+		}
+	case "matches":
+		key = make([]int64, len(hits))
+		c := *g
+		c.C = false
+		c.L = false
+		c.Total = true
+		c.Stdout = io.Discard
+		c.Stderr = io.Discard
+		for i, h := range hits {
+			c.Count = 0
+			grepHit(&c, h)
+			key[i] = int64(c.Count)
+		}
+	default:
+		return
+	}
+	idx := make([]int, len(hits))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return key[idx[i]] > key[idx[j]] })
+	sorted := make([]hit, len(hits))
+	for i, j := range idx {
+		sorted[i] = hits[j]
+	}
+	copy(hits, sorted)
+}
+
+// topHits returns the k hits ranked most relevant for re, best first.
+func topHits(re *regexp.Regexp, hits []hit, k int) []hit {
+	byName := make(map[string]hit)
+	var names []string
+	for _, h := range hits {
+		if _, ok := byName[h.name]; !ok {
+			byName[h.name] = h
+			names = append(names, h.name)
+		}
+	}
+	r := &rank.Ranker{Regexp: re}
+	var top []hit
+	for _, res := range r.Top(names, k) {
+		top = append(top, byName[res.Name])
+	}
+	return top
+}
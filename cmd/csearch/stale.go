@@ -0,0 +1,124 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Stale indexes.
+//
+// cindex records when it indexed each path (see index.Index.BuildTimes).
+// Before searching, csearch checks each path of each index: the path is
+// stale if it was indexed longer ago than -stale, or before its own
+// modification time. The latter check costs a single stat per path, so
+// it notices files added to or removed from the top directory of a
+// path, but not changes deeper in the tree.
+
+// staleCheck holds the stale paths of an index.
+type staleCheck struct {
+	paths []string  // stale paths, as recorded in the index
+	built time.Time // build time of the least recently indexed stale path
+}
+
+// checkStale warns about the stale paths of the indexes at indexPaths
+// or, with -refresh, runs cindex to reindex them.
+func checkStale(indexPaths []string) {
+	for _, indexPath := range indexPaths {
+		if isURL(indexPath) {
+			continue
+		}
+		st, err := staleRoots(indexPath)
+		if err != nil || len(st.paths) == 0 {
+			// An index that cannot be opened fails the search later.
+			continue
+		}
+		ago := time.Since(st.built).Round(time.Second)
+		if !*refreshFlag {
+			log.Printf("warning: index %s may be out of date for %s, indexed %v ago; run cindex or use -refresh\n", indexPath, strings.Join(st.paths, ", "), ago)
+			continue
+		}
+		if err := refresh(indexPath, st.paths); err != nil {
+			log.Printf("warning: refreshing index %s: %v; searching it as is\n", indexPath, err)
+		}
+	}
+}
+
+// staleRoots returns the stale paths of the index at indexPath.
+// It returns none for a history index, which is up to date as of
+// a commit rather than a time, and for an index that does not record
+// when it was built.
+func staleRoots(indexPath string) (*staleCheck, error) {
+	var paths []string
+	var times []time.Time
+	if info := daemonInfo(indexPath); info != nil {
+		paths, times = info.Paths, info.Built
+	} else {
+		ixs, err := openIndex(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		ix := ixs[0]
+		if ix.GitRepo() != "" {
+			return new(staleCheck), nil
+		}
+		if paths, err = ix.Paths(); err != nil {
+			return nil, err
+		}
+		if times, err = ix.BuildTimes(); err != nil {
+			return nil, err
+		}
+	}
+	st := new(staleCheck)
+	for i, p := range paths {
+		if i >= len(times) || times[i].IsZero() {
+			continue
+		}
+		t := times[i]
+		stale := *staleFlag > 0 && time.Since(t) > *staleFlag
+		if fi, err := os.Stat(rewritePath(p)); err == nil && fi.ModTime().After(t) {
+			stale = true
+		}
+		if !stale {
+			continue
+		}
+		st.paths = append(st.paths, p)
+		if st.built.IsZero() || t.Before(st.built) {
+			st.built = t
+		}
+	}
+	return st, nil
+}
+
+// refresh runs cindex to reindex the given paths of the index at
+// indexPath, keeping its other paths.
+func refresh(indexPath string, paths []string) error {
+	for _, p := range paths {
+		if rewritePath(p) != p {
+			// cindex would look for the files at the old path.
+			return fmt.Errorf("path %s is rewritten by -path-rewrite", p)
+		}
+	}
+	args := append([]string{"-index", indexPath, "-noprogress"}, paths...)
+	cmd := exec.Command("cindex", args...)
+	if *verboseFlag {
+		log.Printf("cindex %s\n", strings.Join(args, " "))
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	} else if out, err := cmd.CombinedOutput(); err != nil {
+		// cindex logs its progress, so show its output only on failure.
+		return fmt.Errorf("cindex: %v\n%s", err, out)
+	}
+	// Ask csearchd again, which reopens the replaced index.
+	delete(daemonInfos, indexPath)
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/andrewarchi/codesearch/internal/cli"
+	"github.com/andrewarchi/codesearch/trace"
+)
+
+// maxSizeFlag is the file size limit set by the -maxsize flag.
+var maxSizeFlag cli.Size
+
+// modifiedAfterFlag is the time set by the -modified-after flag.
+var modifiedAfterFlag timeValue
+
+// A timeValue is a flag.Value holding a time, given as a date such as
+// 2024-01-01, in local time; an RFC 3339 time; or a duration, such as
+// 72h, meaning that long before now.
+type timeValue struct {
+	t time.Time
+}
+
+func (v *timeValue) String() string {
+	if v.t.IsZero() {
+		return ""
+	}
+	return v.t.Format(time.RFC3339)
+}
+
+func (v *timeValue) Set(s string) error {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		v.t = t
+		return nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		v.t = t
+		return nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		v.t = time.Now().Add(-d)
+		return nil
+	}
+	return fmt.Errorf("invalid time %q; want a date, an RFC 3339 time, or a duration", s)
+}
+
+// statFilter returns the hits whose files pass the -maxsize and
+// -modified-after filters, as found by looking up each file not already
+// checked by the index. Files that cannot be looked up are dropped.
+func statFilter(hits []hit) []hit {
+	if maxSizeFlag == 0 && modifiedAfterFlag.t.IsZero() {
+		return hits
+	}
+	sp := trace.Start(span, "stat filter")
+	defer sp.End()
+	kept := hits[:0]
+	for _, h := range hits {
+		if h.checked {
+			kept = append(kept, h)
+			continue
+		}
+		fi, err := os.Stat(h.name)
+		if err != nil {
+			continue
+		}
+		if maxSizeFlag > 0 && fi.Size() > int64(maxSizeFlag) {
+			continue
+		}
+		if !modifiedAfterFlag.t.IsZero() && !fi.ModTime().After(modifiedAfterFlag.t) {
+			continue
+		}
+		kept = append(kept, h)
+	}
+	if *verboseFlag {
+		log.Printf("size and time filters matched %d files\n", len(kept))
+	}
+	sp.SetAttr("files", len(kept))
+	return kept
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/andrewarchi/codesearch/index"
+	"github.com/andrewarchi/codesearch/internal/cli"
+	"github.com/andrewarchi/codesearch/trace"
+)
+
+var usageMessage = `usage: csearchd [-socket path] [-dir dir] [-metrics addr] [-prefetch] [-strict] [-cache n] [-trace] [-verbose] [-loglevel level] [index...]
+
+csearchd is a search daemon for csearch. It keeps the indexes that
+csearch searches open, so that they stay mapped in memory and warm in
+the page cache between searches, and answers csearch's index queries
+on a Unix socket. Each search then costs csearch a connection and a
+round trip instead of opening and paging in the index again, which
+makes interactive searches of large indexes noticeably faster.
+
+csearch uses the daemon whenever one is listening, and otherwise
+searches the index itself, so starting or stopping csearchd never
+changes the results. csearch reads the matching files itself either
+way. The daemon reopens an index when cindex replaces it. History
+indexes, built by cindex -history, and indexes named by URLs are
+always searched by csearch itself.
+
+The socket is named by the -socket flag, or else by $CSEARCHSOCKET,
+or else is $HOME/.csearchd.sock. csearch finds the daemon the same way.
+
+The index arguments name indexes to open at startup, as for csearch
+-index; other indexes are opened when first searched. With no
+arguments, csearchd opens the index csearch would use by default.
+
+The -dir flag causes csearchd to serve the indexes in the given
+directory as a registry of repositories, one index each, named by the
+name of the index file, or of a sharded index. csearch -all searches
+them all at once, labeling each file found by its repository. The
+daemon rescans the directory for each such search, so indexes added
+to the directory are searched and those removed are closed without a
+restart. With -dir and no arguments, csearchd opens no other index.
+
+The -prefetch flag reads the posting list index and the name index of
+each index into memory in the background when the daemon opens it, and
+tells the kernel that they will be read at random, so that the first
+searches of a large index on a cold page cache wait less for the disk.
+It takes effect only on Linux.
+
+The -strict flag checks the whole of each index when the daemon opens
+it, as cindex -verify does, and refuses to serve one that is corrupt,
+reporting the problem, rather than giving wrong results. It is meant
+for indexes from untrusted sources or copied from elsewhere; opening
+a large index takes longer.
+
+The -cache flag sets how many file names, 100000 by default, the
+daemon keeps for each index from the results of recent searches, so
+that a search repeated, as when an editor or web page searches again
+for the same text, is answered without evaluating it again. The cache
+of an index is dropped when cindex replaces it, so results are never
+stale. -cache 0 turns the cache off.
+
+The -metrics flag serves metrics for monitoring on http://addr/metrics,
+in the Prometheus text format: the requests answered, by kind and
+result; histograms of the time spent in each phase of a request and of
+the number of files found by each search; the bytes of posting lists
+decoded; the searches answered by the cache, and not; and the time
+since each open index was built. For example, csearchd -metrics
+localhost:9100.
+
+The -trace flag prints a trace of each request to standard error: the
+time spent opening the index, applying the filters, evaluating each
+node of the posting query, and looking up the names of the files found.
+Programs embedding index.Daemon can instead trace requests with any
+tracing system, such as OpenTelemetry, by implementing the interfaces of
+package github.com/andrewarchi/codesearch/trace.
+
+The -verbose flag logs each request, as does -loglevel debug, which
+sets the level of the messages logged.
+`
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageMessage)
+	os.Exit(2)
+}
+
+var (
+	socketFlag   = flag.String("socket", "", "listen on the Unix socket at `path`")
+	dirFlag      = flag.String("dir", "", "serve the indexes in `dir` as a registry of repositories")
+	metricsFlag  = flag.String("metrics", "", "serve metrics on http://`addr`/metrics")
+	traceFlag    = flag.Bool("trace", false, "print a trace of each request")
+	prefetchFlag = flag.Bool("prefetch", false, "read the index's name and posting list indexes into memory when opening it")
+	strictFlag   = flag.Bool("strict", false, "check the whole of each index when opening it, refusing corrupt ones")
+	cacheFlag    = flag.Int("cache", 100000, "keep the results of recent searches of each index, up to `n` file names")
+	verboseFlag  = flag.Bool("verbose", false, "log each request")
+)
+
+// logLevelFlag is the level set by the -loglevel flag.
+var logLevelFlag = cli.LogLevel()
+
+func main() {
+	log.SetPrefix("csearchd: ")
+	log.SetFlags(0)
+	flag.Usage = usage
+	flag.Parse()
+	slog.SetLogLoggerLevel(*logLevelFlag)
+
+	socket := *socketFlag
+	if socket == "" {
+		socket = index.DaemonSocket()
+	}
+	if c, err := index.DialDaemon(socket); err == nil {
+		c.Close()
+		log.Fatalf("a daemon is already listening on %s", socket)
+	}
+	// A daemon that did not exit cleanly leaves its socket behind.
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	d := &index.Daemon{Verbose: *verboseFlag, Prefetch: *prefetchFlag, Strict: *strictFlag, CacheSize: *cacheFlag}
+	if *traceFlag {
+		d.Tracer = trace.NewWriter(os.Stderr)
+	}
+	if *dirFlag != "" {
+		if err := d.LoadDir(*dirFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	files := flag.Args()
+	if len(files) == 0 && *dirFlag == "" {
+		files = []string{index.File()}
+	}
+	for _, arg := range files {
+		for _, file := range strings.Split(arg, ",") {
+			if file == "" {
+				continue
+			}
+			if err := d.Open(file); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+
+	if *metricsFlag != "" {
+		ml, err := net.Listen("tcp", *metricsFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			d.WriteMetrics(w)
+		})
+		go func() {
+			log.Fatal(http.Serve(ml, mux))
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		// Closing the listener removes the socket.
+		l.Close()
+	}()
+	if err := d.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Fatal(err)
+	}
+}
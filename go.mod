@@ -3,6 +3,7 @@ module github.com/andrewarchi/codesearch
 require (
 	github.com/go-git/go-billy/v5 v5.0.0
 	github.com/go-git/go-git/v5 v5.2.0
+	github.com/klauspost/compress v1.18.0
 )
 
-go 1.16
+go 1.22
@@ -0,0 +1,235 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Repo is a git repository, read by running the git command.
+type Repo struct {
+	Dir string // top-level directory of the work tree
+
+	cat   *exec.Cmd // git cat-file --batch, started on first use
+	in    io.WriteCloser
+	out   *bufio.Reader
+	trees map[string][]treeEntry // entries of the trees read so far
+}
+
+// A Commit is a commit and its tree.
+type Commit struct {
+	Hash string
+	Tree string
+}
+
+// A File is a file in a tree: its slash-separated path and its blob.
+type File struct {
+	Path string
+	Blob string
+}
+
+// A treeEntry is an entry in a git tree object.
+type treeEntry struct {
+	mode string
+	name string
+	hash string
+}
+
+// Open opens the git repository containing dir.
+func Open(dir string) (*Repo, error) {
+	r := &Repo{Dir: dir}
+	top, err := r.git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	r.Dir = filepath.Clean(strings.TrimSuffix(string(top), "\n"))
+	return r, nil
+}
+
+// Close stops the git process reading the repository's objects, if any.
+func (r *Repo) Close() error {
+	if r.cat == nil {
+		return nil
+	}
+	r.in.Close()
+	err := r.cat.Wait()
+	r.cat = nil
+	return err
+}
+
+// git runs git in the repository with the given arguments
+// and returns its standard output.
+func (r *Repo) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", r.Dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return out, nil
+}
+
+// Commits returns the commits reachable from any ref, newest first.
+func (r *Repo) Commits() ([]Commit, error) {
+	out, err := r.git("log", "--all", "--format=%H %T")
+	if err != nil {
+		return nil, err
+	}
+	var commits []Commit
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("git log: unexpected output %q", line)
+		}
+		commits = append(commits, Commit{f[0], f[1]})
+	}
+	return commits, nil
+}
+
+// Resolve returns the hash of the commit named by rev,
+// such as a branch, tag, or abbreviated hash.
+func (r *Repo) Resolve(rev string) (string, error) {
+	if strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("invalid revision %q", rev)
+	}
+	out, err := r.git("rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown revision %q", rev)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Files returns the regular files in the tree with the given hash,
+// including those in subtrees, sorted by path. Symbolic links and
+// submodules are omitted.
+func (r *Repo) Files(tree string) ([]File, error) {
+	var files []File
+	if err := r.listTree(tree, "", &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// listTree appends to files the regular files in the tree with the
+// given hash, whose path in the repository is dir.
+func (r *Repo) listTree(tree, dir string, files *[]File) error {
+	entries, err := r.tree(tree)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.name
+		if dir != "" {
+			name = dir + "/" + name
+		}
+		switch e.mode {
+		case "40000":
+			if err := r.listTree(e.hash, name, files); err != nil {
+				return err
+			}
+		case "100644", "100755", "100664":
+			*files = append(*files, File{name, e.hash})
+		}
+	}
+	return nil
+}
+
+// tree returns the entries of the tree with the given hash.
+// Trees are cached, since most are shared by many commits.
+func (r *Repo) tree(hash string) ([]treeEntry, error) {
+	if entries, ok := r.trees[hash]; ok {
+		return entries, nil
+	}
+	data, err := r.object(hash, "tree")
+	if err != nil {
+		return nil, err
+	}
+	var entries []treeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+1+20 {
+			return nil, fmt.Errorf("tree %s: malformed entry", hash)
+		}
+		entries = append(entries, treeEntry{
+			mode: string(data[:sp]),
+			name: string(data[sp+1 : nul]),
+			hash: hex.EncodeToString(data[nul+1 : nul+1+20]),
+		})
+		data = data[nul+1+20:]
+	}
+	if r.trees == nil {
+		r.trees = make(map[string][]treeEntry)
+	}
+	r.trees[hash] = entries
+	return entries, nil
+}
+
+// ReadBlob returns the contents of the blob with the given hash.
+func (r *Repo) ReadBlob(hash string) ([]byte, error) {
+	return r.object(hash, "blob")
+}
+
+// object returns the contents of the object with the given hash,
+// which must have the given type.
+func (r *Repo) object(hash, typ string) ([]byte, error) {
+	if strings.ContainsAny(hash, " \n") {
+		return nil, fmt.Errorf("invalid object name %q", hash)
+	}
+	if r.cat == nil {
+		cmd := exec.Command("git", "-C", r.Dir, "cat-file", "--batch")
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		r.cat, r.in, r.out = cmd, in, bufio.NewReader(out)
+	}
+	if _, err := io.WriteString(r.in, hash+"\n"); err != nil {
+		return nil, fmt.Errorf("git cat-file: %v", err)
+	}
+	line, err := r.out.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file: %v", err)
+	}
+	f := strings.Fields(line)
+	if len(f) != 3 {
+		return nil, fmt.Errorf("%s %s: %s", typ, hash, strings.TrimSpace(line))
+	}
+	size, err := strconv.Atoi(f[2])
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file: unexpected output %q", line)
+	}
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(r.out, data); err != nil {
+		return nil, fmt.Errorf("git cat-file: %v", err)
+	}
+	if f[1] != typ {
+		return nil, fmt.Errorf("%s is a %s, not a %s", hash, f[1], typ)
+	}
+	return data[:size], nil
+}
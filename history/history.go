@@ -0,0 +1,134 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package history indexes the history of a git repository: every
+// version of every file in any commit reachable from the repository's
+// refs, so that a search can see the files as of any of those commits.
+//
+// Each distinct blob is indexed once, however many commits contain it,
+// as a file named like
+//
+//	dir@blob/path
+//
+// where dir is the repository's directory, blob is the blob's hash, and
+// path is the first path, in sorted order, at which the blob appears.
+// The name keeps the file's base name, so that its language is detected
+// as usual. The index also records the files of each commit, as
+// described in package index, for Index.CommitFiles.
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+// Index adds to ix the history of the repository r.
+// The index must be empty; it holds only the history.
+func Index(ix *index.Writer, r *Repo) error {
+	commits, err := r.Commits()
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("%s: no commits", r.Dir)
+	}
+	var trees []string
+	seen := make(map[string]bool)
+	for _, c := range commits {
+		if !seen[c.Tree] {
+			seen[c.Tree] = true
+			trees = append(trees, c.Tree)
+		}
+	}
+
+	// Find each blob and the first path at which it appears.
+	first := make(map[string]string)
+	for _, tree := range trees {
+		files, err := r.Files(tree)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if p, ok := first[f.Blob]; !ok || f.Path < p {
+				first[f.Blob] = f.Path
+			}
+		}
+	}
+	type blob struct {
+		name, hash string
+	}
+	blobs := make([]blob, 0, len(first))
+	for hash, path := range first {
+		blobs = append(blobs, blob{r.blobName(hash, path), hash})
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].name < blobs[j].name })
+
+	// Index the blobs, noting the file ID of each one not skipped.
+	ids := make(map[string]uint32)
+	for _, b := range blobs {
+		data, err := r.ReadBlob(b.hash)
+		if err != nil {
+			return err
+		}
+		n := ix.NumFiles()
+		if err := ix.Add(b.name, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		if ix.NumFiles() > n {
+			ids[b.hash] = uint32(n)
+		}
+	}
+
+	for _, tree := range trees {
+		files, err := r.Files(tree)
+		if err != nil {
+			return err
+		}
+		var list []index.CommitFile
+		for _, f := range files {
+			if id, ok := ids[f.Blob]; ok {
+				list = append(list, index.CommitFile{Path: f.Path, FileID: id})
+			}
+		}
+		if err := ix.AddTree(tree, list); err != nil {
+			return err
+		}
+	}
+	for _, c := range commits {
+		if err := ix.AddCommit(c.Hash, c.Tree); err != nil {
+			return err
+		}
+	}
+	ix.SetGitRepo(r.Dir)
+	ix.AddPaths([]string{r.Dir})
+	return nil
+}
+
+// blobName returns the indexed name of the blob with the given hash,
+// first found at the given path.
+func (r *Repo) blobName(hash, path string) string {
+	return r.Dir + "@" + hash + string(filepath.Separator) + filepath.FromSlash(path)
+}
+
+// BlobHash returns the hash of the blob indexed under the given name
+// in a history index of the repository.
+func (r *Repo) BlobHash(name string) (string, bool) {
+	rest := strings.TrimPrefix(name, r.Dir+"@")
+	i := strings.IndexByte(rest, filepath.Separator)
+	if len(rest) == len(name) || i < 0 {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+// Name returns the name of the file at the given slash-separated path
+// in the repository's work tree.
+func (r *Repo) Name(path string) string {
+	return filepath.Join(r.Dir, filepath.FromSlash(path))
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/andrewarchi/codesearch/index"
+)
+
+// gitRepo returns a new git repository holding two commits.
+func gitRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@b", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@b")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(name, data string) {
+		t.Helper()
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := os.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("init", "-q")
+	write("main.go", "package main\n\nfunc oldName() {}\n")
+	write("doc/notes", "hello world\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "one")
+	run("tag", "v1")
+	write("main.go", "package main\n\nfunc newName() {}\n")
+	write("copy", "hello world\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "two")
+	return dir
+}
+
+func TestIndex(t *testing.T) {
+	r, err := Open(gitRepo(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out := filepath.Join(t.TempDir(), "index")
+	w, err := index.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Index(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := index.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.GitRepo() != r.Dir || ix.NumCommits() != 2 {
+		t.Errorf("GitRepo, NumCommits = %q, %d, want %q, 2", ix.GitRepo(), ix.NumCommits(), r.Dir)
+	}
+	// Three distinct blobs: two versions of main.go, and the notes.
+	if n := ix.NumNames(); n != 3 {
+		t.Errorf("NumNames() = %d, want 3", n)
+	}
+
+	for _, tt := range []struct {
+		rev   string
+		paths []string
+		match string // path of the only file containing "Name"
+	}{
+		{"v1", []string{"doc/notes", "main.go"}, "main.go"},
+		{"HEAD", []string{"copy", "doc/notes", "main.go"}, "main.go"},
+	} {
+		commit, err := r.Resolve(tt.rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := ix.CommitFiles(commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		var restrict []uint32
+		for _, f := range files {
+			paths = append(paths, f.Path)
+			restrict = append(restrict, f.FileID)
+		}
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("%s: paths = %v, want %v", tt.rev, paths, tt.paths)
+		}
+		sort.Slice(restrict, func(i, j int) bool { return restrict[i] < restrict[j] })
+		q := &index.Query{Op: index.QAnd, Trigram: []string{"Nam", "ame"}}
+		post, err := ix.PostingQueryRestrict(q, restrict)
+		if err != nil || len(post) != 1 {
+			t.Fatalf("%s: PostingQueryRestrict = %v, %v, want one file", tt.rev, post, err)
+		}
+		name, _ := ix.Name(post[0])
+		blob, ok := r.BlobHash(name)
+		if !ok {
+			t.Fatalf("%s: BlobHash(%q) failed", tt.rev, name)
+		}
+		data, err := r.ReadBlob(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"v1": "oldName", "HEAD": "newName"}[tt.rev]
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s: matching blob %s = %q, want it to contain %q", tt.rev, name, data, want)
+		}
+	}
+	if _, err := r.Resolve("no-such-rev"); err == nil {
+		t.Error("Resolve(no-such-rev) succeeded")
+	}
+}
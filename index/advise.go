@@ -0,0 +1,64 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"os"
+)
+
+// Access advice.
+//
+// A mapped index is read by page faults, so on a cold page cache each
+// page first touched is read from disk, along with the pages after it,
+// which the kernel reads ahead expecting the file to be read in order.
+// A query reads the posting list index and the name index by binary
+// search and lookup, touching a few entries scattered across them, so
+// for a multi-GB index most of what is read ahead goes unused.
+// AdviseRandom tells the kernel not to read ahead in those sections,
+// and Prefetch asks it to read them in whole, in the background, so
+// that the first queries find them in memory. The advice applies only
+// to an index mapped into memory, and only on Linux; elsewhere, or for
+// an index read as needed (see OpenRead), it does nothing.
+
+const (
+	adviseRandom = iota + 1
+	adviseWillNeed
+)
+
+// AdviseRandom advises the operating system that the posting list
+// index and the name index of ix will be read at random, not in order.
+func (ix *Index) AdviseRandom() error {
+	return ix.advise(adviseRandom)
+}
+
+// Prefetch asks the operating system to read the posting list index
+// and the name index of ix into memory in the background.
+func (ix *Index) Prefetch() error {
+	return ix.advise(adviseWillNeed)
+}
+
+// advise gives the advice for the name index and the posting list
+// index of ix, which are adjacent in the index.
+func (ix *Index) advise(advice int) error {
+	if err := ix.acquire(); err != nil {
+		return err
+	}
+	defer ix.release()
+	m, ok := ix.data.(*mmapData)
+	if !ok {
+		return nil
+	}
+	// The mapping starts on a page boundary, and so must the advice.
+	lo := int(ix.nameIndex) &^ (os.Getpagesize() - 1)
+	hi := min(int(ix.postIndex)+ix.numPost*postEntrySize, len(m.d))
+	if lo >= hi {
+		return nil
+	}
+	if err := madvise(m.d[lo:hi], advice); err != nil {
+		return fmt.Errorf("index %s: madvise: %w", ix.file, err)
+	}
+	return nil
+}
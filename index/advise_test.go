@@ -0,0 +1,36 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdvise(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(t, out, nil, postFiles)
+	for _, open := range []func(string) (*Index, error){Open, OpenRead} {
+		ix, err := open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ix.AdviseRandom(); err != nil {
+			t.Errorf("AdviseRandom: %v", err)
+		}
+		if err := ix.Prefetch(); err != nil {
+			t.Errorf("Prefetch: %v", err)
+		}
+		q := &Query{Op: QAnd, Trigram: []string{"Sea"}}
+		if got, err := ix.PostingQuery(q); err != nil || !equalList(got, []uint32{1, 3}) {
+			t.Errorf("PostingQuery(%v) = %v, %v, want [1 3]", q, got, err)
+		}
+		ix.Close()
+		if err := ix.Prefetch(); !errors.Is(err, ErrClosed) {
+			t.Errorf("Prefetch after Close = %v, want ErrClosed", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A blockCache holds the most recently used blocks of index data
+// that are costly to produce, such as blocks read from a remote
+// index or decompressed from a compressed one.
+// It is safe for concurrent use.
+type blockCache struct {
+	max int // maximum number of blocks
+
+	mu     sync.Mutex
+	blocks map[int]*list.Element // block number to element of lru
+	lru    *list.List            // *cachedBlock, most recently used first
+}
+
+// A cachedBlock is a block in a blockCache.
+type cachedBlock struct {
+	i    int
+	data []byte
+}
+
+func newBlockCache(max int) *blockCache {
+	return &blockCache{
+		max:    max,
+		blocks: make(map[int]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// get returns block i, or nil if it is not cached.
+func (c *blockCache) get(i int) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[i]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedBlock).data
+}
+
+// add caches block i, evicting the least recently used block if needed.
+func (c *blockCache) add(i int, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.blocks[i]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.blocks[i] = c.lru.PushFront(&cachedBlock{i, data})
+	for c.lru.Len() > c.max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.blocks, e.Value.(*cachedBlock).i)
+	}
+}
+
+// A blockData is index data read as needed, in blocks of blockSize
+// bytes, keeping the most recently used blocks in cache.
+type blockData struct {
+	n         int // size of the data
+	blockSize int
+	cache     *blockCache
+
+	// read reads exactly n bytes at off.
+	read func(off, n int) ([]byte, error)
+}
+
+func (b *blockData) size() int {
+	return b.n
+}
+
+func (b *blockData) slice(off, n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	first, last := off/b.blockSize, (off+n-1)/b.blockSize
+	if err := b.load(first, last); err != nil {
+		return nil, err
+	}
+	blocks := make([][]byte, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		blocks = append(blocks, b.cache.get(i))
+	}
+
+	lo := off - first*b.blockSize
+	if len(blocks) == 1 && blocks[0] != nil {
+		return blocks[0][lo : lo+n], nil
+	}
+	buf := make([]byte, 0, n)
+	for _, d := range blocks {
+		if d == nil {
+			// Evicted while loading a range larger than the cache.
+			return b.read(off, n)
+		}
+		buf = append(buf, d[lo:]...)
+		lo = 0
+	}
+	return buf[:n], nil
+}
+
+// load makes sure blocks first through last are cached, reading each
+// run of missing blocks with a single read.
+func (b *blockData) load(first, last int) error {
+	for i := first; i <= last; {
+		if b.cache.get(i) != nil {
+			i++
+			continue
+		}
+		j := i + 1
+		for j <= last && b.cache.get(j) == nil {
+			j++
+		}
+		off := i * b.blockSize
+		n := j*b.blockSize - off
+		if off+n > b.n {
+			n = b.n - off
+		}
+		data, err := b.read(off, n)
+		if err != nil {
+			return err
+		}
+		for k := i; k < j; k++ {
+			d := data[(k-i)*b.blockSize:]
+			if len(d) > b.blockSize {
+				d = d[:b.blockSize]
+			}
+			b.cache.add(k, d)
+		}
+		i = j
+	}
+	return nil
+}
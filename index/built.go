@@ -0,0 +1,153 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Build times.
+//
+// An index records when each of its paths was indexed, so that a search
+// can warn that the index may be out of date. The "built" section holds,
+// for each entry in the list of paths, in order, the time at which the
+// Writer that indexed it was created, as an 8-byte big-endian count of
+// nanoseconds since the Unix epoch, or 0 if unknown. The time is that of
+// the start of indexing, not the end, since files may change while they
+// are being read. Merging keeps the time of each path from the index that
+// provided it, so after an incremental cindex run the paths it reindexed
+// are newer than the others.
+
+// builtEntrySize is the size of a "built" section entry.
+const builtEntrySize = 8
+
+// builtSection returns a temporary file in dir holding the "built"
+// section recording times, or nil if all are unknown.
+func builtSection(dir string, times []time.Time) (*bufWriter, error) {
+	known := false
+	for _, t := range times {
+		known = known || !t.IsZero()
+	}
+	if !known {
+		return nil, nil
+	}
+	b, err := bufCreateTemp(dir)
+	if err != nil {
+		return nil, err
+	}
+	var buf [builtEntrySize]byte
+	for _, t := range times {
+		var ns int64
+		if !t.IsZero() {
+			ns = t.UnixNano()
+		}
+		binary.BigEndian.PutUint64(buf[:], uint64(ns))
+		if err := b.write(buf[:]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// BuildTimes returns the time at which each path of the index, as listed
+// by Paths, was indexed, or the zero time if that is unknown. It returns
+// nil for an index that records no build times, such as one written
+// before they were recorded.
+func (ix *Index) BuildTimes() ([]time.Time, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	s, ok := ix.sections["built"]
+	if !ok {
+		return nil, nil
+	}
+	paths, err := ix.Paths()
+	if err != nil {
+		return nil, err
+	}
+	if int(s.size) != len(paths)*builtEntrySize {
+		return nil, ix.corrupt("built", s.off, ErrMalformed)
+	}
+	d, err := ix.sectionSlice("built", 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	times := make([]time.Time, len(paths))
+	for i := range times {
+		if ns := int64(binary.BigEndian.Uint64(d[i*builtEntrySize:])); ns != 0 {
+			times[i] = time.Unix(0, ns)
+		}
+	}
+	return times, nil
+}
+
+// Built returns the time at which the least recently indexed path of the
+// index was indexed, or the zero time if that is unknown.
+func (ix *Index) Built() (time.Time, error) {
+	if err := ix.acquire(); err != nil {
+		return time.Time{}, err
+	}
+	defer ix.release()
+	times, err := ix.BuildTimes()
+	if err != nil || len(times) == 0 {
+		return time.Time{}, err
+	}
+	built := times[0]
+	for _, t := range times[1:] {
+		if t.IsZero() {
+			return time.Time{}, nil
+		}
+		if t.Before(built) {
+			built = t
+		}
+	}
+	return built, nil
+}
+
+// mergeBuildTimes returns the build times of paths, the merged path list
+// of ix1 and ix2, taking those of the paths of ix2 from ix2, as the
+// newer index, and the others from ix1.
+func mergeBuildTimes(ix1, ix2 *Index, paths, paths2 []string) ([]time.Time, error) {
+	t1, err := pathBuildTimes(ix1)
+	if err != nil {
+		return nil, err
+	}
+	t2, err := pathBuildTimes(ix2)
+	if err != nil {
+		return nil, err
+	}
+	in2 := make(map[string]bool)
+	for _, p := range paths2 {
+		in2[p] = true
+	}
+	times := make([]time.Time, len(paths))
+	for i, p := range paths {
+		if in2[p] {
+			times[i] = t2[p]
+		} else {
+			times[i] = t1[p]
+		}
+	}
+	return times, nil
+}
+
+// pathBuildTimes returns the build times of the paths of ix, by path.
+func pathBuildTimes(ix *Index) (map[string]time.Time, error) {
+	times, err := ix.BuildTimes()
+	if err != nil || times == nil {
+		return nil, err
+	}
+	paths, err := ix.Paths()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]time.Time)
+	for i, p := range paths {
+		m[p] = times[i]
+	}
+	return m, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildTimes(t *testing.T) {
+	dir := t.TempDir()
+	started := func(start time.Time) func(*Writer) {
+		return func(ix *Writer) { ix.start = start }
+	}
+	t1 := time.Unix(1600000000, 0)
+	t2 := time.Unix(1700000000, 0)
+	old := filepath.Join(dir, "old")
+	buildFlushIndex(t, old, []string{"/a", "/b"}, false, map[string]string{
+		"/a/x": "hello world",
+		"/b/y": "hello world",
+	}, started(t1))
+	update := filepath.Join(dir, "update")
+	buildFlushIndex(t, update, []string{"/b", "/c"}, false, map[string]string{
+		"/b/y": "hello world",
+		"/c/z": "hello world",
+	}, started(t2))
+	merged := filepath.Join(dir, "merged")
+	if err := Merge(merged, old, update); err != nil {
+		t.Fatal(err)
+	}
+	pruned := filepath.Join(dir, "pruned")
+	if _, err := Prune(pruned, merged, func(name string) bool { return name != "/a/x" }); err != nil {
+		t.Fatal(err)
+	}
+	unknown := filepath.Join(dir, "unknown")
+	buildFlushIndex(t, unknown, []string{"/b"}, false, map[string]string{"/b/y": "hello world"}, started(time.Time{}))
+	mergedUnknown := filepath.Join(dir, "merged-unknown")
+	if err := Merge(mergedUnknown, old, unknown); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		file  string
+		times []time.Time
+		built time.Time
+	}{
+		{old, []time.Time{t1, t1}, t1},
+		{update, []time.Time{t2, t2}, t2},
+		{merged, []time.Time{t1, t2, t2}, t1},
+		{pruned, []time.Time{t1, t2, t2}, t1},
+		{unknown, nil, time.Time{}},
+		{mergedUnknown, []time.Time{t1, {}}, time.Time{}},
+	} {
+		ix, err := Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		times, err := ix.BuildTimes()
+		if err != nil || !reflect.DeepEqual(times, tt.times) {
+			t.Errorf("%s: BuildTimes() = %v, %v, want %v", filepath.Base(tt.file), times, err, tt.times)
+		}
+		if built, err := ix.Built(); err != nil || !built.Equal(tt.built) {
+			t.Errorf("%s: Built() = %v, %v, want %v", filepath.Base(tt.file), built, err, tt.built)
+		}
+		ix.Close()
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+)
+
+// Search result cache.
+//
+// Interactive clients, such as web UIs searching as the user types,
+// send the same searches again and again: a query typed, refined, and
+// then taken back, or the next page of the same results. A Daemon with
+// a positive CacheSize keeps the names found by the most recent searches
+// of each index, keyed by the query and options encoded as JSON, and
+// answers a repeated search from them, without reading posting lists or
+// names. The cache of an index belongs to the index as opened, so it is
+// dropped when the daemon reopens the index after cindex replaces it,
+// and a cached result is never stale.
+
+// A searchCache holds the results of the most recently used searches
+// of an index, up to a total of max names. Each result counts as one
+// name more than it holds, so that empty results take room too.
+type searchCache struct {
+	mu      sync.Mutex
+	max     int                      // most names held
+	n       int                      // names held, with one more per result
+	entries map[string]*list.Element // of *cacheEntry, by key
+	lru     list.List                // of *cacheEntry, most recently used first
+}
+
+// A cacheEntry is the result of a search held in a searchCache.
+type cacheEntry struct {
+	key   string
+	names []string
+}
+
+// newSearchCache returns an empty cache holding up to max names.
+func newSearchCache(max int) *searchCache {
+	return &searchCache{max: max, entries: make(map[string]*list.Element)}
+}
+
+// cacheKey returns the key of the search for q with opt.
+// The statistics and trace of opt are not part of the key.
+func cacheKey(q *Query, opt *SearchOptions) (string, error) {
+	data, err := json.Marshal(struct {
+		Q   *Query
+		Opt *SearchOptions
+	}{q, opt})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// get returns the names found by the search with the given key, and
+// whether it is in the cache. The names must not be modified.
+func (c *searchCache) get(key string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).names, true
+}
+
+// put records that the search with the given key found names,
+// evicting the least recently used results to make room for them.
+// A result too large for the cache is not kept.
+func (c *searchCache) put(key string, names []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(names)+1 > c.max || c.entries[key] != nil {
+		return
+	}
+	for c.n+len(names)+1 > c.max {
+		old := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, old.key)
+		c.n -= len(old.names) + 1
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, names})
+	c.n += len(names) + 1
+}
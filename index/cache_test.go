@@ -0,0 +1,98 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+func TestSearchCache(t *testing.T) {
+	c := newSearchCache(6)
+	c.put("a", []string{"/a/x", "/a/y"})
+	c.put("b", nil)
+	c.put("c", []string{"/c/x"})
+	if names, ok := c.get("a"); !ok || !reflect.DeepEqual(names, []string{"/a/x", "/a/y"}) {
+		t.Errorf("get(a) = %q, %v, want [/a/x /a/y], true", names, ok)
+	}
+	// a, b, and c take 3, 1, and 2 of the 6 names; d evicts b, the
+	// least recently used, and then c.
+	c.put("d", []string{"/d/x", "/d/y"})
+	for _, tt := range []struct {
+		key string
+		ok  bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", false},
+		{"d", true},
+	} {
+		if _, ok := c.get(tt.key); ok != tt.ok {
+			t.Errorf("get(%s) found %v, want %v", tt.key, ok, tt.ok)
+		}
+	}
+	// A result larger than the cache is not kept, and evicts nothing.
+	c.put("e", []string{"1", "2", "3", "4", "5", "6"})
+	if _, ok := c.get("e"); ok {
+		t.Error("cache kept a result larger than itself")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("result too large for the cache evicted another")
+	}
+}
+
+func TestDaemonCache(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+
+	re, err := syntax.Parse("now", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := RegexpQuery(re)
+	d := &Daemon{CacheSize: 100}
+	search := func(opt *SearchOptions) []string {
+		resp := d.handle(&daemonRequest{Op: "search", Index: out, Query: q, Options: opt})
+		if resp.Err != "" {
+			t.Fatal(resp.Err)
+		}
+		return resp.Names
+	}
+	for i := 0; i < 2; i++ {
+		if names, want := search(nil), []string{"/b/xx", "/c/de"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("search #%d = %q, want %q", i, names, want)
+		}
+		if names, want := search(&SearchOptions{Prefix: "/c/"}), []string{"/c/de"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("search #%d with prefix = %q, want %q", i, names, want)
+		}
+	}
+
+	// Replacing the index, as cindex does, must drop the cached results.
+	buildIndex(t, out+"~", mergePaths2, mergeFiles2)
+	if err := os.Rename(out+"~", out); err != nil {
+		t.Fatal(err)
+	}
+	if names, want := search(nil), []string{"/b/xx", "/b/yy"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("search after rebuild = %q, want %q", names, want)
+	}
+
+	var b strings.Builder
+	if err := d.WriteMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`csearchd_cache_searches_total{result="hit"} 2`,
+		`csearchd_cache_searches_total{result="miss"} 3`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, b.String())
+		}
+	}
+}
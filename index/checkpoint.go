@@ -0,0 +1,193 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/andrewarchi/codesearch/norm"
+)
+
+// Checkpoints.
+//
+// Indexing a large tree can take hours. Writer.Checkpoint saves the
+// state of a Writer so that, if the process is interrupted, a later
+// process can pick up where it left off with Resume. The state lives
+// mostly in the Writer's temporary files: the file names, the file
+// languages, sizes, and times, and the flushed posting entries. Checkpoint flushes the
+// entries held in memory, so that the temporary files hold everything
+// added so far, and records their names and sizes. Anything written
+// to them after the checkpoint is discarded by Resume.
+
+// A Checkpoint records the state of a Writer.
+// It is meant to be saved, for example as JSON, and passed to Resume.
+type Checkpoint struct {
+	Paths        []string
+	Excludes     []string
+	Repos        []Repo
+	Quadgrams    bool
+	CompressTemp bool
+	Normalize    norm.Mode
+	Start        time.Time // when indexing began
+	NumName      int
+	TotalBytes   int64
+	NameData     string // temporary file names
+	NameLen      uint32 // size of NameData
+	NameIndex    string
+	LangData     string
+	StatData     string
+	Stats        bool     // the size and mtime of some file are known
+	Truncated    []uint32 // IDs of the files cut short by HeadBytes
+	Gzipped      []uint32 // IDs of the files decompressed by Gunzip
+	Classes      []FileClass
+	PostFiles    []string
+	QuadFiles    []string
+}
+
+// Checkpoint flushes the files added so far to temporary files and
+// returns a Checkpoint from which Resume can continue writing the index.
+// The temporary files are removed by Flush, after which the checkpoint
+// is no longer valid.
+func (ix *Writer) Checkpoint() (*Checkpoint, error) {
+	if err := ix.createTemp(); err != nil {
+		return nil, err
+	}
+	if len(ix.post) > 0 {
+		if err := ix.flushPost(); err != nil {
+			return nil, err
+		}
+	}
+	if err := ix.flushQuad(); err != nil {
+		return nil, err
+	}
+	for _, b := range []*bufWriter{ix.nameData, ix.nameIndex, ix.langData, ix.statData} {
+		if err := b.flush(); err != nil {
+			return nil, err
+		}
+	}
+	c := &Checkpoint{
+		Paths:        ix.paths,
+		Excludes:     ix.excludes,
+		Repos:        ix.repos,
+		Quadgrams:    ix.Quadgrams,
+		CompressTemp: ix.CompressTemp,
+		Normalize:    ix.Normalize,
+		Start:        ix.start,
+		NumName:      ix.numName,
+		TotalBytes:   ix.totalBytes,
+		NameData:     ix.nameData.name,
+		NameLen:      ix.nameData.offset(),
+		NameIndex:    ix.nameIndex.name,
+		LangData:     ix.langData.name,
+		StatData:     ix.statData.name,
+		Stats:        ix.stats,
+		Truncated:    ix.truncated,
+		Gzipped:      ix.gzipped,
+		Classes:      ix.classes,
+	}
+	for _, f := range ix.postFile {
+		c.PostFiles = append(c.PostFiles, f.Name())
+	}
+	for _, f := range ix.quadFile {
+		c.QuadFiles = append(c.QuadFiles, f.Name())
+	}
+	return c, nil
+}
+
+// Resume returns a new Writer that will write the index to file,
+// continuing from the state recorded in c. The Writer's temporary
+// files stay where they are; TempDir applies only to new ones.
+// CompressTemp is set as recorded in c and must not be changed.
+func Resume(file string, c *Checkpoint) (*Writer, error) {
+	w := &Writer{
+		Quadgrams:    c.Quadgrams,
+		CompressTemp: c.CompressTemp,
+		Normalize:    c.Normalize,
+		trigram:      newTrigramSet(),
+		paths:        c.Paths,
+		excludes:     c.Excludes,
+		repos:        c.Repos,
+		start:        c.Start,
+		numName:      c.NumName,
+		totalBytes:   c.TotalBytes,
+		truncated:    c.Truncated,
+		gzipped:      c.Gzipped,
+		classes:      c.Classes,
+		stats:        c.Stats,
+		inbuf:        make([]byte, 16384),
+	}
+	var err error
+	if w.nameData, err = bufResume(c.NameData, int64(c.NameLen)); err != nil {
+		return nil, err
+	}
+	if w.nameIndex, err = bufResume(c.NameIndex, 4*int64(c.NumName)); err != nil {
+		return nil, err
+	}
+	if w.langData, err = bufResume(c.LangData, int64(c.NumName)); err != nil {
+		return nil, err
+	}
+	if w.statData, err = bufResume(c.StatData, statEntrySize*int64(c.NumName)); err != nil {
+		return nil, err
+	}
+	if w.postFile, err = openFiles(c.PostFiles); err != nil {
+		return nil, err
+	}
+	if w.quadFile, err = openFiles(c.QuadFiles); err != nil {
+		return nil, err
+	}
+	if w.main, err = bufCreate(file); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// bufResume returns a bufWriter appending to the named file,
+// after truncating it to size.
+func bufResume(name string, size int64) (*bufWriter, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.Size() < size {
+		f.Close()
+		return nil, fmt.Errorf("%s: checkpoint file truncated", name)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &bufWriter{
+		name: name,
+		buf:  make([]byte, 0, 256<<10),
+		file: f,
+	}, nil
+}
+
+// openFiles opens the named files for reading.
+func openFiles(names []string) ([]*os.File, error) {
+	var files []*os.File
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
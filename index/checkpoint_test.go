@@ -0,0 +1,80 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	var files []string
+	for name := range mergeFiles1 {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+
+	for _, quad := range []bool{false, true} {
+		f, _ := os.CreateTemp("", "index-test")
+		want := f.Name()
+		f.Close()
+		defer os.Remove(want)
+		if quad {
+			buildQuadIndex(t, want, mergePaths1, false, mergeFiles1)
+		} else {
+			buildIndex(t, want, mergePaths1, mergeFiles1)
+		}
+
+		f, _ = os.CreateTemp("", "index-test")
+		out := f.Name()
+		f.Close()
+		defer os.Remove(out)
+		ix, err := Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.start = testBuildTime
+		ix.Quadgrams = quad
+		ix.AddPaths(mergePaths1)
+		for _, name := range files[:3] {
+			ix.Add(name, strings.NewReader(mergeFiles1[name]))
+		}
+		c, err := ix.Checkpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Work done after the checkpoint is lost.
+		ix.Add(files[3], strings.NewReader(mergeFiles1[files[3]]))
+		if _, err := ix.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+
+		ix, err = Resume(out, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range files[3:] {
+			ix.Add(name, strings.NewReader(mergeFiles1[name]))
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		have, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantData, err := os.ReadFile(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, wantData) {
+			t.Errorf("quadgrams=%v: resumed index differs from index built in one run", quad)
+		}
+	}
+}
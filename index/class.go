@@ -0,0 +1,140 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/andrewarchi/codesearch/lang"
+)
+
+// File classes.
+//
+// A Writer with Classify set records the class of each file, as judged
+// by lang.Classify, so that searches can leave out generated, minified,
+// and vendored files (see SearchOptions.SkipClasses). The "class"
+// section lists the files of a class other than lang.Normal, in
+// increasing order of ID, each as a 4-byte big-endian ID followed by
+// a byte holding its class. Merging keeps the class of each file from
+// the index that provided it.
+
+// A FileClass is the class of the file with the given ID.
+type FileClass struct {
+	ID    uint32
+	Class lang.Class
+}
+
+// classSection returns a temporary file in dir holding the "class"
+// section listing classes, or nil if there are none.
+func classSection(dir string, classes []FileClass) (*bufWriter, error) {
+	if len(classes) == 0 {
+		return nil, nil
+	}
+	b, err := bufCreateTemp(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range classes {
+		if err := b.writeUint32(c.ID); err != nil {
+			return nil, err
+		}
+		if err := b.writeByte(byte(c.Class)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// FileClasses returns the classes of the files of a class other than
+// lang.Normal, sorted by ID, as recorded by Writer.Classify.
+func (ix *Index) FileClasses() ([]FileClass, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	d, err := ix.classData()
+	if err != nil {
+		return nil, err
+	}
+	var classes []FileClass
+	for i := 0; i < len(d); i += 5 {
+		id := binary.BigEndian.Uint32(d[i:])
+		if id >= uint32(ix.numName) || len(classes) > 0 && id <= classes[len(classes)-1].ID {
+			return nil, ix.corrupt("class", ix.sections["class"].off+uint32(i), ErrMalformed)
+		}
+		classes = append(classes, FileClass{id, lang.Class(d[i+4])})
+	}
+	return classes, nil
+}
+
+// Class returns the class of the file with the given ID. Files in
+// indexes without class information are lang.Normal.
+func (ix *Index) Class(fileID uint32) (lang.Class, error) {
+	if err := ix.acquire(); err != nil {
+		return 0, err
+	}
+	defer ix.release()
+	d, err := ix.classData()
+	if err != nil {
+		return lang.Normal, err
+	}
+	n := len(d) / 5
+	i := sort.Search(n, func(i int) bool {
+		return binary.BigEndian.Uint32(d[5*i:]) >= fileID
+	})
+	if i < n && binary.BigEndian.Uint32(d[5*i:]) == fileID {
+		return lang.Class(d[5*i+4]), nil
+	}
+	return lang.Normal, nil
+}
+
+// FilesByClass returns the sorted IDs of the files in any of the given
+// classes, which must not include lang.Normal.
+func (ix *Index) FilesByClass(classes ...lang.Class) ([]uint32, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	all, err := ix.FileClasses()
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, c := range all {
+		for _, want := range classes {
+			if c.Class == want {
+				ids = append(ids, c.ID)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+// classMap returns the classes of the files of ix, by ID.
+func classMap(ix *Index) (map[uint32]lang.Class, error) {
+	classes, err := ix.FileClasses()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[uint32]lang.Class)
+	for _, c := range classes {
+		m[c.ID] = c.Class
+	}
+	return m, nil
+}
+
+// classData returns the "class" section, or nil if there is none.
+func (ix *Index) classData() ([]byte, error) {
+	s, ok := ix.sections["class"]
+	if !ok {
+		return nil, nil
+	}
+	if s.size%5 != 0 {
+		return nil, ix.corrupt("class", s.off, ErrMalformed)
+	}
+	return ix.sectionSlice("class", 0, -1)
+}
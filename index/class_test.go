@@ -0,0 +1,116 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/andrewarchi/codesearch/lang"
+)
+
+func TestClasses(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old")
+	buildFlushIndex(t, old, []string{"/a"}, false, map[string]string{
+		"/a/api.pb.go":      "package api // needle\n",
+		"/a/main.go":        "package main // needle\n",
+		"/a/vendor/x/x.go":  "package x // needle\n",
+		"/a/web/app.min.js": "needle()\n",
+	}, func(ix *Writer) { ix.Classify = true })
+	var skipped []string
+	update := filepath.Join(dir, "update")
+	buildFlushIndex(t, update, []string{"/b"}, false, map[string]string{
+		"/b/gen.go":   "// Code generated by hand; DO NOT EDIT.\npackage b // needle\n",
+		"/b/main.go":  "package main // needle\n",
+		"/b/x.min.js": "needle()\n",
+	}, func(ix *Writer) {
+		ix.SkipClasses = []lang.Class{lang.Minified}
+		ix.OnSkip = func(name string, reason SkipReason) bool {
+			skipped = append(skipped, name+": "+reason.String())
+			return true
+		}
+	})
+	if want := []string{"/b/x.min.js: minified file"}; !slices.Equal(skipped, want) {
+		t.Errorf("skipped %q, want %q", skipped, want)
+	}
+	merged := filepath.Join(dir, "merged")
+	if err := Merge(merged, old, update); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	imported := filepath.Join(dir, "imported")
+	if ix, err := Open(merged); err != nil {
+		t.Fatal(err)
+	} else {
+		err := ix.Export(&dump)
+		ix.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Import(imported, &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	oldClasses := []FileClass{{0, lang.Generated}, {2, lang.Vendored}, {3, lang.Minified}}
+	mergedClasses := []FileClass{{0, lang.Generated}, {2, lang.Vendored}, {3, lang.Minified}, {4, lang.Generated}}
+	for _, tt := range []struct {
+		file    string
+		classes []FileClass
+	}{
+		{old, oldClasses},
+		{update, []FileClass{{0, lang.Generated}}},
+		{merged, mergedClasses},
+		{imported, mergedClasses},
+	} {
+		ix, err := Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		classes, err := ix.FileClasses()
+		if err != nil || !reflect.DeepEqual(classes, tt.classes) {
+			t.Errorf("%s: FileClasses() = %v, %v, want %v", filepath.Base(tt.file), classes, err, tt.classes)
+		}
+		for id := uint32(0); id < uint32(ix.NumNames()); id++ {
+			want := lang.Normal
+			for _, c := range tt.classes {
+				if c.ID == id {
+					want = c.Class
+				}
+			}
+			if c, err := ix.Class(id); c != want || err != nil {
+				t.Errorf("%s: Class(%d) = %v, %v, want %v", filepath.Base(tt.file), id, c, err, want)
+			}
+		}
+		if _, err := ix.Verify(); err != nil {
+			t.Errorf("%s: Verify: %v", filepath.Base(tt.file), err)
+		}
+	}
+
+	ix, err := Open(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	q := &Query{Op: QAnd, Trigram: []string{"nee", "eed", "dle"}}
+	for _, tt := range []struct {
+		skip []lang.Class
+		want []string
+	}{
+		{nil, []string{"/a/api.pb.go", "/a/main.go", "/a/vendor/x/x.go", "/a/web/app.min.js", "/b/gen.go", "/b/main.go"}},
+		{[]lang.Class{lang.Generated, lang.Minified, lang.Vendored}, []string{"/a/main.go", "/b/main.go"}},
+		{[]lang.Class{lang.Vendored}, []string{"/a/api.pb.go", "/a/main.go", "/a/web/app.min.js", "/b/gen.go", "/b/main.go"}},
+	} {
+		names, err := ix.Search(q, &SearchOptions{SkipClasses: tt.skip})
+		if err != nil || !slices.Equal(names, tt.want) {
+			t.Errorf("Search with SkipClasses %v = %v, %v, want %v", tt.skip, names, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// Compressed temporary files.
+//
+// With Writer.CompressTemp, the sorted post entries flushed to temporary
+// files are stored as the differences between consecutive entries,
+// as little-endian uint64s, in an S2 stream (see package
+// github.com/klauspost/compress/s2). Within a trigram the differences
+// are small file ID gaps, mostly zero bytes, which compress well and
+// quickly. Compressed files cannot be mapped into memory, so mergePost
+// decodes them postDecodeSize entries at a time.
+
+const postDecodeSize = 64 << 10
+
+// writeCompressedPost writes the sorted post entries to f, compressed.
+func writeCompressedPost(f *os.File, post []postEntry) error {
+	enc := s2.NewWriter(f)
+	buf := make([]byte, 0, postDecodeSize*8)
+	var last postEntry
+	for len(post) > 0 {
+		n := min(len(post), postDecodeSize)
+		buf = buf[:0]
+		for _, e := range post[:n] {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(e-last))
+			last = e
+		}
+		post = post[n:]
+		if _, err := enc.Write(buf); err != nil {
+			return fmt.Errorf("writing %s: %v", f.Name(), err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("writing %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// A postDecoder reads post entries written by writeCompressedPost.
+type postDecoder struct {
+	name string
+	r    *s2.Reader
+	raw  []byte
+	buf  []postEntry
+	last postEntry
+}
+
+func newPostDecoder(f *os.File) *postDecoder {
+	return &postDecoder{
+		name: f.Name(),
+		r:    s2.NewReader(f),
+		raw:  make([]byte, postDecodeSize*8),
+		buf:  make([]postEntry, postDecodeSize),
+	}
+}
+
+// read returns the next entries, or none at the end of the file.
+// The returned slice is only valid until the next call to read.
+func (d *postDecoder) read() ([]postEntry, error) {
+	n, err := io.ReadFull(d.r, d.raw)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("reading %s: %v", d.name, err)
+	}
+	if n%8 != 0 {
+		return nil, fmt.Errorf("reading %s: truncated entry", d.name)
+	}
+	m := d.buf[:n/8]
+	for i := range m {
+		d.last += postEntry(binary.LittleEndian.Uint64(d.raw[8*i:]))
+		m[i] = d.last
+	}
+	return m, nil
+}
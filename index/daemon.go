@@ -0,0 +1,561 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrewarchi/codesearch/norm"
+	"github.com/andrewarchi/codesearch/trace"
+)
+
+// Search daemon.
+//
+// A Daemon, run by csearchd, keeps indexes open, so that their pages
+// stay mapped and cached between searches, and answers requests on a
+// Unix socket, normally the one named by DaemonSocket. A client sends
+// requests, each a frame holding a daemonRequest, and the daemon
+// answers each with a frame holding a daemonResponse, in order, on the
+// same connection. A frame is a 4-byte big-endian length followed by
+// that many bytes of JSON.
+//
+// The daemon names each index by the absolute path of its file, as
+// given to Open, or of a sharded index, as given to OpenSharded. It
+// reopens an index when any of its files is replaced, as by cindex, as
+// reported by Index.Replaced, and closes the old one once the searches
+// using it finish. The daemon is locked while it finds or opens the
+// indexes of a request, but not while it searches them, so that
+// requests are answered concurrently. A daemon may also
+// serve a directory of indexes as a registry of repositories, searched
+// all at once, as described in registry.go.
+
+// maxFrame is the largest frame accepted, to guard against corrupt input.
+const maxFrame = 1 << 30
+
+// DaemonSocket returns the name of the daemon's Unix socket:
+// $CSEARCHSOCKET, or else $HOME/.csearchd.sock.
+func DaemonSocket() string {
+	if f := os.Getenv("CSEARCHSOCKET"); f != "" {
+		return f
+	}
+	return filepath.Clean(homeDir() + "/.csearchd.sock")
+}
+
+// A daemonRequest is a request sent to the daemon.
+type daemonRequest struct {
+	Op      string         `json:"op"`              // "info", "search", "repos", or "searchall"
+	Index   string         `json:"index,omitempty"` // absolute path of the index, for info and search
+	Query   *Query         `json:"query,omitempty"`
+	Options *SearchOptions `json:"options,omitempty"`
+}
+
+// A daemonResponse is the daemon's answer to a daemonRequest.
+type daemonResponse struct {
+	Err     string         `json:"err,omitempty"`
+	Info    *DaemonInfo    `json:"info,omitempty"`
+	Names   []string       `json:"names,omitempty"`
+	Repos   []DaemonRepo   `json:"repos,omitempty"`
+	Results []DaemonResult `json:"results,omitempty"`
+}
+
+// DaemonInfo describes an index open in the daemon.
+type DaemonInfo struct {
+	Normalization norm.Mode   `json:"normalization"`
+	Quadgrams     bool        `json:"quadgrams"`         // some shard has quadgram posting lists
+	History       bool        `json:"history"`           // the index is a history index, which the daemon cannot search
+	Paths         []string    `json:"paths"`             // the indexed paths, as by Index.Paths
+	NumNames      int         `json:"numNames"`          // the number of files indexed, over all shards
+	Built         []time.Time `json:"built,omitempty"`   // when each path was indexed, as by Index.BuildTimes
+	Gzipped       []string    `json:"gzipped,omitempty"` // the files indexed decompressed, as by Index.GzippedNames
+
+	// Stats reports whether every shard records the sizes and times
+	// of its files (see Index.HasStats), and Unstatted then lists,
+	// sorted, the files of which they are not recorded anyway, as by
+	// Index.UnstattedNames. Searches filter the others by them.
+	Stats     bool     `json:"stats"`
+	Unstatted []string `json:"unstatted,omitempty"`
+}
+
+// A Daemon serves searches of the indexes it holds open.
+type Daemon struct {
+	Verbose bool         // log requests
+	Logger  *slog.Logger // if nil, slog.Default()
+	Tracer  trace.Tracer // if non-nil, traces each request
+
+	// Prefetch causes the daemon to advise random access to the
+	// posting list index and name index of each index it opens, and
+	// to prefetch them, as by Index.AdviseRandom and Index.Prefetch.
+	Prefetch bool
+
+	// Strict causes the daemon to check the whole of each index it
+	// opens, as by OpenStrict, refusing to search a corrupt one.
+	Strict bool
+
+	// CacheSize, if positive, is the most file names the daemon keeps,
+	// for each index, of the results of recent searches, to answer the
+	// same searches again without evaluating them, as described in
+	// cache.go. The cache of an index is dropped when it is reopened.
+	CacheSize int
+
+	mu       sync.Mutex
+	indexes  map[string]*daemonIndex
+	dir      string            // directory of the registry, if any
+	registry map[string]string // index file of each repository in the registry
+	metrics  daemonMetrics
+}
+
+// A daemonIndex is an index held open by a Daemon.
+type daemonIndex struct {
+	mu      sync.RWMutex // held for reading by searches, and for writing to close the shards
+	shards  []*Index
+	info    DaemonInfo
+	sharded bool
+	cache   *searchCache   // if non-nil, results of recent searches
+	metrics *daemonMetrics // of the daemon, for counting cache hits
+}
+
+// replaced reports whether any of the files of dx has been replaced,
+// or the index now has n shards, zero meaning it is not sharded.
+func (dx *daemonIndex) replaced(n int) bool {
+	if dx.sharded != (n > 0) || dx.sharded && n != len(dx.shards) {
+		return true
+	}
+	for _, ix := range dx.shards {
+		if ix.Replaced() {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve accepts connections on l and answers their requests,
+// until l fails, as when it is closed.
+func (d *Daemon) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go d.serveConn(conn)
+	}
+}
+
+// Open opens the index in the named file ahead of the first search of it.
+func (d *Daemon) Open(file string) error {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err = d.open(file)
+	return err
+}
+
+// serveConn answers the requests on conn until it is closed.
+func (d *Daemon) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var req daemonRequest
+		if err := readFrame(r, &req); err != nil {
+			if err != io.EOF {
+				logDetail(d.Logger, d.Verbose, "daemon", "err", err)
+			}
+			return
+		}
+		resp := d.handle(&req)
+		if err := writeFrame(conn, resp); err != nil {
+			logDetail(d.Logger, d.Verbose, "daemon", "err", err)
+			return
+		}
+	}
+}
+
+// handle answers req.
+func (d *Daemon) handle(req *daemonRequest) *daemonResponse {
+	start := time.Now()
+	resp := new(daemonResponse)
+	var span trace.Span
+	if d.Tracer != nil {
+		span = d.Tracer.Start(req.Op)
+		span.SetAttr("index", req.Index)
+		defer span.End()
+	}
+	// The daemon is locked only to find or open the indexes, which are
+	// then held for searching, so that one slow search does not hold
+	// up the requests of other clients.
+	openSpan := trace.Start(span, "open")
+	var dx *daemonIndex
+	var names []string // of the repositories searched, for searchall
+	var dxs []*daemonIndex
+	var err error
+	d.mu.Lock()
+	switch req.Op {
+	case "repos":
+		if err = d.scan(); err == nil {
+			resp.Repos = d.repos()
+		}
+	case "searchall":
+		if err = d.scan(); err == nil {
+			names, dxs = d.searchable()
+		}
+	default:
+		if dx, err = d.open(req.Index); err == nil {
+			dxs = []*daemonIndex{dx}
+		}
+	}
+	for _, dx := range dxs {
+		dx.mu.RLock()
+		defer dx.mu.RUnlock()
+	}
+	d.mu.Unlock()
+	openSpan.End()
+	phases := map[string]time.Duration{"open": time.Since(start)}
+	if err == nil {
+		switch req.Op {
+		case "info":
+			info := dx.info
+			resp.Info = &info
+		case "search":
+			var st SearchStats
+			var n int64
+			resp.Names, n, err = dx.search(req.Query, req.Options, &st, span)
+			if err == nil {
+				phases["filter"] = st.Filter
+				phases["query"] = st.Query
+				phases["names"] = st.Names
+				d.metrics.search(st.Candidates, n)
+			}
+		case "repos":
+		case "searchall":
+			var st SearchStats
+			var n int64
+			resp.Results, n, err = searchAll(names, dxs, req.Query, req.Options, &st, span)
+			if err == nil {
+				phases["filter"] = st.Filter
+				phases["query"] = st.Query
+				phases["names"] = st.Names
+				d.metrics.search(st.Candidates, n)
+			}
+		default:
+			err = fmt.Errorf("unknown request %q", req.Op)
+		}
+	}
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	op := req.Op
+	switch op {
+	case "info", "search", "repos", "searchall":
+	default:
+		op = "unknown"
+	}
+	d.metrics.request(op, err, phases)
+	logDetail(d.Logger, d.Verbose, req.Op, "index", req.Index, "names", len(resp.Names), "duration", time.Since(start), "err", err)
+	return resp
+}
+
+// open returns the index named file, opening it if it is not already
+// open or has been replaced since it was opened.
+func (d *Daemon) open(file string) (*daemonIndex, error) {
+	if !filepath.IsAbs(file) {
+		return nil, fmt.Errorf("index %s: not an absolute path", file)
+	}
+	n := NumShards(file)
+	if old := d.indexes[file]; old != nil {
+		if !old.replaced(n) {
+			return old, nil
+		}
+		d.close(file)
+	}
+
+	dx := &daemonIndex{sharded: n > 0, metrics: &d.metrics}
+	if d.CacheSize > 0 {
+		dx.cache = newSearchCache(d.CacheSize)
+	}
+	if dx.sharded {
+		s, err := OpenSharded(file)
+		if err != nil {
+			return nil, err
+		}
+		dx.shards = s.Shards
+	} else {
+		ix, err := Open(file)
+		if err != nil {
+			return nil, err
+		}
+		dx.shards = []*Index{ix}
+	}
+	if err := d.init(file, dx); err != nil {
+		for _, ix := range dx.shards {
+			ix.Close()
+		}
+		return nil, err
+	}
+	if d.indexes == nil {
+		d.indexes = make(map[string]*daemonIndex)
+	}
+	d.indexes[file] = dx
+	logDetail(d.Logger, d.Verbose, "opened", "index", file)
+	return dx, nil
+}
+
+// init prepares the newly opened index dx, named file, for searching,
+// and records it in the daemon's metrics.
+func (d *Daemon) init(file string, dx *daemonIndex) error {
+	if d.Strict {
+		for _, ix := range dx.shards {
+			if _, err := ix.Verify(); err != nil {
+				return err
+			}
+		}
+	}
+	for i, ix := range dx.shards {
+		ix.Verbose = d.Verbose
+		ix.Logger = d.Logger
+		if d.Prefetch {
+			if err := ix.AdviseRandom(); err != nil {
+				return err
+			}
+			if err := ix.Prefetch(); err != nil {
+				return err
+			}
+		}
+		m, err := ix.Normalization()
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			dx.info.Normalization = m
+			if dx.info.Paths, err = ix.Paths(); err != nil {
+				return err
+			}
+			if dx.info.Built, err = ix.BuildTimes(); err != nil {
+				return err
+			}
+		} else if m != dx.info.Normalization {
+			return fmt.Errorf("index %s: shards normalized differently", file)
+		}
+		dx.info.NumNames += ix.NumNames()
+		dx.info.Quadgrams = dx.info.Quadgrams || ix.HasQuadgrams()
+		dx.info.History = dx.info.History || ix.GitRepo() != ""
+		gz, err := ix.GzippedNames()
+		if err != nil {
+			return err
+		}
+		dx.info.Gzipped = append(dx.info.Gzipped, gz...)
+		dx.info.Stats = (i == 0 || dx.info.Stats) && ix.HasStats()
+		if dx.info.Stats {
+			un, err := ix.UnstattedNames()
+			if err != nil {
+				return err
+			}
+			dx.info.Unstatted = append(dx.info.Unstatted, un...)
+		}
+	}
+	sort.Strings(dx.info.Gzipped)
+	if !dx.info.Stats {
+		dx.info.Unstatted = nil
+	}
+	sort.Strings(dx.info.Unstatted)
+	built, err := dx.shards[0].Built()
+	if err != nil {
+		return err
+	}
+	d.metrics.opened(file, built)
+	return nil
+}
+
+// close closes the index named file, if it is open.
+func (d *Daemon) close(file string) {
+	dx := d.indexes[file]
+	if dx == nil {
+		return
+	}
+	delete(d.indexes, file)
+	d.metrics.closed(file)
+	// Searches still holding dx finish first, without holding up the
+	// daemon.
+	go func() {
+		dx.mu.Lock()
+		defer dx.mu.Unlock()
+		for _, ix := range dx.shards {
+			ix.Close()
+		}
+	}()
+}
+
+// search returns the names of the files in dx that might match q
+// and pass the filters in opt, adding statistics about the search to
+// st and tracing it under span, and the number of bytes of posting
+// lists it decoded. A search answered from the cache decodes none.
+func (dx *daemonIndex) search(q *Query, opt *SearchOptions, st *SearchStats, span trace.Span) ([]string, int64, error) {
+	if q == nil {
+		return nil, 0, errors.New("search without query")
+	}
+	if dx.info.History {
+		return nil, 0, errors.New("cannot search history index")
+	}
+	var key string
+	if dx.cache != nil {
+		var err error
+		if key, err = cacheKey(q, opt); err != nil {
+			return nil, 0, err
+		}
+		names, ok := dx.cache.get(key)
+		dx.metrics.cached(ok)
+		if span != nil {
+			span.SetAttr("cached", ok)
+		}
+		if ok {
+			st.Candidates += len(names)
+			return names, 0, nil
+		}
+	}
+	var o SearchOptions
+	if opt != nil {
+		o = *opt
+	}
+	o.Stats = st
+	o.Trace = span
+	var names []string
+	var bytes int64
+	for _, ix := range dx.shards {
+		before := ix.PostingBytes()
+		n, err := ix.Search(q, &o)
+		if err != nil {
+			return nil, 0, err
+		}
+		bytes += ix.PostingBytes() - before
+		names = append(names, n...)
+	}
+	if len(dx.shards) > 1 {
+		// Shards partition files by hash, not by name.
+		sort.Strings(names)
+	}
+	if dx.cache != nil {
+		dx.cache.put(key, names)
+	}
+	return names, bytes, nil
+}
+
+// A DaemonClient is a connection to a Daemon.
+type DaemonClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// DialDaemon connects to the daemon listening on the Unix socket named
+// socket.
+func DialDaemon(socket string) (*DaemonClient, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	return &DaemonClient{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the connection to the daemon.
+func (c *DaemonClient) Close() error {
+	return c.conn.Close()
+}
+
+// Info returns information about the index in the named file,
+// which the daemon opens if needed.
+func (c *DaemonClient) Info(file string) (*DaemonInfo, error) {
+	resp, err := c.call(&daemonRequest{Op: "info", Index: file})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Info == nil {
+		return nil, fmt.Errorf("daemon: no info for %s", file)
+	}
+	return resp.Info, nil
+}
+
+// Search returns the names of the files in the index in the named file
+// that might match q and pass the filters in opt, which may be nil,
+// as by Index.Search.
+func (c *DaemonClient) Search(file string, q *Query, opt *SearchOptions) ([]string, error) {
+	resp, err := c.call(&daemonRequest{Op: "search", Index: file, Query: q, Options: opt})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Names, nil
+}
+
+// call sends req to the daemon and returns its response.
+func (c *DaemonClient) call(req *daemonRequest) (*daemonResponse, error) {
+	if req.Index != "" && !filepath.IsAbs(req.Index) {
+		abs, err := filepath.Abs(req.Index)
+		if err != nil {
+			return nil, err
+		}
+		req.Index = abs
+	}
+	if err := writeFrame(c.conn, req); err != nil {
+		return nil, err
+	}
+	var resp daemonResponse
+	if err := readFrame(c.r, &resp); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("daemon: %w", err)
+	}
+	if resp.Err != "" {
+		return nil, fmt.Errorf("daemon: %s", resp.Err)
+	}
+	return &resp, nil
+}
+
+// writeFrame writes v to w as a frame.
+func writeFrame(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	_, err = w.Write(append(buf, data...))
+	return err
+}
+
+// readFrame reads a frame from r into v.
+// It returns io.EOF if r is at the end of its input.
+func readFrame(r io.Reader, v interface{}) error {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated frame")
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n > maxFrame {
+		return fmt.Errorf("frame of %d bytes too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"sync"
+	"testing"
+)
+
+func TestDaemon(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go new(Daemon).Serve(l)
+	c, err := DialDaemon(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	info, err := c.Info(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range info.Built {
+		if !b.Equal(testBuildTime) {
+			t.Errorf("Info.Built = %v, want %v", info.Built, testBuildTime)
+			break
+		}
+	}
+	if len(info.Built) != len(mergePaths1) {
+		t.Errorf("Info.Built = %v, want %d times", info.Built, len(mergePaths1))
+	}
+	info.Built = nil
+	want := DaemonInfo{Paths: mergePaths1, NumNames: len(mergeFiles1)}
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("Info = %+v, want %+v", *info, want)
+	}
+
+	re, err := syntax.Parse("now", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := RegexpQuery(re)
+	tests := []struct {
+		opt  *SearchOptions
+		want []string
+	}{
+		{nil, []string{"/b/xx", "/c/de"}},
+		{&SearchOptions{Prefix: "/c/"}, []string{"/c/de"}},
+		{&SearchOptions{Prefix: "/a/"}, nil},
+	}
+	for _, tt := range tests {
+		names, err := c.Search(out, q, tt.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("Search(%q, %+v) = %q, want %q", q, tt.opt, names, tt.want)
+		}
+	}
+
+	// Replacing the index, as cindex does, must reopen it.
+	buildIndex(t, out+"~", mergePaths2, mergeFiles2)
+	if err := os.Rename(out+"~", out); err != nil {
+		t.Fatal(err)
+	}
+	names, err := c.Search(out, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/b/xx", "/b/yy"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Search after rebuild = %q, want %q", names, want)
+	}
+
+	if _, err := c.Search(filepath.Join(dir, "missing"), q, nil); err == nil {
+		t.Error("Search of missing index succeeded")
+	}
+}
+
+func TestDaemonConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+	re, err := syntax.Parse("now", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := RegexpQuery(re)
+	want1, want2 := []string{"/b/xx", "/c/de"}, []string{"/b/xx", "/b/yy"}
+
+	// Searches run while the index is replaced, reopened, and closed
+	// under them, and see one index or the other.
+	d := &Daemon{CacheSize: 10}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				resp := d.handle(&daemonRequest{Op: "search", Index: out, Query: q})
+				if resp.Err != "" {
+					t.Error(resp.Err)
+					return
+				}
+				if !reflect.DeepEqual(resp.Names, want1) && !reflect.DeepEqual(resp.Names, want2) {
+					t.Errorf("search = %q, want %q or %q", resp.Names, want1, want2)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		paths, files := mergePaths1, mergeFiles1
+		if i%2 == 0 {
+			paths, files = mergePaths2, mergeFiles2
+		}
+		buildIndex(t, out+"~", paths, files)
+		if err := os.Rename(out+"~", out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorrupt matches, with errors.Is, every *IndexError.
+var ErrCorrupt = errors.New("corrupt index")
+
+// ErrClosed is returned, wrapped, by reads of an index after Close.
+var ErrClosed = errors.New("index closed")
+
+// ErrVersion is returned, wrapped, when opening an index in a format
+// this package does not know, such as one written by a newer version.
+var ErrVersion = errors.New("unknown index format")
+
+// Kinds of corruption, reported as the Err of an *IndexError.
+var (
+	ErrTruncated = errors.New("truncated")
+	ErrBadVarint = errors.New("bad varint")
+	ErrFileID    = errors.New("file ID out of range")
+	ErrMalformed = errors.New("malformed")
+)
+
+// An IndexError reports that an index is corrupt: the data at Offset,
+// in the named section of the index, cannot be read. For a compressed
+// index, the offsets in the "seek table" and "compressed block"
+// sections are in the compressed file, and all others are in the
+// decompressed data.
+type IndexError struct {
+	File    string // index file or URL, if known
+	Section string // part of the index, such as "posting list", if known
+	Offset  int64  // byte offset of the bad data in the index
+	Err     error  // ErrTruncated, ErrBadVarint, ErrFileID, ErrMalformed, or another cause
+}
+
+func (e *IndexError) Error() string {
+	s := "corrupt index"
+	if e.File != "" {
+		s += " " + e.File
+	}
+	s += ": "
+	if e.Section != "" {
+		s += e.Section + " "
+	}
+	return s + fmt.Sprintf("at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *IndexError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrCorrupt.
+func (e *IndexError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// ErrInconsistent matches, with errors.Is, every *MergeError.
+var ErrInconsistent = errors.New("inconsistent index")
+
+// A MergeError reports that Merge, Prune, or Upgrade found the files
+// with IDs in [Lo, Hi) in the index File inconsistent with the rest of
+// the merge, as when an index holds files that are not under any of its
+// paths or not in order. File is a source index, or for an error in the
+// merge itself, the index being written.
+type MergeError struct {
+	File   string
+	Lo, Hi uint32
+	Reason string
+}
+
+func (e *MergeError) Error() string {
+	ids := fmt.Sprintf("file %d", e.Lo)
+	if e.Hi > e.Lo+1 {
+		ids = fmt.Sprintf("files %d-%d", e.Lo, e.Hi-1)
+	}
+	return fmt.Sprintf("merge: inconsistent index %s: %s: %s", e.File, ids, e.Reason)
+}
+
+// Is reports whether target is ErrInconsistent.
+func (e *MergeError) Is(target error) bool {
+	return target == ErrInconsistent
+}
+
+// corrupt returns an *IndexError for the data at off in the named section.
+func (ix *Index) corrupt(section string, off uint32, err error) error {
+	return &IndexError{File: ix.file, Section: section, Offset: int64(off), Err: err}
+}
+
+// inSection returns err, recording the file and section in it if it is
+// an *IndexError that does not yet record them. Low-level reads report
+// only offsets; their callers know what they were reading.
+func (ix *Index) inSection(section string, err error) error {
+	var e *IndexError
+	if errors.As(err, &e) {
+		if e.File == "" {
+			e.File = ix.file
+		}
+		if e.Section == "" {
+			e.Section = section
+		}
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Plan explains how a Query is evaluated against an index.
+// It mirrors the structure of the query, annotating each trigram with
+// the size of its posting list and each node with an estimate of the
+// number of candidate files it yields.
+type Plan struct {
+	Op       QueryOp
+	Trigram  []TrigramCount
+	Sub      []*Plan
+	Estimate int // estimated number of candidate files
+}
+
+// A TrigramCount records the number of files containing a trigram
+// (or quadgram).
+type TrigramCount struct {
+	Trigram string
+	Count   int
+}
+
+// Explain returns the plan for evaluating q against the index.
+//
+// The estimates are upper bounds computed from posting list sizes alone,
+// without reading the lists: an AND yields at most as many files as its
+// smallest operand and an OR at most the sum of its operands.
+func (ix *Index) Explain(q *Query) (*Plan, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	p := &Plan{Op: q.Op}
+	switch q.Op {
+	case QNone:
+		return p, nil
+	case QAll:
+		p.Estimate = ix.numName
+		return p, nil
+	}
+	est := 0
+	if q.Op == QAnd {
+		est = ix.numName
+	}
+	combine := func(n int) {
+		if q.Op == QAnd {
+			if n < est {
+				est = n
+			}
+		} else {
+			if est += n; est > ix.numName {
+				est = ix.numName
+			}
+		}
+	}
+	for _, t := range q.Trigram {
+		count, err := ix.gramCount(t)
+		if err != nil {
+			return nil, err
+		}
+		p.Trigram = append(p.Trigram, TrigramCount{t, count})
+		combine(count)
+	}
+	for _, sub := range q.Sub {
+		sp, err := ix.Explain(sub)
+		if err != nil {
+			return nil, err
+		}
+		p.Sub = append(p.Sub, sp)
+		combine(sp.Estimate)
+	}
+	p.Estimate = est
+	return p, nil
+}
+
+// String returns an indented, multi-line rendering of the plan.
+func (p *Plan) String() string {
+	var b strings.Builder
+	p.format(&b, "")
+	return b.String()
+}
+
+func (p *Plan) format(b *strings.Builder, indent string) {
+	switch p.Op {
+	case QAll:
+		fmt.Fprintf(b, "%sall: %d files (no trigrams required; every file is searched)\n", indent, p.Estimate)
+		return
+	case QNone:
+		fmt.Fprintf(b, "%snone: 0 files (regexp cannot match)\n", indent)
+		return
+	}
+	op := "and"
+	if p.Op == QOr {
+		op = "or"
+	}
+	fmt.Fprintf(b, "%s%s: ~%d files\n", indent, op, p.Estimate)
+	indent += "  "
+	for _, t := range p.Trigram {
+		fmt.Fprintf(b, "%s%s: %d files\n", indent, strconv.Quote(t.Trigram), t.Count)
+	}
+	for _, sub := range p.Sub {
+		sub.format(b, indent)
+	}
+}
@@ -0,0 +1,680 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andrewarchi/codesearch/lang"
+	"github.com/andrewarchi/codesearch/norm"
+)
+
+// Dump format.
+//
+// Export writes an index as a dump: a sequence of JSON objects, one per
+// line, that scripts can inspect, compare, and transform, and that
+// Import turns back into an index. The lines are, in order:
+//
+//	{"format":"csearch dump","version":1,"quadgrams":true,"meta":{"tool":"cindex"}}
+//	{"path":"/home/rsc/src","built":"2020-09-13T12:26:40Z"}  for each indexed path
+//	{"exclude":"vendor/**"}                                  for each exclude pattern
+//	{"file":0,"name":"/home/rsc/src/x.go","lang":"go"}       for each file
+//	{"trigram":"616263","files":[0,3,4]}                     for each trigram
+//	{"quadgram":"61626364","files":[3]}                      for each quadgram
+//
+// Paths and file names are sorted, and files are numbered from 0 in
+// order. The "lang" field is omitted for files of unknown language, and
+// the "truncated" field, set for files of which only the start was
+// indexed (see Writer.HeadBytes), is omitted for the others, as is the
+// "gzip" field, set for files indexed decompressed (see Writer.Gunzip),
+// and the "class" field, naming the class of a file that is generated,
+// minified, or vendored (see Writer.Classify). The "size" and "mtime"
+// fields give the size and modification time of a file when indexed
+// (see Index.FileStat), if known.
+// Trigrams and quadgrams are written in hexadecimal, since they need
+// not be valid UTF-8, and appear in increasing order, each with the
+// sorted IDs of the files containing it. The "quadgrams" field of the
+// first line is set for indexes with quadgrams (see Writer.Quadgrams),
+// and only those have quadgram lines. The "normalize" field names the
+// normalization of the indexed text (see Writer.Normalize), if any,
+// and its "meta" field holds the metadata of the index (see
+// Writer.Metadata). The "built" field of a path line gives the time the
+// path was indexed (see Index.BuildTimes), if known, and its "repo" and
+// "branch" fields name the repository holding it (see Writer.AddRepos).
+// Import accepts trigrams and quadgrams with no files, and ignores them.
+
+const (
+	dumpFormat  = "csearch dump"
+	dumpVersion = 1
+)
+
+// A dumpLine is one line of a dump. Only the fields of its kind are set.
+type dumpLine struct {
+	Format    string            `json:"format,omitempty"`
+	Version   int               `json:"version,omitempty"`
+	Quadgrams bool              `json:"quadgrams,omitempty"`
+	Normalize string            `json:"normalize,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	Path      *string           `json:"path,omitempty"`
+	Built     string            `json:"built,omitempty"`
+	Repo      *string           `json:"repo,omitempty"`
+	Branch    string            `json:"branch,omitempty"`
+	Exclude   *string           `json:"exclude,omitempty"`
+	File      *uint32           `json:"file,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Lang      string            `json:"lang,omitempty"`
+	Truncated bool              `json:"truncated,omitempty"`
+	Gzip      bool              `json:"gzip,omitempty"`
+	Class     string            `json:"class,omitempty"`
+	Size      int64             `json:"size,omitempty"`
+	Mtime     string            `json:"mtime,omitempty"`
+	Trigram   string            `json:"trigram,omitempty"`
+	Quadgram  string            `json:"quadgram,omitempty"`
+	Files     []uint32          `json:"files,omitempty"`
+}
+
+// Export writes the index to w as a dump, as described above.
+// It fails if a path or file name is not valid UTF-8,
+// which JSON cannot represent.
+func (ix *Index) Export(w io.Writer) error {
+	if err := ix.acquire(); err != nil {
+		return err
+	}
+	defer ix.release()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	header := dumpLine{Format: dumpFormat, Version: dumpVersion, Quadgrams: ix.HasQuadgrams()}
+	mode, err := ix.Normalization()
+	if err != nil {
+		return err
+	}
+	if mode != norm.None {
+		header.Normalize = mode.String()
+	}
+	if header.Meta, err = ix.Metadata(); err != nil {
+		return err
+	}
+	for k, v := range header.Meta {
+		if !utf8.ValidString(k) || !utf8.ValidString(v) {
+			return fmt.Errorf("export: metadata %q=%q is not UTF-8", k, v)
+		}
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	paths, err := ix.Paths()
+	if err != nil {
+		return err
+	}
+	times, err := ix.BuildTimes()
+	if err != nil {
+		return err
+	}
+	repos, err := ix.Repos()
+	if err != nil {
+		return err
+	}
+	repoOf := make(map[string]Repo)
+	for _, r := range repos {
+		repoOf[r.Path] = r
+	}
+	for i, p := range paths {
+		if !utf8.ValidString(p) {
+			return fmt.Errorf("export: path %q is not UTF-8", p)
+		}
+		line := dumpLine{Path: &p}
+		if times != nil && !times[i].IsZero() {
+			line.Built = times[i].UTC().Format(time.RFC3339Nano)
+		}
+		if r, ok := repoOf[p]; ok {
+			if !utf8.ValidString(r.Name) || !utf8.ValidString(r.Branch) {
+				return fmt.Errorf("export: repository %q of %s is not UTF-8", r.Name, p)
+			}
+			line.Repo, line.Branch = &r.Name, r.Branch
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	excludes, err := ix.Excludes()
+	if err != nil {
+		return err
+	}
+	for _, x := range excludes {
+		if err := enc.Encode(dumpLine{Exclude: &x}); err != nil {
+			return err
+		}
+	}
+	truncated, err := truncatedSet(ix)
+	if err != nil {
+		return err
+	}
+	gzipped, err := gzipSet(ix)
+	if err != nil {
+		return err
+	}
+	classes, err := classMap(ix)
+	if err != nil {
+		return err
+	}
+	for id := uint32(0); id < uint32(ix.numName); id++ {
+		name, err := ix.Name(id)
+		if err != nil {
+			return err
+		}
+		if !utf8.ValidString(name) {
+			return fmt.Errorf("export: file name %q is not UTF-8", name)
+		}
+		l, err := ix.Lang(id)
+		if err != nil {
+			return err
+		}
+		line := dumpLine{File: &id, Name: name, Truncated: truncated[id], Gzip: gzipped[id]}
+		if l != lang.Unknown {
+			line.Lang = l.String()
+		}
+		if c, ok := classes[id]; ok {
+			line.Class = c.String()
+		}
+		st, err := ix.FileStat(id)
+		if err != nil {
+			return err
+		}
+		if st != nil {
+			line.Size, line.Mtime = st.Size, st.ModTime.UTC().Format(time.RFC3339Nano)
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	var buf [4]byte
+	for i := 0; i < ix.NumTrigrams(); i++ {
+		info, err := ix.TrigramAt(i)
+		if err != nil {
+			return err
+		}
+		files, err := ix.PostingList(info.Trigram)
+		if err != nil {
+			return err
+		}
+		buf[0], buf[1], buf[2] = byte(info.Trigram>>16), byte(info.Trigram>>8), byte(info.Trigram)
+		if err := enc.Encode(dumpLine{Trigram: hex.EncodeToString(buf[:3]), Files: files}); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < ix.numQuad(); i++ {
+		quad, _, _, err := ix.quadAt(i)
+		if err != nil {
+			return err
+		}
+		var r postReader
+		if err := r.initQuad(ix, quad, nil); err != nil {
+			return err
+		}
+		files, err := r.list()
+		if err != nil {
+			return err
+		}
+		buf[0], buf[1], buf[2], buf[3] = byte(quad>>24), byte(quad>>16), byte(quad>>8), byte(quad)
+		if err := enc.Encode(dumpLine{Quadgram: hex.EncodeToString(buf[:]), Files: files}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Import creates a new index in the file dst from the dump read from r,
+// as written by Export. If the dump is malformed, Import removes dst
+// and returns an error giving the line at fault.
+func Import(dst string, r io.Reader) error {
+	im := importer{dec: json.NewDecoder(bufio.NewReader(r))}
+	err := im.run(dst)
+	im.cleanup()
+	if err != nil {
+		os.Remove(dst)
+		if im.line > 0 {
+			err = fmt.Errorf("import: line %d: %w", im.line, err)
+		}
+	}
+	return err
+}
+
+// Stages of an import, in the order the lines of a dump must appear.
+const (
+	stageHeader = iota
+	stagePath
+	stageExclude
+	stageFile
+	stageTrigram
+	stageQuadgram
+)
+
+// An importer holds the state of an Import.
+type importer struct {
+	dec   *json.Decoder
+	line  int
+	stage int
+
+	out       *bufWriter
+	nameIndex *bufWriter
+	langData  *bufWriter
+	statData  *bufWriter
+	quadData  *bufWriter
+	post      postDataWriter
+	quad      postDataWriter
+	temps     []*bufWriter
+
+	off       [6]uint32 // offsets for the trailer
+	excludes  []string
+	truncated []uint32
+	gzipped   []uint32
+	classes   []FileClass
+	stats     bool // some file has a size and time
+	meta      map[string]string
+	built     []time.Time // build time of each path
+	repos     []Repo
+	lastPath  string
+	lastName  string
+	numName   uint32
+	hasQuad   bool
+	mode      norm.Mode // normalization of the indexed text
+	lastGram  uint32
+	anyGram   bool // whether lastGram is set in this stage
+}
+
+func (im *importer) run(dst string) error {
+	var err error
+	if im.out, err = bufCreate(dst); err != nil {
+		return err
+	}
+	if im.nameIndex, err = im.temp(); err != nil {
+		return err
+	}
+	if im.langData, err = im.temp(); err != nil {
+		return err
+	}
+	if im.statData, err = im.temp(); err != nil {
+		return err
+	}
+	if err := im.out.writeString(magic); err != nil {
+		return err
+	}
+	im.off[0] = im.out.offset()
+	for {
+		var l dumpLine
+		err := im.dec.Decode(&l)
+		if err == io.EOF {
+			break
+		}
+		im.line++
+		if err != nil {
+			return err
+		}
+		if err := im.add(&l); err != nil {
+			return err
+		}
+	}
+	if im.stage == stageHeader {
+		return errors.New("import: missing header")
+	}
+	im.line = 0
+	if err := im.advance(stageQuadgram + 1); err != nil {
+		return err
+	}
+	return im.finish()
+}
+
+// temp returns a new temporary file, to be removed by cleanup.
+func (im *importer) temp() (*bufWriter, error) {
+	b, err := bufCreateTemp("")
+	if err != nil {
+		return nil, err
+	}
+	im.temps = append(im.temps, b)
+	return b, nil
+}
+
+func (im *importer) cleanup() {
+	if im.out != nil {
+		im.out.file.Close()
+	}
+	for _, b := range im.temps {
+		b.file.Close()
+		os.Remove(b.name)
+	}
+}
+
+// add adds the dump line l.
+func (im *importer) add(l *dumpLine) error {
+	switch {
+	case l.Format != "":
+		if im.stage != stageHeader {
+			return errors.New("unexpected header")
+		}
+		if l.Format != dumpFormat || l.Version != dumpVersion {
+			return fmt.Errorf("unknown dump format %q version %d", l.Format, l.Version)
+		}
+		im.hasQuad = l.Quadgrams
+		im.meta = l.Meta
+		if l.Normalize != "" {
+			if err := im.mode.Set(l.Normalize); err != nil {
+				return err
+			}
+		}
+		im.stage = stagePath
+		return nil
+	case im.stage == stageHeader:
+		return errors.New("missing header")
+
+	case l.Path != nil:
+		if err := im.advance(stagePath); err != nil {
+			return err
+		}
+		p := *l.Path
+		if p == "" || p <= im.lastPath || strings.Contains(p, "\x00") {
+			return fmt.Errorf("invalid or unsorted path %q", p)
+		}
+		im.lastPath = p
+		var built time.Time
+		if l.Built != "" {
+			var err error
+			if built, err = time.Parse(time.RFC3339Nano, l.Built); err != nil {
+				return fmt.Errorf("invalid build time %q", l.Built)
+			}
+		}
+		im.built = append(im.built, built)
+		if l.Repo != nil {
+			im.repos = append(im.repos, Repo{p, *l.Repo, l.Branch})
+		}
+		if err := im.out.writeString(p); err != nil {
+			return err
+		}
+		return im.out.writeByte('\x00')
+
+	case l.Exclude != nil:
+		if err := im.advance(stageExclude); err != nil {
+			return err
+		}
+		if strings.Contains(*l.Exclude, "\x00") {
+			return fmt.Errorf("invalid exclude pattern %q", *l.Exclude)
+		}
+		im.excludes = append(im.excludes, *l.Exclude)
+		return nil
+
+	case l.File != nil:
+		if err := im.advance(stageFile); err != nil {
+			return err
+		}
+		if *l.File != im.numName {
+			return fmt.Errorf("file %d out of order, want %d", *l.File, im.numName)
+		}
+		if l.Name == "" || l.Name <= im.lastName || strings.Contains(l.Name, "\x00") {
+			return fmt.Errorf("invalid or unsorted file name %q", l.Name)
+		}
+		id := lang.Unknown
+		if l.Lang != "" {
+			var ok bool
+			if id, ok = lang.Lookup(l.Lang); !ok {
+				return fmt.Errorf("unknown language %q", l.Lang)
+			}
+		}
+		if l.Truncated {
+			im.truncated = append(im.truncated, im.numName)
+		}
+		if l.Gzip {
+			im.gzipped = append(im.gzipped, im.numName)
+		}
+		if l.Class != "" {
+			c, ok := lang.LookupClass(l.Class)
+			if !ok {
+				return fmt.Errorf("unknown class %q", l.Class)
+			}
+			if c != lang.Normal {
+				im.classes = append(im.classes, FileClass{im.numName, c})
+			}
+		}
+		var st *FileStat
+		if l.Mtime != "" {
+			t, err := time.Parse(time.RFC3339Nano, l.Mtime)
+			if err != nil || t.UnixNano() == 0 {
+				return fmt.Errorf("invalid modification time %q", l.Mtime)
+			}
+			st = &FileStat{Size: l.Size, ModTime: t}
+			im.stats = true
+		}
+		if err := writeStat(im.statData, st); err != nil {
+			return err
+		}
+		im.lastName = l.Name
+		im.numName++
+		if err := im.nameIndex.writeUint32(im.out.offset() - im.off[1]); err != nil {
+			return err
+		}
+		if err := im.langData.writeByte(byte(id)); err != nil {
+			return err
+		}
+		if err := im.out.writeString(l.Name); err != nil {
+			return err
+		}
+		return im.out.writeByte('\x00')
+
+	case l.Trigram != "":
+		if err := im.advance(stageTrigram); err != nil {
+			return err
+		}
+		t, err := parseGram(l.Trigram, 3)
+		if err != nil {
+			return err
+		}
+		return im.addList(&im.post, t, l.Files)
+
+	case l.Quadgram != "":
+		if !im.hasQuad {
+			return errors.New("quadgram in dump without quadgrams")
+		}
+		if err := im.advance(stageQuadgram); err != nil {
+			return err
+		}
+		q, err := parseGram(l.Quadgram, 4)
+		if err != nil {
+			return err
+		}
+		return im.addList(&im.quad, q, l.Files)
+	}
+	return errors.New("unrecognized line")
+}
+
+// advance moves the import to the given stage, finishing the
+// sections of the stages in between.
+func (im *importer) advance(stage int) error {
+	if stage < im.stage {
+		return errors.New("line out of order")
+	}
+	for im.stage < stage {
+		switch im.stage {
+		case stagePath:
+			if err := im.out.writeByte('\x00'); err != nil {
+				return err
+			}
+			im.off[1] = im.out.offset()
+		case stageFile:
+			// The name list ends with an empty name.
+			if err := im.nameIndex.writeUint32(im.out.offset() - im.off[1]); err != nil {
+				return err
+			}
+			if err := im.out.writeByte('\x00'); err != nil {
+				return err
+			}
+			im.off[2] = im.out.offset()
+			if err := im.post.init(im.out, ""); err != nil {
+				return err
+			}
+			im.temps = append(im.temps, im.post.postIndexFile)
+			skips, err := newSkipWriter("")
+			if err != nil {
+				return err
+			}
+			im.post.skips = skips
+			im.temps = append(im.temps, skips.data, skips.index)
+		case stageTrigram:
+			var err error
+			if im.quadData, err = im.temp(); err != nil {
+				return err
+			}
+			if err := im.quad.init(im.quadData, ""); err != nil {
+				return err
+			}
+			im.temps = append(im.temps, im.quad.postIndexFile)
+			im.quad.quad = true
+		}
+		im.stage++
+		im.anyGram = false
+	}
+	return nil
+}
+
+// addList adds the posting list for gram to w.
+func (im *importer) addList(w *postDataWriter, gram uint32, files []uint32) error {
+	if im.anyGram && gram <= im.lastGram {
+		return errors.New("grams out of order")
+	}
+	im.lastGram, im.anyGram = gram, true
+	w.trigram(gram)
+	for i, id := range files {
+		if id >= im.numName || i > 0 && id <= files[i-1] {
+			return fmt.Errorf("invalid or unsorted file ID %d", id)
+		}
+		if err := w.fileID(id); err != nil {
+			return err
+		}
+	}
+	return w.endTrigram()
+}
+
+// finish writes the indexes, sections, and trailer.
+func (im *importer) finish() error {
+	im.off[3] = im.out.offset()
+	if err := copyFile(im.out, im.nameIndex); err != nil {
+		return err
+	}
+	im.off[4] = im.out.offset()
+	if err := copyFile(im.out, im.post.postIndexFile); err != nil {
+		return err
+	}
+	sections := []section{
+		{"lang", im.langData},
+	}
+	if im.stats {
+		sections = append(sections, section{"stat", im.statData})
+	}
+	if len(im.excludes) > 0 {
+		excludes, err := stringSection("", im.excludes)
+		if err != nil {
+			return err
+		}
+		im.temps = append(im.temps, excludes)
+		sections = append(sections, section{"exclude", excludes})
+	}
+	repos, err := repoSection("", im.repos)
+	if err != nil {
+		return err
+	}
+	if repos != nil {
+		im.temps = append(im.temps, repos)
+		sections = append(sections, section{"repo", repos})
+	}
+	normData, err := normSection("", im.mode)
+	if err != nil {
+		return err
+	}
+	if normData != nil {
+		im.temps = append(im.temps, normData)
+		sections = append(sections, section{"norm", normData})
+	}
+	built, err := builtSection("", im.built)
+	if err != nil {
+		return err
+	}
+	if built != nil {
+		im.temps = append(im.temps, built)
+		sections = append(sections, section{"built", built})
+	}
+	meta, err := metaSection("", im.meta)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		im.temps = append(im.temps, meta)
+		sections = append(sections, section{"meta", meta})
+	}
+	truncated, err := truncatedSection("", im.truncated)
+	if err != nil {
+		return err
+	}
+	if truncated != nil {
+		im.temps = append(im.temps, truncated)
+		sections = append(sections, section{"truncated", truncated})
+	}
+	gzipped, err := gzipSection("", im.gzipped)
+	if err != nil {
+		return err
+	}
+	if gzipped != nil {
+		im.temps = append(im.temps, gzipped)
+		sections = append(sections, section{"gzip", gzipped})
+	}
+	classes, err := classSection("", im.classes)
+	if err != nil {
+		return err
+	}
+	if classes != nil {
+		im.temps = append(im.temps, classes)
+		sections = append(sections, section{"class", classes})
+	}
+	if im.hasQuad {
+		sections = append(sections, section{"quad", im.quadData}, section{"quadindex", im.quad.postIndexFile})
+	}
+	sections = append(sections, im.post.skips.sections()...)
+	sectionIndex, err := writeSections(im.out, sections)
+	if err != nil {
+		return err
+	}
+	im.off[5] = sectionIndex
+	for _, v := range im.off {
+		if err := im.out.writeUint32(v); err != nil {
+			return err
+		}
+	}
+	if err := im.out.writeString(trailerMagic); err != nil {
+		return err
+	}
+	if err := im.out.flush(); err != nil {
+		return err
+	}
+	return im.out.file.Close()
+}
+
+// parseGram parses a trigram or quadgram of n bytes written in hexadecimal.
+func parseGram(s string, n int) (uint32, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != n {
+		return 0, fmt.Errorf("invalid %d-byte gram %q", n, s)
+	}
+	var g uint32
+	for _, c := range b {
+		g = g<<8 | uint32(c)
+	}
+	return g, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var exportFiles = map[string]string{
+	"/src/a/main.go": "package main\n\nfunc main() {}\n",
+	"/src/a/notes":   "some notes about main\n",
+	"/src/b/util.py": "def main(): pass\n",
+	"/src/b/été":     "été à Paris\n",
+}
+
+func TestExportImport(t *testing.T) {
+	for _, quad := range []bool{false, true} {
+		dir := t.TempDir()
+		orig, imported := filepath.Join(dir, "orig"), filepath.Join(dir, "imported")
+		w, err := Create(orig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.start = testBuildTime
+		w.Quadgrams = quad
+		w.Metadata = map[string]string{"created": "2020-09-13T12:26:40Z", "tool": "test"}
+		w.AddPaths([]string{"/src/a", "/src/b"})
+		w.AddRepos([]Repo{{"/src/b", "b", "main"}})
+		for _, name := range []string{"/src/a/main.go", "/src/a/notes", "/src/b/util.py", "/src/b/été"} {
+			w.Add(name, strings.NewReader(exportFiles[name]))
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		ix, err := Open(orig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dump bytes.Buffer
+		if err := ix.Export(&dump); err != nil {
+			t.Fatal(err)
+		}
+		if err := Import(imported, bytes.NewReader(dump.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		ix2, err := Open(imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dump2 bytes.Buffer
+		if err := ix2.Export(&dump2); err != nil {
+			t.Fatal(err)
+		}
+		if dump.String() != dump2.String() {
+			t.Errorf("quad=%v: export of imported index differs:\n%s\nwant:\n%s", quad, dump2.String(), dump.String())
+		}
+		if ix2.HasQuadgrams() != quad {
+			t.Errorf("quad=%v: imported index HasQuadgrams() = %v", quad, ix2.HasQuadgrams())
+		}
+		for _, want := range []string{`"meta":{"created":"2020-09-13T12:26:40Z","tool":"test"}`, `"built":"2020-09-13T12:26:40Z"`, `"repo":"b","branch":"main"`} {
+			if !strings.Contains(dump.String(), want) {
+				t.Errorf("quad=%v: dump missing %s:\n%s", quad, want, dump.String())
+			}
+		}
+		if repos, err := ix2.Repos(); err != nil || !reflect.DeepEqual(repos, []Repo{{"/src/b", "b", "main"}}) {
+			t.Errorf("quad=%v: imported Repos() = %v, %v", quad, repos, err)
+		}
+		if times, err := ix2.BuildTimes(); err != nil || len(times) != 2 || !times[0].Equal(testBuildTime) || !times[1].Equal(testBuildTime) {
+			t.Errorf("quad=%v: imported BuildTimes() = %v, %v, want %v twice", quad, times, err, testBuildTime)
+		}
+		if meta, err := ix2.Metadata(); err != nil || meta["tool"] != "test" {
+			t.Errorf("quad=%v: imported Metadata() = %v, %v", quad, meta, err)
+		}
+		q := &Query{Op: QAnd, Trigram: []string{"mai", "ain"}}
+		if quad {
+			q.Trigram = []string{"main"}
+		}
+		want, _ := ix.PostingQuery(q)
+		got, err := ix2.PostingQuery(q)
+		if err != nil || !equalList(got, want) {
+			t.Errorf("quad=%v: imported PostingQuery(%v) = %v, %v, want %v", quad, q, got, err, want)
+		}
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	const header = `{"format":"csearch dump","version":1}` + "\n"
+	for _, tt := range []struct {
+		dump string
+		err  string
+	}{
+		{``, "missing header"},
+		{`{"path":"/a"}`, "line 1: missing header"},
+		{header + `{"path":"/b"}` + "\n" + `{"path":"/a"}`, "line 3: invalid or unsorted path"},
+		{header + `{"file":0,"name":"/a"}` + "\n" + `{"path":"/a"}`, "line 3: line out of order"},
+		{header + `{"file":1,"name":"/a"}`, "line 2: file 1 out of order"},
+		{header + `{"file":0,"name":"/a","lang":"cobol++"}`, "unknown language"},
+		{header + `{"file":0,"name":"/a"}` + "\n" + `{"trigram":"616263","files":[1]}`, "line 3: invalid or unsorted file ID 1"},
+		{header + `{"trigram":"6162","files":[]}`, "invalid 3-byte gram"},
+		{header + `{"trigram":"616264"}` + "\n" + `{"trigram":"616263"}`, "line 3: grams out of order"},
+		{header + `{"quadgram":"61626364"}`, "quadgram in dump without quadgrams"},
+		{header + `{"name":"/a"}`, "unrecognized line"},
+		{header + `{"path":`, "unexpected EOF"},
+		{header + `{"path":"/a","built":"yesterday"}`, "invalid build time"},
+	} {
+		file := filepath.Join(t.TempDir(), "index")
+		err := Import(file, strings.NewReader(tt.dump))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Import(%q) = %v, want error containing %q", tt.dump, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import "io"
+
+// An Extractor converts files of a format that is not plain text, such
+// as PDF documents, Jupyter notebooks, or protocol buffer descriptors,
+// into the text to index for them.
+//
+// A Writer applies the first of its Extractors whose CanHandle method
+// accepts a file's name to the file as read, before any decompression
+// or decoding, and indexes the text it returns in place of the file's
+// content. The text is then checked like that of any other file, so it
+// must still look like text to be indexed.
+//
+// Searches read files as they are on disk, so a program searching an
+// index built with extractors must convert the files found the same way
+// before matching them, such as by passing the text to regexp.Grep's
+// Reader method.
+type Extractor interface {
+	// CanHandle reports whether the Extractor converts the file
+	// with the given name.
+	CanHandle(name string) bool
+
+	// Extract returns a reader of the text of the file read from r.
+	// If the reader is also an io.Closer, it is closed once read.
+	Extract(r io.Reader) (io.Reader, error)
+}
+
+// extractor returns the first of ix.Extractors to handle the file with
+// the given name, or nil if there is none.
+func (ix *Writer) extractor(name string) Extractor {
+	for _, e := range ix.Extractors {
+		if e.CanHandle(name) {
+			return e
+		}
+	}
+	return nil
+}
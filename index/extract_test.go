@@ -0,0 +1,106 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// notebookExtractor extracts the source of the cells of Jupyter
+// notebooks.
+type notebookExtractor struct {
+	closed int
+}
+
+func (e *notebookExtractor) CanHandle(name string) bool {
+	return strings.HasSuffix(name, ".ipynb")
+}
+
+func (e *notebookExtractor) Extract(r io.Reader) (io.Reader, error) {
+	var nb struct {
+		Cells []struct {
+			Source []string `json:"source"`
+		} `json:"cells"`
+	}
+	if err := json.NewDecoder(r).Decode(&nb); err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	for _, c := range nb.Cells {
+		for _, line := range c.Source {
+			text.WriteString(line)
+		}
+		text.WriteString("\n")
+	}
+	return &closeCounter{strings.NewReader(text.String()), &e.closed}, nil
+}
+
+type closeCounter struct {
+	io.Reader
+	n *int
+}
+
+func (c *closeCounter) Close() error {
+	*c.n++
+	return nil
+}
+
+func TestExtractors(t *testing.T) {
+	nb := &notebookExtractor{}
+	file := filepath.Join(t.TempDir(), "index")
+	ix, err := Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.Extractors = []Extractor{nb}
+	ix.AddPaths([]string{"/a"})
+	files := []struct {
+		name, data string
+	}{
+		{"/a/analysis.ipynb", `{"cells": [{"source": ["import pandas\n", "df = load()"]}], "metadata": {"kernel": "needle"}}`},
+		{"/a/main.py", "import pandas\n"},
+	}
+	for _, f := range files {
+		if err := ix.Add(f.name, strings.NewReader(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.Add("/a/bad.ipynb", strings.NewReader("{")); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Add(bad.ipynb) = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if nb.closed != 1 {
+		t.Errorf("closed %d extracted readers, want 1", nb.closed)
+	}
+
+	r, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, tt := range []struct {
+		trigrams []string
+		want     []string
+	}{
+		// The cells are indexed, and the rest of the notebook is not.
+		{[]string{"pan", "and", "nda", "das"}, []string{"/a/analysis.ipynb", "/a/main.py"}},
+		{[]string{"loa", "oad"}, []string{"/a/analysis.ipynb"}},
+		{[]string{"nee", "eed", "dle"}, nil},
+		{[]string{"cel", "ell"}, nil},
+	} {
+		names, err := r.Search(&Query{Op: QAnd, Trigram: tt.trigrams}, nil)
+		if err != nil || !slices.Equal(names, tt.want) {
+			t.Errorf("Search(%q) = %v, %v, want %v", tt.trigrams, names, err, tt.want)
+		}
+	}
+}
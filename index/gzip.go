@@ -0,0 +1,125 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Gzip-compressed files.
+//
+// A Writer with Gunzip set indexes the decompressed text of each file
+// compressed with gzip, such as a rotated log, rather than skipping it
+// as binary. The "gzip" section lists the IDs of the files indexed
+// that way, in increasing order, each as a 4-byte big-endian number,
+// so that searches know to decompress them too, as zgrep does (see
+// regexp.Grep.Gunzip). Merging keeps the mark of each file from the
+// index that provided it.
+
+// gzipSection returns a temporary file in dir holding the "gzip"
+// section listing ids, or nil if there are none.
+func gzipSection(dir string, ids []uint32) (*bufWriter, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	b, err := bufCreateTemp(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if err := b.writeUint32(id); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// GzippedFiles returns the sorted IDs of the files that were indexed
+// decompressed, as by Writer.Gunzip.
+func (ix *Index) GzippedFiles() ([]uint32, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	d, err := ix.gzipData()
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for i := 0; i < len(d); i += 4 {
+		id := binary.BigEndian.Uint32(d[i:])
+		if id >= uint32(ix.numName) || len(ids) > 0 && id <= ids[len(ids)-1] {
+			return nil, ix.corrupt("gzip", ix.sections["gzip"].off+uint32(i), ErrMalformed)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// GzippedNames returns the sorted names of the files that were indexed
+// decompressed, as by Writer.Gunzip.
+func (ix *Index) GzippedNames() ([]string, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	ids, err := ix.GzippedFiles()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, id := range ids {
+		name, err := ix.Name(id)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Gzipped reports whether the file with the given ID is compressed
+// with gzip and was indexed decompressed, as by Writer.Gunzip.
+func (ix *Index) Gzipped(fileID uint32) (bool, error) {
+	if err := ix.acquire(); err != nil {
+		return false, err
+	}
+	defer ix.release()
+	d, err := ix.gzipData()
+	if err != nil {
+		return false, err
+	}
+	n := len(d) / 4
+	i := sort.Search(n, func(i int) bool {
+		return binary.BigEndian.Uint32(d[4*i:]) >= fileID
+	})
+	return i < n && binary.BigEndian.Uint32(d[4*i:]) == fileID, nil
+}
+
+// gzipSet returns the IDs of the gzipped files of ix, as a set.
+func gzipSet(ix *Index) (map[uint32]bool, error) {
+	ids, err := ix.GzippedFiles()
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[uint32]bool)
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set, nil
+}
+
+// gzipData returns the "gzip" section, or nil if there is none.
+func (ix *Index) gzipData() ([]byte, error) {
+	s, ok := ix.sections["gzip"]
+	if !ok {
+		return nil, nil
+	}
+	if s.size%4 != 0 {
+		return nil, ix.corrupt("gzip", s.off, ErrMalformed)
+	}
+	return ix.sectionSlice("gzip", 0, -1)
+}
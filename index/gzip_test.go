@@ -0,0 +1,123 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/andrewarchi/codesearch/lang"
+)
+
+func gzipString(t *testing.T, s string) string {
+	var b bytes.Buffer
+	z := gzip.NewWriter(&b)
+	if _, err := z.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestGzipped(t *testing.T) {
+	dir := t.TempDir()
+	var skipped []string
+	gunzip := func(ix *Writer) {
+		ix.Gunzip = true
+		ix.OnSkip = func(name string, reason SkipReason) bool {
+			skipped = append(skipped, name+": "+reason.String())
+			return false
+		}
+	}
+	bad := gzipString(t, "needle\n")
+	old := filepath.Join(dir, "old")
+	buildFlushIndex(t, old, []string{"/a"}, false, map[string]string{
+		"/a/bad.gz":   bad[:len(bad)-4],
+		"/a/bad2.gz":  bad[:4],
+		"/a/main.go":  "package main // needle\n",
+		"/a/old.log":  gzipString(t, "started\nneedle found\n"),
+		"/a/x.go.gz":  gzipString(t, "package x // needle\n"),
+		"/a/y.go.txt": "needle\n",
+	}, gunzip)
+	update := filepath.Join(dir, "update")
+	buildFlushIndex(t, update, []string{"/b"}, false, map[string]string{
+		"/b/log.1.gz": gzipString(t, "needle again\n"),
+	}, gunzip)
+	if want := []string{"/a/bad.gz: corrupt gzip data", "/a/bad2.gz: corrupt gzip data"}; !slices.Equal(skipped, want) {
+		t.Errorf("skipped %q, want %q", skipped, want)
+	}
+	merged := filepath.Join(dir, "merged")
+	if err := Merge(merged, old, update); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	imported := filepath.Join(dir, "imported")
+	if ix, err := Open(merged); err != nil {
+		t.Fatal(err)
+	} else {
+		err := ix.Export(&dump)
+		ix.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Import(imported, &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		file    string
+		gzipped []uint32
+	}{
+		{old, []uint32{1, 2}},
+		{update, []uint32{0}},
+		{merged, []uint32{1, 2, 4}},
+		{imported, []uint32{1, 2, 4}},
+	} {
+		ix, err := Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		ids, err := ix.GzippedFiles()
+		if err != nil || !slices.Equal(ids, tt.gzipped) {
+			t.Errorf("%s: GzippedFiles() = %v, %v, want %v", filepath.Base(tt.file), ids, err, tt.gzipped)
+		}
+		for id := uint32(0); id < uint32(ix.NumNames()); id++ {
+			want := slices.Contains(tt.gzipped, id)
+			if gz, err := ix.Gzipped(id); gz != want || err != nil {
+				t.Errorf("%s: Gzipped(%d) = %v, %v, want %v", filepath.Base(tt.file), id, gz, err, want)
+			}
+		}
+		if _, err := ix.Verify(); err != nil {
+			t.Errorf("%s: Verify: %v", filepath.Base(tt.file), err)
+		}
+	}
+
+	// The decompressed text is indexed, and x.go.gz is Go.
+	ix, err := Open(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	names, err := ix.Search(&Query{Op: QAnd, Trigram: []string{"nee", "eed", "dle"}}, nil)
+	want := []string{"/a/main.go", "/a/old.log", "/a/x.go.gz", "/a/y.go.txt", "/b/log.1.gz"}
+	if err != nil || !slices.Equal(names, want) {
+		t.Errorf("Search = %v, %v, want %v", names, err, want)
+	}
+	want = []string{"/a/old.log", "/a/x.go.gz", "/b/log.1.gz"}
+	if names, err := ix.GzippedNames(); err != nil || !slices.Equal(names, want) {
+		t.Errorf("GzippedNames() = %v, %v, want %v", names, err, want)
+	}
+	goID, _ := lang.Lookup("go")
+	if l, err := ix.Lang(2); l != goID || err != nil {
+		t.Errorf("Lang(x.go.gz) = %v, %v, want %v", l, err, goID)
+	}
+}
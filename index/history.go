@@ -0,0 +1,311 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Git history.
+//
+// A history index holds every version of every file reachable from the
+// commits of a git repository, each distinct blob indexed once as a
+// file of its own, along with the files in each commit, so that a
+// search can be restricted to the files of any one commit. Package
+// history builds such indexes. Four sections describe the history:
+//
+// The "gitrepo" section holds the directory of the repository,
+// NUL-terminated.
+//
+// The "gitpaths" section lists, each NUL-terminated, the paths of the
+// files in the repository's trees. Path #0 is the first, and so on.
+//
+// The "gittrees" section holds the file list of each distinct tree:
+//
+//	count [v]
+//	path ID [v], file ID [v]...
+//
+// The entries are sorted by path.
+//
+// The "gitcommits" section is a sequence of entries sorted by commit
+// hash, each giving a commit and the offset of its tree's file list in
+// the "gittrees" section:
+//
+//	hash [20]
+//	offset [4]
+//
+// File IDs in the trees refer to the files of the index as written, and
+// merging renumbers files, so Merge, Prune, and Upgrade refuse history
+// indexes rather than drop these sections. A history index is rebuilt
+// from its repository instead.
+
+const commitEntrySize = 20 + 4
+
+// ErrNoCommit is returned, wrapped, by CommitFiles when the index does
+// not hold the commit.
+var ErrNoCommit = errors.New("commit not in index")
+
+// ErrHistoryMerge is returned, wrapped, by Merge, Prune, and Upgrade
+// when given a history index.
+var ErrHistoryMerge = errors.New("cannot merge a history index")
+
+// A CommitFile is a file in a commit: its path in the repository and
+// the ID of the indexed file holding its contents.
+type CommitFile struct {
+	Path   string
+	FileID uint32
+}
+
+// parseHash parses a hexadecimal SHA-1 commit or tree hash.
+func parseHash(s string) ([20]byte, error) {
+	var h [20]byte
+	if len(s) != 2*len(h) {
+		return h, fmt.Errorf("invalid git hash %q", s)
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("invalid git hash %q", s)
+	}
+	return h, nil
+}
+
+// SetGitRepo records that the index holds the history of the git
+// repository in dir.
+func (ix *Writer) SetGitRepo(dir string) {
+	ix.gitRepo = dir
+}
+
+// NumFiles returns the number of files added to the index so far.
+// Add skips files that cannot be indexed, so after a call to Add,
+// NumFiles reports whether the file was added and, if so, that its
+// file ID is NumFiles()-1.
+func (ix *Writer) NumFiles() int {
+	return ix.numName
+}
+
+// AddTree records the files in the git tree with the given hash.
+// Each file's FileID must name a file already added to the index.
+// Every tree must be added before the commits using it.
+func (ix *Writer) AddTree(tree string, files []CommitFile) error {
+	if _, err := parseHash(tree); err != nil {
+		return err
+	}
+	if _, ok := ix.gitTreeOff[tree]; ok {
+		return nil
+	}
+	if ix.gitTrees == nil {
+		var err error
+		if ix.gitTrees, err = bufCreateTemp(ix.TempDir); err != nil {
+			return err
+		}
+		ix.gitPathID = make(map[string]uint32)
+		ix.gitTreeOff = make(map[string]uint32)
+	}
+	files = append([]CommitFile(nil), files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	ix.gitTreeOff[tree] = ix.gitTrees.offset()
+	if err := ix.gitTrees.writeUvarint(uint32(len(files))); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.FileID >= uint32(ix.numName) {
+			return fmt.Errorf("tree %s: %s: file ID %d out of range", tree, f.Path, f.FileID)
+		}
+		id, ok := ix.gitPathID[f.Path]
+		if !ok {
+			id = uint32(len(ix.gitPaths))
+			ix.gitPathID[f.Path] = id
+			ix.gitPaths = append(ix.gitPaths, f.Path)
+		}
+		if err := ix.gitTrees.writeUvarint(id); err != nil {
+			return err
+		}
+		if err := ix.gitTrees.writeUvarint(f.FileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddCommit records the commit with the given hash, whose files are
+// those of the given tree, which must already have been added.
+func (ix *Writer) AddCommit(commit, tree string) error {
+	h, err := parseHash(commit)
+	if err != nil {
+		return err
+	}
+	off, ok := ix.gitTreeOff[tree]
+	if !ok {
+		return fmt.Errorf("commit %s: tree %s not added", commit, tree)
+	}
+	var e [commitEntrySize]byte
+	copy(e[:], h[:])
+	binary.BigEndian.PutUint32(e[20:], off)
+	ix.gitCommits = append(ix.gitCommits, e)
+	return nil
+}
+
+// historySections returns the sections describing the git history
+// recorded with SetGitRepo, AddTree, and AddCommit, if any.
+// The caller must remove their temporary files.
+func (ix *Writer) historySections() ([]section, error) {
+	if ix.gitRepo == "" {
+		return nil, nil
+	}
+	if ix.gitTrees == nil {
+		var err error
+		if ix.gitTrees, err = bufCreateTemp(ix.TempDir); err != nil {
+			return nil, err
+		}
+	}
+	repo, err := stringSection(ix.TempDir, []string{ix.gitRepo})
+	if err != nil {
+		return nil, err
+	}
+	paths, err := stringSection(ix.TempDir, ix.gitPaths)
+	if err != nil {
+		os.Remove(repo.name)
+		return nil, err
+	}
+	commits, err := bufCreateTemp(ix.TempDir)
+	if err != nil {
+		os.Remove(repo.name)
+		os.Remove(paths.name)
+		return nil, err
+	}
+	sort.Slice(ix.gitCommits, func(i, j int) bool {
+		return bytes.Compare(ix.gitCommits[i][:20], ix.gitCommits[j][:20]) < 0
+	})
+	for i, e := range ix.gitCommits {
+		if i > 0 && bytes.Equal(e[:20], ix.gitCommits[i-1][:20]) {
+			continue
+		}
+		if err := commits.write(e[:]); err != nil {
+			return nil, err
+		}
+	}
+	return []section{
+		{"gitrepo", repo},
+		{"gitpaths", paths},
+		{"gittrees", ix.gitTrees},
+		{"gitcommits", commits},
+	}, nil
+}
+
+// GitRepo returns the directory of the git repository whose history
+// the index holds, or "" if it is not a history index.
+func (ix *Index) GitRepo() string {
+	if ix.acquire() != nil {
+		return ""
+	}
+	defer ix.release()
+	d := ix.section("gitrepo")
+	if i := bytes.IndexByte(d, 0); i >= 0 {
+		return string(d[:i])
+	}
+	return ""
+}
+
+// NumCommits returns the number of commits in a history index.
+func (ix *Index) NumCommits() int {
+	s := ix.sections["gitcommits"]
+	return int(s.size / commitEntrySize)
+}
+
+// CommitFiles returns the files in the commit with the given hash,
+// sorted by path. If the index does not hold the commit, CommitFiles
+// returns an error wrapping ErrNoCommit.
+func (ix *Index) CommitFiles(commit string) ([]CommitFile, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	h, err := parseHash(commit)
+	if err != nil {
+		return nil, err
+	}
+	n := ix.NumCommits()
+	i := sort.Search(n, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var d []byte
+		d, err = ix.sectionSlice("gitcommits", uint32(i*commitEntrySize), 20)
+		return err != nil || bytes.Compare(d, h[:]) >= 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	var e []byte
+	if i < n {
+		if e, err = ix.sectionSlice("gitcommits", uint32(i*commitEntrySize), commitEntrySize); err != nil {
+			return nil, err
+		}
+	}
+	if e == nil || !bytes.Equal(e[:20], h[:]) {
+		return nil, fmt.Errorf("%s: %w", commit, ErrNoCommit)
+	}
+
+	paths, err := ix.sectionSlice("gitpaths", 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	var pathOff []int
+	for i := 0; i < len(paths); {
+		pathOff = append(pathOff, i)
+		j := bytes.IndexByte(paths[i:], 0)
+		if j < 0 {
+			return nil, ix.corrupt("gitpaths", ix.sections["gitpaths"].off+uint32(i), ErrTruncated)
+		}
+		i += j + 1
+	}
+
+	off := binary.BigEndian.Uint32(e[20:])
+	trees, err := ix.sectionSlice("gittrees", off, -1)
+	if err != nil {
+		return nil, err
+	}
+	base := ix.sections["gittrees"].off + off
+	d := trees
+	uvarint := func() (uint32, error) {
+		v, n := binary.Uvarint(d)
+		if n <= 0 || v > 1<<32-1 {
+			return 0, ix.corrupt("gittrees", base+uint32(len(trees)-len(d)), ErrBadVarint)
+		}
+		d = d[n:]
+		return uint32(v), nil
+	}
+	count, err := uvarint()
+	if err != nil {
+		return nil, err
+	}
+	var files []CommitFile
+	for ; count > 0; count-- {
+		pos := base + uint32(len(trees)-len(d))
+		pathID, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		fileID, err := uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if int(pathID) >= len(pathOff) {
+			return nil, ix.corrupt("gittrees", pos, ErrMalformed)
+		}
+		if int(fileID) >= ix.numName {
+			return nil, ix.corrupt("gittrees", pos, ErrFileID)
+		}
+		p := paths[pathOff[pathID]:]
+		p = p[:bytes.IndexByte(p, 0)]
+		files = append(files, CommitFile{string(p), fileID})
+	}
+	return files, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	const (
+		tree1   = "1111111111111111111111111111111111111111"
+		tree2   = "2222222222222222222222222222222222222222"
+		commit1 = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		commit2 = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+		commit3 = "cccccccccccccccccccccccccccccccccccccccc"
+	)
+	out := filepath.Join(t.TempDir(), "index")
+	ix, err := Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct{ name, data string }{
+		{"/repo@01/a.go", "package old\n"},
+		{"/repo@02/a.go", "package new\n"},
+		{"/repo@03/b.txt", "shared text\n"},
+	} {
+		if err := ix.Add(f.name, strings.NewReader(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := ix.NumFiles(); n != 3 {
+		t.Fatalf("NumFiles() = %d, want 3", n)
+	}
+	files1 := []CommitFile{{"b.txt", 2}, {"a.go", 0}}
+	files2 := []CommitFile{{"a.go", 1}, {"b.txt", 2}, {"c/b.txt", 2}}
+	if err := ix.AddTree(tree1, files1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.AddTree(tree2, files2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.AddTree(tree2, []CommitFile{{"x", 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.AddTree("xyz", nil); err == nil {
+		t.Error("AddTree with bad hash succeeded")
+	}
+	for _, c := range [][2]string{{commit2, tree2}, {commit1, tree1}, {commit3, tree2}} {
+		if err := ix.AddCommit(c[0], c[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.AddCommit(commit1, "3333333333333333333333333333333333333333"); err == nil {
+		t.Error("AddCommit with unknown tree succeeded")
+	}
+	ix.SetGitRepo("/repo")
+	ix.AddPaths([]string{"/repo"})
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo := r.GitRepo(); repo != "/repo" {
+		t.Errorf("GitRepo() = %q, want /repo", repo)
+	}
+	if n := r.NumCommits(); n != 3 {
+		t.Errorf("NumCommits() = %d, want 3", n)
+	}
+	want := map[string][]CommitFile{
+		commit1: {{"a.go", 0}, {"b.txt", 2}},
+		commit2: files2,
+		commit3: files2,
+	}
+	for commit, want := range want {
+		got, err := r.CommitFiles(commit)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("CommitFiles(%s) = %v, %v, want %v", commit, got, err, want)
+		}
+	}
+	if _, err := r.CommitFiles("dddddddddddddddddddddddddddddddddddddddd"); !errors.Is(err, ErrNoCommit) {
+		t.Errorf("CommitFiles(unknown) = %v, want ErrNoCommit", err)
+	}
+
+	// Merging would drop the history, so it is refused.
+	other := filepath.Join(t.TempDir(), "other")
+	buildIndex(t, other, []string{"/src"}, exportFiles)
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := Merge(dst, other, out); !errors.Is(err, ErrHistoryMerge) {
+		t.Errorf("Merge = %v, want ErrHistoryMerge", err)
+	}
+	if _, err := Prune(dst, out, func(string) bool { return true }); !errors.Is(err, ErrHistoryMerge) {
+		t.Errorf("Prune = %v, want ErrHistoryMerge", err)
+	}
+	if err := Upgrade(dst, out); !errors.Is(err, ErrHistoryMerge) {
+		t.Errorf("Upgrade = %v, want ErrHistoryMerge", err)
+	}
+
+	buildIndex(t, out, []string{"/src"}, exportFiles)
+	if r, err = Open(out); err != nil {
+		t.Fatal(err)
+	}
+	if repo := r.GitRepo(); repo != "" {
+		t.Errorf("GitRepo() = %q for index without history", repo)
+	}
+	if _, err := r.CommitFiles(commit1); !errors.Is(err, ErrNoCommit) {
+		t.Errorf("CommitFiles in index without history = %v, want ErrNoCommit", err)
+	}
+}
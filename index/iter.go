@@ -0,0 +1,116 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// A PostingIterator reads a posting list one file ID at a time,
+// decoding it as it goes, so that callers can combine posting lists
+// lazily instead of materializing them with PostingList.
+//
+// For example, to intersect the posting lists of two trigrams:
+//
+//	a, b := ix.Postings(t1), ix.Postings(t2)
+//	id, ok := a.Next()
+//	for ok {
+//		id2, ok2 := b.Seek(id)
+//		if !ok2 {
+//			break
+//		}
+//		if id2 == id {
+//			use(id)
+//			id, ok = a.Next()
+//		} else {
+//			id, ok = a.Seek(id2)
+//		}
+//	}
+//
+// followed by checking a.Err() and b.Err().
+type PostingIterator struct {
+	r       postReader
+	len     int
+	cur     uint32
+	started bool
+	done    bool
+	err     error
+}
+
+// Postings returns an iterator over the posting list for trigram.
+func (ix *Index) Postings(trigram uint32) *PostingIterator {
+	it := new(PostingIterator)
+	if err := ix.acquire(); err != nil {
+		it.err, it.done = err, true
+		return it
+	}
+	defer ix.release()
+	if err := it.r.init(ix, trigram, nil); err != nil {
+		it.err = err
+	}
+	it.len = it.r.max()
+	if it.len == 0 {
+		it.done = true
+	}
+	return it
+}
+
+// Len returns the number of file IDs in the posting list.
+func (it *PostingIterator) Len() int {
+	return it.len
+}
+
+// Next advances to the next file ID in the posting list and returns it.
+// It returns ok == false at the end of the list or after an error.
+func (it *PostingIterator) Next() (fileID uint32, ok bool) {
+	if it.done {
+		return 0, false
+	}
+	if err := it.r.ix.acquire(); err != nil {
+		it.err, it.done = err, true
+		return 0, false
+	}
+	defer it.r.ix.release()
+	ok, err := it.r.next()
+	if err != nil {
+		it.err = err
+	}
+	if !ok {
+		it.done = true
+		return 0, false
+	}
+	it.cur = it.r.fileID
+	it.started = true
+	return it.cur, true
+}
+
+// Seek advances to the first file ID in the posting list greater than
+// or equal to fileID and returns it. If the iterator is already at such
+// a file ID, Seek returns it without advancing. It returns ok == false
+// if there is no such file ID or after an error. Seek skips over long
+// stretches of the list without decoding them, where the index records
+// skip entries for the list.
+func (it *PostingIterator) Seek(fileID uint32) (uint32, bool) {
+	if it.started && !it.done && it.cur >= fileID {
+		return it.cur, true
+	}
+	if it.done {
+		return 0, false
+	}
+	if err := it.r.ix.acquire(); err != nil {
+		it.err, it.done = err, true
+		return 0, false
+	}
+	it.r.seek(fileID)
+	it.r.ix.release()
+	for {
+		id, ok := it.Next()
+		if !ok || id >= fileID {
+			return id, ok
+		}
+	}
+}
+
+// Err returns the first error encountered while reading the posting
+// list, if any.
+func (it *PostingIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"errors"
+	"os"
+)
+
+// Index locking.
+//
+// Processes writing an index serialize on an advisory lock held on a
+// separate lock file next to the index. Readers need not take the lock:
+// writers build the new index under a temporary name and rename it into
+// place, so a reader sees either the old index or the new one.
+
+// ErrLocked is returned by LockIndex when another process holds the lock.
+var ErrLocked = errors.New("index is locked by another process")
+
+// LockFile returns the name of the lock file for the index file.
+func LockFile(file string) string {
+	return file + ".lock"
+}
+
+// A Lock is a held index lock.
+type Lock struct {
+	f *os.File
+}
+
+// LockIndex acquires the write lock for the index file, creating the
+// lock file if needed. If another process holds the lock, LockIndex
+// waits for it to be released if wait is true, and otherwise returns
+// ErrLocked.
+func LockIndex(file string, wait bool) (*Lock, error) {
+	f, err := os.OpenFile(LockFile(file), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, true, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f}, nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	err := unlockFile(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// WaitUnlocked waits until no process holds the write lock for the
+// index file. It returns immediately if the index has no lock file.
+func WaitUnlocked(file string) error {
+	f, err := os.Open(LockFile(file))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f, false, true); err != nil {
+		return err
+	}
+	return unlockFile(f)
+}
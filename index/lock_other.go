@@ -0,0 +1,21 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || freebsd || linux || netbsd || openbsd || windows)
+
+package index
+
+import "os"
+
+// On systems without file locks, such as js/wasm, wasip1, and plan9,
+// locking an index does nothing, so concurrent writers of the same
+// index are not serialized.
+
+func lockFile(f *os.File, exclusive, wait bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
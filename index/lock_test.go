@@ -0,0 +1,60 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLockIndex(t *testing.T) {
+	switch runtime.GOOS {
+	case "darwin", "freebsd", "linux", "netbsd", "openbsd", "windows":
+	default:
+		t.Skipf("no file locks on %s", runtime.GOOS)
+	}
+	dir, err := os.MkdirTemp("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index")
+
+	if err := WaitUnlocked(file); err != nil {
+		t.Fatalf("WaitUnlocked without lock file: %v", err)
+	}
+	l, err := LockIndex(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockIndex(file, false); err != ErrLocked {
+		t.Fatalf("second LockIndex = %v, want ErrLocked", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- WaitUnlocked(file)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("WaitUnlocked returned %v while locked", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("WaitUnlocked: %v", err)
+	}
+
+	l, err = LockIndex(file, false)
+	if err != nil {
+		t.Fatalf("LockIndex after Unlock: %v", err)
+	}
+	l.Unlock()
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	_LOCKFILE_FAIL_IMMEDIATELY = 0x1
+	_LOCKFILE_EXCLUSIVE_LOCK   = 0x2
+	_ERROR_LOCK_VIOLATION      = syscall.Errno(33)
+)
+
+// lockFile locks the whole file, as a range of the maximum length.
+func lockFile(f *os.File, exclusive, wait bool) error {
+	var flags uintptr
+	if exclusive {
+		flags |= _LOCKFILE_EXCLUSIVE_LOCK
+	}
+	if !wait {
+		flags |= _LOCKFILE_FAIL_IMMEDIATELY
+	}
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, ^uintptr(0), ^uintptr(0), uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == _ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+	return &os.PathError{Op: "LockFileEx", Path: f.Name(), Err: err}
+}
+
+func unlockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, ^uintptr(0), ^uintptr(0), uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return &os.PathError{Op: "UnlockFileEx", Path: f.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logging.
+//
+// A Writer, Index, or Daemon logs through the *slog.Logger in its Logger
+// field, or through slog.Default() if that is nil, so that a program can
+// route, filter, or silence its logs. Progress that is always reported,
+// such as the summary of the index written by Flush, is logged at level
+// Info. Details, such as each file added or the number of files each
+// search filter matched, are logged at level Info if Verbose is set, as
+// before loggers were configurable, and otherwise at level Debug, for a
+// logger enabled for Debug to see without setting Verbose.
+
+// loggerOrDefault returns l, or slog.Default() if l is nil.
+func loggerOrDefault(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// logDetail logs a detail through l, at level Info if verbose is set
+// and otherwise at level Debug.
+func logDetail(l *slog.Logger, verbose bool, msg string, args ...interface{}) {
+	l = loggerOrDefault(l)
+	level := slog.LevelDebug
+	if verbose {
+		level = slog.LevelInfo
+	}
+	ctx := context.Background()
+	if l.Enabled(ctx, level) {
+		l.Log(ctx, level, msg, args...)
+	}
+}
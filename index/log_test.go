@@ -0,0 +1,63 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	for _, tt := range []struct {
+		level   slog.Level
+		verbose bool
+		want    []string
+		notWant []string
+	}{
+		{slog.LevelInfo, false, []string{"msg=merge", "msg=flush"}, []string{"msg=add", "msg=\"path filter\""}},
+		{slog.LevelInfo, true, []string{"msg=merge", "level=INFO msg=add file=/a/x", "msg=\"path filter\" files=1"}, nil},
+		{slog.LevelDebug, false, []string{"level=DEBUG msg=add file=/a/x", "level=DEBUG msg=\"path filter\""}, nil},
+		{slog.LevelWarn, true, nil, []string{"msg=merge", "msg=add"}},
+	} {
+		var b strings.Builder
+		logger := slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{Level: tt.level}))
+		out := filepath.Join(t.TempDir(), "index")
+		w, err := Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Logger = logger
+		w.Verbose = tt.verbose
+		w.Add("/a/x", strings.NewReader("hello world"))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		ix, err := Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.Logger = logger
+		ix.Verbose = tt.verbose
+		if _, err := ix.Search(&Query{Op: QAll}, &SearchOptions{Prefix: "/a/"}); err != nil {
+			t.Fatal(err)
+		}
+		ix.Close()
+
+		log := b.String()
+		for _, s := range tt.want {
+			if !strings.Contains(log, s) {
+				t.Errorf("level %v, verbose %v: log missing %q:\n%s", tt.level, tt.verbose, s, log)
+			}
+		}
+		for _, s := range tt.notWant {
+			if strings.Contains(log, s) {
+				t.Errorf("level %v, verbose %v: log has %q:\n%s", tt.level, tt.verbose, s, log)
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Query serialization.
+//
+// A Query can be encoded in a compact binary form, for caching
+// precompiled queries or shipping them to a search server, or as JSON.
+//
+// The binary form is a version byte (queryVersion) followed by the
+// encoding of the query itself:
+//
+//	op [1]
+//	number of trigrams [v]
+//	trigrams (length [1], bytes [3 or 4])...
+//	number of subqueries [v]
+//	subqueries...
+//
+// where each subquery is encoded recursively in the same way.
+// Quadgrams (see quad.go) are stored alongside trigrams, distinguished
+// by their length.
+//
+// In JSON, the op is written as the string "all", "none", "and", or "or",
+// and empty trigram and subquery lists are omitted:
+//
+//	{"op":"and","trigram":["abc","bcd"],"sub":[{"op":"or","trigram":["xyz","xyw"]}]}
+//
+// Trigrams and quadgrams are byte strings that need not be valid UTF-8,
+// so in JSON each byte is written as the code point with the same value.
+// ASCII trigrams appear as themselves.
+
+const queryVersion = 2
+
+// maxQueryDepth bounds the nesting of decoded queries, so that a
+// malicious encoding cannot exhaust the stack.
+const maxQueryDepth = 1000
+
+var errBadQuery = errors.New("malformed query encoding")
+
+var queryOpNames = [...]string{
+	QAll:  "all",
+	QNone: "none",
+	QAnd:  "and",
+	QOr:   "or",
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (op QueryOp) MarshalText() ([]byte, error) {
+	if op < 0 || int(op) >= len(queryOpNames) {
+		return nil, fmt.Errorf("invalid query op %d", int(op))
+	}
+	return []byte(queryOpNames[op]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (op *QueryOp) UnmarshalText(text []byte) error {
+	for i, name := range queryOpNames {
+		if string(text) == name {
+			*op = QueryOp(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid query op %q", text)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (q *Query) MarshalBinary() ([]byte, error) {
+	return q.appendBinary([]byte{queryVersion})
+}
+
+func (q *Query) appendBinary(b []byte) ([]byte, error) {
+	if q.Op < 0 || int(q.Op) >= len(queryOpNames) {
+		return nil, fmt.Errorf("invalid query op %d", int(q.Op))
+	}
+	b = append(b, byte(q.Op))
+	b = appendUvarint(b, uint64(len(q.Trigram)))
+	for _, t := range q.Trigram {
+		if !validGram(t) {
+			return nil, fmt.Errorf("invalid trigram %q", t)
+		}
+		b = append(b, byte(len(t)))
+		b = append(b, t...)
+	}
+	b = appendUvarint(b, uint64(len(q.Sub)))
+	var err error
+	for _, sub := range q.Sub {
+		if b, err = sub.appendBinary(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// validGram reports whether t is a trigram or quadgram.
+func validGram(t string) bool {
+	return len(t) == 3 || len(t) == 4
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var v [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(v[:], x)
+	return append(b, v[:n]...)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (q *Query) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != queryVersion {
+		return errBadQuery
+	}
+	rest, err := q.decodeBinary(data[1:], 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errBadQuery
+	}
+	return nil
+}
+
+func (q *Query) decodeBinary(b []byte, depth int) ([]byte, error) {
+	if depth > maxQueryDepth || len(b) == 0 {
+		return nil, errBadQuery
+	}
+	*q = Query{Op: QueryOp(b[0])}
+	if int(q.Op) >= len(queryOpNames) {
+		return nil, errBadQuery
+	}
+	b = b[1:]
+	n, w := binary.Uvarint(b)
+	// Each trigram takes at least four bytes.
+	if w <= 0 || n > uint64(len(b)-w)/4 {
+		return nil, errBadQuery
+	}
+	b = b[w:]
+	if n > 0 {
+		q.Trigram = make([]string, n)
+		for i := range q.Trigram {
+			if len(b) == 0 || len(b)-1 < int(b[0]) {
+				return nil, errBadQuery
+			}
+			t := string(b[1 : 1+b[0]])
+			if !validGram(t) {
+				return nil, errBadQuery
+			}
+			q.Trigram[i] = t
+			b = b[1+len(t):]
+		}
+	}
+	n, w = binary.Uvarint(b)
+	// Each subquery takes at least three bytes.
+	if w <= 0 || n > uint64(len(b)-w)/3 {
+		return nil, errBadQuery
+	}
+	b = b[w:]
+	if n > 0 {
+		q.Sub = make([]*Query, n)
+		for i := range q.Sub {
+			q.Sub[i] = new(Query)
+			var err error
+			if b, err = q.Sub[i].decodeBinary(b, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+// jsonQuery is the JSON form of a Query.
+type jsonQuery struct {
+	Op      QueryOp  `json:"op"`
+	Trigram []string `json:"trigram,omitempty"`
+	Sub     []*Query `json:"sub,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (q *Query) MarshalJSON() ([]byte, error) {
+	j := jsonQuery{Op: q.Op, Sub: q.Sub}
+	for _, t := range q.Trigram {
+		if !validGram(t) {
+			return nil, fmt.Errorf("invalid trigram %q", t)
+		}
+		r := make([]rune, len(t))
+		for i := 0; i < len(t); i++ {
+			r[i] = rune(t[i])
+		}
+		j.Trigram = append(j.Trigram, string(r))
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (q *Query) UnmarshalJSON(data []byte) error {
+	var j jsonQuery
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	for i, t := range j.Trigram {
+		var b []byte
+		for _, r := range t {
+			if r > 0xff {
+				return fmt.Errorf("invalid trigram %q", t)
+			}
+			b = append(b, byte(r))
+		}
+		if !validGram(string(b)) {
+			return fmt.Errorf("invalid trigram %q", t)
+		}
+		j.Trigram[i] = string(b)
+	}
+	for _, sub := range j.Sub {
+		if sub == nil {
+			return errBadQuery
+		}
+	}
+	*q = Query(j)
+	return nil
+}
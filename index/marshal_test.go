@@ -0,0 +1,120 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/json"
+	"regexp/syntax"
+	"testing"
+)
+
+func TestQueryMarshal(t *testing.T) {
+	for _, tt := range queryTests {
+		re, err := syntax.Parse(tt.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := RegexpQuery(re)
+
+		b, err := q.MarshalBinary()
+		if err != nil {
+			t.Errorf("MarshalBinary(%s): %v", q, err)
+			continue
+		}
+		var q1 Query
+		if err := q1.UnmarshalBinary(b); err != nil {
+			t.Errorf("UnmarshalBinary(%s): %v", q, err)
+		} else if q1.String() != tt.q {
+			t.Errorf("binary round trip of %#q = %#q, want %#q", tt.re, q1.String(), tt.q)
+		}
+
+		j, err := json.Marshal(q)
+		if err != nil {
+			t.Errorf("json.Marshal(%s): %v", q, err)
+			continue
+		}
+		var q2 Query
+		if err := json.Unmarshal(j, &q2); err != nil {
+			t.Errorf("json.Unmarshal(%s): %v", j, err)
+		} else if q2.String() != tt.q {
+			t.Errorf("JSON round trip of %#q = %#q, want %#q", tt.re, q2.String(), tt.q)
+		}
+	}
+}
+
+func TestQueryMarshalJSONBytes(t *testing.T) {
+	q := &Query{Op: QOr, Trigram: []string{"abc", "\xc3\xa9x", "\xa9\xff\x00"}}
+	j, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"op":"or","trigram":["abc","Ã©x","©ÿ\u0000"]}`
+	if string(j) != want {
+		t.Errorf("json.Marshal(%s) = %s, want %s", q, j, want)
+	}
+	var q1 Query
+	if err := json.Unmarshal(j, &q1); err != nil {
+		t.Fatal(err)
+	}
+	if q1.String() != q.String() {
+		t.Errorf("JSON round trip of %s = %s", q, &q1)
+	}
+}
+
+func TestQueryMarshalQuad(t *testing.T) {
+	q := &Query{Op: QAnd, Trigram: []string{"abc", "defg", "\xff\x00ab"}}
+	b, err := q.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q1 Query
+	if err := q1.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	} else if q1.String() != q.String() {
+		t.Errorf("binary round trip of %s = %s", q, &q1)
+	}
+	j, err := json.Marshal(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q2 Query
+	if err := json.Unmarshal(j, &q2); err != nil {
+		t.Fatal(err)
+	} else if q2.String() != q.String() {
+		t.Errorf("JSON round trip of %s = %s", q, &q2)
+	}
+}
+
+func TestQueryUnmarshalErrors(t *testing.T) {
+	bad := [][]byte{
+		nil,
+		{0},
+		{queryVersion},
+		{queryVersion, byte(QAnd), 1, 'a', 'b'},
+		{queryVersion, byte(QAnd), 1, 2, 'a', 'b', 0},
+		{queryVersion, byte(QAnd), 1, 5, 'a', 'b', 'c', 'd', 'e', 0},
+		{queryVersion, byte(QAnd), 0, 5},
+		{queryVersion, 9, 0, 0},
+		{queryVersion, byte(QAll), 0, 0, 0},
+	}
+	for _, b := range bad {
+		var q Query
+		if err := q.UnmarshalBinary(b); err == nil {
+			t.Errorf("UnmarshalBinary(%q) = %s, want error", b, &q)
+		}
+	}
+
+	for _, j := range []string{
+		`{"op":"xor"}`,
+		`{"op":"and","trigram":["ab"]}`,
+		`{"op":"or","sub":[null]}`,
+		`{"op":"or","trigram":["ab\u0100"]}`,
+	} {
+		var q Query
+		if err := json.Unmarshal([]byte(j), &q); err == nil {
+			t.Errorf("json.Unmarshal(%s) = %s, want error", j, &q)
+		}
+	}
+}
@@ -29,10 +29,16 @@ package index
 //
 // Copy the name index and posting list index into C's index and write the trailer.
 // Rename C's index onto the new index.
+//
+// Pruning files from an index A is a merge of A with nothing, in which
+// the mapping from A's docids discards the pruned files.
 
 import (
 	"encoding/binary"
+	"fmt"
+	"log/slog"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -47,18 +53,47 @@ type postIndex struct {
 	offset uint32
 }
 
+// MergeOptions control the reporting of a merge.
+type MergeOptions struct {
+	// Logger and Verbose control the logging of the steps of the
+	// merge, as details, as for a Writer.
+	Logger  *slog.Logger
+	Verbose bool
+
+	// Progress, if non-nil, is called from time to time during the
+	// merge of the posting lists with the number of trigrams merged so
+	// far out of the total in the two indexes, and once more at the end,
+	// with done == total.
+	Progress func(done, total int)
+}
+
+// progressInterval is the number of trigrams merged between
+// calls to MergeOptions.Progress.
+const progressInterval = 4096
+
 // Merge creates a new index in the file dst that corresponds to merging
 // the two indices src1 and src2. If both src1 and src2 claim responsibility
 // for a path, src2 is assumed to be newer and is given preference.
 func Merge(dst, src1, src2 string) error {
+	return MergeWith(dst, src1, src2, nil)
+}
+
+// MergeWith is like Merge but reports its progress as set by opt,
+// which may be nil.
+func MergeWith(dst, src1, src2 string, opt *MergeOptions) error {
+	if opt == nil {
+		opt = new(MergeOptions)
+	}
 	ix1, err := Open(src1)
 	if err != nil {
 		return err
 	}
+	defer ix1.Close()
 	ix2, err := Open(src2)
 	if err != nil {
 		return err
 	}
+	defer ix2.Close()
 	paths1, err := ix1.Paths()
 	if err != nil {
 		return err
@@ -67,6 +102,9 @@ func Merge(dst, src1, src2 string) error {
 	if err != nil {
 		return err
 	}
+	if _, err := mergeNormalization(ix1, ix2); err != nil {
+		return err
+	}
 
 	// Build docID maps.
 	var i1, i2, new uint32
@@ -113,7 +151,7 @@ func Merge(dst, src1, src2 string) error {
 				return err
 			}
 			if name < path {
-				panic("merge: inconsistent index")
+				return &MergeError{File: src2, Lo: i2, Hi: i2 + 1, Reason: fmt.Sprintf("%q is not under an indexed path, or out of order", name)}
 			}
 		}
 		lo = i2
@@ -139,10 +177,94 @@ func Merge(dst, src1, src2 string) error {
 		new += uint32(ix1.numName) - i1
 	}
 	if i2 < uint32(ix2.numName) {
-		panic("merge: inconsistent index")
+		name, err := ix2.Name(i2)
+		if err != nil {
+			return err
+		}
+		return &MergeError{File: src2, Lo: i2, Hi: uint32(ix2.numName), Reason: fmt.Sprintf("%q is not under an indexed path, or out of order", name)}
+	}
+	return writeMerged(dst, ix1, ix2, paths1, paths2, map1, map2, new, opt)
+}
+
+// Prune creates a new index in the file dst holding the files of the
+// index src for which keep returns true. It returns the number of files
+// dropped.
+func Prune(dst, src string, keep func(name string) bool) (int, error) {
+	ix, err := Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer ix.Close()
+	paths, err := ix.Paths()
+	if err != nil {
+		return 0, err
+	}
+
+	// Build a docID map keeping runs of kept files.
+	var idMap []idRange
+	var lo, new uint32
+	inRun := false
+	for id := uint32(0); id <= uint32(ix.numName); id++ {
+		k := false
+		if id < uint32(ix.numName) {
+			name, err := ix.Name(id)
+			if err != nil {
+				return 0, err
+			}
+			k = keep(name)
+		}
+		if k && !inRun {
+			lo = id
+			inRun = true
+		} else if !k && inRun {
+			idMap = append(idMap, idRange{lo, id, new})
+			new += id - lo
+			inRun = false
+		}
+	}
+
+	// Merge the index with nothing.
+	if err := writeMerged(dst, ix, ix, paths, nil, idMap, nil, new, nil); err != nil {
+		return 0, err
+	}
+	return ix.numName - int(new), nil
+}
+
+// Upgrade creates a new index in the file dst holding the same files as
+// the index src, but written in the current format, FormatVersion.
+// Indexes in older formats remain readable, but lack the data that
+// newer formats add, such as the file languages.
+func Upgrade(dst, src string) error {
+	ix, err := Open(src)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+	paths, err := ix.Paths()
+	if err != nil {
+		return err
+	}
+	var idMap []idRange
+	n := uint32(ix.numName)
+	if n > 0 {
+		idMap = []idRange{{0, n, 0}}
 	}
-	numName := new
+	return writeMerged(dst, ix, ix, paths, nil, idMap, nil, n, nil)
+}
 
+// writeMerged writes to dst the index merging the files of ix1 and ix2,
+// which have the given paths, as mapped by map1 and map2 to numName files,
+// reporting its progress as set by opt, which may be nil.
+func writeMerged(dst string, ix1, ix2 *Index, paths1, paths2 []string, map1, map2 []idRange, numName uint32, opt *MergeOptions) error {
+	if opt == nil {
+		opt = new(MergeOptions)
+	}
+	for _, ix := range []*Index{ix1, ix2} {
+		if ix.GitRepo() != "" {
+			return fmt.Errorf("index %s: %w", ix.file, ErrHistoryMerge)
+		}
+	}
+	logDetail(opt.Logger, opt.Verbose, "merge names", "index", dst, "files", numName)
 	ix3, err := bufCreate(dst)
 	if err != nil {
 		return err
@@ -153,22 +275,8 @@ func Merge(dst, src1, src2 string) error {
 
 	// Merged list of paths.
 	pathData := ix3.offset()
-	mi1 := 0
-	mi2 := 0
-	last := "\x00" // not a prefix of anything
-	for mi1 < len(paths1) || mi2 < len(paths2) {
-		var p string
-		if mi2 >= len(paths2) || mi1 < len(paths1) && paths1[mi1] <= paths2[mi2] {
-			p = paths1[mi1]
-			mi1++
-		} else {
-			p = paths2[mi2]
-			mi2++
-		}
-		if strings.HasPrefix(p, last) {
-			continue
-		}
-		last = p
+	paths := mergePaths(paths1, paths2)
+	for _, p := range paths {
 		if err := ix3.writeString(p); err != nil {
 			return err
 		}
@@ -186,9 +294,44 @@ func Merge(dst, src1, src2 string) error {
 	if err != nil {
 		return err
 	}
-	new = 0
-	mi1 = 0
-	mi2 = 0
+	langFile, err := bufCreate("")
+	if err != nil {
+		return err
+	}
+	statFile, err := bufCreate("")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(statFile.name)
+	cut1, err := truncatedSet(ix1)
+	if err != nil {
+		return err
+	}
+	cut2, err := truncatedSet(ix2)
+	if err != nil {
+		return err
+	}
+	gz1, err := gzipSet(ix1)
+	if err != nil {
+		return err
+	}
+	gz2, err := gzipSet(ix2)
+	if err != nil {
+		return err
+	}
+	class1, err := classMap(ix1)
+	if err != nil {
+		return err
+	}
+	class2, err := classMap(ix2)
+	if err != nil {
+		return err
+	}
+	var truncated, gzipped []uint32
+	var classes []FileClass
+	new := uint32(0)
+	mi1 := 0
+	mi2 := 0
 	for new < numName {
 		if mi1 < len(map1) && map1[mi1].new == new {
 			for i := map1[mi1].lo; i < map1[mi1].hi; i++ {
@@ -196,9 +339,32 @@ func Merge(dst, src1, src2 string) error {
 				if err != nil {
 					return err
 				}
+				l, err := ix1.Lang(i)
+				if err != nil {
+					return err
+				}
+				st, err := ix1.FileStat(i)
+				if err != nil {
+					return err
+				}
 				if err := nameIndexFile.writeUint32(ix3.offset() - nameData); err != nil {
 					return err
 				}
+				if err := langFile.writeByte(byte(l)); err != nil {
+					return err
+				}
+				if err := writeStat(statFile, st); err != nil {
+					return err
+				}
+				if cut1[i] {
+					truncated = append(truncated, new)
+				}
+				if gz1[i] {
+					gzipped = append(gzipped, new)
+				}
+				if c, ok := class1[i]; ok {
+					classes = append(classes, FileClass{new, c})
+				}
 				if err := ix3.writeString(name); err != nil {
 					return err
 				}
@@ -214,9 +380,32 @@ func Merge(dst, src1, src2 string) error {
 				if err != nil {
 					return err
 				}
+				l, err := ix2.Lang(i)
+				if err != nil {
+					return err
+				}
+				st, err := ix2.FileStat(i)
+				if err != nil {
+					return err
+				}
 				if err := nameIndexFile.writeUint32(ix3.offset() - nameData); err != nil {
 					return err
 				}
+				if err := langFile.writeByte(byte(l)); err != nil {
+					return err
+				}
+				if err := writeStat(statFile, st); err != nil {
+					return err
+				}
+				if cut2[i] {
+					truncated = append(truncated, new)
+				}
+				if gz2[i] {
+					gzipped = append(gzipped, new)
+				}
+				if c, ok := class2[i]; ok {
+					classes = append(classes, FileClass{new, c})
+				}
 				if err := ix3.writeString(name); err != nil {
 					return err
 				}
@@ -227,17 +416,18 @@ func Merge(dst, src1, src2 string) error {
 			}
 			mi2++
 		} else {
-			panic("merge: inconsistent index")
+			return &MergeError{File: dst, Lo: new, Hi: numName, Reason: "not mapped from either source index"}
 		}
 	}
 	if new*4 != nameIndexFile.offset() {
-		panic("merge: inconsistent index")
+		return &MergeError{File: dst, Lo: 0, Hi: new, Reason: fmt.Sprintf("%d names written", nameIndexFile.offset()/4)}
 	}
 	if err := nameIndexFile.writeUint32(ix3.offset()); err != nil {
 		return err
 	}
 
 	// Merged list of posting lists.
+	logDetail(opt.Logger, opt.Verbose, "merge posting lists", "index", dst, "trigrams", ix1.NumTrigrams()+ix2.NumTrigrams())
 	postData := ix3.offset()
 	var r1 postMapReader
 	var r2 postMapReader
@@ -248,75 +438,21 @@ func Merge(dst, src1, src2 string) error {
 	if err := r2.init(ix2, map2); err != nil {
 		return err
 	}
-	if err := w.init(ix3); err != nil {
+	if err := w.init(ix3, ""); err != nil {
 		return err
 	}
-	for {
-		if r1.trigram < r2.trigram {
-			w.trigram(r1.trigram)
-			for {
-				ok, err := r1.nextID()
-				if err != nil {
-					return err
-				}
-				if !ok {
-					break
-				}
-				if err := w.fileID(r1.fileID); err != nil {
-					return err
-				}
-			}
-			r1.nextTrigram()
-			w.endTrigram()
-		} else if r2.trigram < r1.trigram {
-			w.trigram(r2.trigram)
-			for {
-				ok, err := r2.nextID()
-				if err != nil {
-					return err
-				}
-				if !ok {
-					break
-				}
-				if err := w.fileID(r2.fileID); err != nil {
-					return err
-				}
-			}
-			r2.nextTrigram()
-			w.endTrigram()
-		} else {
-			if r1.trigram == ^uint32(0) {
-				break
-			}
-			w.trigram(r1.trigram)
-			r1.nextID()
-			r2.nextID()
-			for r1.fileID < ^uint32(0) || r2.fileID < ^uint32(0) {
-				if r1.fileID < r2.fileID {
-					if err := w.fileID(r1.fileID); err != nil {
-						return err
-					}
-					r1.nextID()
-				} else if r2.fileID < r1.fileID {
-					if err := w.fileID(r2.fileID); err != nil {
-						return err
-					}
-					r2.nextID()
-				} else {
-					panic("merge: inconsistent index")
-				}
-			}
-			if err := r1.nextTrigram(); err != nil {
-				return err
-			}
-			if err := r2.nextTrigram(); err != nil {
-				return err
-			}
-			if err := w.endTrigram(); err != nil {
-				return err
-			}
-		}
+	if w.skips, err = newSkipWriter(""); err != nil {
+		return err
+	}
+	defer w.skips.remove()
+	var prog *mergeProgress
+	if opt.Progress != nil {
+		prog = &mergeProgress{f: opt.Progress, total: ix1.NumTrigrams() + ix2.NumTrigrams()}
+	}
+	if err := mergeLists(&w, &r1, &r2, prog); err != nil {
+		return err
 	}
+	prog.report(&r1, &r2, true)
 
 	// Name index
 	nameIndex := ix3.offset()
@@ -326,6 +462,132 @@ func Merge(dst, src1, src2 string) error {
 	postIndex := ix3.offset()
 	copyFile(ix3, w.postIndexFile)
 
+	// Sections
+	sections := []section{
+		{"lang", langFile},
+	}
+	if ix1.HasStats() || ix2.HasStats() {
+		sections = append(sections, section{"stat", statFile})
+	}
+	excludes, err := mergeExcludes(ix1, ix2)
+	if err != nil {
+		return err
+	}
+	if len(excludes) > 0 {
+		excludeFile, err := stringSection("", excludes)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(excludeFile.name)
+		sections = append(sections, section{"exclude", excludeFile})
+	}
+	repos, err := mergeRepos(ix1, ix2, paths)
+	if err != nil {
+		return err
+	}
+	repoFile, err := repoSection("", repos)
+	if err != nil {
+		return err
+	}
+	if repoFile != nil {
+		defer os.Remove(repoFile.name)
+		sections = append(sections, section{"repo", repoFile})
+	}
+	mode, err := mergeNormalization(ix1, ix2)
+	if err != nil {
+		return err
+	}
+	normFile, err := normSection("", mode)
+	if err != nil {
+		return err
+	}
+	if normFile != nil {
+		defer os.Remove(normFile.name)
+		sections = append(sections, section{"norm", normFile})
+	}
+	times, err := mergeBuildTimes(ix1, ix2, paths, paths2)
+	if err != nil {
+		return err
+	}
+	builtFile, err := builtSection("", times)
+	if err != nil {
+		return err
+	}
+	if builtFile != nil {
+		defer os.Remove(builtFile.name)
+		sections = append(sections, section{"built", builtFile})
+	}
+	meta, err := mergeMetadata(ix1, ix2)
+	if err != nil {
+		return err
+	}
+	metaFile, err := metaSection("", meta)
+	if err != nil {
+		return err
+	}
+	if metaFile != nil {
+		defer os.Remove(metaFile.name)
+		sections = append(sections, section{"meta", metaFile})
+	}
+	truncatedFile, err := truncatedSection("", truncated)
+	if err != nil {
+		return err
+	}
+	if truncatedFile != nil {
+		defer os.Remove(truncatedFile.name)
+		sections = append(sections, section{"truncated", truncatedFile})
+	}
+	gzipFile, err := gzipSection("", gzipped)
+	if err != nil {
+		return err
+	}
+	if gzipFile != nil {
+		defer os.Remove(gzipFile.name)
+		sections = append(sections, section{"gzip", gzipFile})
+	}
+	classFile, err := classSection("", classes)
+	if err != nil {
+		return err
+	}
+	if classFile != nil {
+		defer os.Remove(classFile.name)
+		sections = append(sections, section{"class", classFile})
+	}
+	if ix1.HasQuadgrams() && ix2.HasQuadgrams() {
+		// Quadgram lists must cover every file or none,
+		// so they are kept only if both indexes have them.
+		logDetail(opt.Logger, opt.Verbose, "merge quadgram lists", "index", dst)
+		quadData, err := bufCreate("")
+		if err != nil {
+			return err
+		}
+		var q1, q2 postMapReader
+		var qw postDataWriter
+		q1.quad = true
+		q2.quad = true
+		qw.quad = true
+		if err := q1.init(ix1, map1); err != nil {
+			return err
+		}
+		if err := q2.init(ix2, map2); err != nil {
+			return err
+		}
+		if err := qw.init(quadData, ""); err != nil {
+			return err
+		}
+		if err := mergeLists(&qw, &q1, &q2, nil); err != nil {
+			return err
+		}
+		defer os.Remove(quadData.name)
+		defer os.Remove(qw.postIndexFile.name)
+		sections = append(sections, section{"quad", quadData}, section{"quadindex", qw.postIndexFile})
+	}
+	sections = append(sections, w.skips.sections()...)
+	sectionIndex, err := writeSections(ix3, sections)
+	if err != nil {
+		return err
+	}
+
 	if err := ix3.writeUint32(pathData); err != nil {
 		return err
 	}
@@ -341,6 +603,9 @@ func Merge(dst, src1, src2 string) error {
 	if err := ix3.writeUint32(postIndex); err != nil {
 		return err
 	}
+	if err := ix3.writeUint32(sectionIndex); err != nil {
+		return err
+	}
 	if err := ix3.writeString(trailerMagic); err != nil {
 		return err
 	}
@@ -349,12 +614,116 @@ func Merge(dst, src1, src2 string) error {
 	}
 
 	os.Remove(nameIndexFile.name)
+	os.Remove(langFile.name)
 	os.Remove(w.postIndexFile.name)
+	logDetail(opt.Logger, opt.Verbose, "merged", "index", dst, "bytes", ix3.offset())
 	return nil
 }
 
+// A mergeProgress reports the progress of merging posting lists
+// to a MergeOptions.Progress function.
+type mergeProgress struct {
+	f     func(done, total int)
+	total int // trigrams to merge
+	next  int // trigrams merged at the next report
+}
+
+// report reports the trigrams read so far by r1 and r2, if at least
+// progressInterval have been read since the last report or if
+// final is set. A nil *mergeProgress reports nothing.
+func (p *mergeProgress) report(r1, r2 *postMapReader, final bool) {
+	if p == nil {
+		return
+	}
+	done := min(int(r1.triNum+r2.triNum), p.total)
+	if done >= p.next || final {
+		p.f(done, p.total)
+		p.next = done + progressInterval
+	}
+}
+
+// mergeLists merges the posting lists read by r1 and r2 into w,
+// reporting its progress to prog, which may be nil.
+func mergeLists(w *postDataWriter, r1, r2 *postMapReader, prog *mergeProgress) error {
+	for {
+		prog.report(r1, r2, false)
+		if r1.trigram < r2.trigram {
+			if err := copyList(w, r1); err != nil {
+				return err
+			}
+		} else if r2.trigram < r1.trigram {
+			if err := copyList(w, r2); err != nil {
+				return err
+			}
+		} else {
+			if r1.trigram == ^uint32(0) {
+				break
+			}
+			w.trigram(r1.trigram)
+			if _, err := r1.nextID(); err != nil {
+				return err
+			}
+			if _, err := r2.nextID(); err != nil {
+				return err
+			}
+			for r1.fileID < ^uint32(0) || r2.fileID < ^uint32(0) {
+				r := r1
+				if r2.fileID < r1.fileID {
+					r = r2
+				} else if r2.fileID == r1.fileID {
+					return &MergeError{
+						File:   r2.ix.file,
+						Lo:     r2.oldID,
+						Hi:     r2.oldID + 1,
+						Reason: fmt.Sprintf("merged as file %d, as is file %d of %s", r2.fileID, r1.oldID, r1.ix.file),
+					}
+				}
+				if err := w.fileID(r.fileID); err != nil {
+					return err
+				}
+				if _, err := r.nextID(); err != nil {
+					return err
+				}
+			}
+			if err := r1.nextTrigram(); err != nil {
+				return err
+			}
+			if err := r2.nextTrigram(); err != nil {
+				return err
+			}
+			if err := w.endTrigram(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyList copies the current posting list of r to w
+// and advances r to the next list.
+func copyList(w *postDataWriter, r *postMapReader) error {
+	w.trigram(r.trigram)
+	for {
+		ok, err := r.nextID()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err := w.fileID(r.fileID); err != nil {
+			return err
+		}
+	}
+	if err := r.nextTrigram(); err != nil {
+		return err
+	}
+	return w.endTrigram()
+}
+
 type postMapReader struct {
 	ix      *Index
+	quad    bool // read quadgram lists instead of trigram lists
 	idMap   []idRange
 	triNum  uint32
 	trigram uint32
@@ -379,12 +748,33 @@ func (r *postMapReader) nextTrigram() error {
 }
 
 func (r *postMapReader) load() error {
-	if r.triNum >= uint32(r.ix.numPost) {
+	num := r.ix.numPost
+	if r.quad {
+		num = r.ix.numQuad()
+	}
+	if r.triNum >= uint32(num) {
 		r.trigram = ^uint32(0)
 		r.count = 0
 		r.fileID = ^uint32(0)
 		return nil
 	}
+	if r.quad {
+		var err error
+		r.trigram, r.count, r.offset, err = r.ix.quadAt(int(r.triNum))
+		if err != nil {
+			return err
+		}
+		r.d, err = r.ix.quadList(int(r.count), r.offset)
+		if err != nil {
+			return err
+		}
+		r.oldID = ^uint32(0)
+		r.i = 0
+		if r.count == 0 {
+			r.fileID = ^uint32(0)
+		}
+		return nil
+	}
 	var err error
 	r.trigram, r.count, r.offset, err = r.ix.listAt(r.triNum * postEntrySize)
 	if err != nil {
@@ -394,24 +784,39 @@ func (r *postMapReader) load() error {
 		r.fileID = ^uint32(0)
 		return nil
 	}
-	r.d, err = r.ix.slice(r.ix.postData+r.offset+3, -1)
+	off := r.ix.postData + r.offset + 3
+	r.d, err = r.ix.slice(off, listSize(off, int(r.count), r.ix.postIndex))
 	r.oldID = ^uint32(0)
 	r.i = 0
 	return err
 }
 
+// corrupt returns an *IndexError for the current posting list.
+func (r *postMapReader) corrupt(err error) error {
+	if r.quad {
+		return r.ix.corrupt("quad", r.ix.sections["quad"].off+r.offset+4, err)
+	}
+	return r.ix.corrupt("posting list", r.ix.postData+r.offset+3, err)
+}
+
 func (r *postMapReader) nextID() (bool, error) {
 	for r.count > 0 {
 		r.count--
 		delta64, n := binary.Uvarint(r.d)
 		delta := uint32(delta64)
-		if n <= 0 || delta == 0 {
-			return false, corrupt()
+		if n <= 0 {
+			return false, r.corrupt(ErrBadVarint)
+		}
+		if delta == 0 {
+			return false, r.corrupt(ErrMalformed)
 		}
 		r.d = r.d[n:]
 		r.oldID += delta
-		for r.i < len(r.idMap) && r.idMap[r.i].hi <= r.oldID {
-			r.i++
+		if r.i < len(r.idMap) && r.idMap[r.i].hi <= r.oldID {
+			// The maps of indexes written in parallel have many
+			// short ranges; search for the one holding oldID.
+			m := r.idMap[r.i:]
+			r.i += sort.Search(len(m), func(j int) bool { return m[j].hi > r.oldID })
 		}
 		if r.i >= len(r.idMap) {
 			r.count = 0
@@ -429,6 +834,8 @@ func (r *postMapReader) nextID() (bool, error) {
 }
 
 type postDataWriter struct {
+	quad          bool        // write quadgram lists instead of trigram lists
+	skips         *skipWriter // if non-nil, records the skip tables of the lists
 	out           *bufWriter
 	postIndexFile *bufWriter
 	buf           [10]byte
@@ -438,8 +845,10 @@ type postDataWriter struct {
 	t             uint32
 }
 
-func (w *postDataWriter) init(out *bufWriter) error {
-	b, err := bufCreate("")
+// init prepares w to write posting lists to out,
+// buffering the posting list index in a temporary file in dir.
+func (w *postDataWriter) init(out *bufWriter, dir string) error {
+	b, err := bufCreateTemp(dir)
 	if err != nil {
 		return err
 	}
@@ -458,15 +867,21 @@ func (w *postDataWriter) trigram(t uint32) {
 
 func (w *postDataWriter) fileID(id uint32) error {
 	if w.count == 0 {
-		if err := w.out.writeTrigram(w.t); err != nil {
+		if err := w.writeGram(w.out); err != nil {
 			return err
 		}
+		if w.skips != nil {
+			w.skips.list(w.t, w.out.offset())
+		}
 	}
 	if err := w.out.writeUvarint(id - w.last); err != nil {
 		return err
 	}
 	w.last = id
 	w.count++
+	if w.skips != nil {
+		return w.skips.add(id, w.out.offset())
+	}
 	return nil
 }
 
@@ -477,7 +892,7 @@ func (w *postDataWriter) endTrigram() error {
 	if err := w.out.writeUvarint(0); err != nil {
 		return err
 	}
-	if err := w.postIndexFile.writeTrigram(w.t); err != nil {
+	if err := w.writeGram(w.postIndexFile); err != nil {
 		return err
 	}
 	if err := w.postIndexFile.writeUint32(w.count); err != nil {
@@ -485,3 +900,62 @@ func (w *postDataWriter) endTrigram() error {
 	}
 	return w.postIndexFile.writeUint32(w.offset - w.base)
 }
+
+// writeGram writes the current trigram or quadgram to b.
+func (w *postDataWriter) writeGram(b *bufWriter) error {
+	if w.quad {
+		return b.writeUint32(w.t)
+	}
+	return b.writeTrigram(w.t)
+}
+
+// mergePaths returns the merge of the sorted path lists, omitting
+// paths inside other paths.
+func mergePaths(paths1, paths2 []string) []string {
+	var paths []string
+	mi1 := 0
+	mi2 := 0
+	last := "\x00" // not a prefix of anything
+	for mi1 < len(paths1) || mi2 < len(paths2) {
+		var p string
+		if mi2 >= len(paths2) || mi1 < len(paths1) && paths1[mi1] <= paths2[mi2] {
+			p = paths1[mi1]
+			mi1++
+		} else {
+			p = paths2[mi2]
+			mi2++
+		}
+		if strings.HasPrefix(p, last) {
+			continue
+		}
+		last = p
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// mergeExcludes returns the exclude patterns recorded in either index.
+func mergeExcludes(ix1, ix2 *Index) ([]string, error) {
+	x1, err := ix1.Excludes()
+	if err != nil {
+		return nil, err
+	}
+	x2, err := ix2.Excludes()
+	if err != nil {
+		return nil, err
+	}
+	x := x1
+	for _, p := range x2 {
+		dup := false
+		for _, q := range x1 {
+			if p == q {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			x = append(x, p)
+		}
+	}
+	return x, nil
+}
@@ -5,7 +5,15 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -119,3 +127,288 @@ func TestMerge(t *testing.T) {
 	check(ix3, "now", 3, 4, 6)
 	check(ix3, "pot", 4, 5, 7)
 }
+
+func TestMergeWith(t *testing.T) {
+	dir := t.TempDir()
+	src1 := filepath.Join(dir, "src1")
+	src2 := filepath.Join(dir, "src2")
+	buildIndex(t, src1, mergePaths1, mergeFiles1)
+	files2 := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		// Distinct trigrams, to merge more than progressInterval lists.
+		files2[fmt.Sprintf("/b/%04d", i)] = fmt.Sprintf("%03x\n%03x\n", i, 4095-i)
+	}
+	buildIndex(t, src2, mergePaths2, files2)
+	var total int
+	for _, file := range []string{src1, src2} {
+		ix, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += ix.NumTrigrams()
+		ix.Close()
+	}
+	if total <= progressInterval {
+		t.Fatalf("merging only %d lists", total)
+	}
+
+	var log bytes.Buffer
+	var calls [][2]int
+	opt := &MergeOptions{
+		Logger:  slog.New(slog.NewTextHandler(&log, nil)),
+		Verbose: true,
+		Progress: func(done, total int) {
+			calls = append(calls, [2]int{done, total})
+		},
+	}
+	out := filepath.Join(dir, "out")
+	if err := MergeWith(out, src1, src2, opt); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) < 2 || calls[len(calls)-1] != [2]int{total, total} {
+		t.Errorf("Progress calls = %v, want several ending with %d, %d", calls, total, total)
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i][0] < calls[i-1][0] || calls[i][1] != total {
+			t.Errorf("Progress calls = %v, want increasing to %d", calls, total)
+			break
+		}
+	}
+	for _, msg := range []string{"merge names", "merge posting lists", "merged"} {
+		if !strings.Contains(log.String(), msg) {
+			t.Errorf("log does not have %q:\n%s", msg, log.String())
+		}
+	}
+
+	// The options do not change the index written.
+	plain := filepath.Join(dir, "plain")
+	if err := Merge(plain, src1, src2); err != nil {
+		t.Fatal(err)
+	}
+	d1, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d1, d2) {
+		t.Errorf("MergeWith wrote a different index than Merge")
+	}
+}
+
+func TestMergeExcludes(t *testing.T) {
+	var names []string
+	for i := 0; i < 3; i++ {
+		f, _ := os.CreateTemp("", "index-test")
+		names = append(names, f.Name())
+		f.Close()
+		defer os.Remove(f.Name())
+	}
+	for i, excludes := range [][]string{{"vendor/**", "*.min.js"}, {"*.min.js", "testdata"}} {
+		ix, err := Create(names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddPaths(mergePaths1)
+		ix.AddExcludes(excludes)
+		ix.Add("/a/x", strings.NewReader("hello world"))
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Merge(names[2], names[0], names[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range [][]string{
+		{"vendor/**", "*.min.js"},
+		{"*.min.js", "testdata"},
+		{"vendor/**", "*.min.js", "testdata"},
+	} {
+		ix, err := Open(names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := ix.Excludes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("index %d: Excludes() = %q, want %q", i, have, want)
+		}
+	}
+}
+
+func TestMergeInconsistent(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old")
+	buildIndex(t, old, mergePaths1, mergeFiles1)
+	for _, tt := range []struct {
+		paths  []string
+		files  map[string]string
+		lo, hi uint32
+	}{
+		// Files before, and after, the indexed paths.
+		{[]string{"/b"}, map[string]string{"/a/z": "zzz", "/b/x": "xxx"}, 0, 1},
+		{[]string{"/b"}, map[string]string{"/b/x": "xxx", "/d/y": "yyy", "/d/z": "zzz"}, 1, 3},
+	} {
+		src := filepath.Join(dir, "src")
+		buildIndex(t, src, tt.paths, tt.files)
+		err := Merge(filepath.Join(dir, "merged"), old, src)
+		var e *MergeError
+		if !errors.Is(err, ErrInconsistent) || !errors.As(err, &e) || e.File != src || e.Lo != tt.lo || e.Hi != tt.hi {
+			t.Errorf("Merge with %v: %v, want MergeError for files [%d, %d) of %s", tt.files, err, tt.lo, tt.hi, src)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	var names []string
+	for i := 0; i < 3; i++ {
+		f, _ := os.CreateTemp("", "index-test")
+		names = append(names, f.Name())
+		f.Close()
+		defer os.Remove(f.Name())
+	}
+	buildIndex(t, names[0], mergePaths1, mergeFiles1)
+	kept := map[string]string{}
+	for name, data := range mergeFiles1 {
+		if name != "/a/y" && name != "/c/ab" && name != "/c/de" {
+			kept[name] = data
+		}
+	}
+	buildIndex(t, names[1], mergePaths1, kept)
+
+	n, err := Prune(names[2], names[0], func(name string) bool {
+		_, ok := kept[name]
+		return ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Prune dropped %d files, want 3", n)
+	}
+	have, err := Open(names[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Open(names[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	haveNames, err := have.Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantNames, err := want.Names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(haveNames, wantNames) {
+		t.Errorf("pruned index names = %q, want %q", haveNames, wantNames)
+	}
+	for _, data := range mergeFiles1 {
+		for i := 0; i+3 <= len(data); i++ {
+			tri := tri(data[i], data[i+1], data[i+2])
+			l1, err := have.PostingList(tri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l2, err := want.PostingList(tri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalList(l1, l2) {
+				t.Errorf("pruned PostingList(%q) = %v, want %v", data[i:i+3], l1, l2)
+			}
+		}
+	}
+}
+
+// downgrade returns the version 1 form of the version 2 index data,
+// dropping its sections.
+func downgrade(t *testing.T, data []byte) []byte {
+	d := make([]byte, len(data))
+	copy(d, data)
+	ix, err := openData("", &mmapData{d: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := ix.postIndex + uint32(ix.numPost*postEntrySize)
+	v1 := append([]byte(magicV1), d[len(magic):end]...)
+	for _, off := range []uint32{ix.pathData, ix.nameData, ix.postData, ix.nameIndex, ix.postIndex} {
+		v1 = binary.BigEndian.AppendUint32(v1, off)
+	}
+	return append(v1, trailerMagic...)
+}
+
+func TestUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	v2, v1, up := filepath.Join(dir, "v2"), filepath.Join(dir, "v1"), filepath.Join(dir, "up")
+	buildIndex(t, v2, mergePaths1, mergeFiles1)
+	data, err := os.ReadFile(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(v1, downgrade(t, data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	old, err := Open(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := old.Version(); v != 1 {
+		t.Fatalf("downgraded index has version %d, want 1", v)
+	}
+	if err := Upgrade(up, v1); err != nil {
+		t.Fatal(err)
+	}
+	have, err := Open(up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := have.Version(); v != FormatVersion {
+		t.Errorf("upgraded index has version %d, want %d", v, FormatVersion)
+	}
+	want, err := Open(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ix := range []*Index{old, have} {
+		paths, err := ix.Paths()
+		if err != nil || !reflect.DeepEqual(paths, mergePaths1) {
+			t.Errorf("version %d Paths() = %q, %v, want %q", ix.Version(), paths, err, mergePaths1)
+		}
+		haveNames, _ := ix.Names()
+		wantNames, _ := want.Names()
+		if !reflect.DeepEqual(haveNames, wantNames) {
+			t.Errorf("version %d Names() = %q, want %q", ix.Version(), haveNames, wantNames)
+		}
+		trigrams, err := want.Trigrams()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range trigrams {
+			l1, err := ix.PostingList(info.Trigram)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l2, _ := want.PostingList(info.Trigram)
+			if !equalList(l1, l2) {
+				t.Errorf("version %d PostingList(%#x) = %v, want %v", ix.Version(), info.Trigram, l1, l2)
+			}
+		}
+	}
+
+	future := filepath.Join(dir, "future")
+	data = append([]byte("csearch index 9\n"), data[len(magic):]...)
+	if err := os.WriteFile(future, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(future); !errors.Is(err, ErrVersion) {
+		t.Errorf("Open(version 9 index) = %v, want ErrVersion", err)
+	}
+}
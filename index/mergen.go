@@ -0,0 +1,169 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Merging many indexes.
+//
+// MergeN combines indexes written in parallel over parts of the same
+// files, as cindex does to use several processors. Unlike Merge, it
+// does not let the paths of one index shadow the files of another:
+// each file of any index is kept, merged into sorted order by name.
+// It merges the indexes in pairs, concurrently, and then the results
+// in pairs, and so on, so that k indexes take about log2(k) rounds.
+
+// MergeN creates a new index in the file dst holding the files of all
+// the indexes srcs, with their paths. If several of srcs hold a file
+// with the same name, the last one is kept. Intermediate indexes are
+// written next to dst and removed once merged. The merge into dst is
+// logged and reports its progress as set by opt, which may be nil;
+// the earlier ones are logged only.
+func MergeN(dst string, srcs []string, opt *MergeOptions) error {
+	if opt == nil {
+		opt = new(MergeOptions)
+	}
+	if len(srcs) == 0 {
+		return errors.New("merge: no indexes")
+	}
+	if len(srcs) == 1 {
+		return mergeUnion(dst, srcs[0], srcs[0], opt)
+	}
+	inner := &MergeOptions{Logger: opt.Logger, Verbose: opt.Verbose}
+	var temps []string
+	defer func() {
+		for _, t := range temps {
+			os.Remove(t)
+		}
+	}()
+	for round := srcs; len(round) > 1; {
+		next := make([]string, (len(round)+1)/2)
+		errs := make([]error, len(next))
+		var wg sync.WaitGroup
+		for i := range next {
+			if 2*i+1 == len(round) {
+				next[i] = round[2*i]
+				continue
+			}
+			o, out := inner, dst
+			if len(round) > 2 {
+				f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".merge*")
+				if err != nil {
+					return err
+				}
+				f.Close()
+				out = f.Name()
+				temps = append(temps, out)
+			} else {
+				o = opt
+			}
+			next[i] = out
+			wg.Add(1)
+			go func(i int, src1, src2 string) {
+				defer wg.Done()
+				errs[i] = mergeUnion(next[i], src1, src2, o)
+			}(i, round[2*i], round[2*i+1])
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+		round = next
+	}
+	return nil
+}
+
+// mergeUnion writes to dst the index holding the files of both src1
+// and src2, preferring src2 for a file in both.
+func mergeUnion(dst, src1, src2 string, opt *MergeOptions) error {
+	ix1, err := Open(src1)
+	if err != nil {
+		return err
+	}
+	defer ix1.Close()
+	ix2 := ix1
+	if src2 != src1 {
+		ix2, err = Open(src2)
+		if err != nil {
+			return err
+		}
+		defer ix2.Close()
+	}
+	paths1, err := ix1.Paths()
+	if err != nil {
+		return err
+	}
+	paths2, err := ix2.Paths()
+	if err != nil {
+		return err
+	}
+	if _, err := mergeNormalization(ix1, ix2); err != nil {
+		return err
+	}
+	if ix2 == ix1 {
+		// Merge the index with nothing, as Upgrade does.
+		n := uint32(ix1.numName)
+		var idMap []idRange
+		if n > 0 {
+			idMap = []idRange{{0, n, 0}}
+		}
+		return writeMerged(dst, ix1, ix1, paths1, nil, idMap, nil, n, opt)
+	}
+	map1, map2, n, err := unionMaps(ix1, ix2)
+	if err != nil {
+		return err
+	}
+	return writeMerged(dst, ix1, ix2, paths1, paths2, map1, map2, n, opt)
+}
+
+// unionMaps returns the docID maps merging the files of ix1 and ix2
+// by name, dropping those of ix1 also in ix2, and the number of files
+// merged.
+func unionMaps(ix1, ix2 *Index) (map1, map2 []idRange, n uint32, err error) {
+	add := func(m []idRange, id uint32) []idRange {
+		if k := len(m) - 1; k >= 0 && m[k].hi == id && m[k].new+m[k].hi-m[k].lo == n {
+			m[k].hi++
+		} else {
+			m = append(m, idRange{id, id + 1, n})
+		}
+		n++
+		return m
+	}
+	var i1, i2 uint32
+	var name1, name2 string
+	n1, n2 := uint32(ix1.numName), uint32(ix2.numName)
+	for i1 < n1 || i2 < n2 {
+		if i1 < n1 && name1 == "" {
+			if name1, err = ix1.Name(i1); err != nil {
+				return nil, nil, 0, err
+			}
+		}
+		if i2 < n2 && name2 == "" {
+			if name2, err = ix2.Name(i2); err != nil {
+				return nil, nil, 0, err
+			}
+		}
+		switch {
+		case i2 == n2 || i1 < n1 && name1 < name2:
+			map1 = add(map1, i1)
+			i1++
+			name1 = ""
+		case i1 < n1 && name1 == name2:
+			// Drop the file of ix1.
+			i1++
+			name1 = ""
+		default:
+			map2 = add(map2, i2)
+			i2++
+			name2 = ""
+		}
+	}
+	return map1, map2, n, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMergeN(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for name, data := range mergeFiles1 {
+		files[name] = data
+	}
+	for name, data := range mergeFiles2 {
+		files[name] = data
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	paths := []string{"/a", "/b", "/c"}
+
+	for n := 1; n <= 4; n++ {
+		// Split the files among n indexes in turn,
+		// as cindex does among its writers.
+		var srcs []string
+		for i := 0; i < n; i++ {
+			part := make(map[string]string)
+			for j := i; j < len(names); j += n {
+				part[names[j]] = files[names[j]]
+			}
+			src := filepath.Join(dir, "part"+string(rune('0'+i)))
+			buildIndex(t, src, paths, part)
+			srcs = append(srcs, src)
+		}
+		// The last index holds a newer copy of one file.
+		newer := filepath.Join(dir, "newer")
+		buildIndex(t, newer, paths, map[string]string{"/a/x": "hello again"})
+		srcs = append(srcs, newer)
+
+		out := filepath.Join(dir, "out")
+		if err := MergeN(out, srcs, nil); err != nil {
+			t.Fatalf("MergeN(%d): %v", n, err)
+		}
+		ix, err := Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for id := uint32(0); id < uint32(ix.NumNames()); id++ {
+			name, err := ix.Name(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, name)
+		}
+		if strings.Join(got, " ") != strings.Join(names, " ") {
+			t.Errorf("MergeN(%d): names %q, want %q", n, got, names)
+		}
+		if p, err := ix.Paths(); err != nil || strings.Join(p, " ") != strings.Join(paths, " ") {
+			t.Errorf("MergeN(%d): Paths() = %q, %v, want %q", n, p, err, paths)
+		}
+		for _, tt := range []struct {
+			trigram string
+			want    []uint32
+		}{
+			{"wor", []uint32{1, 2}},
+			{"hel", []uint32{0}},
+			{"aga", []uint32{0}},
+			{"now", []uint32{3, 5, 7}},
+			{"pot", []uint32{5, 6, 8}},
+		} {
+			l, err := ix.PostingList(tri(tt.trigram[0], tt.trigram[1], tt.trigram[2]))
+			if err != nil || !equalList(l, tt.want) {
+				t.Errorf("MergeN(%d): PostingList(%s) = %v, %v, want %v", n, tt.trigram, l, err, tt.want)
+			}
+		}
+		if _, err := ix.Verify(); err != nil {
+			t.Errorf("MergeN(%d): Verify: %v", n, err)
+		}
+		ix.Close()
+
+		// Only the output is left behind.
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(srcs)+1 {
+			t.Errorf("MergeN(%d) left %d files in %s, want %d", n, len(entries), dir, len(srcs)+1)
+		}
+		for _, src := range srcs {
+			os.Remove(src)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Parallel merging.
+//
+// Merging the flushed post entries into posting lists is the last and,
+// for a large index, longest step of Flush. The posting lists of
+// different trigrams are independent, so the merge splits the trigrams
+// into contiguous ranges, by their first byte, with about as many entries
+// in each, and merges the ranges concurrently, each into temporary files
+// of its own. The ranges are then copied into the index in order, with
+// the offsets in their index entries and skip indexes moved by the size
+// of the ranges before them.
+//
+// Splitting needs random access to the flushed entries, so only an index
+// that has flushed entries, and not compressed them, is merged in parts.
+// A smaller index is merged in one part, without the copying.
+
+// maxMergeParts is the most parts merged concurrently.
+const maxMergeParts = 16
+
+// numMergeParts returns the number of parts in which to merge the
+// posting lists.
+func (ix *Writer) numMergeParts() int {
+	if ix.CompressTemp {
+		return 1
+	}
+	if ix.mergeParts > 0 {
+		return ix.mergeParts
+	}
+	if len(ix.postFile) == 0 {
+		return 1
+	}
+	return min(runtime.GOMAXPROCS(0), maxMergeParts)
+}
+
+// A mergePart is one range of trigrams, merged concurrently with the others.
+type mergePart struct {
+	lo, hi uint32     // trigrams in [lo, hi)
+	data   *bufWriter // posting lists
+	index  *bufWriter // index entries, with offsets relative to data
+	skips  *skipWriter
+	err    error
+}
+
+// remove removes p's temporary files.
+func (p *mergePart) remove() {
+	if p.data != nil {
+		os.Remove(p.data.name)
+	}
+	if p.index != nil {
+		os.Remove(p.index.name)
+	}
+	if p.skips != nil {
+		p.skips.remove()
+	}
+}
+
+// mergePostParts is mergePost for an index with uncompressed flushed
+// entries, merging up to parts ranges of trigrams concurrently.
+func (ix *Writer) mergePostParts(out *bufWriter, skips *skipWriter, parts int) error {
+	chunks := [][]postEntry{ix.post}
+	for _, f := range ix.postFile {
+		data, err := mmapFile(f)
+		if err != nil {
+			return err
+		}
+		defer data.unmap()
+		chunks = append(chunks, postEntries(data))
+	}
+
+	// Split the first bytes of trigrams into ranges with about
+	// total/parts entries each.
+	var below [257]int // entries with first byte below b
+	for _, m := range chunks {
+		for b := range below {
+			below[b] += searchPost(m, uint32(b)<<16)
+		}
+	}
+	total := below[256]
+	bounds := []uint32{0}
+	for b := 1; b < 256 && len(bounds) < parts; b++ {
+		if below[b] >= total*len(bounds)/parts && below[b] > below[bounds[len(bounds)-1]] {
+			bounds = append(bounds, uint32(b))
+		}
+	}
+	bounds = append(bounds, 256)
+
+	ps := make([]*mergePart, len(bounds)-1)
+	for i := range ps {
+		ps[i] = &mergePart{lo: bounds[i] << 16, hi: bounds[i+1] << 16}
+		defer ps[i].remove()
+	}
+	var wg sync.WaitGroup
+	for i, p := range ps {
+		wg.Add(1)
+		go func(p *mergePart, end bool) {
+			defer wg.Done()
+			p.err = ix.mergePart(p, chunks, end)
+		}(p, i == len(ps)-1)
+	}
+	wg.Wait()
+
+	offset0 := out.offset()
+	for _, p := range ps {
+		if p.err != nil {
+			return p.err
+		}
+		base := out.offset() - offset0
+		if err := copyFile(out, p.data); err != nil {
+			return err
+		}
+		if err := copyOffsets(ix.postIndex, p.index, postEntrySize, base); err != nil {
+			return err
+		}
+		if err := skips.append(p.skips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergePart merges the entries of chunks with trigrams in p's range,
+// writing the posting lists to temporary files in p. If end is set,
+// it finishes with the list that ends the posting lists.
+func (ix *Writer) mergePart(p *mergePart, chunks [][]postEntry, end bool) error {
+	var err error
+	if p.data, err = bufCreateTemp(ix.TempDir); err != nil {
+		return err
+	}
+	if p.index, err = bufCreateTemp(ix.TempDir); err != nil {
+		return err
+	}
+	if p.skips, err = newSkipWriter(ix.TempDir); err != nil {
+		return err
+	}
+	h := postTree{file: ix.main.name}
+	for _, m := range chunks {
+		h.addMem(m[searchPost(m, p.lo):searchPost(m, p.hi)])
+	}
+	return writePostLists(&h, p.data, p.index, p.skips, 0, end)
+}
+
+// searchPost returns the index of the first entry in the sorted m
+// with a trigram at least t.
+func searchPost(m []postEntry, t uint32) int {
+	e := makePostEntry(t, 0)
+	return sort.Search(len(m), func(i int) bool { return m[i] >= e })
+}
+
+// copyOffsets copies the records of the given size in src to dst,
+// adding delta to the 4-byte offset that ends each record.
+func copyOffsets(dst, src *bufWriter, size int, delta uint32) error {
+	f, err := src.finish()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	rec := make([]byte, size)
+	for {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		off := rec[size-4:]
+		binary.BigEndian.PutUint32(off, binary.BigEndian.Uint32(off)+delta)
+		if err := dst.write(rec); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Metadata.
+//
+// An index may record its provenance, so that a shared index can be
+// audited. The "meta" section holds key/value pairs sorted by key, each
+// key followed by its value, both NUL-terminated. A Writer records the
+// pairs in its Metadata field. cindex records "created", the time it
+// started in RFC 3339 format; "hostname", the name of the host it ran
+// on; "tool", its name and version; and "flags", the flags it was run
+// with. Merging keeps the pairs of the newer index and those of the
+// older one with other keys, so an index updated by an incremental
+// cindex run describes that run.
+
+// metaSection returns a temporary file in dir holding the "meta"
+// section recording m, or nil if m is empty.
+func metaSection(dir string, m map[string]string) (*bufWriter, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	var keys []string
+	for k, v := range m {
+		if k == "" || strings.Contains(k, "\x00") || strings.Contains(v, "\x00") {
+			return nil, fmt.Errorf("invalid metadata %q=%q", k, v)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var list []string
+	for _, k := range keys {
+		list = append(list, k, m[k])
+	}
+	return stringSection(dir, list)
+}
+
+// Metadata returns the key/value pairs recording the provenance of the
+// index, as set by Writer.Metadata. It returns nil for an index that
+// records none, such as one written before they were recorded.
+func (ix *Index) Metadata() (map[string]string, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	s, ok := ix.sections["meta"]
+	if !ok {
+		return nil, nil
+	}
+	d, err := ix.slice(s.off, int(s.size))
+	if err != nil {
+		return nil, ix.inSection("meta", err)
+	}
+	m := make(map[string]string)
+	for len(d) > 0 {
+		i := bytes.IndexByte(d, 0)
+		j := -1
+		if i >= 0 {
+			j = bytes.IndexByte(d[i+1:], 0)
+		}
+		if j < 0 {
+			return nil, ix.corrupt("meta", s.off+s.size-uint32(len(d)), ErrTruncated)
+		}
+		m[string(d[:i])] = string(d[i+1 : i+1+j])
+		d = d[i+1+j+1:]
+	}
+	return m, nil
+}
+
+// mergeMetadata returns the metadata of the merge of ix1 and ix2,
+// preferring that of ix2, as the newer index.
+func mergeMetadata(ix1, ix2 *Index) (map[string]string, error) {
+	m, err := ix1.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	m2, err := ix2.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = make(map[string]string)
+	}
+	for k, v := range m2 {
+		m[k] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	dir := t.TempDir()
+	withMeta := func(meta map[string]string) func(*Writer) {
+		return func(ix *Writer) { ix.Metadata = meta }
+	}
+	oldMeta := map[string]string{"created": "2020-09-13T12:26:40Z", "hostname": "a", "owner": "rsc"}
+	updateMeta := map[string]string{"created": "2023-11-14T22:13:20Z", "hostname": "b", "flags": ""}
+	old := filepath.Join(dir, "old")
+	buildFlushIndex(t, old, []string{"/a"}, false, map[string]string{"/a/x": "hello world"}, withMeta(oldMeta))
+	update := filepath.Join(dir, "update")
+	buildFlushIndex(t, update, []string{"/b"}, false, map[string]string{"/b/y": "hello world"}, withMeta(updateMeta))
+	none := filepath.Join(dir, "none")
+	buildFlushIndex(t, none, []string{"/c"}, false, map[string]string{"/c/z": "hello world"}, nil)
+	merged := filepath.Join(dir, "merged")
+	if err := Merge(merged, old, update); err != nil {
+		t.Fatal(err)
+	}
+	upgraded := filepath.Join(dir, "upgraded")
+	if err := Upgrade(upgraded, old); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		file string
+		meta map[string]string
+	}{
+		{old, oldMeta},
+		{update, updateMeta},
+		{none, nil},
+		{merged, map[string]string{"created": "2023-11-14T22:13:20Z", "hostname": "b", "flags": "", "owner": "rsc"}},
+		{upgraded, oldMeta},
+	} {
+		ix, err := Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := ix.Metadata()
+		ix.Close()
+		if err != nil {
+			t.Errorf("%s: %v", filepath.Base(tt.file), err)
+			continue
+		}
+		if !reflect.DeepEqual(meta, tt.meta) {
+			t.Errorf("%s: Metadata() = %v, want %v", filepath.Base(tt.file), meta, tt.meta)
+		}
+	}
+
+	ix, err := Create(filepath.Join(dir, "bad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.Metadata = map[string]string{"a\x00b": "c"}
+	if err := ix.Flush(); err == nil {
+		t.Errorf("Flush with NUL in metadata key succeeded")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Daemon metrics.
+//
+// A Daemon counts the requests it answers and measures the time spent
+// in each phase of a search, so that the operators of a shared search
+// service can monitor it. WriteMetrics writes the metrics in the
+// Prometheus text exposition format, for csearchd to serve on /metrics.
+// The phases are: open, finding the index and reopening it if it has
+// been replaced; filter, applying the -lang, -path, and -repo filters;
+// query, evaluating the posting query; and names, looking up the names
+// of the files found.
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of
+// the request duration histogram.
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// candidateBuckets are the upper bounds of the buckets of the histogram
+// of files found by each search.
+var candidateBuckets = []float64{0, 1, 10, 100, 1000, 10000, 100000, 1000000}
+
+// A histogram counts observations in buckets, as a Prometheus histogram.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // counts[i] counts observations <= bounds[i] but not any earlier bound
+	sum    float64
+	n      uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// observe adds the observation v to h.
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.n++
+}
+
+// write writes h as the samples of the histogram called name,
+// with the given labels, which may be empty.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d\n", name, labelPrefix(labels), formatFloat(b), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labelPrefix(labels), h.n)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.n)
+}
+
+// labelPrefix returns labels followed by a comma, if there are any.
+func labelPrefix(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return labels + ","
+}
+
+// braces returns labels in braces, if there are any.
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// daemonMetrics are the metrics of a Daemon.
+type daemonMetrics struct {
+	mu           sync.Mutex
+	requests     map[[2]string]uint64 // by op and result
+	latency      map[string]*histogram
+	candidates   *histogram
+	postingBytes int64
+	cacheHits    uint64               // searches answered by a result cache
+	cacheMisses  uint64               // searches of indexes with a cache not answered by it
+	built        map[string]time.Time // build time of each open index, by name
+}
+
+// request records a request for op, which failed if err is not nil,
+// with the time spent in each phase.
+func (m *daemonMetrics) request(op string, err error, phases map[string]time.Duration) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[[2]string]uint64)
+		m.latency = make(map[string]*histogram)
+	}
+	m.requests[[2]string{op, result}]++
+	for phase, d := range phases {
+		h := m.latency[phase]
+		if h == nil {
+			h = newHistogram(latencyBuckets)
+			m.latency[phase] = h
+		}
+		h.observe(d.Seconds())
+	}
+}
+
+// search records a search that found n candidate files
+// and decoded postingBytes bytes of posting lists.
+func (m *daemonMetrics) search(n int, postingBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.candidates == nil {
+		m.candidates = newHistogram(candidateBuckets)
+	}
+	m.candidates.observe(float64(n))
+	m.postingBytes += postingBytes
+}
+
+// cached records a search of an index with a cache, which was answered
+// from the cache if hit is set.
+func (m *daemonMetrics) cached(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.cacheHits++
+	} else {
+		m.cacheMisses++
+	}
+}
+
+// opened records that the index named file, built at the given time,
+// or at an unknown time if built is zero, has been opened.
+func (m *daemonMetrics) opened(file string, built time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.built == nil {
+		m.built = make(map[string]time.Time)
+	}
+	m.built[file] = built
+}
+
+// closed records that the index named file has been closed.
+func (m *daemonMetrics) closed(file string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.built, file)
+}
+
+// WriteMetrics writes the daemon's metrics to w in the Prometheus text
+// exposition format:
+//
+//	csearchd_requests_total{op,result}         requests answered, by op and by result, ok or error
+//	csearchd_request_duration_seconds{phase}   histogram of time spent in each phase of a request
+//	csearchd_search_candidates                 histogram of files found by each search
+//	csearchd_posting_bytes_total               bytes of posting lists decoded by searches
+//	csearchd_cache_searches_total{result}      searches of indexes with a cache, by result, hit or miss
+//	csearchd_indexes_open                      indexes held open
+//	csearchd_index_age_seconds{index}          time since each open index was built, if known
+func (d *Daemon) WriteMetrics(w io.Writer) error {
+	m := &d.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP csearchd_requests_total Requests answered.\n")
+	fmt.Fprintf(bw, "# TYPE csearchd_requests_total counter\n")
+	var keys [][2]string
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(bw, "csearchd_requests_total{op=%s,result=%q} %d\n", quoteLabel(k[0]), k[1], m.requests[k])
+	}
+
+	fmt.Fprintf(bw, "# HELP csearchd_request_duration_seconds Time spent in each phase of a request.\n")
+	fmt.Fprintf(bw, "# TYPE csearchd_request_duration_seconds histogram\n")
+	var phases []string
+	for phase := range m.latency {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		m.latency[phase].write(bw, "csearchd_request_duration_seconds", "phase="+quoteLabel(phase))
+	}
+
+	fmt.Fprintf(bw, "# HELP csearchd_search_candidates Files found by each search, which might match.\n")
+	fmt.Fprintf(bw, "# TYPE csearchd_search_candidates histogram\n")
+	if m.candidates == nil {
+		m.candidates = newHistogram(candidateBuckets)
+	}
+	m.candidates.write(bw, "csearchd_search_candidates", "")
+
+	fmt.Fprintf(bw, "# HELP csearchd_posting_bytes_total Bytes of posting lists decoded by searches.\n")
+	fmt.Fprintf(bw, "# TYPE csearchd_posting_bytes_total counter\n")
+	fmt.Fprintf(bw, "csearchd_posting_bytes_total %d\n", m.postingBytes)
+
+	fmt.Fprintf(bw, "# HELP csearchd_cache_searches_total Searches of indexes with a result cache, by whether the cache answered them.\n")
+	fmt.Fprintf(bw, "# TYPE csearchd_cache_searches_total counter\n")
+	fmt.Fprintf(bw, "csearchd_cache_searches_total{result=\"hit\"} %d\n", m.cacheHits)
+	fmt.Fprintf(bw, "csearchd_cache_searches_total{result=\"miss\"} %d\n", m.cacheMisses)
+
+	fmt.Fprintf(bw, "# HELP csearchd_indexes_open Indexes held open.\n")
+	fmt.Fprintf(bw, "# TYPE csearchd_indexes_open gauge\n")
+	fmt.Fprintf(bw, "csearchd_indexes_open %d\n", len(m.built))
+
+	fmt.Fprintf(bw, "# HELP csearchd_index_age_seconds Time since each open index was built.\n")
+	fmt.Fprintf(bw, "# TYPE csearchd_index_age_seconds gauge\n")
+	var files []string
+	for file := range m.built {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	now := time.Now()
+	for _, file := range files {
+		if t := m.built[file]; !t.IsZero() {
+			fmt.Fprintf(bw, "csearchd_index_age_seconds{index=%s} %s\n", quoteLabel(file), formatFloat(now.Sub(t).Seconds()))
+		}
+	}
+	return bw.Flush()
+}
+
+// quoteLabel quotes a label value as the exposition format requires,
+// escaping only backslashes, double quotes, and newlines.
+func quoteLabel(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"path/filepath"
+	"regexp/syntax"
+	"strings"
+	"testing"
+
+	"github.com/andrewarchi/codesearch/trace"
+)
+
+func TestDaemonMetrics(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+
+	re, err := syntax.Parse("now", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := RegexpQuery(re)
+	d := new(Daemon)
+	for _, req := range []*daemonRequest{
+		{Op: "info", Index: out},
+		{Op: "search", Index: out, Query: q},
+		{Op: "search", Index: out, Query: q, Options: &SearchOptions{Prefix: "/c/"}},
+		{Op: "search", Index: filepath.Join(dir, "missing"), Query: q},
+		{Op: "bogus", Index: out},
+	} {
+		d.handle(req)
+	}
+
+	var b strings.Builder
+	if err := d.WriteMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	metrics := b.String()
+	for _, want := range []string{
+		`csearchd_requests_total{op="info",result="ok"} 1`,
+		`csearchd_requests_total{op="search",result="ok"} 2`,
+		`csearchd_requests_total{op="search",result="error"} 1`,
+		`csearchd_requests_total{op="unknown",result="error"} 1`,
+		`csearchd_request_duration_seconds_count{phase="open"} 5`,
+		`csearchd_request_duration_seconds_count{phase="query"} 2`,
+		`csearchd_request_duration_seconds_bucket{phase="query",le="+Inf"} 2`,
+		`csearchd_search_candidates_bucket{le="0"} 0`,
+		`csearchd_search_candidates_bucket{le="1"} 1`,
+		`csearchd_search_candidates_bucket{le="10"} 2`,
+		`csearchd_search_candidates_sum 3`,
+		`csearchd_search_candidates_count 2`,
+		`csearchd_indexes_open 1`,
+		`csearchd_index_age_seconds{index="` + out + `"} `,
+		"# TYPE csearchd_posting_bytes_total counter\ncsearchd_posting_bytes_total ",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics missing %q:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, "csearchd_posting_bytes_total 0\n") {
+		t.Errorf("searches decoded no posting list bytes:\n%s", metrics)
+	}
+}
+
+func TestDaemonTrace(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+
+	re, err := syntax.Parse("now|time", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	d := &Daemon{Tracer: trace.NewWriter(&b)}
+	resp := d.handle(&daemonRequest{Op: "search", Index: out, Query: RegexpQuery(re)})
+	if resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	tr := b.String()
+	for _, want := range []string{
+		"search ",
+		"\n  open ",
+		"\n  filter ",
+		"\n  query ",
+		"\n    postingQuery ",
+		" op=| ",
+		"\n  names ",
+	} {
+		if !strings.Contains(tr, want) {
+			t.Errorf("trace missing %q:\n%s", want, tr)
+		}
+	}
+}
@@ -37,3 +37,17 @@ func mmapFile(f *os.File) (*mmapData, error) {
 	}
 	return &mmapData{f, data[:n]}, nil
 }
+
+// unmap unmaps the data.
+func (m *mmapData) unmap() error {
+	if m.d == nil {
+		return nil
+	}
+	// The mapping is rounded up to a whole page.
+	return syscall.Munmap(m.d[:cap(m.d)])
+}
+
+// madvise does nothing; the advice is only a hint.
+func madvise(b []byte, advice int) error {
+	return nil
+}
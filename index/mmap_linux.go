@@ -29,3 +29,23 @@ func mmapFile(f *os.File) (*mmapData, error) {
 	}
 	return &mmapData{f, data[:n]}, nil
 }
+
+// unmap unmaps the data.
+func (m *mmapData) unmap() error {
+	if m.d == nil {
+		return nil
+	}
+	// The mapping is rounded up to a whole page.
+	return syscall.Munmap(m.d[:cap(m.d)])
+}
+
+// madvise gives the advice for b, which starts on a page boundary.
+func madvise(b []byte, advice int) error {
+	switch advice {
+	case adviseRandom:
+		return syscall.Madvise(b, syscall.MADV_RANDOM)
+	case adviseWillNeed:
+		return syscall.Madvise(b, syscall.MADV_WILLNEED)
+	}
+	return nil
+}
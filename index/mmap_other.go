@@ -0,0 +1,48 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || freebsd || linux || netbsd || openbsd || windows)
+
+package index
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// On systems without mmap, such as js/wasm, wasip1, and plan9,
+// mmapFile reads the whole file into memory instead.
+
+func mmapFile(f *os.File) (*mmapData, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("%s: too large to read", f.Name())
+	}
+	if size == 0 {
+		return &mmapData{f, nil}, nil
+	}
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("reading %s: %w", f.Name(), err)
+	}
+	return &mmapData{f, data}, nil
+}
+
+// unmap does nothing; the data is garbage collected.
+func (m *mmapData) unmap() error {
+	return nil
+}
+
+// madvise does nothing; the advice is only a hint.
+func madvise(b []byte, advice int) error {
+	return nil
+}
@@ -29,9 +29,24 @@ func mmapFile(f *os.File) (*mmapData, error) {
 	}
 
 	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ, 0, 0, 0)
+	// The view holds its own reference to the mapping.
+	syscall.CloseHandle(h)
 	if err != nil {
 		return nil, fmt.Errorf("MapViewOfFile %s: %w", f.Name(), err)
 	}
 	data := (*[1 << 30]byte)(unsafe.Pointer(addr))
 	return &mmapData{f, data[:size]}, nil
 }
+
+// unmap unmaps the data.
+func (m *mmapData) unmap() error {
+	if m.d == nil {
+		return nil
+	}
+	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&m.d[0])))
+}
+
+// madvise does nothing; the advice is only a hint.
+func madvise(b []byte, advice int) error {
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/andrewarchi/codesearch/norm"
+)
+
+// Normalization.
+//
+// An index written with Writer.Normalize set holds the n-grams of the
+// normalized text of its files. The "norm" section records the mode,
+// as its name NUL-terminated, so that a search can normalize both its
+// pattern and the files it reads the same way. An index without the
+// section holds the text unchanged.
+
+// normSection returns a temporary file in dir holding the "norm"
+// section recording m, or nil if m is norm.None.
+func normSection(dir string, m norm.Mode) (*bufWriter, error) {
+	if m == norm.None {
+		return nil, nil
+	}
+	return stringSection(dir, []string{m.String()})
+}
+
+// Normalization returns the normalization of the text in the index.
+func (ix *Index) Normalization() (norm.Mode, error) {
+	if err := ix.acquire(); err != nil {
+		return 0, err
+	}
+	defer ix.release()
+	s, ok := ix.sections["norm"]
+	if !ok {
+		return norm.None, nil
+	}
+	d, err := ix.sectionSlice("norm", 0, -1)
+	if err != nil {
+		return norm.None, err
+	}
+	i := bytes.IndexByte(d, 0)
+	if i < 0 {
+		return norm.None, ix.corrupt("norm", s.off, ErrTruncated)
+	}
+	var m norm.Mode
+	if err := m.Set(string(d[:i])); err != nil {
+		return norm.None, ix.corrupt("norm", s.off, ErrMalformed)
+	}
+	return m, nil
+}
+
+// mergeNormalization returns the normalization of the merge of ix1
+// and ix2, which must be the same for both.
+func mergeNormalization(ix1, ix2 *Index) (norm.Mode, error) {
+	m1, err := ix1.Normalization()
+	if err != nil {
+		return norm.None, err
+	}
+	m2, err := ix2.Normalization()
+	if err != nil {
+		return norm.None, err
+	}
+	if m1 != m2 {
+		return norm.None, fmt.Errorf("cannot merge index normalized as %v with index normalized as %v", m1, m2)
+	}
+	return m1, nil
+}
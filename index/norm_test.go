@@ -0,0 +1,85 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewarchi/codesearch/norm"
+)
+
+func TestNormalization(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"/src/composed":   "caf\u00e9 au lait\n",
+		"/src/decomposed": "cafe\u0301 au lait\n",
+		"/src/plain":      "cafe au lait\n",
+	}
+	composed := &Query{Op: QAnd, Trigram: []string{"af\xc3", "f\xc3\xa9"}}
+	plain := &Query{Op: QAnd, Trigram: []string{"afe", "fe "}}
+	for _, tt := range []struct {
+		mode   norm.Mode
+		q      *Query
+		want   []uint32
+		plainQ []uint32
+	}{
+		{norm.None, composed, []uint32{0}, []uint32{2}},
+		{norm.NFC, composed, []uint32{0, 1}, []uint32{2}},
+		{norm.Strip, composed, nil, []uint32{0, 1, 2}},
+	} {
+		file := filepath.Join(dir, tt.mode.String())
+		buildFlushIndex(t, file, []string{"/src"}, false, files, func(ix *Writer) { ix.Normalize = tt.mode })
+		ix, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err := ix.Normalization(); m != tt.mode || err != nil {
+			t.Errorf("%v: Normalization() = %v, %v", tt.mode, m, err)
+		}
+		if post, err := ix.PostingQuery(tt.q); err != nil || !equalList(post, tt.want) {
+			t.Errorf("%v: PostingQuery(café) = %v, %v, want %v", tt.mode, post, err, tt.want)
+		}
+		if post, err := ix.PostingQuery(plain); err != nil || !equalList(post, tt.plainQ) {
+			t.Errorf("%v: PostingQuery(cafe) = %v, %v, want %v", tt.mode, post, err, tt.plainQ)
+		}
+
+		// Export and import keep the normalization.
+		var dump bytes.Buffer
+		if err := ix.Export(&dump); err != nil {
+			t.Fatal(err)
+		}
+		imported := file + ".imported"
+		if err := Import(imported, &dump); err != nil {
+			t.Fatal(err)
+		}
+		ix2, err := Open(imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err := ix2.Normalization(); m != tt.mode || err != nil {
+			t.Errorf("%v: imported Normalization() = %v, %v", tt.mode, m, err)
+		}
+	}
+
+	// Merging keeps the normalization, which must agree.
+	update := filepath.Join(dir, "update")
+	buildFlushIndex(t, update, []string{"/src"}, false, map[string]string{"/src/plain": "caf\u00e9\n"}, func(ix *Writer) { ix.Normalize = norm.NFC })
+	merged := filepath.Join(dir, "merged")
+	if err := Merge(merged, filepath.Join(dir, "nfc"), update); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := ix.Normalization(); m != norm.NFC || err != nil {
+		t.Errorf("merged Normalization() = %v, %v, want nfc", m, err)
+	}
+	if err := Merge(merged, filepath.Join(dir, "none"), update); err == nil {
+		t.Errorf("Merge of index normalized as none with index normalized as nfc succeeded")
+	}
+}
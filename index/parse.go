@@ -0,0 +1,543 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+
+	"github.com/andrewarchi/codesearch/lang"
+	"github.com/andrewarchi/codesearch/regexp"
+)
+
+// Query language.
+//
+// ParseSearch parses a search written as a line of text, as a user
+// would type it into a search box, such as
+//
+//	foo file:\.go$ -file:_test lang:go case:no repo:backend
+//
+// The line is a list of atoms separated by spaces. These atoms filter
+// the files searched:
+//
+//	file:re    only files whose names match the regexp re
+//	-file:re   only files whose names do not match re
+//	lang:list  only files in the comma-separated languages
+//	repo:list  only files in the comma-separated repositories
+//	case:yes   match the text case-sensitively
+//	case:no    match the text case-insensitively
+//	case:auto  match case-insensitively unless the text has an upper-case
+//	           letter, the default
+//
+// Every other atom is text to search for. Adjacent text atoms are
+// joined by single spaces into a regular expression, so that foo bar
+// searches for the phrase "foo bar". Double quotes group text holding
+// spaces into one atom, as in "foo  bar" or file:"my dir/"; within them,
+// \" stands for a quote. Repeated file: and -file: atoms must all hold,
+// wherever they appear, while repeated lang: and repo: atoms add to the
+// lists of languages and repositories.
+//
+// The texts combine with the operators AND, OR, and NOT, in upper case,
+// and parentheses, as in
+//
+//	(openssl OR boringssl) AND NOT vendor
+//
+// NOT binds tightest and OR loosest; AND may be left out between a text
+// and a parenthesized group or NOT. Parentheses that balance within an
+// atom, as in (a|b), belong to its regular expression. A file matches
+// if its contents satisfy the expression, each text standing for
+// whether the file has a match of it. The trigram query of the search
+// requires the texts as the operators combine them, except those under
+// NOT, which cannot narrow it: the files found must be checked by Match.
+
+// A SearchQuery is a search parsed by ParseSearch.
+type SearchQuery struct {
+	Pattern  string      // regexp matching the texts not under NOT; "" for all files
+	Expr     *SearchExpr // the texts and operators, or nil if there are none
+	Files    []string    // regexps the file names must all match
+	NotFiles []string    // regexps the file names must not match
+	Langs    []lang.ID   // if non-nil, only files in these languages
+	Repos    []string    // if non-nil, only files in these repositories
+	Case     string      // "yes", "no", or "auto"
+
+	res map[*SearchExpr]*regexp.Regexp // compiled texts, for Match
+}
+
+// A SearchExpr is an expression of texts and operators in a search.
+type SearchExpr struct {
+	Op   SearchOp
+	Text string        // regexp, for SearchText
+	Sub  []*SearchExpr // operands, for the other ops
+}
+
+type SearchOp int
+
+const (
+	SearchText SearchOp = iota // The file has a match of Text
+	SearchAnd                  // All of Sub hold
+	SearchOr                   // At least one of Sub holds
+	SearchNot                  // Sub[0] does not hold
+)
+
+// ParseSearch parses the search s, written in the query language
+// described above.
+func ParseSearch(s string) (*SearchQuery, error) {
+	atoms, err := splitAtoms(s)
+	if err != nil {
+		return nil, err
+	}
+	sq := &SearchQuery{Case: "auto"}
+	var words []string // text atoms and operators
+	for _, atom := range atoms {
+		key, value, ok := strings.Cut(atom, ":")
+		if !ok || strings.Contains(key, `"`) {
+			key = "" // text, such as "foo:bar"
+		}
+		switch key {
+		case "file", "-file", "lang", "repo", "case":
+			value = unquoteAtom(value)
+			if value == "" {
+				return nil, fmt.Errorf("query: empty %s: atom", key)
+			}
+		}
+		switch key {
+		case "file":
+			sq.Files = append(sq.Files, value)
+		case "-file":
+			sq.NotFiles = append(sq.NotFiles, value)
+		case "lang":
+			for _, name := range strings.Split(value, ",") {
+				l, ok := lang.Lookup(name)
+				if !ok {
+					return nil, fmt.Errorf("query: unknown language %q; known languages: %s", name, strings.Join(lang.Names(), ", "))
+				}
+				sq.Langs = append(sq.Langs, l)
+			}
+		case "repo":
+			for _, name := range strings.Split(value, ",") {
+				if name != "" {
+					sq.Repos = append(sq.Repos, name)
+				}
+			}
+		case "case":
+			switch value {
+			case "yes", "no", "auto":
+				sq.Case = value
+			default:
+				return nil, fmt.Errorf("query: unknown case:%s; want yes, no, or auto", value)
+			}
+		default:
+			words = append(words, splitParens(atom)...)
+		}
+	}
+	if len(words) > 0 {
+		p := &exprParser{words: words}
+		if sq.Expr, err = p.parse(); err != nil {
+			return nil, err
+		}
+	}
+	var pos []string
+	var texts func(x *SearchExpr, neg bool) error
+	texts = func(x *SearchExpr, neg bool) error {
+		if x.Op != SearchText {
+			for _, sub := range x.Sub {
+				if err := texts(sub, neg != (x.Op == SearchNot)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if !neg {
+			pos = append(pos, x.Text)
+		}
+		_, err := regexp.CompileFlags(x.Text, sq.flags())
+		return err
+	}
+	if sq.Expr != nil {
+		if err := texts(sq.Expr, false); err != nil {
+			return nil, err
+		}
+	}
+	if len(pos) == 1 {
+		sq.Pattern = pos[0]
+	} else if len(pos) > 1 {
+		sq.Pattern = "(?:" + strings.Join(pos, ")|(?:") + ")"
+	}
+	return sq, nil
+}
+
+// isOperator reports whether the word of a search is an operator.
+func isOperator(w string) bool {
+	switch w {
+	case "AND", "OR", "NOT", "(", ")":
+		return true
+	}
+	return false
+}
+
+// An exprParser parses the words of a search into a SearchExpr.
+type exprParser struct {
+	words []string
+	pos   int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.words) {
+		return p.words[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	w := p.peek()
+	p.pos++
+	return w
+}
+
+func (p *exprParser) parse() (*SearchExpr, error) {
+	x, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.words) {
+		return nil, fmt.Errorf("query: unexpected %s", p.peek())
+	}
+	return x, nil
+}
+
+func (p *exprParser) or() (*SearchExpr, error) {
+	x, err := p.and()
+	for err == nil && p.peek() == "OR" {
+		p.next()
+		var y *SearchExpr
+		if y, err = p.and(); err == nil {
+			x = combine(SearchOr, x, y)
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) and() (*SearchExpr, error) {
+	x, err := p.unary()
+	for err == nil {
+		switch p.peek() {
+		case "AND":
+			p.next()
+		case "", "OR", ")":
+			return x, nil
+		}
+		var y *SearchExpr
+		if y, err = p.unary(); err == nil {
+			x = combine(SearchAnd, x, y)
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) unary() (*SearchExpr, error) {
+	switch w := p.next(); w {
+	case "":
+		return nil, fmt.Errorf("query: missing text at end")
+	case "NOT":
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &SearchExpr{Op: SearchNot, Sub: []*SearchExpr{x}}, nil
+	case "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("query: missing )")
+		}
+		return x, nil
+	case "AND", "OR", ")":
+		return nil, fmt.Errorf("query: unexpected %s", w)
+	default:
+		text := []string{unquoteAtom(w)}
+		for p.peek() != "" && !isOperator(p.peek()) {
+			text = append(text, unquoteAtom(p.next()))
+		}
+		return &SearchExpr{Op: SearchText, Text: strings.Join(text, " ")}, nil
+	}
+}
+
+// String returns the expression in the syntax of ParseSearch.
+func (x *SearchExpr) String() string {
+	var b strings.Builder
+	x.format(&b, SearchOr)
+	return b.String()
+}
+
+// format writes x to b, in parentheses if it binds more loosely than
+// an operand of outer.
+func (x *SearchExpr) format(b *strings.Builder, outer SearchOp) {
+	switch x.Op {
+	case SearchText:
+		if strings.ContainsAny(x.Text, " \t\r\n\"()") || isOperator(x.Text) {
+			b.WriteString(`"` + strings.ReplaceAll(x.Text, `"`, `\"`) + `"`)
+		} else {
+			b.WriteString(x.Text)
+		}
+		return
+	case SearchNot:
+		b.WriteString("NOT ")
+		x.Sub[0].format(b, SearchNot)
+		return
+	}
+	paren := outer == SearchNot || outer == SearchAnd && x.Op == SearchOr
+	if paren {
+		b.WriteString("(")
+	}
+	for i, sub := range x.Sub {
+		if i > 0 {
+			if x.Op == SearchAnd {
+				b.WriteString(" AND ")
+			} else {
+				b.WriteString(" OR ")
+			}
+		}
+		sub.format(b, x.Op)
+	}
+	if paren {
+		b.WriteString(")")
+	}
+}
+
+// combine returns the expression x op y, flattening x if it is one.
+func combine(op SearchOp, x, y *SearchExpr) *SearchExpr {
+	if x.Op == op {
+		x.Sub = append(x.Sub, y)
+		return x
+	}
+	return &SearchExpr{Op: op, Sub: []*SearchExpr{x, y}}
+}
+
+// splitParens splits off the parentheses at the start and end of
+// the atom that group operators: those left unbalanced by the
+// parentheses of the atom's regexp.
+func splitParens(atom string) []string {
+	opens, closes := 0, 0
+	inQuote := false
+	for i := 0; i < len(atom); i++ {
+		switch c := atom[i]; {
+		case c == '"':
+			inQuote = !inQuote
+		case c == '\\':
+			i++
+		case inQuote:
+		case c == '(':
+			opens++
+		case c == ')':
+			closes++
+		}
+	}
+	var words, after []string
+	for opens > closes && strings.HasPrefix(atom, "(") {
+		words = append(words, "(")
+		atom = atom[1:]
+		opens--
+	}
+	for closes > opens && strings.HasSuffix(atom, ")") && !strings.HasSuffix(atom, `\)`) {
+		after = append(after, ")")
+		atom = atom[:len(atom)-1]
+		closes--
+	}
+	if atom != "" {
+		words = append(words, atom)
+	}
+	return append(words, after...)
+}
+
+// splitAtoms splits s into atoms at the spaces outside double quotes.
+func splitAtoms(s string) ([]string, error) {
+	var atoms []string
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return atoms, nil
+		}
+		inQuote := false
+		i := 0
+		for ; i < len(s); i++ {
+			c := s[i]
+			if c == '"' {
+				inQuote = !inQuote
+			} else if c == '\\' && inQuote && i+1 < len(s) {
+				i++
+			} else if !inQuote && (c == ' ' || c == '\t' || c == '\n' || c == '\r') {
+				break
+			}
+		}
+		if inQuote {
+			return nil, fmt.Errorf("query: unterminated quote in %s", s[:i])
+		}
+		atoms = append(atoms, s[:i])
+		s = s[i:]
+	}
+}
+
+// unquoteAtom removes the double quotes from the text of an atom,
+// replacing each \" inside them by a quote.
+func unquoteAtom(s string) string {
+	if !strings.Contains(s, `"`) {
+		return s
+	}
+	var b strings.Builder
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+		case c == '\\' && inQuote && i+1 < len(s) && s[i+1] == '"':
+			b.WriteByte('"')
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// FoldCase reports whether the search matches text case-insensitively.
+func (sq *SearchQuery) FoldCase() bool {
+	switch sq.Case {
+	case "yes":
+		return false
+	case "no":
+		return true
+	}
+	var upper func(x *SearchExpr) bool
+	upper = func(x *SearchExpr) bool {
+		if x.Op == SearchText {
+			return strings.ContainsFunc(x.Text, unicode.IsUpper)
+		}
+		for _, sub := range x.Sub {
+			if upper(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return sq.Expr == nil || !upper(sq.Expr)
+}
+
+// flags returns the flags with which the search's texts are parsed.
+func (sq *SearchQuery) flags() syntax.Flags {
+	flags := syntax.Perl &^ syntax.OneLine
+	if sq.FoldCase() {
+		flags |= syntax.FoldCase
+	}
+	return flags
+}
+
+// Query returns the Query selecting the files that might match the
+// search's texts, using quadgrams if quad is set.
+func (sq *SearchQuery) Query(quad bool) *Query {
+	if sq.Expr == nil {
+		return &Query{Op: QAll}
+	}
+	return sq.Expr.query(sq.flags(), quad)
+}
+
+func (x *SearchExpr) query(flags syntax.Flags, quad bool) *Query {
+	switch x.Op {
+	case SearchText:
+		re, err := syntax.Parse(x.Text, flags)
+		if err != nil {
+			// Not parsed by ParseSearch: search all files.
+			return &Query{Op: QAll}
+		}
+		return regexpQuery(re, quad)
+	case SearchAnd, SearchOr:
+		q := x.Sub[0].query(flags, quad)
+		for _, sub := range x.Sub[1:] {
+			if x.Op == SearchAnd {
+				q = q.and(sub.query(flags, quad))
+			} else {
+				q = q.or(sub.query(flags, quad))
+			}
+		}
+		return q
+	}
+	// A file without a match of the text might have
+	// any trigrams, or none.
+	return &Query{Op: QAll}
+}
+
+// PostFilter reports whether the files found by the search's Query and
+// matching its Pattern must also be checked by Match, because the search
+// combines texts with operators.
+func (sq *SearchQuery) PostFilter() bool {
+	return sq.Expr != nil && sq.Expr.Op != SearchText
+}
+
+// Match reports whether the contents of a file, data, satisfy the
+// search's expression of texts and operators. Like a Regexp, a
+// SearchQuery is not safe for concurrent use by Match.
+func (sq *SearchQuery) Match(data []byte) bool {
+	if sq.Expr == nil {
+		return true
+	}
+	return sq.match(sq.Expr, data)
+}
+
+func (sq *SearchQuery) match(x *SearchExpr, data []byte) bool {
+	switch x.Op {
+	case SearchText:
+		re := sq.res[x]
+		if re == nil {
+			var err error
+			if re, err = regexp.CompileFlags(x.Text, sq.flags()); err != nil {
+				return false
+			}
+			if sq.res == nil {
+				sq.res = make(map[*SearchExpr]*regexp.Regexp)
+			}
+			sq.res[x] = re
+		}
+		return re.Match(data, true, true) >= 0
+	case SearchAnd:
+		for _, sub := range x.Sub {
+			if !sq.match(sub, data) {
+				return false
+			}
+		}
+		return true
+	case SearchOr:
+		for _, sub := range x.Sub {
+			if sq.match(sub, data) {
+				return true
+			}
+		}
+		return false
+	}
+	return !sq.match(x.Sub[0], data)
+}
+
+// Compile returns the Query selecting the files that might match the
+// search, as by sq.Query(quad); a Regexp matching its Pattern, as used
+// by Grep, or nil if the Pattern is empty; and the SearchOptions
+// restricting the search to the files passing its filters. As in
+// csearch, ^ and $ in the texts match at the start and end of each line.
+func (sq *SearchQuery) Compile(quad bool) (*Query, *regexp.Regexp, *SearchOptions, error) {
+	opt := &SearchOptions{Langs: sq.Langs, Repos: sq.Repos, Files: sq.Files, NotFiles: sq.NotFiles}
+	if _, err := opt.NameFilter(); err != nil {
+		return nil, nil, nil, err
+	}
+	if sq.Pattern == "" {
+		return sq.Query(quad), nil, opt, nil
+	}
+	re, err := regexp.CompileFlags(sq.Pattern, sq.flags())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return sq.Query(quad), re, opt, nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/andrewarchi/codesearch/lang"
+)
+
+var (
+	langGo, _     = lang.Lookup("go")
+	langPython, _ = lang.Lookup("python")
+)
+
+var parseSearchTests = []struct {
+	s    string
+	want *SearchQuery
+}{
+	{`foo`, &SearchQuery{Pattern: "foo", Expr: text("foo"), Case: "auto"}},
+	{`foo  bar`, &SearchQuery{Pattern: "foo bar", Expr: text("foo bar"), Case: "auto"}},
+	{`"foo  bar"`, &SearchQuery{Pattern: "foo  bar", Expr: text("foo  bar"), Case: "auto"}},
+	{`"say \"hi\""`, &SearchQuery{Pattern: `say "hi"`, Expr: text(`say "hi"`), Case: "auto"}},
+	{`\bfoo\b "a:b" http://x`, &SearchQuery{Pattern: `\bfoo\b a:b http://x`, Expr: text(`\bfoo\b a:b http://x`), Case: "auto"}},
+	{
+		`foo file:\.go$ -file:_test lang:go case:no repo:backend`,
+		&SearchQuery{
+			Pattern:  "foo",
+			Expr:     text("foo"),
+			Files:    []string{`\.go$`},
+			NotFiles: []string{"_test"},
+			Langs:    []lang.ID{langGo},
+			Repos:    []string{"backend"},
+			Case:     "no",
+		},
+	},
+	{
+		`file:"my dir/" file:x lang:go,python repo:a,b repo:c`,
+		&SearchQuery{
+			Files: []string{"my dir/", "x"},
+			Langs: []lang.ID{langGo, langPython},
+			Repos: []string{"a", "b", "c"},
+			Case:  "auto",
+		},
+	},
+	{`-foo -lang:go`, &SearchQuery{Pattern: "-foo -lang:go", Expr: text("-foo -lang:go"), Case: "auto"}},
+	{`file:`, nil},
+	{`lang:cobol`, nil},
+	{`case:maybe`, nil},
+	{`"foo`, nil},
+	{`foo(`, nil},
+}
+
+func text(s string) *SearchExpr {
+	return &SearchExpr{Op: SearchText, Text: s}
+}
+
+func TestParseSearch(t *testing.T) {
+	for _, tt := range parseSearchTests {
+		sq, err := ParseSearch(tt.s)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseSearch(%#q) = %+v, want error", tt.s, sq)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(sq, tt.want) {
+			t.Errorf("ParseSearch(%#q) = %+v, %v, want %+v", tt.s, sq, err, tt.want)
+		}
+	}
+}
+
+var parseBoolTests = []struct {
+	s       string
+	expr    string // Expr.String(), or "" for an error
+	pattern string
+}{
+	{`(openssl OR boringssl) AND NOT vendor`, `(openssl OR boringssl) AND NOT vendor`, `(?:openssl)|(?:boringssl)`},
+	{`(openssl OR boringssl) NOT vendor`, `(openssl OR boringssl) AND NOT vendor`, `(?:openssl)|(?:boringssl)`},
+	{`a b OR c AND d`, `"a b" OR c AND d`, `(?:a b)|(?:c)|(?:d)`},
+	{`a AND b AND c`, `a AND b AND c`, `(?:a)|(?:b)|(?:c)`},
+	{`NOT NOT a`, `NOT NOT a`, `a`},
+	{`NOT (a OR NOT b)`, `NOT (a OR NOT b)`, `b`},
+	{`( (a OR b) )`, `a OR b`, `(?:a)|(?:b)`},
+	{`((a))`, `"((a))"`, `((a))`},
+	{`(a|b) c`, `"(a|b) c"`, `(a|b) c`},
+	{`(\(a OR b\))`, `"\(a" OR "b\)"`, `(?:\(a)|(?:b\))`},
+	{`"AND" "OR" file:x`, `"AND OR"`, `AND OR`},
+	{`(a OR b`, ``, ``},
+	{`a OR b)`, ``, ``},
+	{`a AND`, ``, ``},
+	{`OR a`, ``, ``},
+	{`NOT`, ``, ``},
+	{`a AND ( )`, ``, ``},
+}
+
+func TestParseSearchBool(t *testing.T) {
+	for _, tt := range parseBoolTests {
+		sq, err := ParseSearch(tt.s)
+		if tt.expr == "" {
+			if err == nil {
+				t.Errorf("ParseSearch(%#q) = %s, want error", tt.s, sq.Expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSearch(%#q): %v", tt.s, err)
+			continue
+		}
+		if s := sq.Expr.String(); s != tt.expr || sq.Pattern != tt.pattern {
+			t.Errorf("ParseSearch(%#q) = %s, pattern %#q, want %s, pattern %#q", tt.s, s, sq.Pattern, tt.expr, tt.pattern)
+		}
+		// The expression parses back to itself.
+		sq2, err := ParseSearch(tt.expr)
+		if err != nil || sq2.Expr.String() != tt.expr {
+			t.Errorf("ParseSearch(%#q) = %v, %v, want %s", tt.expr, sq2.Expr, err, tt.expr)
+		}
+	}
+}
+
+func TestSearchQueryMatch(t *testing.T) {
+	sq, err := ParseSearch("(openssl OR boringssl) AND NOT vendor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sq.PostFilter() {
+		t.Error("PostFilter() = false, want true")
+	}
+	for _, tt := range []struct {
+		data string
+		want bool
+	}{
+		{"use openssl\n", true},
+		{"#include <boringssl.h>\n", true},
+		{"OpenSSL\n", true},
+		{"openssl\nfrom vendor/x\n", false},
+		{"libressl\n", false},
+	} {
+		if got := sq.Match([]byte(tt.data)); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+	if sq, _ := ParseSearch("foo"); sq.PostFilter() {
+		t.Error("PostFilter() = true for text only")
+	}
+}
+
+func TestSearchQueryFoldCase(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		fold bool
+	}{
+		{"foo", true},
+		{"Foo", false},
+		{"Foo case:no", true},
+		{"foo case:yes", false},
+		{"file:Foo foo", true},
+	} {
+		sq, err := ParseSearch(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fold := sq.FoldCase(); fold != tt.fold {
+			t.Errorf("ParseSearch(%#q).FoldCase() = %v, want %v", tt.s, fold, tt.fold)
+		}
+	}
+}
+
+func TestSearchQueryCompile(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	for _, tt := range []struct {
+		s    string
+		want []string
+	}{
+		{"WORLD", []string{}},
+		{"World case:no", []string{"/a/x", "/a/y"}},
+		{"world -file:y$", []string{"/a/x"}},
+		{"file:^/c/", []string{"/c/ab", "/c/de"}},
+		{"give file:^/c/ -file:b", []string{"/c/de"}},
+		{"all file:a -file:a", []string{}},
+		{"(world OR potatoes) AND NOT hello", []string{"/a/y", "/c/ab"}},
+		{"now AND (give OR time)", []string{"/b/xx", "/c/de"}},
+		{"NOT hello file:^/a/", []string{"/a/y"}},
+	} {
+		sq, err := ParseSearch(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, re, opt, err := sq.Compile(ix.HasQuadgrams())
+		if err != nil {
+			t.Fatalf("Compile(%#q): %v", tt.s, err)
+		}
+		if (re == nil) != (sq.Pattern == "") {
+			t.Errorf("Compile(%#q): Regexp = %v", tt.s, re)
+		}
+		names, err := ix.Search(q, opt)
+		if sq.PostFilter() {
+			// Check the candidates against the texts under NOT.
+			var match []string
+			for _, name := range names {
+				if sq.Match([]byte(mergeFiles1[name])) {
+					match = append(match, name)
+				}
+			}
+			names = match
+		}
+		if err != nil || !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("Search(%#q) = %q, %v, want %q", tt.s, names, err, tt.want)
+		}
+	}
+
+	sq, err := ParseSearch("foo file:(")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := sq.Compile(false); err == nil {
+		t.Error("Compile with invalid file regexp succeeded")
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"os"
+	"sort"
+)
+
+// Posting list skip entries.
+//
+// Intersecting a long posting list with a few files, as when a
+// selective query narrows the candidates to a short list before
+// reading the list of a common trigram, need not decode every entry of
+// the long list. The "skip" section holds, for each trigram posting
+// list of at least skipInterval entries, a table with an entry for
+// every skipInterval entries of the list: the skipInterval'th file ID,
+// the 2*skipInterval'th, and so on, each with the offset of the delta
+// following it, relative to the start of the list's deltas:
+//
+//	file ID [4]
+//	offset [4]
+//
+// The table of a list with count entries has count/skipInterval
+// entries. The "skipindex" section locates the tables, in increasing
+// order of trigram, with an entry for each:
+//
+//	trigram [3]
+//	offset [4]
+//
+// giving the offset of the table in the "skip" section. A reader
+// looking for a file ID at or after x can resume decoding after the
+// last skip entry with a file ID below x. A reader restricted to some
+// files looks for the next of them each time, whether they are checked
+// as a list or, when dense, as a bitmap, so that the stretches of a
+// long list between them are skipped. An index without these
+// sections, such as one written before they were added, is read by
+// decoding every entry.
+
+const (
+	skipInterval  = 128   // posting list entries per skip entry
+	skipEntrySize = 4 + 4 // size of a "skip" section entry
+	skipIndexSize = 3 + 4 // size of a "skipindex" section entry
+)
+
+// A skipWriter writes the skip tables of trigram posting lists
+// as the lists are written.
+type skipWriter struct {
+	data  *bufWriter // "skip" section
+	index *bufWriter // "skipindex" section
+	t     uint32     // trigram of the current list
+	start uint32     // offset of the current list's deltas in the output
+	n     uint32     // entries in the current list so far
+}
+
+// newSkipWriter returns a skipWriter writing to temporary files in dir.
+func newSkipWriter(dir string) (*skipWriter, error) {
+	data, err := bufCreateTemp(dir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := bufCreateTemp(dir)
+	if err != nil {
+		os.Remove(data.name)
+		return nil, err
+	}
+	return &skipWriter{data: data, index: index}, nil
+}
+
+// list starts the table of the posting list of trigram t,
+// whose deltas begin at offset start in the output.
+func (w *skipWriter) list(t, start uint32) {
+	w.t, w.start, w.n = t, start, 0
+}
+
+// add records the next entry of the current list, for fileID,
+// whose delta ends at offset end in the output.
+func (w *skipWriter) add(fileID, end uint32) error {
+	w.n++
+	if w.n%skipInterval != 0 {
+		return nil
+	}
+	if w.n == skipInterval {
+		if err := w.index.writeTrigram(w.t); err != nil {
+			return err
+		}
+		if err := w.index.writeUint32(w.data.offset()); err != nil {
+			return err
+		}
+	}
+	if err := w.data.writeUint32(fileID); err != nil {
+		return err
+	}
+	return w.data.writeUint32(end - w.start)
+}
+
+// sections returns the sections holding the tables written,
+// or nil if there are none.
+func (w *skipWriter) sections() []section {
+	if w.index.offset() == 0 {
+		return nil
+	}
+	return []section{{"skip", w.data}, {"skipindex", w.index}}
+}
+
+// append appends the tables written by p to those of w.
+func (w *skipWriter) append(p *skipWriter) error {
+	base := w.data.offset()
+	if err := copyFile(w.data, p.data); err != nil {
+		return err
+	}
+	return copyOffsets(w.index, p.index, skipIndexSize, base)
+}
+
+// remove removes w's temporary files.
+func (w *skipWriter) remove() {
+	os.Remove(w.data.name)
+	os.Remove(w.index.name)
+}
+
+// skipTable returns the skip table of the posting list of trigram,
+// which has count entries, or nil if the index has none for it.
+func (ix *Index) skipTable(trigram uint32, count int) ([]byte, error) {
+	s, ok := ix.sections["skipindex"]
+	if count < skipInterval || !ok {
+		return nil, nil
+	}
+	if s.size%skipIndexSize != 0 {
+		return nil, ix.corrupt("skipindex", s.off, ErrMalformed)
+	}
+	// binary search, reading only the entries probed
+	var err error
+	entry := func(i int) (t, off uint32) {
+		d, e := ix.sectionSlice("skipindex", uint32(i*skipIndexSize), skipIndexSize)
+		if e != nil {
+			err = e
+			return 1<<24 - 1, 0
+		}
+		return uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2]), binary.BigEndian.Uint32(d[3:])
+	}
+	n := int(s.size / skipIndexSize)
+	i := sort.Search(n, func(i int) bool {
+		t, _ := entry(i)
+		return t >= trigram
+	})
+	if i == n {
+		return nil, err
+	}
+	t, off := entry(i)
+	if err != nil || t != trigram {
+		return nil, err
+	}
+	return ix.sectionSlice("skip", off, count/skipInterval*skipEntrySize)
+}
+
+// seek advances r, using its skip table, past entries below id,
+// without decoding them. It may leave some such entries for next
+// to decode, but never moves r backward.
+func (r *postReader) seek(id uint32) {
+	if r.count <= 0 {
+		return
+	}
+	// Drop the skip entries already passed by decoding.
+	for len(r.skip) > 0 && r.fileID != ^uint32(0) && binary.BigEndian.Uint32(r.skip) <= r.fileID {
+		r.skip = r.skip[skipEntrySize:]
+		r.skipped++
+	}
+	if len(r.skip) == 0 || binary.BigEndian.Uint32(r.skip) >= id {
+		return
+	}
+	// Find the last skip entry below id.
+	n := len(r.skip) / skipEntrySize
+	j := sort.Search(n, func(j int) bool {
+		return binary.BigEndian.Uint32(r.skip[j*skipEntrySize:]) >= id
+	}) - 1
+	e := r.skip[j*skipEntrySize:]
+	off := binary.BigEndian.Uint32(e[4:])
+	if int(off) > len(r.data) {
+		// Corrupt; decode the entries instead.
+		r.skip = nil
+		return
+	}
+	r.skipped += j + 1
+	r.skip = r.skip[(j+1)*skipEntrySize:]
+	pos := r.start0 + off
+	r.start += pos - r.pos // count only the bytes decoded
+	r.pos = pos
+	r.d = r.data[off:]
+	r.fileID = binary.BigEndian.Uint32(e)
+	r.count = r.total - r.skipped*skipInterval
+}
+
+// nextBit returns the first file ID at or after id allowed by r's
+// restriction bitmap, or r.hi if there is none. It remembers the empty
+// stretch of the bitmap it found, so that the entries of the posting
+// list within the stretch, which seek may have to decode one by one,
+// do not each scan it again.
+func (r *postReader) nextBit(id uint32) uint32 {
+	if r.bitFrom <= id && id < r.bitNext {
+		return r.bitNext
+	}
+	next := r.hi
+	for i := int(id / 64); i < len(r.bits); i++ {
+		w := r.bits[i]
+		if i == int(id/64) {
+			w &= ^uint64(0) << (id % 64)
+		}
+		if w != 0 {
+			next = uint32(i)*64 + uint32(bits.TrailingZeros64(w))
+			break
+		}
+	}
+	r.bitFrom, r.bitNext = id, next
+	return next
+}
+
+// verifySkips checks the skip table of the posting list of trigram
+// against the list itself, whose entries are list, as decoded from the
+// posting list data starting at offset start, the first delta.
+func (ix *Index) verifySkips(trigram uint32, list []uint32, start uint32) error {
+	tab, err := ix.skipTable(trigram, len(list))
+	if err != nil || tab == nil {
+		return err
+	}
+	d, err := ix.slice(start, listSize(start, len(list), ix.postIndex))
+	if err != nil {
+		return ix.inSection("posting list", err)
+	}
+	off := 0
+	for i, id := range list {
+		_, n := binary.Uvarint(d[off:])
+		off += n
+		if (i+1)%skipInterval != 0 {
+			continue
+		}
+		e := tab[((i+1)/skipInterval-1)*skipEntrySize:]
+		if binary.BigEndian.Uint32(e) != id || binary.BigEndian.Uint32(e[4:]) != uint32(off) {
+			return ix.corrupt("skip", ix.sections["skip"].off, ErrMalformed)
+		}
+	}
+	return nil
+}
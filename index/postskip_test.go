@@ -0,0 +1,123 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestPostingSkips(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "index")
+	files, ids := skewFiles(5000)
+	buildIndex(t, out, nil, files)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	com := tri('c', 'o', 'm')
+	tab, err := ix.skipTable(com, len(ids["com"]))
+	if err != nil || len(tab) != len(ids["com"])/skipInterval*skipEntrySize {
+		t.Fatalf("skipTable(com) = %d bytes, %v, want %d", len(tab), err, len(ids["com"])/skipInterval*skipEntrySize)
+	}
+	if tab, err := ix.skipTable(tri('r', 'a', 'r'), len(ids["rar"])); tab != nil || err != nil {
+		t.Errorf("skipTable(rar) = %d bytes, %v, want none for a short list", len(tab), err)
+	}
+
+	// Intersecting the short list with the long one skips most of it.
+	before := ix.PostingBytes()
+	if _, err := ix.PostingList(com); err != nil {
+		t.Fatal(err)
+	}
+	full := ix.PostingBytes() - before
+	short := []uint32{5, 1500, 2003, 3101, 4702}
+	want := []uint32{5, 1500, 3101, 4702}
+	before = ix.PostingBytes()
+	got, err := ix.PostingAnd(append([]uint32(nil), short...), com)
+	if err != nil || !equalList(got, want) {
+		t.Errorf("PostingAnd(%v, com) = %v, %v, want %v", short, got, err, want)
+	}
+	if n := ix.PostingBytes() - before; n > full/4 {
+		t.Errorf("PostingAnd(%v, com) decoded %d of %d bytes", short, n, full)
+	}
+	got, err = ix.PostingQueryRestrict(&Query{Op: QAnd, Trigram: []string{"com"}}, short)
+	if err != nil || !equalList(got, want) {
+		t.Errorf("PostingQueryRestrict(com, %v) = %v, %v, want %v", short, got, err, want)
+	}
+
+	// So does a dense restriction, checked with a bitmap, that
+	// leaves out long stretches of the list.
+	var clustered, wantClustered []uint32
+	for id := uint32(0); id < 5000; id++ {
+		if id < 100 || id >= 4900 {
+			clustered = append(clustered, id)
+			if id%10 != 3 {
+				wantClustered = append(wantClustered, id)
+			}
+		}
+	}
+	before = ix.PostingBytes()
+	got, err = ix.PostingQueryRestrict(&Query{Op: QAnd, Trigram: []string{"com"}}, clustered)
+	if err != nil || !equalList(got, wantClustered) {
+		t.Errorf("PostingQueryRestrict(com, clustered) = %v, %v, want %v", got, err, wantClustered)
+	}
+	if n := ix.PostingBytes() - before; n > full/4 {
+		t.Errorf("PostingQueryRestrict(com, clustered) decoded %d of %d bytes", n, full)
+	}
+	got, err = ix.PostingQueryRange(&Query{Op: QAnd, Trigram: []string{"com"}}, 4000, 4010, nil)
+	if want := []uint32{4000, 4001, 4002, 4004, 4005, 4006, 4007, 4008, 4009}; err != nil || !equalList(got, want) {
+		t.Errorf("PostingQueryRange(com, 4000, 4010) = %v, %v, want %v", got, err, want)
+	}
+
+	it := ix.Postings(com)
+	for _, target := range []uint32{0, 3, 1000, 1003, 1003, 2500, 4999, 5000} {
+		want, wantOK := target, target < 5000
+		if target%10 == 3 {
+			want++
+		}
+		if id, ok := it.Seek(target); id != want && wantOK || ok != wantOK {
+			t.Errorf("Seek(%d) = %d, %v, want %d, %v", target, id, ok, want, wantOK)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Error(err)
+	}
+	if _, err := ix.Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// Rewriting the index, by Upgrade or through a dump, keeps the tables.
+	upgraded := filepath.Join(dir, "upgraded")
+	if err := Upgrade(upgraded, out); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if err := ix.Export(&dump); err != nil {
+		t.Fatal(err)
+	}
+	imported := filepath.Join(dir, "imported")
+	if err := Import(imported, &dump); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{upgraded, imported} {
+		ix2, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix2.Close()
+		for _, name := range []string{"skip", "skipindex"} {
+			if !bytes.Equal(ix2.section(name), ix.section(name)) {
+				t.Errorf("%s: %q section differs from original", filepath.Base(file), name)
+			}
+		}
+		if _, err := ix2.Verify(); err != nil {
+			t.Errorf("%s: Verify: %v", filepath.Base(file), err)
+		}
+	}
+}
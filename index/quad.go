@@ -0,0 +1,260 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Quadgram posting lists.
+//
+// A query may name quadgrams (4-byte strings) alongside trigrams,
+// as produced by RegexpQuadQuery. Indexes written with Writer.Quadgrams
+// answer quadgrams from their "quad" sections. Other indexes answer a
+// quadgram abcd by intersecting the posting lists of abc and bcd, which
+// is exactly what the trigram query would have done.
+
+const quadEntrySize = 4 + 4 + 4
+
+// HasQuadgrams reports whether the index has quadgram posting lists.
+func (ix *Index) HasQuadgrams() bool {
+	_, ok := ix.sections["quadindex"]
+	return ok
+}
+
+// numQuad returns the number of quadgram posting lists.
+func (ix *Index) numQuad() int {
+	return len(ix.section("quadindex")) / quadEntrySize
+}
+
+// quadAt returns the i'th quadgram index entry.
+func (ix *Index) quadAt(i int) (quad, count, offset uint32, err error) {
+	d, err := ix.sectionSlice("quadindex", uint32(i*quadEntrySize), quadEntrySize)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return binary.BigEndian.Uint32(d), binary.BigEndian.Uint32(d[4:]), binary.BigEndian.Uint32(d[8:]), nil
+}
+
+func (ix *Index) findQuad(quad uint32) (count int, offset uint32, err error) {
+	n := ix.numQuad()
+	i := sort.Search(n, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var q uint32
+		q, _, _, err = ix.quadAt(i)
+		return err != nil || q >= quad
+	})
+	if err != nil || i >= n {
+		return 0, 0, err
+	}
+	q, c, off, err := ix.quadAt(i)
+	if err != nil || q != quad {
+		return 0, 0, err
+	}
+	return int(c), off, nil
+}
+
+// quadList returns the encoded posting list for the quadgram
+// index entry with the given count and offset.
+func (ix *Index) quadList(count int, offset uint32) ([]byte, error) {
+	s := ix.sections["quad"]
+	return ix.sectionSlice("quad", offset+4, listSize(offset+4, count, s.size))
+}
+
+func (r *postReader) initQuad(ix *Index, quad uint32, restrict *restriction) error {
+	count, offset, err := ix.findQuad(quad)
+	if count == 0 || err != nil {
+		return err
+	}
+	d, err := ix.quadList(count, offset)
+	if err != nil {
+		return err
+	}
+	r.ix = ix
+	r.section = "quad"
+	r.count = count
+	r.offset = offset
+	r.pos = ix.sections["quad"].off + offset + 4
+	r.start = r.pos
+	r.fileID = ^uint32(0)
+	r.d = d
+	r.setRestriction(restrict)
+	return nil
+}
+
+func gramTrigram(g string) uint32 {
+	return uint32(g[0])<<16 | uint32(g[1])<<8 | uint32(g[2])
+}
+
+func gramQuad(g string) uint32 {
+	return uint32(g[0])<<24 | uint32(g[1])<<16 | uint32(g[2])<<8 | uint32(g[3])
+}
+
+// gramList returns the posting list for g, a trigram or quadgram.
+func (ix *Index) gramList(g string, restrict *restriction) ([]uint32, error) {
+	if len(g) == 3 {
+		return ix.postingList(gramTrigram(g), restrict)
+	}
+	if !ix.HasQuadgrams() {
+		list, err := ix.postingList(gramTrigram(g), restrict)
+		if len(list) == 0 || err != nil {
+			return list, err
+		}
+		return ix.postingAnd(list, gramTrigram(g[1:]), restrict)
+	}
+	var r postReader
+	if err := r.initQuad(ix, gramQuad(g), restrict); err != nil {
+		return nil, err
+	}
+	return r.list()
+}
+
+// gramAnd returns the intersection of list and the posting list for g,
+// a trigram or quadgram.
+func (ix *Index) gramAnd(list []uint32, g string, restrict *restriction) ([]uint32, error) {
+	if len(g) == 3 {
+		return ix.postingAnd(list, gramTrigram(g), restrict)
+	}
+	if !ix.HasQuadgrams() {
+		list, err := ix.postingAnd(list, gramTrigram(g), restrict)
+		if len(list) == 0 || err != nil {
+			return list, err
+		}
+		return ix.postingAnd(list, gramTrigram(g[1:]), restrict)
+	}
+	var r postReader
+	if err := r.initQuad(ix, gramQuad(g), restrict); err != nil {
+		return nil, err
+	}
+	return r.and(list)
+}
+
+// gramOr returns the union of list and the posting list for g,
+// a trigram or quadgram, storing it in buf if buf is large enough.
+func (ix *Index) gramOr(list []uint32, g string, restrict *restriction, buf []uint32) ([]uint32, error) {
+	if len(g) == 3 {
+		return ix.postingOr(list, gramTrigram(g), restrict, buf)
+	}
+	list1, err := ix.gramList(g, restrict)
+	if err != nil {
+		return nil, err
+	}
+	return mergeOr(list, list1, buf), nil
+}
+
+// gramCount returns the number of files containing g, a trigram or
+// quadgram. Without quadgram posting lists, the count for a quadgram
+// is an upper bound.
+func (ix *Index) gramCount(g string) (int, error) {
+	if len(g) == 4 && ix.HasQuadgrams() {
+		count, _, err := ix.findQuad(gramQuad(g))
+		return count, err
+	}
+	count, _, err := ix.findList(gramTrigram(g))
+	if len(g) == 3 || err != nil {
+		return count, err
+	}
+	count1, _, err := ix.findList(gramTrigram(g[1:]))
+	if count1 < count {
+		count = count1
+	}
+	return count, err
+}
+
+// maxQuadBuf is the number of quadgrams buffered for a file before
+// duplicates are removed.
+const maxQuadBuf = 1 << 16
+
+// addQuad adds quad to the quadgrams for the current file.
+func (ix *Writer) addQuad(quad uint32) {
+	if len(ix.quad) >= maxQuadBuf && len(ix.quad) == cap(ix.quad) {
+		ix.compactQuad()
+		if len(ix.quad) > cap(ix.quad)/2 {
+			// Mostly distinct; let the buffer grow.
+			ix.quad = append(make([]uint32, 0, 2*cap(ix.quad)), ix.quad...)
+		}
+	}
+	ix.quad = append(ix.quad, quad)
+}
+
+// compactQuad sorts the quadgrams for the current file
+// and removes duplicates.
+func (ix *Writer) compactQuad() {
+	q := ix.quad
+	sort.Slice(q, func(i, j int) bool { return q[i] < q[j] })
+	w := 0
+	for _, x := range q {
+		if w == 0 || q[w-1] != x {
+			q[w] = x
+			w++
+		}
+	}
+	ix.quad = q[:w]
+}
+
+// flushQuad writes ix.quadPost to a new temporary file and
+// clears the slice.
+func (ix *Writer) flushQuad() error {
+	if len(ix.quadPost) == 0 {
+		return nil
+	}
+	ix.sort.sortQuad(ix.quadPost)
+	w, err := ix.writePostFile(ix.quadPost)
+	if err != nil {
+		return err
+	}
+	ix.quadPost = ix.quadPost[:0]
+	ix.quadFile = append(ix.quadFile, w)
+	return nil
+}
+
+// mergeQuad merges the flushed quadgram entries into posting lists,
+// returning temporary files holding the "quad" and "quadindex" sections.
+func (ix *Writer) mergeQuad() (data, index *bufWriter, err error) {
+	h := postTree{file: ix.main.name}
+	defer h.unmap()
+	for _, f := range ix.quadFile {
+		if err := h.addFile(f, ix.CompressTemp); err != nil {
+			return nil, nil, err
+		}
+	}
+	ix.sort.sortQuad(ix.quadPost)
+	h.addMem(ix.quadPost)
+
+	if data, err = bufCreateTemp(ix.TempDir); err != nil {
+		return nil, nil, err
+	}
+	var w postDataWriter
+	if err := w.init(data, ix.TempDir); err != nil {
+		return nil, nil, err
+	}
+	w.quad = true
+	started := false
+	for !h.empty() {
+		e := h.next()
+		if !started || e.trigram() != w.t {
+			if started {
+				if err := w.endTrigram(); err != nil {
+					return nil, nil, err
+				}
+			}
+			w.trigram(e.trigram())
+			started = true
+		}
+		if err := w.fileID(e.fileID()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := w.endTrigram(); err != nil {
+		return nil, nil, err
+	}
+	if h.err != nil {
+		return nil, nil, h.err
+	}
+	return data, w.postIndexFile, nil
+}
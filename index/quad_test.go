@@ -0,0 +1,198 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var quadQueryTests = []struct {
+	re string
+	q  string
+}{
+	{`Abcdef`, `"Abcd" "bcde" "cdef"`},
+	{`abc.*(defg|ghi)`, `"abc" ("defg"|"ghi")`},
+	{`ab[cde]fg`, `("abcf" "bcfg")|("abdf" "bdfg")|("abef" "befg")`},
+	{`ab.f`, `+`},
+}
+
+func TestRegexpQuadQuery(t *testing.T) {
+	for _, tt := range quadQueryTests {
+		re, err := syntax.Parse(tt.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := RegexpQuadQuery(re).String()
+		if q != tt.q {
+			t.Errorf("RegexpQuadQuery(%#q) = %#q, want %#q", tt.re, q, tt.q)
+		}
+	}
+}
+
+func buildQuadIndex(t *testing.T, out string, paths []string, doFlush bool, fileData map[string]string) {
+	ix, err := Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.start = testBuildTime
+	ix.Quadgrams = true
+	ix.AddPaths(paths)
+	var files []string
+	for name := range fileData {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		ix.Add(name, strings.NewReader(fileData[name]))
+		if doFlush {
+			if err := ix.flushQuad(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var quadRegexps = []string{
+	`now is`,
+	`world`,
+	`potatoes`,
+	`(party|aid) of`,
+	`xyzzy`,
+	`the`,
+}
+
+// checkQuadIndex checks that quadgram queries against ix find
+// the same files as trigram queries.
+func checkQuadIndex(t *testing.T, ix *Index) {
+	for _, s := range quadRegexps {
+		re, err := syntax.Parse(s, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ix.PostingQuery(RegexpQuery(re))
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := ix.PostingQuery(RegexpQuadQuery(re))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalList(have, want) {
+			t.Errorf("PostingQuery(RegexpQuadQuery(%#q)) = %v, want %v", s, have, want)
+		}
+	}
+}
+
+func TestQuadIndex(t *testing.T) {
+	for _, doFlush := range []bool{false, true} {
+		f, _ := os.CreateTemp("", "index-test")
+		out := f.Name()
+		f.Close()
+		defer os.Remove(out)
+		buildQuadIndex(t, out, mergePaths1, doFlush, mergeFiles1)
+
+		ix, err := Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ix.HasQuadgrams() {
+			t.Fatalf("HasQuadgrams() = false, want true")
+		}
+		checkQuadIndex(t, ix)
+
+		count, err := ix.gramCount("orld")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("gramCount(%q) = %d, want 2", "orld", count)
+		}
+	}
+
+	// Quadgram queries fall back to trigrams on indexes without quadgrams.
+	f, _ := os.CreateTemp("", "index-test")
+	out := f.Name()
+	f.Close()
+	defer os.Remove(out)
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.HasQuadgrams() {
+		t.Fatalf("HasQuadgrams() = true, want false")
+	}
+	checkQuadIndex(t, ix)
+}
+
+func TestQuadMerge(t *testing.T) {
+	var names []string
+	for i := 0; i < 4; i++ {
+		f, _ := os.CreateTemp("", "index-test")
+		names = append(names, f.Name())
+		f.Close()
+		defer os.Remove(f.Name())
+	}
+	buildQuadIndex(t, names[0], mergePaths1, false, mergeFiles1)
+	buildQuadIndex(t, names[1], mergePaths2, false, mergeFiles2)
+	buildIndex(t, names[2], mergePaths2, mergeFiles2)
+
+	if err := Merge(names[3], names[0], names[1]); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(names[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ix.HasQuadgrams() {
+		t.Fatalf("merged HasQuadgrams() = false, want true")
+	}
+	checkQuadIndex(t, ix)
+	count, err := ix.gramCount("pota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("gramCount(%q) = %d, want 3", "pota", count)
+	}
+
+	// Merging with an index without quadgrams drops them.
+	if err := Merge(names[3], names[0], names[2]); err != nil {
+		t.Fatal(err)
+	}
+	ix, err = Open(names[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.HasQuadgrams() {
+		t.Errorf("merged HasQuadgrams() = true, want false")
+	}
+	checkQuadIndex(t, ix)
+}
+
+func TestSortQuad(t *testing.T) {
+	// Entries arrive sorted by file ID.
+	post := []postEntry{
+		makePostEntry(0xfffefdfc, 0),
+		makePostEntry(0xfffefdfc, 1),
+		makePostEntry(0x61626364, 2),
+		makePostEntry(0x00010203, 5),
+		makePostEntry(0x61626365, 5),
+	}
+	var s postSorter
+	s.sortQuad(post)
+	for i := 1; i < len(post); i++ {
+		if post[i-1] > post[i] {
+			t.Fatalf("sortQuad: not sorted: %x", post)
+		}
+	}
+}
@@ -8,12 +8,14 @@ package index
 //
 // An index stored on disk has the format:
 //
-//	"csearch index 1\n"
+//	"csearch index 2\n"
 //	list of paths
 //	list of names
 //	list of posting lists
 //	name index
 //	posting list index
+//	sections
+//	section index
 //	trailer
 //
 // The list of paths is a sorted sequence of NUL-terminated file or directory names.
@@ -55,6 +57,32 @@ package index
 // of the possible trigrams are never seen, so omitting the missing
 // ones represents a significant storage savings.
 //
+// The sections hold optional data that not every reader needs, such as
+// per-file metadata. The section index is a sequence of entries, each
+// naming and locating one section:
+//
+//	name [NUL-terminated]
+//	offset [4]
+//	size [4]
+//
+// The section index ends with an empty name ("\x00"). Readers ignore
+// sections they do not recognize, so new sections can be added without
+// changing the format version.
+//
+// The "lang" section holds one byte per file: the lang.ID of file #0,
+// then file #1, and so on.
+//
+// The "exclude" section, if present, lists the patterns of files
+// excluded from the index, each NUL-terminated, for tools that update
+// the index to apply again. See Writer.AddExcludes.
+//
+// The experimental "quad" and "quadindex" sections, written only when
+// Writer.Quadgrams is set, hold posting lists for quadgrams (4-byte
+// sequences). They have the same form as the trigram posting lists and
+// posting list index, except that each quadgram takes 4 bytes and there
+// is no terminating "\xff\xff\xff" entry. Offsets in the quadgram index
+// are relative to the start of the "quad" section.
+//
 // The trailer has the form:
 //
 //	offset of path list [4]
@@ -62,28 +90,53 @@ package index
 //	offset of posting lists [4]
 //	offset of name index [4]
 //	offset of posting list index [4]
+//	offset of section index [4]
 //	"\ncsearch trailr\n"
+//
+// The header names the format version, currently FormatVersion.
+// Readers also accept older versions, and Upgrade rewrites an index
+// in an older format in the current one.
+//
+// Version 1 indexes ("csearch index 1\n") have neither sections nor a
+// section index, and their trailer omits the section index offset.
+//
+// An index file may also hold an index compressed with zstd, as described
+// in zstd.go.
 
 import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andrewarchi/codesearch/lang"
+	"github.com/andrewarchi/codesearch/trace"
 )
 
 const (
-	magic        = "csearch index 1\n"
+	magic        = "csearch index 2\n"
+	magicV1      = "csearch index 1\n"
 	trailerMagic = "\ncsearch trailr\n"
 )
 
+// FormatVersion is the version of the index format written by Writer,
+// Merge, and the other functions that create indexes.
+const FormatVersion = 2
+
 // An Index implements read-only access to a trigram index.
 type Index struct {
-	Verbose   bool
-	data      mmapData
+	Verbose   bool         // log details of searches
+	Logger    *slog.Logger // if nil, slog.Default()
+	file      string
+	data      indexData
 	pathData  uint32
 	nameData  uint32
 	postData  uint32
@@ -91,20 +144,136 @@ type Index struct {
 	postIndex uint32
 	numName   int
 	numPost   int
+	version   int
+	sections  map[string]sectionRange
+	fi        os.FileInfo // of the file opened, for Replaced
+	closed    atomic.Bool
+	readers   atomic.Int64 // calls in progress, which Close waits for
+	unmap     sync.Once    // closes data once Close is called and readers is 0
+	closeErr  error        // from closing data
+	postBytes atomic.Int64 // bytes of posting lists decoded, for PostingBytes
+}
+
+// A sectionRange locates a section in the index data.
+type sectionRange struct {
+	off, size uint32
 }
 
 const postEntrySize = 3 + 4 + 4
 
+// Open opens the index in the named file.
+//
+// Open maps the file into memory, unless $CSEARCHNOMMAP is set, as
+// for a file system where mapping files is slow or unreliable. If the
+// file cannot be mapped, as on some network and FUSE file systems, or
+// it is not mapped, Open reads it as needed instead, like OpenRead.
 func Open(file string) (*Index, error) {
-	mm, err := mmap(file)
+	return open(file, os.Getenv("CSEARCHNOMMAP") != "")
+}
+
+// OpenRead is like Open, but never maps the file into memory. Instead
+// it reads the file as needed, in blocks, keeping the most recently
+// used fileCacheBlocks blocks in memory.
+func OpenRead(file string) (*Index, error) {
+	return open(file, true)
+}
+
+// OpenStrict is like Open, but before returning it checks the whole
+// index with Verify: that the names and grams are sorted, that every
+// offset lies within the index, and that every posting list decodes to
+// its recorded length, ending where it should. A corrupt index, as from
+// an untrusted source or a replica copied in part, then fails to open
+// with a precise error, rather than giving wrong results or failing in
+// the middle of a search. OpenStrict reads all of the index, so it
+// takes time in proportion to the index's size.
+func OpenStrict(file string) (*Index, error) {
+	ix, err := Open(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ix.Verify(); err != nil {
+		ix.Close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+func open(file string, noMmap bool) (*Index, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	// Look up the file, for Replaced, before mapping it, so that no
+	// mapping is left behind if that fails. Once mapped, the data is
+	// closed, with the file, on any error.
+	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	if len(mm.d) < 4*4+len(trailerMagic) || string(mm.d[len(mm.d)-len(trailerMagic):]) != trailerMagic {
-		return nil, corrupt()
+	var data indexData
+	if !noMmap {
+		if mm, err := mmapFile(f); err == nil {
+			data = mm
+		}
+	}
+	if data == nil {
+		if data, err = readFile(f, fi.Size(), fileBlockSize, fileCacheBlocks); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	ix, err := openData(file, data)
+	if err != nil {
+		data.close()
+		return nil, err
+	}
+	ix.fi = fi
+	return ix, nil
+}
+
+// openData opens the index with the given name and data.
+func openData(file string, data indexData) (*Index, error) {
+	ix := &Index{file: file, data: data}
+	if isZstd(data) {
+		z, err := newZstdData(data)
+		if err != nil {
+			return nil, ix.inSection("seek table", err)
+		}
+		ix.data = z
+	}
+	size := ix.data.size()
+	if size < len(magic) {
+		return nil, ix.corrupt("header", 0, ErrTruncated)
+	}
+	head, err := ix.slice(0, len(magicV1))
+	if err != nil {
+		return nil, err
+	}
+	nOff := 6
+	switch string(head) {
+	case magic:
+		ix.version = 2
+	case magicV1:
+		ix.version = 1
+		nOff = 5
+	default:
+		if !bytes.HasPrefix(head, []byte(magic[:len(magic)-2])) {
+			return nil, ix.corrupt("header", 0, ErrMalformed)
+		}
+		return nil, fmt.Errorf("index %s: %w %q", file, ErrVersion, head)
+	}
+	if size < len(magic)+nOff*4+len(trailerMagic) {
+		return nil, ix.corrupt("trailer", 0, ErrTruncated)
+	}
+	n := uint32(size - len(trailerMagic) - nOff*4)
+	trailer, err := ix.slice(n, nOff*4+len(trailerMagic))
+	if err != nil {
+		return nil, err
+	}
+	if string(trailer[nOff*4:]) != trailerMagic {
+		return nil, ix.corrupt("trailer", n+uint32(nOff*4), ErrMalformed)
 	}
-	n := uint32(len(mm.d) - len(trailerMagic) - 5*4)
-	ix := &Index{data: *mm}
 	if ix.pathData, err = ix.uint32(n); err != nil {
 		return nil, err
 	}
@@ -120,22 +289,151 @@ func Open(file string) (*Index, error) {
 	if ix.postIndex, err = ix.uint32(n + 16); err != nil {
 		return nil, err
 	}
+	// The posting list index ends where the sections begin.
+	end := n
+	if nOff == 6 {
+		if end, err = ix.uint32(n + 20); err != nil {
+			return nil, err
+		}
+		if err := ix.readSections(end); err != nil {
+			return nil, err
+		}
+		for _, s := range ix.sections {
+			if s.off < end {
+				end = s.off
+			}
+		}
+	}
 	ix.numName = int((ix.postIndex-ix.nameIndex)/4) - 1
-	ix.numPost = int((n - ix.postIndex) / postEntrySize)
+	ix.numPost = int((end - ix.postIndex) / postEntrySize)
 	return ix, nil
 }
 
+// Close closes the index, unmapping its memory and closing its file.
+// Calls on ix begun after Close return errors matching ErrClosed. Calls
+// in progress when Close is called, in other goroutines, finish first:
+// the memory is unmapped when the last of them returns, and Close then
+// returns nil, the error of closing the file being lost. Byte slices
+// returned by NameBytes are valid only until Close. Closing a closed
+// index does nothing.
+func (ix *Index) Close() error {
+	if !ix.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if ix.readers.Load() == 0 {
+		ix.closeData()
+	}
+	return ix.closeErr
+}
+
+// acquire begins a call reading the data of ix, which Close waits for
+// until the matching call to release. It fails if ix is closed.
+func (ix *Index) acquire() error {
+	// Close sets closed before checking readers, and acquire counts
+	// the reader before checking closed, so that either Close sees
+	// the reader or the reader sees that ix is closed.
+	ix.readers.Add(1)
+	if ix.closed.Load() {
+		ix.release()
+		return fmt.Errorf("index %s: %w", ix.file, ErrClosed)
+	}
+	return nil
+}
+
+// release ends a call begun by acquire, closing the data of ix if it
+// was the last call in progress when ix was closed.
+func (ix *Index) release() {
+	if ix.readers.Add(-1) == 0 && ix.closed.Load() {
+		ix.closeData()
+	}
+}
+
+// closeData unmaps and closes the data of ix, once.
+func (ix *Index) closeData() {
+	ix.unmap.Do(func() { ix.closeErr = ix.data.close() })
+}
+
+// readSections reads the section index at the given offset.
+func (ix *Index) readSections(off uint32) error {
+	ix.sections = make(map[string]sectionRange)
+	for {
+		name, err := ix.str(off)
+		if err != nil {
+			return ix.inSection("section index", err)
+		}
+		if len(name) == 0 {
+			return nil
+		}
+		off += uint32(len(name) + 1)
+		d, err := ix.slice(off, 8)
+		if err != nil {
+			return ix.inSection("section index", err)
+		}
+		s := sectionRange{binary.BigEndian.Uint32(d), binary.BigEndian.Uint32(d[4:])}
+		if uint64(s.off)+uint64(s.size) > uint64(ix.data.size()) {
+			return ix.corrupt("section index", off, ErrTruncated)
+		}
+		ix.sections[string(name)] = s
+		off += 8
+	}
+}
+
+// section returns the data of the named section, or nil if the index
+// has no such section or it cannot be read.
+func (ix *Index) section(name string) []byte {
+	s, ok := ix.sections[name]
+	if !ok {
+		return nil
+	}
+	d, err := ix.slice(s.off, int(s.size))
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+// sectionSlice returns n bytes of the named section starting at the
+// given offset within the section. If n < 0, it returns the rest of
+// the section.
+func (ix *Index) sectionSlice(name string, off uint32, n int) ([]byte, error) {
+	s, ok := ix.sections[name]
+	if !ok || off > s.size || n >= 0 && uint64(off)+uint64(n) > uint64(s.size) {
+		return nil, ix.corrupt(name, s.off+off, ErrTruncated)
+	}
+	if n < 0 {
+		n = int(s.size - off)
+	}
+	d, err := ix.slice(s.off+off, n)
+	return d, ix.inSection(name, err)
+}
+
 // slice returns the slice of index data starting at the given byte offset.
 // If n >= 0, the slice must have length at least n and is truncated to length n.
+// Otherwise it extends to the end of the data, which for a remote index
+// means reading all of it; callers should bound n where they can.
 func (ix *Index) slice(off uint32, n int) ([]byte, error) {
+	if ix.closed.Load() {
+		return nil, fmt.Errorf("index %s: %w", ix.file, ErrClosed)
+	}
 	o := int(off)
-	if uint32(o) != off || n >= 0 && o+n > len(ix.data.d) {
-		return nil, corrupt()
+	size := ix.data.size()
+	if uint32(o) != off || o > size || n >= 0 && o+n > size {
+		return nil, ix.corrupt("", off, ErrTruncated)
 	}
 	if n < 0 {
-		return ix.data.d[o:], nil
+		n = size - o
+	}
+	d, err := ix.data.slice(o, n)
+	return d, ix.inSection("", err)
+}
+
+// boundedSlice is like slice but returns at most n bytes,
+// fewer if the data ends first.
+func (ix *Index) boundedSlice(off uint32, n int) ([]byte, error) {
+	if rest := ix.data.size() - int(off); rest < n {
+		n = rest
 	}
-	return ix.data.d[o : o+n], nil
+	return ix.slice(off, n)
 }
 
 // uint32 returns the uint32 value at the given offset in the index data.
@@ -149,25 +447,29 @@ func (ix *Index) uint32(off uint32) (uint32, error) {
 
 // uvarint returns the varint value at the given offset in the index data.
 func (ix *Index) uvarint(off uint32) (uint32, error) {
-	d, err := ix.slice(off, -1)
+	d, err := ix.boundedSlice(off, binary.MaxVarintLen32)
 	if err != nil {
 		return 0, err
 	}
 	v, n := binary.Uvarint(d)
 	if n <= 0 {
-		return 0, corrupt()
+		return 0, ix.corrupt("", off, ErrBadVarint)
 	}
 	return uint32(v), nil
 }
 
 // Paths returns the list of indexed paths.
 func (ix *Index) Paths() ([]string, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
 	off := ix.pathData
 	var x []string
 	for {
 		s, err := ix.str(off)
 		if err != nil {
-			return nil, err
+			return nil, ix.inSection("path list", err)
 		}
 		if len(s) == 0 {
 			break
@@ -178,32 +480,72 @@ func (ix *Index) Paths() ([]string, error) {
 	return x, nil
 }
 
+// Excludes returns the exclude patterns recorded in the index.
+func (ix *Index) Excludes() ([]string, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	s, ok := ix.sections["exclude"]
+	if !ok {
+		return nil, nil
+	}
+	d, err := ix.slice(s.off, int(s.size))
+	if err != nil {
+		return nil, ix.inSection("exclude", err)
+	}
+	var x []string
+	for len(d) > 0 {
+		i := bytes.IndexByte(d, 0)
+		if i < 0 {
+			return nil, ix.corrupt("exclude", s.off+s.size-uint32(len(d)), ErrTruncated)
+		}
+		x = append(x, string(d[:i]))
+		d = d[i+1:]
+	}
+	return x, nil
+}
+
 // NameBytes returns the name corresponding to the given file ID.
 func (ix *Index) NameBytes(fileID uint32) ([]byte, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
 	if fileID > uint32(ix.numName) {
 		return nil, fmt.Errorf("file ID %d out of range", fileID)
 	}
 	off, err := ix.uint32(ix.nameIndex + 4*fileID)
 	if err != nil {
-		return nil, err
+		return nil, ix.inSection("name index", err)
 	}
-	return ix.str(ix.nameData + off)
+	name, err := ix.str(ix.nameData + off)
+	return name, ix.inSection("name list", err)
 }
 
 func (ix *Index) str(off uint32) ([]byte, error) {
-	str, err := ix.slice(off, -1)
-	if err != nil {
-		return nil, err
-	}
-	i := bytes.IndexByte(str, '\x00')
-	if i < 0 {
-		return nil, corrupt()
+	// Read in growing chunks, since the length is not known
+	// and reading a remote index is costly.
+	for n := 256; ; n *= 2 {
+		str, err := ix.boundedSlice(off, n)
+		if err != nil {
+			return nil, err
+		}
+		if i := bytes.IndexByte(str, '\x00'); i >= 0 {
+			return str[:i], nil
+		}
+		if len(str) < n {
+			return nil, ix.corrupt("", off+uint32(len(str)), ErrTruncated)
+		}
 	}
-	return str[:i], nil
 }
 
 // Name returns the name corresponding to the given file ID.
 func (ix *Index) Name(fileID uint32) (string, error) {
+	if err := ix.acquire(); err != nil {
+		return "", err
+	}
+	defer ix.release()
 	name, err := ix.NameBytes(fileID)
 	if err != nil {
 		return "", err
@@ -213,6 +555,10 @@ func (ix *Index) Name(fileID uint32) (string, error) {
 
 // Names returns all file names in the index.
 func (ix *Index) Names() ([]string, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
 	names := make([]string, 0, ix.numName)
 	for i := 0; i < ix.numName; i++ {
 		name, err := ix.Name(uint32(i))
@@ -224,16 +570,139 @@ func (ix *Index) Names() ([]string, error) {
 	return names, nil
 }
 
+// Version returns the format version of the index, which is at most
+// FormatVersion.
+func (ix *Index) Version() int {
+	return ix.version
+}
+
 // NumNames returns the number of file names in the index.
 func (ix *Index) NumNames() int {
 	return ix.numName
 }
 
+// NameRange returns the range [lo, hi) of IDs of the files whose names
+// begin with prefix. Since names are stored in sorted order, those files
+// are numbered consecutively; the range is empty if there are none.
+func (ix *Index) NameRange(prefix string) (lo, hi uint32, err error) {
+	if err := ix.acquire(); err != nil {
+		return 0, 0, err
+	}
+	defer ix.release()
+	p := []byte(prefix)
+	search := func(start int, f func(name []byte) bool) uint32 {
+		i := sort.Search(ix.numName-start, func(i int) bool {
+			if err != nil {
+				return true
+			}
+			var name []byte
+			name, err = ix.NameBytes(uint32(start + i))
+			return err != nil || f(name)
+		})
+		return uint32(start + i)
+	}
+	lo = search(0, func(name []byte) bool {
+		return bytes.Compare(name, p) >= 0
+	})
+	hi = search(int(lo), func(name []byte) bool {
+		return !bytes.HasPrefix(name, p)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return lo, hi, nil
+}
+
+// FilesUnder returns the range of IDs of the files named path or in the
+// directory path or its subdirectories, which may be empty. Unlike
+// NameRange, it matches only whole path elements: the files under /a/b
+// do not include /a/bc. Like NameRange, it takes time logarithmic in the
+// number of files.
+func (ix *Index) FilesUnder(path string) (FileRange, error) {
+	if err := ix.acquire(); err != nil {
+		return FileRange{}, err
+	}
+	defer ix.release()
+	lo, hi, err := ix.NameRange(strings.TrimSuffix(path, string(filepath.Separator)) + string(filepath.Separator))
+	if err != nil || lo < hi {
+		return FileRange{lo, hi}, err
+	}
+	lo, hi, err = ix.NameRange(path)
+	if err != nil || lo == hi {
+		return FileRange{lo, lo}, err
+	}
+	name, err := ix.Name(lo)
+	if err != nil || name != path {
+		return FileRange{lo, lo}, err
+	}
+	return FileRange{lo, lo + 1}, nil
+}
+
+// Lang returns the language of the file with the given ID.
+// Files in indexes without language information are lang.Unknown.
+func (ix *Index) Lang(fileID uint32) (lang.ID, error) {
+	if err := ix.acquire(); err != nil {
+		return 0, err
+	}
+	defer ix.release()
+	if fileID >= uint32(ix.numName) {
+		return lang.Unknown, fmt.Errorf("file ID %d out of range", fileID)
+	}
+	d := ix.section("lang")
+	if d == nil {
+		return lang.Unknown, nil
+	}
+	if len(d) != ix.numName {
+		return lang.Unknown, ix.corrupt("lang", ix.sections["lang"].off, ErrMalformed)
+	}
+	return lang.ID(d[fileID]), nil
+}
+
+// FilesByLang returns the sorted IDs of the files in any of the given
+// languages. The result is non-nil, so it can be used as the restrict
+// list of PostingQueryRestrict.
+func (ix *Index) FilesByLang(langs ...lang.ID) ([]uint32, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	var want [256]bool
+	for _, l := range langs {
+		want[l] = true
+	}
+	list := []uint32{}
+	d := ix.section("lang")
+	if d == nil {
+		if want[lang.Unknown] {
+			return ix.allFiles(), nil
+		}
+		return list, nil
+	}
+	if len(d) != ix.numName {
+		return nil, ix.corrupt("lang", ix.sections["lang"].off, ErrMalformed)
+	}
+	for i, l := range d {
+		if want[l] {
+			list = append(list, uint32(i))
+		}
+	}
+	return list, nil
+}
+
+// allFiles returns the IDs of all files in the index.
+func (ix *Index) allFiles() []uint32 {
+	list := make([]uint32, ix.numName)
+	for i := range list {
+		list[i] = uint32(i)
+	}
+	return list
+}
+
 // listAt returns the index list entry at the given offset.
 func (ix *Index) listAt(off uint32) (trigram, count, offset uint32, err error) {
 	d, err := ix.slice(ix.postIndex+off, postEntrySize)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, ix.inSection("posting index", err)
 	}
 	trigram = uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2])
 	count = binary.BigEndian.Uint32(d[3:])
@@ -241,6 +710,60 @@ func (ix *Index) listAt(off uint32) (trigram, count, offset uint32, err error) {
 	return
 }
 
+// A TrigramInfo describes the posting list of a trigram.
+type TrigramInfo struct {
+	Trigram uint32 // the trigram, in the low 24 bits
+	Count   int    // number of files containing the trigram
+	Offset  uint32 // offset of the posting list in the posting list data
+}
+
+// NumTrigrams returns the number of trigrams in the index.
+func (ix *Index) NumTrigrams() int {
+	n := ix.numPost
+	// The list of posting lists ends with an empty list for 0xffffff.
+	if n > 0 {
+		if t, c, _, err := ix.listAt(uint32(n-1) * postEntrySize); err == nil && t == 1<<24-1 && c == 0 {
+			n--
+		}
+	}
+	return n
+}
+
+// TrigramAt returns the i'th trigram in the index, in increasing order,
+// for 0 <= i < NumTrigrams().
+func (ix *Index) TrigramAt(i int) (TrigramInfo, error) {
+	if err := ix.acquire(); err != nil {
+		return TrigramInfo{}, err
+	}
+	defer ix.release()
+	if i < 0 || i >= ix.numPost {
+		return TrigramInfo{}, fmt.Errorf("trigram %d out of range", i)
+	}
+	t, c, off, err := ix.listAt(uint32(i) * postEntrySize)
+	if err != nil {
+		return TrigramInfo{}, err
+	}
+	return TrigramInfo{Trigram: t, Count: int(c), Offset: off}, nil
+}
+
+// Trigrams returns all the trigrams in the index, in increasing order.
+func (ix *Index) Trigrams() ([]TrigramInfo, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	n := ix.NumTrigrams()
+	list := make([]TrigramInfo, 0, n)
+	for i := 0; i < n; i++ {
+		info, err := ix.TrigramAt(i)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
 func (ix *Index) dumpPosting() error {
 	d, err := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
 	if err != nil {
@@ -251,83 +774,233 @@ func (ix *Index) dumpPosting() error {
 		t := uint32(d[j])<<16 | uint32(d[j+1])<<8 | uint32(d[j+2])
 		count := int(binary.BigEndian.Uint32(d[j+3:]))
 		offset := binary.BigEndian.Uint32(d[j+3+4:])
-		log.Printf("%#x: %d at %d", t, count, offset)
+		loggerOrDefault(ix.Logger).Info("posting list", "trigram", fmt.Sprintf("%#x", t), "count", count, "offset", offset)
 	}
 	return nil
 }
 
 func (ix *Index) findList(trigram uint32) (count int, offset uint32, err error) {
-	// binary search
-	d, err := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
-	if err != nil {
-		return 0, 0, err
-	}
+	// binary search, reading only the entries probed
 	i := sort.Search(ix.numPost, func(i int) bool {
-		i *= postEntrySize
-		t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
-		return t >= trigram
+		if err != nil {
+			return true
+		}
+		var t uint32
+		t, _, _, err = ix.listAt(uint32(i) * postEntrySize)
+		return err != nil || t >= trigram
 	})
-	if i >= ix.numPost {
-		return 0, 0, nil
+	if err != nil || i >= ix.numPost {
+		return 0, 0, err
 	}
-	i *= postEntrySize
-	t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
-	if t != trigram {
-		return 0, 0, nil
+	t, c, offset, err := ix.listAt(uint32(i) * postEntrySize)
+	if err != nil || t != trigram {
+		return 0, 0, err
 	}
-	count = int(binary.BigEndian.Uint32(d[i+3:]))
-	offset = binary.BigEndian.Uint32(d[i+3+4:])
-	return
+	return int(c), offset, nil
 }
 
 type postReader struct {
 	ix       *Index
+	section  string // for errors
 	count    int
 	offset   uint32
+	pos      uint32 // offset of d in the index data
+	start    uint32 // initial pos, for counting the bytes decoded
 	fileID   uint32
 	d        []byte
 	restrict []uint32
+	bits     []uint64 // if non-nil, the restriction's bitmap, used instead of restrict
+	lo, hi   uint32
+
+	// bits has no file IDs in [bitFrom, bitNext), as found by nextBit.
+	bitFrom, bitNext uint32
+
+	// Skip entries, for seek. See postskip.go.
+	skip    []byte // skip entries not yet passed
+	skipped int    // skip entries passed
+	total   int    // entries in the list
+	data    []byte // the whole list, from the first delta
+	start0  uint32 // offset of data in the index
+}
+
+// A restriction limits a posting query to a subset of the files.
+// A nil *restriction considers all files.
+type restriction struct {
+	list   []uint32  // if non-nil, only these file IDs, sorted
+	lo, hi uint32    // only file IDs in [lo, hi)
+	bits   []uint64  // bitmap of list, built by bitmap
+	once   sync.Once // builds bits
+}
+
+// bitmap returns a bitmap of the file IDs in rs.list, building it on
+// first use, or nil if the list is too sparse for one to pay off.
+// A restriction may be shared by the reads of many posting lists, as
+// Search shares one across the ranges it searches, so the bitmap is
+// built only once, even if they run concurrently.
+//
+// Checking a posting against the list means galloping through it,
+// which for a list of medium size costs a few probes per posting;
+// checking the bitmap costs one load. The bitmap is used only if it is
+// at most twice the size of the list, so building it costs little more
+// than reading the list, and a short list, which galloping and the
+// skip entries handle well, is checked as a list.
+func (rs *restriction) bitmap() []uint64 {
+	rs.once.Do(func() {
+		if len(rs.list) == 0 {
+			return
+		}
+		last := rs.list[len(rs.list)-1]
+		if int(last/64) >= len(rs.list) {
+			return
+		}
+		rs.bits = make([]uint64, last/64+1)
+		for _, id := range rs.list {
+			rs.bits[id/64] |= 1 << (id % 64)
+		}
+	})
+	return rs.bits
+}
+
+// files returns the IDs of the files allowed by rs.
+func (rs *restriction) files(ix *Index) []uint32 {
+	lo, hi := rs.lo, rs.hi
+	if hi > uint32(ix.numName) {
+		hi = uint32(ix.numName)
+	}
+	if rs.list == nil {
+		list := make([]uint32, 0, hi-lo)
+		for id := lo; id < hi; id++ {
+			list = append(list, id)
+		}
+		return list
+	}
+	list := rs.list
+	i := sort.Search(len(list), func(i int) bool { return list[i] >= lo })
+	j := sort.Search(len(list), func(i int) bool { return list[i] >= hi })
+	if i > j {
+		i = j
+	}
+	return list[i:j]
 }
 
-func (r *postReader) init(ix *Index, trigram uint32, restrict []uint32) error {
+// setRestriction limits r to the files allowed by rs.
+func (r *postReader) setRestriction(rs *restriction) {
+	r.lo, r.hi = 0, ^uint32(0)
+	r.restrict = nil
+	r.bits = nil
+	r.bitFrom, r.bitNext = 0, 0
+	if rs == nil {
+		return
+	}
+	r.lo, r.hi = rs.lo, rs.hi
+	r.restrict = rs.list
+	if bits := rs.bitmap(); bits != nil {
+		// No file outside the list's span can match.
+		first, last := rs.list[0], rs.list[len(rs.list)-1]
+		r.lo = max(r.lo, first)
+		if last < r.hi {
+			r.hi = last + 1
+		}
+		r.restrict = nil
+		r.bits = bits
+	}
+}
+
+func (r *postReader) init(ix *Index, trigram uint32, restrict *restriction) error {
 	count, offset, err := ix.findList(trigram)
 	if count == 0 || err != nil {
 		return err
 	}
-	d, err := ix.slice(ix.postData+offset+3, -1)
+	pos := ix.postData + offset + 3
+	d, err := ix.slice(pos, listSize(pos, count, ix.postIndex))
 	if err != nil {
-		return err
+		return ix.inSection("posting list", err)
 	}
 	r.ix = ix
+	r.section = "posting list"
 	r.count = count
 	r.offset = offset
+	r.pos = pos
+	r.start = pos
 	r.fileID = ^uint32(0)
 	r.d = d
-	r.restrict = restrict
+	r.setRestriction(restrict)
+	if r.skip, err = ix.skipTable(trigram, count); err != nil {
+		return err
+	}
+	r.total, r.data, r.start0 = count, d, pos
 	return nil
 }
 
+// listSize returns an upper bound on the size of the encoding of a
+// posting list with count entries starting at off and ending before end:
+// each delta takes at most binary.MaxVarintLen32 bytes, and a zero byte
+// terminates the list.
+func listSize(off uint32, count int, end uint32) int {
+	if off > end {
+		return 0
+	}
+	n := count*binary.MaxVarintLen32 + 1
+	if rest := int(end - off); rest < n {
+		n = rest
+	}
+	return n
+}
+
 func (r *postReader) max() int {
 	return int(r.count)
 }
 
 func (r *postReader) next() (bool, error) {
 	for r.count > 0 {
+		if r.skip != nil {
+			id := r.lo
+			if len(r.restrict) > 0 && r.restrict[0] > id {
+				id = r.restrict[0]
+			} else if r.bits != nil {
+				// Skip runs of the list outside a clustered
+				// restriction, such as the files of a few
+				// directories in another language.
+				id = r.nextBit(max(id, r.fileID+1))
+			}
+			r.seek(id)
+		}
 		r.count--
 		delta64, n := binary.Uvarint(r.d)
 		delta := uint32(delta64)
-		if n <= 0 || delta == 0 {
-			return false, corrupt()
+		if n <= 0 {
+			return false, r.ix.corrupt(r.section, r.pos, ErrBadVarint)
+		}
+		if delta == 0 {
+			return false, r.ix.corrupt(r.section, r.pos, ErrMalformed)
 		}
 		r.d = r.d[n:]
+		r.pos += uint32(n)
 		r.fileID += delta
-		if r.restrict != nil {
-			i := 0
-			for i < len(r.restrict) && r.restrict[i] < r.fileID {
-				i++
+		if r.fileID >= uint32(r.ix.numName) {
+			return false, r.ix.corrupt(r.section, r.pos-uint32(n), ErrFileID)
+		}
+		if r.fileID < r.lo {
+			continue
+		}
+		if r.fileID >= r.hi {
+			// No later entry can match; stop decoding.
+			r.count = 0
+			r.d = nil
+			break
+		}
+		if r.bits != nil {
+			if r.bits[r.fileID/64]&(1<<(r.fileID%64)) == 0 {
+				continue
 			}
-			r.restrict = r.restrict[i:]
-			if len(r.restrict) == 0 || r.restrict[0] != r.fileID {
+		} else if r.restrict != nil {
+			r.restrict = r.restrict[gallop(r.restrict, 0, r.fileID):]
+			if len(r.restrict) == 0 {
+				r.count = 0
+				r.d = nil
+				break
+			}
+			if r.restrict[0] != r.fileID {
 				continue
 			}
 		}
@@ -335,21 +1008,56 @@ func (r *postReader) next() (bool, error) {
 	}
 	// list should end with terminating 0 delta
 	if r.d != nil && (len(r.d) == 0 || r.d[0] != 0) {
-		return false, corrupt()
+		return false, r.ix.corrupt(r.section, r.pos, ErrMalformed)
 	}
 	r.fileID = ^uint32(0)
 	return false, nil
 }
 
+// PostingCount returns the number of files containing trigram,
+// the length of its posting list, without decoding the list.
+func (ix *Index) PostingCount(trigram uint32) (int, error) {
+	if err := ix.acquire(); err != nil {
+		return 0, err
+	}
+	defer ix.release()
+	count, _, err := ix.findList(trigram)
+	return count, err
+}
+
 func (ix *Index) PostingList(trigram uint32) ([]uint32, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
 	return ix.postingList(trigram, nil)
 }
 
-func (ix *Index) postingList(trigram uint32, restrict []uint32) ([]uint32, error) {
+func (ix *Index) postingList(trigram uint32, restrict *restriction) ([]uint32, error) {
 	var r postReader
 	if err := r.init(ix, trigram, restrict); err != nil {
 		return nil, err
 	}
+	return r.list()
+}
+
+// done adds the bytes of the posting list decoded by r to the count
+// returned by PostingBytes.
+func (r *postReader) done() {
+	if r.ix != nil {
+		r.ix.postBytes.Add(int64(r.pos - r.start))
+	}
+}
+
+// PostingBytes returns the number of bytes of posting lists, for
+// trigrams and quadgrams, that queries of ix have decoded.
+func (ix *Index) PostingBytes() int64 {
+	return ix.postBytes.Load()
+}
+
+// list returns the file IDs remaining in r.
+func (r *postReader) list() ([]uint32, error) {
+	defer r.done()
 	x := make([]uint32, 0, r.max())
 	for {
 		ok, err := r.next()
@@ -365,12 +1073,40 @@ func (ix *Index) postingList(trigram uint32, restrict []uint32) ([]uint32, error
 }
 
 func (ix *Index) PostingAnd(list []uint32, trigram uint32) ([]uint32, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
 	return ix.postingAnd(list, trigram, nil)
 }
 
-func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) ([]uint32, error) {
+func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict *restriction) ([]uint32, error) {
 	var r postReader
-	r.init(ix, trigram, restrict)
+	if err := r.init(ix, trigram, restrict); err != nil {
+		return nil, err
+	}
+	return r.and(list)
+}
+
+// and returns the intersection of list and the file IDs remaining in r,
+// reusing list's storage.
+//
+// The posting list is decoded entry by entry, except where its skip
+// entries allow skipping ahead to the next entry of list, decoding stops
+// after the last entry of list, and list is searched by galloping, so
+// that intersecting a short list with a long posting list, or a long
+// list with a short posting list, costs little more than the shorter one.
+func (r *postReader) and(list []uint32) ([]uint32, error) {
+	defer r.done()
+	if len(list) == 0 {
+		return list, nil
+	}
+	if r.lo < list[0] {
+		r.lo = list[0]
+	}
+	if last := list[len(list)-1]; last != ^uint32(0) && last+1 < r.hi {
+		r.hi = last + 1
+	}
 	x := list[:0]
 	i := 0
 	for {
@@ -382,25 +1118,75 @@ func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) ([
 			break
 		}
 		fileID := r.fileID
-		for i < len(list) && list[i] < fileID {
-			i++
+		i = gallop(list, i, fileID)
+		if i == len(list) {
+			break
 		}
-		if i < len(list) && list[i] == fileID {
+		if list[i] == fileID {
 			x = append(x, fileID)
 			i++
 		}
+		if i < len(list) && list[i] > r.lo {
+			// Let next skip ahead to list[i].
+			r.lo = list[i]
+		}
 	}
 	return x, nil
 }
 
+// gallop returns the smallest j >= i such that list[j] >= x, or len(list)
+// if there is none. It probes list[i+1], list[i+3], list[i+7], and so on
+// before searching between the last two probes, so finding an element d
+// entries ahead takes O(log d) steps rather than d.
+func gallop(list []uint32, i int, x uint32) int {
+	if i >= len(list) || list[i] >= x {
+		return i
+	}
+	// Invariant: list[lo] < x, and list[hi] >= x if hi < len(list).
+	lo, step := i, 1
+	hi := lo + step
+	for hi < len(list) && list[hi] < x {
+		lo = hi
+		step <<= 1
+		hi = lo + step
+	}
+	if hi > len(list) {
+		hi = len(list)
+	}
+	for hi-lo > 1 {
+		m := int(uint(lo+hi) >> 1)
+		if list[m] < x {
+			lo = m
+		} else {
+			hi = m
+		}
+	}
+	return hi
+}
+
 func (ix *Index) PostingOr(list []uint32, trigram uint32) ([]uint32, error) {
-	return ix.postingOr(list, trigram, nil)
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	return ix.postingOr(list, trigram, nil, nil)
 }
 
-func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) ([]uint32, error) {
+// postingOr returns the union of list and the posting list for trigram,
+// storing it in buf if buf is large enough. Buf must not overlap list.
+func (ix *Index) postingOr(list []uint32, trigram uint32, restrict *restriction, buf []uint32) ([]uint32, error) {
 	var r postReader
-	r.init(ix, trigram, restrict)
-	x := make([]uint32, 0, len(list)+r.max())
+	if err := r.init(ix, trigram, restrict); err != nil {
+		return nil, err
+	}
+	return r.or(list, buf)
+}
+
+// or returns the union of list and the file IDs remaining in r,
+// storing it in buf if buf is large enough.
+func (r *postReader) or(list, buf []uint32) ([]uint32, error) {
+	defer r.done()
+	x := growList(buf, len(list)+r.max())
 	i := 0
 	for {
 		ok, err := r.next()
@@ -424,71 +1210,165 @@ func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) ([]
 	return x, nil
 }
 
+// growList returns buf[:0] if buf has capacity for n entries,
+// or else a new empty slice with that capacity.
+func growList(buf []uint32, n int) []uint32 {
+	if cap(buf) < n {
+		return make([]uint32, 0, n)
+	}
+	return buf[:0]
+}
+
 func (ix *Index) PostingQuery(q *Query) ([]uint32, error) {
-	return ix.postingQuery(q, nil)
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	return ix.postingQuery(q, nil, nil)
+}
+
+// PostingQueryRestrict is like PostingQuery, but if restrict is non-nil,
+// only the file IDs listed in restrict, which must be sorted, are
+// considered. Restricting the query up front is cheaper than filtering
+// its result, since posting list entries outside restrict are skipped
+// while decoding.
+func (ix *Index) PostingQueryRestrict(q *Query, restrict []uint32) ([]uint32, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	if restrict == nil {
+		return ix.postingQuery(q, nil, nil)
+	}
+	return ix.postingQuery(q, &restriction{list: restrict, hi: ^uint32(0)}, nil)
+}
+
+// PostingQueryRange is like PostingQueryRestrict, but also considers
+// only file IDs in the range [lo, hi), such as one returned by NameRange.
+// Decoding of each posting list stops at the end of the range.
+func (ix *Index) PostingQueryRange(q *Query, lo, hi uint32, restrict []uint32) ([]uint32, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	return ix.postingQuery(q, &restriction{list: restrict, lo: lo, hi: hi}, nil)
 }
 
-func (ix *Index) postingQuery(q *Query, restrict []uint32) ([]uint32, error) {
-	var list []uint32
-	var err error
+// postingQuery evaluates q, limited to the files allowed by restrict,
+// recording a span for each node of q as a child of span, if not nil.
+func (ix *Index) postingQuery(q *Query, restrict *restriction, span trace.Span) (list []uint32, err error) {
+	if span != nil {
+		span = span.Start("postingQuery")
+		span.SetAttr("op", q.Op.String())
+		if len(q.Trigram) > 0 {
+			span.SetAttr("grams", len(q.Trigram))
+		}
+		defer func() {
+			span.SetAttr("files", len(list))
+			span.End()
+		}()
+	}
 	switch q.Op {
 	case QNone:
 		// nothing
 	case QAll:
 		if restrict != nil {
-			return restrict, nil
+			return restrict.files(ix), nil
 		}
-		list = make([]uint32, ix.numName)
-		for i := range list {
-			list[i] = uint32(i)
-		}
-		return list, nil
+		return ix.allFiles(), nil
 	case QAnd:
-		for _, t := range q.Trigram {
-			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
+		var grams []string
+		grams, err = ix.byCount(q.Trigram)
+		if err != nil {
+			return nil, err
+		}
+		if len(q.Trigram) > 0 && grams == nil {
+			// Some trigram is in no file.
+			return nil, nil
+		}
+		for _, t := range grams {
 			if list == nil {
-				list, err = ix.postingList(tri, restrict)
+				list, err = ix.gramList(t, restrict)
 			} else {
-				list, err = ix.postingAnd(list, tri, restrict)
+				list, err = ix.gramAnd(list, t, restrict)
 			}
 			if len(list) == 0 || err != nil {
 				return nil, err
 			}
 		}
 		for _, sub := range q.Sub {
-			if list == nil {
-				list = restrict
+			subRestrict := restrict
+			if list != nil {
+				subRestrict = &restriction{list: list, hi: ^uint32(0)}
 			}
-			list, err = ix.postingQuery(sub, list)
+			list, err = ix.postingQuery(sub, subRestrict, span)
 			if len(list) == 0 || err != nil {
 				return nil, err
 			}
 		}
 	case QOr:
+		// Each union is written into spare, the storage of the
+		// union before it, so that a long disjunction allocates
+		// two lists rather than one per trigram.
+		var spare []uint32
 		for _, t := range q.Trigram {
-			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
 			if list == nil {
-				list, err = ix.postingList(tri, restrict)
+				list, err = ix.gramList(t, restrict)
 			} else {
-				list, err = ix.postingOr(list, tri, restrict)
+				var next []uint32
+				next, err = ix.gramOr(list, t, restrict, spare)
+				list, spare = next, list
 			}
 			if err != nil {
 				return nil, err
 			}
 		}
 		for _, sub := range q.Sub {
-			list1, err := ix.postingQuery(sub, restrict)
+			list1, err := ix.postingQuery(sub, restrict, span)
 			if err != nil {
 				return nil, err
 			}
-			list = mergeOr(list, list1)
+			list, spare = mergeOr(list, list1, spare), list
 		}
 	}
 	return list, nil
 }
 
-func mergeOr(l1, l2 []uint32) []uint32 {
-	var l []uint32
+// byCount returns grams sorted by the number of files containing each,
+// fewest first, so that an intersection starts with its shortest
+// posting list and each later step has the least left to check.
+// If some gram is in no file, byCount returns nil.
+func (ix *Index) byCount(grams []string) ([]string, error) {
+	if len(grams) == 0 {
+		return nil, nil
+	}
+	type gramCount struct {
+		g     string
+		count int
+	}
+	counts := make([]gramCount, len(grams))
+	for i, g := range grams {
+		count, err := ix.gramCount(g)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, nil
+		}
+		counts[i] = gramCount{g, count}
+	}
+	sort.SliceStable(counts, func(i, j int) bool { return counts[i].count < counts[j].count })
+	sorted := make([]string, len(grams))
+	for i, c := range counts {
+		sorted[i] = c.g
+	}
+	return sorted, nil
+}
+
+// mergeOr returns the union of l1 and l2, storing it in buf if buf is
+// large enough. Buf must not overlap l1 or l2.
+func mergeOr(l1, l2, buf []uint32) []uint32 {
+	l := growList(buf, len(l1)+len(l2))
 	i := 0
 	j := 0
 	for i < len(l1) || j < len(l2) {
@@ -508,8 +1388,19 @@ func mergeOr(l1, l2 []uint32) []uint32 {
 	return l
 }
 
-func corrupt() error {
-	return fmt.Errorf("corrupt index: remove %s", File())
+// indexData is the data of an index, either mapped from a local file,
+// read from one as needed, or read on demand from a remote one.
+type indexData interface {
+	// size returns the length of the data.
+	size() int
+
+	// slice returns the n bytes at offset off,
+	// which the caller has checked are in range.
+	// The result must not be modified.
+	slice(off, n int) ([]byte, error)
+
+	// close releases the data, which must not be used afterward.
+	close() error
 }
 
 // An mmapData is mmap'ed read-only data from a file.
@@ -518,18 +1409,70 @@ type mmapData struct {
 	d []byte
 }
 
-// mmap maps the given file into memory.
-func mmap(file string) (*mmapData, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
+func (m *mmapData) size() int {
+	return len(m.d)
+}
+
+func (m *mmapData) slice(off, n int) ([]byte, error) {
+	return m.d[off : off+n], nil
+}
+
+func (m *mmapData) close() error {
+	err := m.unmap()
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
 	}
-	return mmapFile(f)
+	return err
+}
+
+// Index data read from a file, for when it cannot be mapped.
+const (
+	fileBlockSize   = 64 << 10
+	fileCacheBlocks = 1024
+)
+
+// fileData is index data read from a file as needed.
+type fileData struct {
+	blockData
+	f *os.File
+}
+
+// readFile returns data read as needed from f, which holds size bytes,
+// in blocks of blockSize bytes, caching up to cacheBlocks blocks.
+func readFile(f *os.File, size int64, blockSize, cacheBlocks int) (*fileData, error) {
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("%s: too large", f.Name())
+	}
+	d := &fileData{f: f}
+	d.blockData = blockData{
+		n:         int(size),
+		blockSize: blockSize,
+		cache:     newBlockCache(cacheBlocks),
+		read:      d.readAt,
+	}
+	return d, nil
+}
+
+// readAt reads exactly n bytes at off.
+func (d *fileData) readAt(off, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := d.f.ReadAt(buf, int64(off)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("reading %s: %w", d.f.Name(), err)
+	}
+	return buf, nil
+}
+
+func (d *fileData) close() error {
+	return d.f.Close()
 }
 
 // File returns the name of the index file to use.
 // It is at $CSEARCHINDEX, the current working directory or a parent
-// directory, or $HOME/.csearchindex.
+// directory, or $HOME/.csearchindex. A directory holding only the
+// shards of a sharded .csearchindex counts as holding the index.
 func File() string {
 	if f := os.Getenv("CSEARCHINDEX"); f != "" {
 		return f
@@ -542,6 +1485,46 @@ func File() string {
 			if _, err := os.Lstat(f); err == nil {
 				return f
 			}
+			if _, err := os.Lstat(ShardFile(f, 0)); err == nil {
+				return f
+			}
+			parent := filepath.Dir(cwd)
+			if parent == cwd {
+				break
+			}
+			cwd = parent
+		}
+	}
+
+	return filepath.Clean(homeDir() + "/.csearchindex")
+}
+
+// Files returns the names of all the index files found by looking as
+// File does, most specific first: the .csearchindex files in the
+// current working directory and each parent up to $HOME, followed by
+// $HOME/.csearchindex, those that exist. If $CSEARCHINDEX is set,
+// Files returns only it. If there are no index files, Files returns
+// nil.
+func Files() []string {
+	if f := os.Getenv("CSEARCHINDEX"); f != "" {
+		return []string{f}
+	}
+
+	var files []string
+	exists := func(f string) bool {
+		if _, err := os.Lstat(f); err == nil {
+			return true
+		}
+		_, err := os.Lstat(ShardFile(f, 0))
+		return err == nil
+	}
+	home := filepath.Clean(homeDir())
+	cwd, err := os.Getwd()
+	if err == nil {
+		for cwd != home {
+			if f := filepath.Join(cwd, ".csearchindex"); exists(f) {
+				files = append(files, f)
+			}
 			parent := filepath.Dir(cwd)
 			if parent == cwd {
 				break
@@ -549,11 +1532,17 @@ func File() string {
 			cwd = parent
 		}
 	}
+	if f := filepath.Join(home, ".csearchindex"); exists(f) {
+		files = append(files, f)
+	}
+	return files
+}
 
-	var home string
-	home = os.Getenv("HOME")
+// homeDir returns the user's home directory.
+func homeDir() string {
+	home := os.Getenv("HOME")
 	if runtime.GOOS == "windows" && home == "" {
 		home = os.Getenv("USERPROFILE")
 	}
-	return filepath.Clean(home + "/.csearchindex")
+	return home
 }
@@ -5,8 +5,18 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/andrewarchi/codesearch/lang"
 )
 
 var postFiles = map[string]string{
@@ -46,6 +56,167 @@ func TestTrivialPosting(t *testing.T) {
 	checkPosting("Goo&Sea", []uint32{1, 3})(ix.PostingAnd([]uint32{1, 2, 3}, tri('S', 'e', 'a')))
 	checkPosting("Sea|Goo", []uint32{1, 2, 3})(ix.PostingOr([]uint32{1, 3}, tri('G', 'o', 'o')))
 	checkPosting("Goo|Sea", []uint32{1, 2, 3})(ix.PostingOr([]uint32{1, 2, 3}, tri('S', 'e', 'a')))
+
+	for _, tt := range []struct {
+		trigram uint32
+		want    int
+	}{
+		{tri('S', 'e', 'a'), 2},
+		{tri('G', 'o', 'o'), 3},
+		{tri('W', 'e', 'b'), 1},
+		{tri('x', 'y', 'z'), 0},
+	} {
+		if n, err := ix.PostingCount(tt.trigram); n != tt.want || err != nil {
+			t.Errorf("PostingCount(%#x) = %d, %v, want %d", tt.trigram, n, err, tt.want)
+		}
+	}
+}
+
+func TestPostings(t *testing.T) {
+	f, _ := os.CreateTemp("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(t, out, nil, postFiles)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, g := range []string{"Sea", "Goo", "Pro", "xyz"} {
+		want, _ := ix.PostingList(tri(g[0], g[1], g[2]))
+		it := ix.Postings(tri(g[0], g[1], g[2]))
+		if it.Len() != len(want) {
+			t.Errorf("Postings(%s).Len() = %d, want %d", g, it.Len(), len(want))
+		}
+		var got []uint32
+		for id, ok := it.Next(); ok; id, ok = it.Next() {
+			got = append(got, id)
+		}
+		if it.Err() != nil || !equalList(got, want) {
+			t.Errorf("Postings(%s) = %v, %v, want %v", g, got, it.Err(), want)
+		}
+	}
+
+	it := ix.Postings(tri('G', 'o', 'o'))
+	for _, tt := range []struct {
+		seek uint32
+		id   uint32
+		ok   bool
+	}{
+		{0, 1, true},
+		{1, 1, true},
+		{2, 2, true},
+		{1, 2, true},
+		{4, 0, false},
+		{0, 0, false},
+	} {
+		if id, ok := it.Seek(tt.seek); id != tt.id || ok != tt.ok {
+			t.Errorf("Seek(%d) = %d, %v, want %d, %v", tt.seek, id, ok, tt.id, tt.ok)
+		}
+	}
+
+	// Intersect Goo and Sea lazily.
+	a, b := ix.Postings(tri('G', 'o', 'o')), ix.Postings(tri('S', 'e', 'a'))
+	var both []uint32
+	id, ok := a.Next()
+	for ok {
+		id2, ok2 := b.Seek(id)
+		if !ok2 {
+			break
+		}
+		if id2 == id {
+			both = append(both, id)
+			id, ok = a.Next()
+		} else {
+			id, ok = a.Seek(id2)
+		}
+	}
+	if want := []uint32{1, 3}; !equalList(both, want) {
+		t.Errorf("Goo&Sea = %v, want %v", both, want)
+	}
+}
+
+func TestTrigrams(t *testing.T) {
+	f, _ := os.CreateTemp("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(t, out, nil, trivialFiles)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		tri    string
+		count  int
+		offset uint32
+	}{
+		{"\na\n", 1, 0},
+		{"\nab", 2, 5},
+		{"\nda", 1, 11},
+		{"\nxy", 1, 16},
+		{"ab\n", 1, 21},
+		{"abc", 2, 26},
+		{"bc\n", 2, 32},
+		{"dab", 1, 38},
+		{"xyz", 1, 43},
+		{"yzw", 1, 48},
+		{"zw\n", 1, 53},
+	}
+	list, err := ix.Trigrams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.NumTrigrams() != len(want) || len(list) != len(want) {
+		t.Fatalf("NumTrigrams() = %d, len(Trigrams()) = %d, want %d", ix.NumTrigrams(), len(list), len(want))
+	}
+	for i, w := range want {
+		tr := tri(w.tri[0], w.tri[1], w.tri[2])
+		if g := list[i]; g.Trigram != tr || g.Count != w.count || g.Offset != w.offset {
+			t.Errorf("Trigrams()[%d] = %#x %d %d, want %#x %d %d", i, g.Trigram, g.Count, g.Offset, tr, w.count, w.offset)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	f, _ := os.CreateTemp("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(t, out, nil, postFiles)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := &Query{
+		Op:      QAnd,
+		Trigram: []string{"Goo", "Sea"},
+		Sub: []*Query{
+			{Op: QOr, Trigram: []string{"Cod", "Web", "zzz"}},
+		},
+	}
+	plan, err := ix.Explain(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `and: ~2 files
+  "Goo": 3 files
+  "Sea": 2 files
+  or: ~3 files
+    "Cod": 2 files
+    "Web": 1 files
+    "zzz": 0 files
+`
+	if plan.String() != want {
+		t.Errorf("Explain(%s) =\n%s\nwant:\n%s", q, plan, want)
+	}
+
+	plan, err = ix.Explain(allQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Estimate != 4 {
+		t.Errorf("Explain(%s).Estimate = %d, want 4", allQuery, plan.Estimate)
+	}
 }
 
 func equalList(x, y []uint32) bool {
@@ -59,3 +230,659 @@ func equalList(x, y []uint32) bool {
 	}
 	return true
 }
+
+func TestGallop(t *testing.T) {
+	list := []uint32{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41}
+	for i := 0; i <= len(list); i++ {
+		for x := uint32(0); x < 45; x++ {
+			want := i
+			for want < len(list) && list[want] < x {
+				want++
+			}
+			if got := gallop(list, i, x); got != want {
+				t.Errorf("gallop(list, %d, %d) = %d, want %d", i, x, got, want)
+			}
+		}
+	}
+}
+
+// skewFiles returns files in which "rar" is rare, "com" is common,
+// and "mid" is in about half the files, along with the IDs of the
+// files containing each.
+func skewFiles(n int) (map[string]string, map[string][]uint32) {
+	files := make(map[string]string)
+	ids := make(map[string][]uint32)
+	for i := 0; i < n; i++ {
+		text := "filler"
+		if i%97 == 5 {
+			text += " rar"
+		}
+		if i%10 != 3 {
+			text += " com"
+		}
+		if i*7919%13 < 6 {
+			text += " mid"
+		}
+		// Names sort in file ID order.
+		files[fmt.Sprintf("f%05d", i)] = text
+		for _, g := range []string{"rar", "com", "mid"} {
+			if strings.Contains(text, g) {
+				ids[g] = append(ids[g], uint32(i))
+			}
+		}
+	}
+	return files, ids
+}
+
+func TestPostingSkewed(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	files, ids := skewFiles(2000)
+	buildIndex(t, out, nil, files)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grams := []string{"rar", "com", "mid"}
+	for _, g1 := range grams {
+		for _, g2 := range grams {
+			var and, or []uint32
+			in2 := make(map[uint32]bool)
+			for _, id := range ids[g2] {
+				in2[id] = true
+			}
+			in1 := make(map[uint32]bool)
+			for _, id := range ids[g1] {
+				in1[id] = true
+				if in2[id] {
+					and = append(and, id)
+				}
+			}
+			for id := uint32(0); id < 2000; id++ {
+				if in1[id] || in2[id] {
+					or = append(or, id)
+				}
+			}
+			t2 := tri(g2[0], g2[1], g2[2])
+			got, err := ix.PostingAnd(append([]uint32(nil), ids[g1]...), t2)
+			if err != nil || !equalList(got, and) {
+				t.Errorf("PostingAnd(%s, %s) = %d files, %v, want %d", g1, g2, len(got), err, len(and))
+			}
+			got, err = ix.PostingOr(ids[g1], t2)
+			if err != nil || !equalList(got, or) {
+				t.Errorf("PostingOr(%s, %s) = %d files, %v, want %d", g1, g2, len(got), err, len(or))
+			}
+
+			q := &Query{Op: QOr, Trigram: []string{g1, g2, "rar"}}
+			want := mergeOr(or, ids["rar"], nil)
+			got, err = ix.PostingQuery(q)
+			if err != nil || !equalList(got, want) {
+				t.Errorf("PostingQuery(%v) = %d files, %v, want %d", q, len(got), err, len(want))
+			}
+		}
+	}
+}
+
+func TestPostingRestrict(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	files, ids := skewFiles(2000)
+	buildIndex(t, out, nil, files)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var thirds, tail []uint32
+	for id := uint32(0); id < 2000; id++ {
+		if id%3 == 0 {
+			thirds = append(thirds, id)
+		}
+		if id >= 1990 {
+			tail = append(tail, id)
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		list   []uint32
+		bitmap bool
+	}{
+		{"empty", []uint32{}, false},
+		{"rar", ids["rar"], false},
+		{"thirds", thirds, true},
+		{"mid", ids["mid"], true},
+		{"tail", tail, false},
+		{"end", []uint32{63, 64, 1999}, false},
+	} {
+		if bits := (&restriction{list: tt.list}).bitmap(); (bits != nil) != tt.bitmap {
+			t.Errorf("%s: bitmap() = %v, want bitmap %v", tt.name, bits != nil, tt.bitmap)
+		}
+		in := make(map[uint32]bool)
+		for _, id := range tt.list {
+			in[id] = true
+		}
+		for _, q := range []*Query{
+			{Op: QAnd, Trigram: []string{"com"}},
+			{Op: QAnd, Trigram: []string{"com", "mid"}},
+			{Op: QOr, Trigram: []string{"rar", "mid"}},
+		} {
+			all, err := ix.PostingQuery(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []uint32
+			for _, id := range all {
+				if in[id] {
+					want = append(want, id)
+				}
+			}
+			got, err := ix.PostingQueryRestrict(q, tt.list)
+			if err != nil || !equalList(got, want) {
+				t.Errorf("%s: PostingQueryRestrict(%v) = %d files, %v, want %d", tt.name, q, len(got), err, len(want))
+			}
+		}
+	}
+}
+
+func TestPostingQueryOrder(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	files, ids := skewFiles(2000)
+	buildIndex(t, out, nil, files)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grams, err := ix.byCount([]string{"com", "mid", "rar", "fil"})
+	if want := []string{"rar", "mid", "com", "fil"}; err != nil || !slices.Equal(grams, want) {
+		t.Errorf("byCount = %q, %v, want %q", grams, err, want)
+	}
+	grams, err = ix.byCount([]string{"com", "zzz", "rar"})
+	if err != nil || grams != nil {
+		t.Errorf("byCount with missing trigram = %q, %v, want nil", grams, err)
+	}
+
+	var want []uint32
+	for _, id := range ids["rar"] {
+		if slices.Contains(ids["com"], id) && slices.Contains(ids["mid"], id) {
+			want = append(want, id)
+		}
+	}
+	q := &Query{Op: QAnd, Trigram: []string{"com", "mid", "rar"}}
+	got, err := ix.PostingQuery(q)
+	if err != nil || !equalList(got, want) {
+		t.Errorf("PostingQuery(%v) = %v, %v, want %v", q, got, err, want)
+	}
+	q = &Query{Op: QAnd, Trigram: []string{"com", "zzz"}, Sub: []*Query{{Op: QAll}}}
+	if got, err := ix.PostingQuery(q); err != nil || len(got) != 0 {
+		t.Errorf("PostingQuery(%v) = %v, %v, want none", q, got, err)
+	}
+}
+
+func BenchmarkPostingAnd(b *testing.B) {
+	out := filepath.Join(b.TempDir(), "index")
+	files, ids := skewFiles(20000)
+	buildIndex(b, out, nil, files)
+	ix, err := Open(out)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]uint32, len(ids["com"]))
+	for _, bb := range []struct {
+		name string
+		list []uint32
+		gram string
+	}{
+		{"RareCommon", ids["rar"], "com"},
+		{"CommonRare", ids["com"], "rar"},
+		{"CommonCommon", ids["com"], "mid"},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			t := tri(bb.gram[0], bb.gram[1], bb.gram[2])
+			for i := 0; i < b.N; i++ {
+				list := append(buf[:0], bb.list...)
+				if _, err := ix.PostingAnd(list, t); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "index")
+	buildIndex(t, good, nil, postFiles)
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sea, err := ix.findList(tri('S', 'e', 'a'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := int(ix.postData + sea + 3)
+	entry := 0
+	for i := 0; i < ix.numPost; i++ {
+		if t, _, _, _ := ix.listAt(uint32(i) * postEntrySize); t == tri('S', 'e', 'a') {
+			entry = int(ix.postIndex) + i*postEntrySize
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		edit    func([]byte) []byte
+		section string
+		err     error
+	}{
+		{"short", func(d []byte) []byte { return d[:10] }, "header", ErrTruncated},
+		{"trailer", func(d []byte) []byte { return d[:len(d)-1] }, "trailer", ErrMalformed},
+		{"varint", func(d []byte) []byte {
+			copy(d[list:], bytes.Repeat([]byte{0xff}, 11))
+			return d
+		}, "posting list", ErrBadVarint},
+		{"fileID", func(d []byte) []byte {
+			d[list] = 0x7f
+			return d
+		}, "posting list", ErrFileID},
+		{"delta", func(d []byte) []byte {
+			d[list+1] = 0
+			return d
+		}, "posting list", ErrMalformed},
+		{"offset", func(d []byte) []byte {
+			binary.BigEndian.PutUint32(d[entry+7:], 1<<30)
+			return d
+		}, "posting list", ErrTruncated},
+	} {
+		file := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(file, tt.edit(slices.Clone(data)), 0666); err != nil {
+			t.Fatal(err)
+		}
+		ix, err := Open(file)
+		if err != nil {
+			checkCorrupt(t, tt.name, err, file, tt.section, tt.err)
+			continue
+		}
+		for op, f := range map[string]func(uint32) ([]uint32, error){
+			"PostingList": ix.PostingList,
+			"PostingAnd":  func(t uint32) ([]uint32, error) { return ix.PostingAnd([]uint32{0, 1, 2}, t) },
+			"PostingOr":   func(t uint32) ([]uint32, error) { return ix.PostingOr([]uint32{0, 1, 2}, t) },
+		} {
+			_, err := f(tri('S', 'e', 'a'))
+			checkCorrupt(t, tt.name+" "+op, err, file, tt.section, tt.err)
+		}
+	}
+}
+
+func checkCorrupt(t *testing.T, name string, err error, file, section string, want error) {
+	t.Helper()
+	var e *IndexError
+	if !errors.As(err, &e) || !errors.Is(err, ErrCorrupt) {
+		t.Errorf("%s: err = %v, want *IndexError", name, err)
+		return
+	}
+	if e.File != file || e.Section != section || !errors.Is(err, want) {
+		t.Errorf("%s: err = %v, want %s %s error in %s", name, err, section, want, file)
+	}
+}
+
+var langFiles = map[string]string{
+	"a/main.go":   "package main\n",
+	"a/script":    "#!/usr/bin/env python3\nprint('hi')\n",
+	"a/notes":     "some notes\n",
+	"a/run":       "#!/bin/sh\n# vim: set ft=ruby:\n",
+	"b/Makefile":  "all:\n",
+	"b/util.py":   "def f(): pass\n",
+	"b/wrapper.c": "int main() {}\n",
+	"b/wrapper.h": "// -*- C++ -*-\n",
+}
+
+func TestLang(t *testing.T) {
+	f, _ := os.CreateTemp("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(t, out, nil, langFiles)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []lang.ID
+	for _, name := range []string{"go", "unknown", "ruby", "python", "make", "python", "c", "cpp"} {
+		id, ok := lang.Lookup(name)
+		if !ok {
+			t.Fatalf("Lookup(%q) failed", name)
+		}
+		want = append(want, id)
+	}
+	for i, w := range want {
+		l, err := ix.Lang(uint32(i))
+		if err != nil {
+			t.Errorf("Lang(%d): %v", i, err)
+		} else if l != w {
+			t.Errorf("Lang(%d) = %v, want %v", i, l, w)
+		}
+	}
+
+	py, _ := lang.Lookup("python")
+	files, err := ix.FilesByLang(py)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{3, 5}; !equalList(files, want) {
+		t.Errorf("FilesByLang(python) = %v, want %v", files, want)
+	}
+
+	q := &Query{Op: QAnd, Trigram: []string{"pri"}}
+	post, err := ix.PostingQueryRestrict(q, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{3}; !equalList(post, want) {
+		t.Errorf("PostingQueryRestrict(%v, python) = %v, want %v", q, post, want)
+	}
+}
+
+func TestOpenRead(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildQuadIndex(t, out, mergePaths1, false, mergeFiles1)
+	local, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	if _, ok := local.data.(*mmapData); !ok {
+		t.Fatalf("Open: data is %T, want mapped", local.data)
+	}
+
+	check := func(name string, ix *Index) {
+		t.Helper()
+		defer ix.Close()
+		names, err := ix.Names()
+		want, _ := local.Names()
+		if err != nil || !slices.Equal(names, want) {
+			t.Errorf("%s: Names() = %v, %v, want %v", name, names, err, want)
+		}
+		for _, q := range []*Query{
+			{Op: QAnd, Trigram: []string{"now"}},
+			{Op: QOr, Trigram: []string{"wor", "all"}},
+			{Op: QAnd, Trigram: []string{"pota", "toes"}},
+		} {
+			have, err := ix.PostingQuery(q)
+			want, _ := local.PostingQuery(q)
+			if err != nil || !equalList(have, want) {
+				t.Errorf("%s: PostingQuery(%v) = %v, %v, want %v", name, q, have, err, want)
+			}
+		}
+		if _, err := ix.Verify(); err != nil {
+			t.Errorf("%s: Verify: %v", name, err)
+		}
+	}
+
+	// Use tiny blocks and cache so that reads span and evict blocks.
+	for _, bs := range []int{7, 64, fileBlockSize} {
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := f.Stat()
+		d, err := readFile(f, fi.Size(), bs, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix, err := openData(out, d)
+		if err != nil {
+			t.Fatalf("blockSize %d: %v", bs, err)
+		}
+		check(fmt.Sprintf("blockSize %d", bs), ix)
+	}
+
+	ix, err := OpenRead(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ix.data.(*fileData); !ok {
+		t.Errorf("OpenRead: data is %T, want read", ix.data)
+	}
+	check("OpenRead", ix)
+
+	t.Setenv("CSEARCHNOMMAP", "1")
+	if ix, err = Open(out); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ix.data.(*fileData); !ok {
+		t.Errorf("Open with $CSEARCHNOMMAP: data is %T, want read", ix.data)
+	}
+	check("CSEARCHNOMMAP", ix)
+}
+
+func TestNameRange(t *testing.T) {
+	f, _ := os.CreateTemp("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(t, out, nil, mergeFiles1)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are /a/x, /a/y, /b/xx, /b/xy, /c/ab, /c/de.
+	for _, tt := range []struct {
+		prefix string
+		lo, hi uint32
+	}{
+		{"", 0, 6},
+		{"/", 0, 6},
+		{"/a/", 0, 2},
+		{"/b/x", 2, 4},
+		{"/b/xy", 3, 4},
+		{"/c/", 4, 6},
+		{"/b/z", 4, 4},
+		{"/d/", 6, 6},
+		{"0", 6, 6},
+	} {
+		lo, hi, err := ix.NameRange(tt.prefix)
+		if err != nil {
+			t.Errorf("NameRange(%q): %v", tt.prefix, err)
+		} else if lo != tt.lo || hi != tt.hi {
+			t.Errorf("NameRange(%q) = %d, %d, want %d, %d", tt.prefix, lo, hi, tt.lo, tt.hi)
+		}
+	}
+
+	lo, hi, _ := ix.NameRange("/c/")
+	for _, tt := range []struct {
+		q        *Query
+		restrict []uint32
+		want     []uint32
+	}{
+		{&Query{Op: QAnd, Trigram: []string{"now"}}, nil, []uint32{5}},
+		{&Query{Op: QOr, Trigram: []string{"wor", "all"}}, nil, []uint32{4}},
+		{&Query{Op: QAll}, nil, []uint32{4, 5}},
+		{&Query{Op: QAll}, []uint32{1, 5}, []uint32{5}},
+		{&Query{Op: QAnd, Trigram: []string{"giv"}}, []uint32{0, 4}, []uint32{4}},
+	} {
+		post, err := ix.PostingQueryRange(tt.q, lo, hi, tt.restrict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalList(post, tt.want) {
+			t.Errorf("PostingQueryRange(%v, %d, %d, %v) = %v, want %v", tt.q, lo, hi, tt.restrict, post, tt.want)
+		}
+	}
+}
+
+func TestFilesUnder(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(t, out, nil, mergeFiles1)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	// Files are /a/x, /a/y, /b/xx, /b/xy, /c/ab, /c/de.
+	for _, tt := range []struct {
+		path string
+		want FileRange
+	}{
+		{"/", FileRange{0, 6}},
+		{"/a", FileRange{0, 2}},
+		{"/a/", FileRange{0, 2}},
+		{"/b/xx", FileRange{2, 3}},
+		{"/b/x", FileRange{2, 2}},
+		{"/c", FileRange{4, 6}},
+		{"/c/a", FileRange{4, 4}},
+		{"/d", FileRange{6, 6}},
+	} {
+		got, err := ix.FilesUnder(tt.path)
+		if err != nil || got != tt.want {
+			t.Errorf("FilesUnder(%q) = %v, %v, want %v", tt.path, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		opt  *SearchOptions
+		want []string
+	}{
+		{&SearchOptions{Dir: "/c"}, []string{"/c/ab", "/c/de"}},
+		{&SearchOptions{Dir: "/b/x"}, nil},
+		{&SearchOptions{Dir: "/b/", Prefix: "/b/xy"}, []string{"/b/xy"}},
+		{&SearchOptions{Dir: "/a", Prefix: "/b"}, nil},
+	} {
+		names, err := ix.Search(&Query{Op: QAll}, tt.opt)
+		if err != nil || !slices.Equal(names, tt.want) {
+			t.Errorf("Search(Dir %q, Prefix %q) = %v, %v, want %v", tt.opt.Dir, tt.opt.Prefix, names, err, tt.want)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+	zout := filepath.Join(dir, "index.zst")
+	if err := compressFile(zout, out, 100); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{out, zout} {
+		ix, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ix.Name(0); err != nil {
+			t.Fatal(err)
+		}
+		if err := ix.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", file, err)
+		}
+		if _, err := ix.Name(0); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: Name after Close: %v, want ErrClosed", file, err)
+		}
+		if _, err := ix.PostingList(tri('n', 'o', 'w')); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: PostingList after Close: %v, want ErrClosed", file, err)
+		}
+		if err := ix.Close(); err != nil {
+			t.Errorf("%s: second Close: %v", file, err)
+		}
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+	for i := 0; i < 20; i++ {
+		ix, err := Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it := ix.Postings(tri('n', 'o', 'w'))
+		if _, ok := it.Next(); !ok {
+			t.Fatalf("Next: %v", it.Err())
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					_, err := ix.Search(&Query{Op: QAll}, nil)
+					if err == nil {
+						_, err = ix.PostingQuery(&Query{Op: QAnd, Trigram: []string{"now"}})
+					}
+					if err != nil {
+						if !errors.Is(err, ErrClosed) {
+							errs <- err
+						}
+						return
+					}
+				}
+			}()
+		}
+		if err := ix.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("search during Close: %v", err)
+		}
+		// An iterator begun before Close fails cleanly after it.
+		if _, ok := it.Next(); ok || !errors.Is(it.Err(), ErrClosed) {
+			t.Errorf("Next after Close = %v, %v, want false, ErrClosed", ok, it.Err())
+		}
+		if _, ok := ix.Postings(tri('n', 'o', 'w')).Seek(0); ok {
+			t.Error("Seek of iterator made after Close succeeded")
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	// Resolve links, as in macOS's /tmp, to match os.Getwd.
+	home, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj := filepath.Join(home, "src", "proj")
+	sub := filepath.Join(proj, "sub")
+	if err := os.MkdirAll(sub, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{
+		filepath.Join(home, ".csearchindex"),
+		filepath.Join(proj, ".csearchindex"),
+		ShardFile(filepath.Join(sub, ".csearchindex"), 0),
+	} {
+		if err := os.WriteFile(f, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("CSEARCHINDEX", "")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		filepath.Join(sub, ".csearchindex"),
+		filepath.Join(proj, ".csearchindex"),
+		filepath.Join(home, ".csearchindex"),
+	}
+	if files := Files(); !slices.Equal(files, want) {
+		t.Errorf("Files() = %q, want %q", files, want)
+	}
+
+	t.Setenv("CSEARCHINDEX", "/ix")
+	if files := Files(); !slices.Equal(files, []string{"/ix"}) {
+		t.Errorf("Files() with $CSEARCHINDEX = %q, want [/ix]", files)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// Read-ahead.
+//
+// Indexing a file takes little time once it is in memory, so on a slow
+// disk or a network file system AddFile spends most of its time waiting
+// for reads. AddFiles reads up to readAheadFiles files ahead, with
+// readAheadWorkers goroutines, while the calling goroutine indexes the
+// files already read. Files larger than readAheadMax are only opened
+// ahead of time, and read as they are indexed, so that at most about
+// readAheadFiles*readAheadMax bytes are held in memory.
+
+const (
+	readAheadFiles   = 32
+	readAheadWorkers = 8
+	readAheadMax     = 1 << 20
+)
+
+// A readResult is a file opened, and perhaps read, ahead of time.
+type readResult struct {
+	data []byte      // contents of the file, if read
+	fi   fs.FileInfo // the file as looked up, if read
+	f    *os.File    // open file, if not read
+	err  error
+}
+
+// AddFiles adds the named files to the index, in order, as if by
+// calling AddFile for each, but reads files ahead in the background.
+// It stops at the first error, returning it along with the number of
+// files added before it, so that names[n] is the file that failed.
+func (ix *Writer) AddFiles(names []string) (n int, err error) {
+	order := make(chan chan readResult, readAheadFiles)
+	stop := make(chan struct{})
+	go func() {
+		defer close(order)
+		sem := make(chan struct{}, readAheadWorkers)
+		for _, name := range names {
+			ch := make(chan readResult, 1)
+			select {
+			case order <- ch:
+			case <-stop:
+				return
+			}
+			sem <- struct{}{}
+			go func(name string) {
+				ch <- readAhead(name)
+				<-sem
+			}(name)
+		}
+	}()
+	defer func() {
+		// Release files read ahead but not indexed.
+		close(stop)
+		for ch := range order {
+			if r := <-ch; r.f != nil {
+				r.f.Close()
+			}
+		}
+	}()
+
+	for ch := range order {
+		r := <-ch
+		if r.err != nil {
+			return n, r.err
+		}
+		name := names[n]
+		if r.f != nil {
+			err = ix.Add(name, r.f)
+			r.f.Close()
+		} else {
+			err = ix.add(name, bytes.NewReader(r.data), fileStat(r.fi))
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// readAhead opens the named file and, if it is small enough, reads it.
+func readAhead(name string) readResult {
+	f, err := os.Open(name)
+	if err != nil {
+		return readResult{err: err}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return readResult{err: err}
+	}
+	if !fi.Mode().IsRegular() || fi.Size() > readAheadMax {
+		return readResult{f: f}
+	}
+	defer f.Close()
+	// Read one byte more than expected, to notice growth.
+	data := make([]byte, fi.Size()+1)
+	m, err := io.ReadFull(f, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return readResult{data: data[:m], fi: fi}
+	}
+	if err != nil {
+		return readResult{err: err}
+	}
+	// The file grew while being read.
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		return readResult{err: err}
+	}
+	return readResult{data: append(data, rest...), fi: fi}
+}
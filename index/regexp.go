@@ -22,7 +22,7 @@ import (
 // more expensive regexp machinery.
 type Query struct {
 	Op      QueryOp
-	Trigram []string
+	Trigram []string // trigrams, or quadgrams in a RegexpQuadQuery
 	Sub     []*Query
 }
 
@@ -43,6 +43,13 @@ func (q *Query) and(r *Query) *Query {
 	return q.andOr(r, QAnd)
 }
 
+// And returns the query q AND r, matching the files that might match
+// both, as for a search requiring matches of several regexps. It may
+// reuse q's and r's storage.
+func (q *Query) And(r *Query) *Query {
+	return q.and(r)
+}
+
 // or returns the query q OR r, possibly reusing q's and r's storage.
 func (q *Query) or(r *Query) *Query {
 	return q.andOr(r, QOr)
@@ -253,7 +260,9 @@ func (q *Query) maybeRewrite(op QueryOp) {
 }
 
 // andTrigrams returns q AND the OR of the AND of the trigrams present in each string.
-func (q *Query) andTrigrams(t stringSet) *Query {
+// If quad is set, strings of four or more bytes contribute their quadgrams
+// instead, which are more selective than the trigrams they contain.
+func (q *Query) andTrigrams(t stringSet, quad bool) *Query {
 	if t.minLen() < 3 {
 		// If there is a short string, we can't guarantee
 		// that any trigrams must be present, so use ALL.
@@ -265,8 +274,12 @@ func (q *Query) andTrigrams(t stringSet) *Query {
 	or := noneQuery
 	for _, tt := range t {
 		var trig stringSet
-		for i := 0; i+3 <= len(tt); i++ {
-			trig.add(tt[i : i+3])
+		n := 3
+		if quad && len(tt) >= 4 {
+			n = 4
+		}
+		for i := 0; i+n <= len(tt); i++ {
+			trig.add(tt[i : i+n])
 		}
 		trig.clean(false)
 		// fmt.Println(tt, "trig", strings.Join(trig, ","))
@@ -341,10 +354,25 @@ func (q *Query) String() string {
 }
 
 // RegexpQuery returns a Query for the given regexp.
+// A case-insensitive literal requires the n-grams of any of its
+// simple case foldings (see unicode.SimpleFold), such as K, k, and
+// U+212A KELVIN SIGN, even when they differ in length in UTF-8.
 func RegexpQuery(re *syntax.Regexp) *Query {
-	info := analyze(re)
-	info.simplify(true)
-	info.addExact()
+	return regexpQuery(re, false)
+}
+
+// RegexpQuadQuery is like RegexpQuery, but for literal strings of four
+// or more bytes it requires quadgrams rather than trigrams. The resulting
+// query is more selective against an index with quadgrams (see
+// Writer.Quadgrams) and no less selective against one without them.
+func RegexpQuadQuery(re *syntax.Regexp) *Query {
+	return regexpQuery(re, true)
+}
+
+func regexpQuery(re *syntax.Regexp, quad bool) *Query {
+	info := analyze(re, quad)
+	info.simplify(true, quad)
+	info.addExact(quad)
 	return info.match
 }
 
@@ -428,7 +456,8 @@ func emptyString() regexpInfo {
 }
 
 // analyze returns the regexpInfo for the regexp re.
-func analyze(re *syntax.Regexp) (out regexpInfo) {
+// The quad flag is passed down to andTrigrams.
+func analyze(re *syntax.Regexp, quad bool) (out regexpInfo) {
 	// fmt.Println("analyze", re)
 	// defer func() { fmt.Println("->", out) }()
 
@@ -460,7 +489,7 @@ func analyze(re *syntax.Regexp) (out regexpInfo) {
 				for r1 := unicode.SimpleFold(r0); r1 != r0; r1 = unicode.SimpleFold(r1) {
 					re1.Rune = append(re1.Rune, r1, r1)
 				}
-				info = analyze(re1)
+				info = analyze(re1, quad)
 				return info
 			}
 			// Multi-letter case-folded string:
@@ -472,7 +501,7 @@ func analyze(re *syntax.Regexp) (out regexpInfo) {
 			info = emptyString()
 			for i := range re.Rune {
 				re1.Rune = re.Rune[i : i+1]
-				info = concat(info, analyze(re1))
+				info = concat(info, analyze(re1, quad), quad)
 			}
 			return info
 		}
@@ -483,16 +512,16 @@ func analyze(re *syntax.Regexp) (out regexpInfo) {
 		return anyChar()
 
 	case syntax.OpCapture:
-		return analyze(re.Sub[0])
+		return analyze(re.Sub[0], quad)
 
 	case syntax.OpConcat:
-		return fold(concat, re.Sub, emptyString())
+		return fold(concat, re.Sub, emptyString(), quad)
 
 	case syntax.OpAlternate:
-		return fold(alternate, re.Sub, noMatch())
+		return fold(alternate, re.Sub, noMatch(), quad)
 
 	case syntax.OpQuest:
-		return alternate(analyze(re.Sub[0]), emptyString())
+		return alternate(analyze(re.Sub[0], quad), emptyString(), quad)
 
 	case syntax.OpStar:
 		// We don't know anything, so assume the worst.
@@ -508,7 +537,7 @@ func analyze(re *syntax.Regexp) (out regexpInfo) {
 		// x+
 		// Since there has to be at least one x, the prefixes and suffixes
 		// stay the same. If x was exact, it isn't anymore.
-		info = analyze(re.Sub[0])
+		info = analyze(re.Sub[0], quad)
 		if info.exact.have() {
 			info.prefix = info.exact
 			info.suffix = info.exact.copy()
@@ -547,27 +576,27 @@ func analyze(re *syntax.Regexp) (out regexpInfo) {
 		}
 	}
 
-	info.simplify(false)
+	info.simplify(false, quad)
 	return info
 }
 
 // fold is the usual higher-order function.
-func fold(f func(x, y regexpInfo) regexpInfo, sub []*syntax.Regexp, zero regexpInfo) regexpInfo {
+func fold(f func(x, y regexpInfo, quad bool) regexpInfo, sub []*syntax.Regexp, zero regexpInfo, quad bool) regexpInfo {
 	if len(sub) == 0 {
 		return zero
 	}
 	if len(sub) == 1 {
-		return analyze(sub[0])
+		return analyze(sub[0], quad)
 	}
-	info := f(analyze(sub[0]), analyze(sub[1]))
+	info := f(analyze(sub[0], quad), analyze(sub[1], quad), quad)
 	for i := 2; i < len(sub); i++ {
-		info = f(info, analyze(sub[i]))
+		info = f(info, analyze(sub[i], quad), quad)
 	}
 	return info
 }
 
 // concat returns the regexp info for xy given x and y.
-func concat(x, y regexpInfo) (out regexpInfo) {
+func concat(x, y regexpInfo, quad bool) (out regexpInfo) {
 	// fmt.Println("concat", x, "...", y)
 	// defer func() { fmt.Println("->", out) }()
 
@@ -602,15 +631,15 @@ func concat(x, y regexpInfo) (out regexpInfo) {
 	if !x.exact.have() && !y.exact.have() &&
 		x.suffix.size() <= maxSet && y.prefix.size() <= maxSet &&
 		x.suffix.minLen()+y.prefix.minLen() >= 3 {
-		xy.match = xy.match.andTrigrams(x.suffix.cross(y.prefix, false))
+		xy.match = xy.match.andTrigrams(x.suffix.cross(y.prefix, false), quad)
 	}
 
-	xy.simplify(false)
+	xy.simplify(false, quad)
 	return xy
 }
 
 // alternate returns the regexpInfo for x|y given x and y.
-func alternate(x, y regexpInfo) (out regexpInfo) {
+func alternate(x, y regexpInfo, quad bool) (out regexpInfo) {
 	// fmt.Println("alternate", x, "...", y)
 	// defer func() { fmt.Println("->", out) }()
 
@@ -618,13 +647,15 @@ func alternate(x, y regexpInfo) (out regexpInfo) {
 	if x.exact.have() && y.exact.have() {
 		xy.exact = x.exact.union(y.exact, false)
 	} else if x.exact.have() {
-		xy.prefix = x.exact.union(y.prefix, false)
-		xy.suffix = x.exact.union(y.suffix, true)
-		x.addExact()
+		// union sorts in place, in storage it may share with x.exact,
+		// which must keep its strings for addExact.
+		xy.prefix = x.exact.copy().union(y.prefix, false)
+		xy.suffix = x.exact.copy().union(y.suffix, true)
+		x.addExact(quad)
 	} else if y.exact.have() {
 		xy.prefix = x.prefix.union(y.exact, false)
 		xy.suffix = x.suffix.union(y.exact.copy(), true)
-		y.addExact()
+		y.addExact(quad)
 	} else {
 		xy.prefix = x.prefix.union(y.prefix, false)
 		xy.suffix = x.suffix.union(y.suffix, true)
@@ -632,19 +663,19 @@ func alternate(x, y regexpInfo) (out regexpInfo) {
 	xy.canEmpty = x.canEmpty || y.canEmpty
 	xy.match = x.match.or(y.match)
 
-	xy.simplify(false)
+	xy.simplify(false, quad)
 	return xy
 }
 
 // addExact adds to the match query the trigrams for matching info.exact.
-func (info *regexpInfo) addExact() {
+func (info *regexpInfo) addExact(quad bool) {
 	if info.exact.have() {
-		info.match = info.match.andTrigrams(info.exact)
+		info.match = info.match.andTrigrams(info.exact, quad)
 	}
 }
 
 // simplify simplifies the regexpInfo when the exact set gets too large.
-func (info *regexpInfo) simplify(force bool) {
+func (info *regexpInfo) simplify(force, quad bool) {
 	// fmt.Println("  simplify", info, " force=", force)
 	// defer func() { fmt.Println("  ->", info) }()
 
@@ -653,7 +684,7 @@ func (info *regexpInfo) simplify(force bool) {
 	// the relevant pieces into prefix and suffix.
 	info.exact.clean(false)
 	if len(info.exact) > maxExact || (info.exact.minLen() >= 3 && force) || info.exact.minLen() >= 4 {
-		info.addExact()
+		info.addExact(quad)
 		for _, s := range info.exact {
 			n := len(s)
 			if n < 3 {
@@ -668,8 +699,8 @@ func (info *regexpInfo) simplify(force bool) {
 	}
 
 	if !info.exact.have() {
-		info.simplifySet(&info.prefix)
-		info.simplifySet(&info.suffix)
+		info.simplifySet(&info.prefix, quad)
+		info.simplifySet(&info.suffix, quad)
 	}
 }
 
@@ -678,12 +709,12 @@ func (info *regexpInfo) simplify(force bool) {
 // they will only be used to create trigrams. As they get too big, simplifySet
 // moves the information they contain into the match query, which is
 // more efficient to pass around.
-func (info *regexpInfo) simplifySet(s *stringSet) {
+func (info *regexpInfo) simplifySet(s *stringSet, quad bool) {
 	t := *s
 	t.clean(s == &info.suffix)
 
 	// Add the OR of the current prefix/suffix set to the query.
-	info.match = info.match.andTrigrams(t)
+	info.match = info.match.andTrigrams(t, quad)
 
 	for n := 3; n == 3 || t.size() > maxSet; n-- {
 		// Replace set by strings of length n-1.
@@ -58,6 +58,7 @@ var queryTests = []struct {
 	// Different sized suffixes.
 	{`(a|ab)cde`, `"cde" ("abc" "bcd")|("acd")`},
 	{`(a|b|c|d)(ef|g|hi|j)`, `+`},
+	{`(ab|bc|cde|fghi)x`, `("abx"|"bcx"|"dex"|"hix")`},
 
 	{`(?s).`, `+`},
 
@@ -69,6 +70,15 @@ var queryTests = []struct {
 	{`(?i)abcd`, `("ABC"|"ABc"|"AbC"|"Abc"|"aBC"|"aBc"|"abC"|"abc") ("BCD"|"BCd"|"BcD"|"Bcd"|"bCD"|"bCd"|"bcD"|"bcd")`},
 	{`(?i)abc|abc`, `("ABC"|"ABc"|"AbC"|"Abc"|"aBC"|"aBc"|"abC"|"abc")`},
 
+	// Expanding Unicode case, including simple foldings
+	// to runes of a different length in UTF-8.
+	{`(?i)é~`, `("É~"|"é~")`},
+	{`(?i)~é~`, `("~É" "É~")|("~é" "é~")`},
+	{`(?i)ÿ~`, `("ÿ~"|"Ÿ~")`},
+	{`(?i)ς~`, `("Σ~"|"ς~"|"σ~")`},
+	{"(?i)\u212a~~", "(\"K~~\"|\"k~~\")|(\"\\x84\\xaa~\" \"\\xaa~~\" \"\u212a\")"},
+	{"(?i)[\u017f]~~", "(\"S~~\"|\"s~~\")|(\"\\xbf~~\" \"\u017f~\")"},
+
 	// Word boundary.
 	{`\b`, `+`},
 	{`\B`, `+`},
@@ -92,3 +102,27 @@ func TestQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryAnd(t *testing.T) {
+	for _, tt := range []struct {
+		re1, re2 string
+		q        string
+	}{
+		{`abc`, `def`, `"abc" "def"`},
+		{`abc`, `abcd`, `"abc" "bcd"`},
+		{`abc`, `.`, `"abc"`},
+		{`abc|xyz`, `def`, `"def" ("abc"|"xyz")`},
+	} {
+		re1, err := syntax.Parse(tt.re1, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re2, err := syntax.Parse(tt.re2, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q := RegexpQuery(re1).And(RegexpQuery(re2)).String(); q != tt.q {
+			t.Errorf("RegexpQuery(%#q).And(RegexpQuery(%#q)) = %#q, want %#q", tt.re1, tt.re2, q, tt.q)
+		}
+	}
+}
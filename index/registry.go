@@ -0,0 +1,224 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andrewarchi/codesearch/trace"
+)
+
+// Index registry.
+//
+// A Daemon given a directory by LoadDir serves the indexes in it as a
+// registry of repositories, one index each, named by the index file, so
+// that one daemon can serve the code of a whole organization. A sharded
+// index, with files name-000, name-001, and so on, is the repository
+// name. The lock files, checkpoints, parts, and temporary files cindex
+// leaves next to an index are skipped. The daemon rescans the directory
+// for each request about the registry, so that indexes added to it or
+// removed from it are noticed without a restart. A search of the
+// registry searches all the indexes at once and reports the files found
+// in each repository separately.
+
+// A DaemonRepo describes a repository in a Daemon's registry.
+type DaemonRepo struct {
+	Name  string     `json:"name"`  // name of the index file in the registry's directory
+	Index string     `json:"index"` // absolute path of the index
+	Info  DaemonInfo `json:"info"`
+}
+
+// A DaemonResult lists the files of a repository in a Daemon's registry
+// found by a search.
+type DaemonResult struct {
+	Repo  string   `json:"repo"`
+	Names []string `json:"names,omitempty"`
+	Err   string   `json:"err,omitempty"` // error searching the repository's index
+}
+
+// LoadDir makes the indexes in dir the daemon's registry of
+// repositories, opening them ahead of the first search.
+func (d *Daemon) LoadDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dir = dir
+	return d.scan()
+}
+
+// scan rescans the registry's directory, opening the indexes added to
+// it and closing those removed from it. An index that cannot be opened
+// is logged and left out of the registry.
+func (d *Daemon) scan() error {
+	if d.dir == "" {
+		return errors.New("no index registry")
+	}
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	reg := make(map[string]string)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || registrySkip(name) {
+			continue
+		}
+		if base, ok := shardBase(d.dir, name); ok {
+			name = base
+		}
+		reg[name] = filepath.Join(d.dir, name)
+	}
+	for name, file := range d.registry {
+		if reg[name] != file {
+			d.close(file)
+		}
+	}
+	for name, file := range reg {
+		if _, err := d.open(file); err != nil {
+			loggerOrDefault(d.Logger).Warn("registry: cannot open index", "index", file, "err", err)
+			delete(reg, name)
+		}
+	}
+	d.registry = reg
+	return nil
+}
+
+// registrySkip reports whether the file name in a registry's directory
+// is not an index, but a file that cindex leaves next to one.
+func registrySkip(name string) bool {
+	if _, _, _, ok := parsePartFile(name); ok {
+		return true
+	}
+	return strings.Contains(name, "~") || strings.HasSuffix(name, ".lock") || strings.HasSuffix(name, ".checkpoint")
+}
+
+// shardBase returns the name of the sharded index of which the file
+// name in dir, as returned by ShardFile, is a shard. A name such as
+// python-310, ending in a dash and three digits, is a shard only if dir
+// holds shard 0 of the index it would be a shard of.
+func shardBase(dir, name string) (string, bool) {
+	i := len(name) - len("-000")
+	if i <= 0 || name[i] != '-' {
+		return "", false
+	}
+	for _, c := range name[i+1:] {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	base := name[:i]
+	if _, err := os.Stat(filepath.Join(dir, ShardFile(base, 0))); err != nil {
+		return "", false
+	}
+	return base, true
+}
+
+// repoNames returns the names of the repositories in the registry, sorted.
+func (d *Daemon) repoNames() []string {
+	var names []string
+	for name := range d.registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// repos returns the repositories in the registry, sorted by name.
+func (d *Daemon) repos() []DaemonRepo {
+	var repos []DaemonRepo
+	for _, name := range d.repoNames() {
+		file := d.registry[name]
+		repos = append(repos, DaemonRepo{Name: name, Index: file, Info: d.indexes[file].info})
+	}
+	return repos
+}
+
+// searchable returns the names and indexes of the repositories in the
+// registry that can be searched, leaving out history indexes.
+func (d *Daemon) searchable() ([]string, []*daemonIndex) {
+	var names []string
+	var dxs []*daemonIndex
+	for _, name := range d.repoNames() {
+		dx := d.indexes[d.registry[name]]
+		if dx.info.History {
+			continue
+		}
+		names = append(names, name)
+		dxs = append(dxs, dx)
+	}
+	return names, dxs
+}
+
+// searchAll searches the indexes dxs of the repositories with the given
+// names at once, as by daemonIndex.search, and returns the files found
+// in each, adding statistics about the searches to st, and the total
+// number of bytes of posting lists they decoded.
+func searchAll(names []string, dxs []*daemonIndex, q *Query, opt *SearchOptions, st *SearchStats, span trace.Span) ([]DaemonResult, int64, error) {
+	if q == nil {
+		return nil, 0, errors.New("search without query")
+	}
+	results := make([]DaemonResult, len(names))
+	for i, name := range names {
+		results[i].Repo = name
+	}
+	stats := make([]SearchStats, len(dxs))
+	bytes := make([]int64, len(dxs))
+	var wg sync.WaitGroup
+	for i, dx := range dxs {
+		sp := trace.Start(span, "repo")
+		sp.SetAttr("repo", results[i].Repo)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sp.End()
+			names, n, err := dx.search(q, opt, &stats[i], sp)
+			if err != nil {
+				results[i].Err = err.Error()
+				return
+			}
+			results[i].Names = names
+			bytes[i] = n
+		}()
+	}
+	wg.Wait()
+	var total int64
+	for i := range dxs {
+		st.Filter += stats[i].Filter
+		st.Query += stats[i].Query
+		st.Names += stats[i].Names
+		st.Candidates += stats[i].Candidates
+		total += bytes[i]
+	}
+	return results, total, nil
+}
+
+// Repos returns the repositories in the daemon's registry, as loaded
+// by Daemon.LoadDir, sorted by name.
+func (c *DaemonClient) Repos() ([]DaemonRepo, error) {
+	resp, err := c.call(&daemonRequest{Op: "repos"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Repos, nil
+}
+
+// SearchAll searches the indexes of all the repositories in the
+// daemon's registry, as by Search, returning the files found in each,
+// sorted by repository name.
+func (c *DaemonClient) SearchAll(q *Query, opt *SearchOptions) ([]DaemonResult, error) {
+	resp, err := c.call(&daemonRequest{Op: "searchall", Query: q, Options: opt})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
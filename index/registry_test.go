@@ -0,0 +1,110 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"testing"
+)
+
+func TestDaemonRegistry(t *testing.T) {
+	dir := t.TempDir()
+	repos := filepath.Join(dir, "repos")
+	if err := os.Mkdir(repos, 0777); err != nil {
+		t.Fatal(err)
+	}
+	buildIndex(t, filepath.Join(repos, "one"), mergePaths1, mergeFiles1)
+	shard := make([]map[string]string, 2)
+	for i := range shard {
+		shard[i] = make(map[string]string)
+	}
+	for name, data := range mergeFiles2 {
+		shard[ShardOf(name, 2)][name] = data
+	}
+	for i, files := range shard {
+		buildIndex(t, ShardFile(filepath.Join(repos, "two"), i), mergePaths2, files)
+	}
+	// Files cindex leaves next to indexes are not repositories.
+	for _, name := range []string{"one.lock", "one~", PartFile("three", 0, 2)} {
+		if err := os.WriteFile(filepath.Join(repos, name), []byte("junk"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	d := new(Daemon)
+	if err := d.LoadDir(repos); err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+	c, err := DialDaemon(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	list, err := c.Repos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range list {
+		names = append(names, r.Name)
+		if r.Index != filepath.Join(repos, r.Name) {
+			t.Errorf("repo %s: Index = %s", r.Name, r.Index)
+		}
+	}
+	if want := []string{"one", "two"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Repos = %q, want %q", names, want)
+	}
+
+	re, err := syntax.Parse("now", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := RegexpQuery(re)
+	results, err := c.SearchAll(q, nil)
+	want := []DaemonResult{
+		{Repo: "one", Names: []string{"/b/xx", "/c/de"}},
+		{Repo: "two", Names: []string{"/b/xx", "/b/yy"}},
+	}
+	if err != nil || !reflect.DeepEqual(results, want) {
+		t.Errorf("SearchAll = %+v, %v, want %+v", results, err, want)
+	}
+	results, err = c.SearchAll(q, &SearchOptions{Prefix: "/c/"})
+	want = []DaemonResult{{Repo: "one", Names: []string{"/c/de"}}, {Repo: "two"}}
+	if err != nil || !reflect.DeepEqual(results, want) {
+		t.Errorf("SearchAll(/c/) = %+v, %v, want %+v", results, err, want)
+	}
+
+	// The registry follows the indexes added to and removed from the
+	// directory. An index whose name merely looks like a shard's is not
+	// taken for one.
+	buildIndex(t, filepath.Join(repos, "python-310"), []string{"/d"}, map[string]string{"/d/x": "now here"})
+	if err := os.Remove(filepath.Join(repos, "one")); err != nil {
+		t.Fatal(err)
+	}
+	results, err = c.SearchAll(q, nil)
+	want = []DaemonResult{
+		{Repo: "python-310", Names: []string{"/d/x"}},
+		{Repo: "two", Names: []string{"/b/xx", "/b/yy"}},
+	}
+	if err != nil || !reflect.DeepEqual(results, want) {
+		t.Errorf("SearchAll after update = %+v, %v, want %+v", results, err, want)
+	}
+
+	// LoadDir fails for a missing directory.
+	if err := new(Daemon).LoadDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("LoadDir of missing directory succeeded")
+	}
+}
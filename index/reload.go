@@ -0,0 +1,87 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Reloading indexes.
+//
+// cindex never rewrites an index in place: it writes a new file and
+// renames it onto the old one. A process that keeps an index open,
+// such as a server, can notice the new file, which has a new inode,
+// with Replaced, and open it with Reopen. The old Index stays usable,
+// mapped in memory, for queries still in progress on it, until it is
+// closed.
+
+// Replaced reports whether the file ix was opened from has since been
+// replaced by another file, as when cindex renames a new index onto it.
+// It reports false for an index not opened by Open, or whose file has
+// been removed without replacement.
+func (ix *Index) Replaced() bool {
+	if ix.fi == nil {
+		return false
+	}
+	fi, err := os.Stat(ix.file)
+	return err == nil && !os.SameFile(fi, ix.fi)
+}
+
+// Reopen opens the file ix was opened from again, returning a new
+// Index. It leaves ix open and unchanged.
+func (ix *Index) Reopen() (*Index, error) {
+	nix, err := Open(ix.file)
+	if err != nil {
+		return nil, err
+	}
+	nix.Verbose = ix.Verbose
+	nix.Logger = ix.Logger
+	return nix, nil
+}
+
+// A Watcher holds an index open, reopening it when its file is
+// replaced. It is safe for concurrent use.
+type Watcher struct {
+	ix atomic.Pointer[Index]
+	mu sync.Mutex // held while reopening
+}
+
+// Watch opens the index in the named file and watches it for
+// replacement.
+func Watch(file string) (*Watcher, error) {
+	ix, err := Open(file)
+	if err != nil {
+		return nil, err
+	}
+	w := new(Watcher)
+	w.ix.Store(ix)
+	return w, nil
+}
+
+// Index returns the current index, first reopening it if its file has
+// been replaced. Queries using an earlier index are unaffected; the
+// Watcher does not close it, since it cannot know when they finish.
+// If the new file cannot be opened, as when it is corrupt, Index
+// returns the error, and later calls try again.
+func (w *Watcher) Index() (*Index, error) {
+	ix := w.ix.Load()
+	if !ix.Replaced() {
+		return ix, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Another call may have reopened it while this one waited.
+	if ix = w.ix.Load(); !ix.Replaced() {
+		return ix, nil
+	}
+	nix, err := ix.Reopen()
+	if err != nil {
+		return nil, err
+	}
+	w.ix.Store(nix)
+	return nix, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "index")
+	buildIndex(t, out, mergePaths1, mergeFiles1)
+
+	w, err := Watch(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := w.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Replaced() {
+		t.Fatal("new index reports Replaced")
+	}
+	if ix, _ := w.Index(); ix != old {
+		t.Fatal("Index reopened unchanged index")
+	}
+
+	buildIndex(t, out+"~", mergePaths2, mergeFiles2)
+	if err := os.Rename(out+"~", out); err != nil {
+		t.Fatal(err)
+	}
+	if !old.Replaced() {
+		t.Fatal("replaced index does not report Replaced")
+	}
+	ix, err := w.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix == old || ix.Replaced() {
+		t.Fatal("Index did not reopen replaced index")
+	}
+	if n := ix.NumNames(); n != len(mergeFiles2) {
+		t.Errorf("reopened index has %d names, want %d", n, len(mergeFiles2))
+	}
+	// The old index must still answer queries.
+	if n := old.NumNames(); n != len(mergeFiles1) {
+		t.Errorf("old index has %d names, want %d", n, len(mergeFiles1))
+	}
+	if name, err := old.Name(0); err != nil || name != "/a/x" {
+		t.Errorf("old index Name(0) = %q, %v, want /a/x", name, err)
+	}
+
+	// A corrupt replacement is an error, until it is fixed.
+	if err := os.WriteFile(out+"~", []byte("not an index"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(out+"~", out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Index(); err == nil {
+		t.Error("Index opened corrupt replacement")
+	}
+	buildIndex(t, out+"~", mergePaths1, mergeFiles1)
+	if err := os.Rename(out+"~", out); err != nil {
+		t.Fatal(err)
+	}
+	if ix, err := w.Index(); err != nil || ix.NumNames() != len(mergeFiles1) {
+		t.Errorf("Index after fix = %v, want index of %d names", err, len(mergeFiles1))
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Remote indexes.
+//
+// OpenURL reads an index from a web server that supports HTTP range
+// requests, such as any static file server. The index is read in blocks
+// of remoteBlockSize bytes as needed, and the most recently used
+// remoteCacheBlocks blocks are kept in memory. A search reads the
+// trailer, a few entries of the posting list index for each trigram,
+// the posting lists themselves, and the names of the matching files,
+// which is usually a small part of the whole index.
+
+const (
+	remoteBlockSize   = 64 << 10
+	remoteCacheBlocks = 256
+)
+
+// OpenURL opens the index at the given http or https URL.
+func OpenURL(url string) (*Index, error) {
+	return openRemote(http.DefaultClient, url, remoteBlockSize, remoteCacheBlocks)
+}
+
+func openRemote(client *http.Client, url string, blockSize, cacheBlocks int) (*Index, error) {
+	r := &remoteData{client: client, url: url}
+	r.blockData = blockData{
+		blockSize: blockSize,
+		cache:     newBlockCache(cacheBlocks),
+		read:      r.fetchFull,
+	}
+	// Learn the size from the first block.
+	first, size, err := r.fetch(0, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	r.n = size
+	r.cache.add(0, first)
+	return openData(url, r)
+}
+
+// remoteData is index data read on demand with HTTP range requests.
+type remoteData struct {
+	blockData
+	client *http.Client
+	url    string
+}
+
+func (r *remoteData) close() error {
+	// Nothing stays open between requests.
+	return nil
+}
+
+// fetchFull reads exactly n bytes at off, bypassing the cache.
+func (r *remoteData) fetchFull(off, n int) ([]byte, error) {
+	data, _, err := r.fetch(off, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != n {
+		return nil, fmt.Errorf("%s: short read", r.url)
+	}
+	return data, nil
+}
+
+// fetch reads up to n bytes at off, returning them along with
+// the total size of the remote file.
+func (r *remoteData) fetch(off, n int) ([]byte, int, error) {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, 0, fmt.Errorf("%s: range request failed: %s", r.url, resp.Status)
+	}
+	size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", r.url, err)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(n)))
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, size, nil
+}
+
+// contentRangeSize returns the complete length from a
+// Content-Range header of the form "bytes first-last/length".
+func contentRangeSize(h string) (int, error) {
+	i := strings.LastIndex(h, "/")
+	if !strings.HasPrefix(h, "bytes ") || i < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", h)
+	}
+	size, err := strconv.Atoi(h[i+1:])
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", h)
+	}
+	return size, nil
+}
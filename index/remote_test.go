@@ -0,0 +1,86 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOpenURL(t *testing.T) {
+	f, _ := os.CreateTemp("", "index-test")
+	out := f.Name()
+	f.Close()
+	defer os.Remove(out)
+	buildQuadIndex(t, out, mergePaths1, false, mergeFiles1)
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		http.ServeContent(w, req, "index", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	local, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use tiny blocks and cache so that reads span and evict blocks.
+	for _, bs := range []int{7, 64, 1 << 16} {
+		ix, err := openRemote(srv.Client(), srv.URL, bs, 4)
+		if err != nil {
+			t.Fatalf("blockSize %d: %v", bs, err)
+		}
+		names, err := ix.Names()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := local.Names()
+		if len(names) != len(want) {
+			t.Fatalf("blockSize %d: Names() = %v, want %v", bs, names, want)
+		}
+		for i := range names {
+			if names[i] != want[i] {
+				t.Fatalf("blockSize %d: Names() = %v, want %v", bs, names, want)
+			}
+		}
+		if !ix.HasQuadgrams() {
+			t.Errorf("blockSize %d: HasQuadgrams() = false", bs)
+		}
+		for _, q := range []*Query{
+			{Op: QAnd, Trigram: []string{"now"}},
+			{Op: QOr, Trigram: []string{"wor", "all"}},
+			{Op: QAnd, Trigram: []string{"pota", "toes"}},
+		} {
+			have, err := ix.PostingQuery(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := local.PostingQuery(q)
+			if !equalList(have, want) {
+				t.Errorf("blockSize %d: PostingQuery(%v) = %v, want %v", bs, q, have, want)
+			}
+		}
+	}
+
+	// With a block as large as the index, everything is read at open.
+	requests = 0
+	ix, err := openRemote(srv.Client(), srv.URL, 1<<16, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.PostingQuery(&Query{Op: QAnd, Trigram: []string{"now"}})
+	ix.Names()
+	if requests != 1 {
+		t.Errorf("made %d requests, want 1", requests)
+	}
+}
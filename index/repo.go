@@ -0,0 +1,160 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Repository metadata.
+//
+// An index may record, for each indexed path, the repository holding
+// it: its name and checked-out branch. Since the names of the files
+// under a path are numbered consecutively, a search limited to some
+// repositories need only consider the file ID ranges of their paths.
+//
+// The "repo" section lists the repositories, sorted by path, each as
+// three NUL-terminated strings: path, name, and branch.
+
+// A Repo is a repository indexed under a path.
+type Repo struct {
+	Path   string // indexed path, as passed to Writer.AddPaths
+	Name   string // name of the repository
+	Branch string // checked-out branch, or "" if unknown
+}
+
+// A FileRange is a range [Lo, Hi) of file IDs.
+type FileRange struct {
+	Lo, Hi uint32
+}
+
+// AddRepos records the repositories holding indexed paths.
+func (ix *Writer) AddRepos(repos []Repo) {
+	ix.repos = append(ix.repos, repos...)
+}
+
+// repoSection returns a temporary file in dir holding the "repo"
+// section listing repos, or nil if there are none.
+func repoSection(dir string, repos []Repo) (*bufWriter, error) {
+	if len(repos) == 0 {
+		return nil, nil
+	}
+	repos = append([]Repo(nil), repos...)
+	sort.SliceStable(repos, func(i, j int) bool { return repos[i].Path < repos[j].Path })
+	var list []string
+	for i, r := range repos {
+		if i+1 < len(repos) && repos[i+1].Path == r.Path {
+			continue // keep the last for each path
+		}
+		list = append(list, r.Path, r.Name, r.Branch)
+	}
+	return stringSection(dir, list)
+}
+
+// Repos returns the repositories recorded in the index, sorted by path.
+func (ix *Index) Repos() ([]Repo, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	s, ok := ix.sections["repo"]
+	if !ok {
+		return nil, nil
+	}
+	d, err := ix.slice(s.off, int(s.size))
+	if err != nil {
+		return nil, ix.inSection("repo", err)
+	}
+	var fields []string
+	for len(d) > 0 {
+		i := bytes.IndexByte(d, 0)
+		if i < 0 {
+			return nil, ix.corrupt("repo", s.off+s.size-uint32(len(d)), ErrTruncated)
+		}
+		fields = append(fields, string(d[:i]))
+		d = d[i+1:]
+	}
+	if len(fields)%3 != 0 {
+		return nil, ix.corrupt("repo", s.off, ErrMalformed)
+	}
+	var repos []Repo
+	for i := 0; i < len(fields); i += 3 {
+		repos = append(repos, Repo{fields[i], fields[i+1], fields[i+2]})
+	}
+	return repos, nil
+}
+
+// RepoRanges returns the ranges of IDs of the files in the named
+// repositories, sorted and disjoint. A name of the form name@branch
+// matches only the repository with that name and branch.
+func (ix *Index) RepoRanges(names ...string) ([]FileRange, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	repos, err := ix.Repos()
+	if err != nil {
+		return nil, err
+	}
+	var ranges []FileRange
+	for _, r := range repos {
+		match := false
+		for _, name := range names {
+			if name == r.Name || r.Branch != "" && name == r.Name+"@"+r.Branch {
+				match = true
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		fr, err := ix.FilesUnder(r.Path)
+		if err != nil {
+			return nil, err
+		}
+		if fr.Lo < fr.Hi {
+			ranges = append(ranges, fr)
+		}
+	}
+	// The ranges of nested paths overlap, and those of paths such as
+	// /a and /a-b, whose files sort in the other order, are out of order.
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Lo < ranges[j].Lo })
+	var merged []FileRange
+	for _, fr := range ranges {
+		if n := len(merged); n > 0 && fr.Lo <= merged[n-1].Hi {
+			if fr.Hi > merged[n-1].Hi {
+				merged[n-1].Hi = fr.Hi
+			}
+			continue
+		}
+		merged = append(merged, fr)
+	}
+	return merged, nil
+}
+
+// mergeRepos returns the repositories of the merge of ix1 and ix2,
+// whose merged path list is paths. Those of ix2 replace those of ix1.
+func mergeRepos(ix1, ix2 *Index, paths []string) ([]Repo, error) {
+	r1, err := ix1.Repos()
+	if err != nil {
+		return nil, err
+	}
+	r2, err := ix2.Repos()
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool)
+	for _, p := range paths {
+		keep[p] = true
+	}
+	var repos []Repo
+	for _, r := range append(r1, r2...) {
+		if keep[r.Path] {
+			repos = append(repos, r)
+		}
+	}
+	return repos, nil
+}
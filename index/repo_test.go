@@ -0,0 +1,72 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRepos(t *testing.T) {
+	dir := t.TempDir()
+	repos := func(repos ...Repo) func(*Writer) {
+		return func(ix *Writer) { ix.AddRepos(repos) }
+	}
+	old := filepath.Join(dir, "old")
+	buildFlushIndex(t, old, []string{"/a", "/ab", "/b"}, false, map[string]string{
+		"/a/x":  "hello world",
+		"/a/y":  "hello world",
+		"/ab/z": "hello world",
+		"/b/w":  "hello world",
+	}, repos(Repo{"/b", "b", "dev"}, Repo{"/a", "a", "main"}))
+	update := filepath.Join(dir, "update")
+	buildFlushIndex(t, update, []string{"/b"}, false, map[string]string{
+		"/b/v": "hello world",
+		"/b/w": "hello world",
+	}, repos(Repo{"/b", "b", "feature"}))
+	merged := filepath.Join(dir, "merged")
+	if err := Merge(merged, old, update); err != nil {
+		t.Fatal(err)
+	}
+	// The files of /c/d are also under /c, and those of /c sort after
+	// those of /c-d.
+	nested := filepath.Join(dir, "nested")
+	buildFlushIndex(t, nested, []string{"/c", "/c-d", "/c/d"}, false, map[string]string{
+		"/c-d/x": "hello world",
+		"/c/d/y": "hello world",
+		"/c/z":   "hello world",
+	}, repos(Repo{"/c", "c", ""}, Repo{"/c-d", "cd", ""}, Repo{"/c/d", "d", ""}))
+
+	for _, tt := range []struct {
+		file  string
+		repos []Repo
+		names []string
+		want  []FileRange
+	}{
+		{old, []Repo{{"/a", "a", "main"}, {"/b", "b", "dev"}}, []string{"a"}, []FileRange{{0, 2}}},
+		{old, nil, []string{"b@dev", "a@main"}, []FileRange{{0, 2}, {3, 4}}},
+		{old, nil, []string{"b@feature", "c"}, nil},
+		{merged, []Repo{{"/a", "a", "main"}, {"/b", "b", "feature"}}, []string{"b@feature"}, []FileRange{{3, 5}}},
+		{nested, nil, []string{"c", "cd", "d"}, []FileRange{{0, 3}}},
+		{nested, nil, []string{"c", "d"}, []FileRange{{1, 3}}},
+		{nested, nil, []string{"d"}, []FileRange{{1, 2}}},
+	} {
+		ix, err := Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.repos != nil {
+			repos, err := ix.Repos()
+			if err != nil || !reflect.DeepEqual(repos, tt.repos) {
+				t.Errorf("%s: Repos() = %v, %v, want %v", filepath.Base(tt.file), repos, err, tt.repos)
+			}
+		}
+		got, err := ix.RepoRanges(tt.names...)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: RepoRanges(%q) = %v, %v, want %v", filepath.Base(tt.file), tt.names, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	stdregexp "regexp"
+	"time"
+
+	"github.com/andrewarchi/codesearch/lang"
+	"github.com/andrewarchi/codesearch/trace"
+)
+
+// SearchOptions restrict a search to some of the files in an index.
+type SearchOptions struct {
+	Prefix string    // only files whose names begin with Prefix
+	Dir    string    // only files under the directory Dir, as found by FilesUnder
+	Langs  []lang.ID // if non-nil, only files in these languages
+	Repos  []string  // if non-nil, only files in these repositories, named as for RepoRanges
+
+	// SkipClasses lists the classes of files to leave out, such as
+	// lang.Generated, in indexes that record them (see Writer.Classify).
+	SkipClasses []lang.Class
+
+	// Files and NotFiles are regular expressions, in the syntax of
+	// package regexp: only files whose names match all of Files and
+	// none of NotFiles.
+	Files    []string
+	NotFiles []string
+
+	// MaxSize, if positive, and ModifiedAfter, if not zero, restrict
+	// the search to files no larger than MaxSize bytes and modified
+	// after ModifiedAfter, as recorded when they were indexed (see
+	// Index.FileStat). Files whose sizes and times the index does not
+	// record pass; see Index.UnstattedNames.
+	MaxSize       int64
+	ModifiedAfter time.Time
+
+	// Stats, if non-nil, accumulates statistics about the search.
+	Stats *SearchStats `json:"-"`
+
+	// Trace, if non-nil, is the span under which the search records
+	// spans for applying the filters, evaluating each node of the
+	// posting query, and looking up the names of the files found.
+	Trace trace.Span `json:"-"`
+}
+
+// SearchStats describes the work done by searches.
+type SearchStats struct {
+	Filter     time.Duration // applying the filters
+	Query      time.Duration // evaluating the posting query
+	Names      time.Duration // looking up the names of the files found
+	Candidates int           // files found, which might match
+}
+
+// Search returns the names of the files in ix that might match q and
+// pass the filters in opt, which may be nil. It logs the number of
+// files passing each filter, as a detail.
+func (ix *Index) Search(q *Query, opt *SearchOptions) ([]string, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	if opt == nil {
+		opt = new(SearchOptions)
+	}
+	st := opt.Stats
+	if st == nil {
+		st = new(SearchStats)
+	}
+	start := time.Now()
+	span := trace.Start(opt.Trace, "filter")
+	var restrict []uint32
+	var err error
+	if opt.Langs != nil {
+		restrict, err = ix.FilesByLang(opt.Langs...)
+		if err != nil {
+			return nil, err
+		}
+		logDetail(ix.Logger, ix.Verbose, "language filter", "files", len(restrict))
+		span.SetAttr("lang", len(restrict))
+	}
+	lo, hi := uint32(0), uint32(ix.NumNames())
+	if opt.Prefix != "" {
+		lo, hi, err = ix.NameRange(opt.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		logDetail(ix.Logger, ix.Verbose, "path filter", "files", hi-lo)
+		span.SetAttr("path", hi-lo)
+	}
+	if opt.Dir != "" {
+		dir, err := ix.FilesUnder(opt.Dir)
+		if err != nil {
+			return nil, err
+		}
+		lo, hi = max(lo, dir.Lo), min(hi, dir.Hi)
+		hi = max(lo, hi)
+		logDetail(ix.Logger, ix.Verbose, "directory filter", "files", hi-lo)
+		span.SetAttr("dir", hi-lo)
+	}
+	ranges := []FileRange{{Lo: lo, Hi: hi}}
+	if opt.Repos != nil {
+		ranges, err = ix.repoRanges(opt.Repos, lo, hi)
+		if err != nil {
+			return nil, err
+		}
+		span.SetAttr("repo ranges", len(ranges))
+	}
+	match, err := opt.NameFilter()
+	if err != nil {
+		return nil, err
+	}
+	var skip map[uint32]bool
+	if len(opt.SkipClasses) > 0 {
+		ids, err := ix.FilesByClass(opt.SkipClasses...)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) > 0 {
+			skip = make(map[uint32]bool, len(ids))
+			for _, id := range ids {
+				skip[id] = true
+			}
+		}
+		span.SetAttr("class", len(ids))
+	}
+	span.End()
+	now := time.Now()
+	st.Filter += now.Sub(start)
+	start = now
+
+	span = trace.Start(opt.Trace, "query")
+	span.SetAttr("query", q.String())
+	var parent trace.Span // of the posting query spans, if tracing
+	if opt.Trace != nil {
+		parent = span
+	}
+	var post []uint32
+	rs := &restriction{list: restrict} // shared, so its bitmap is built once
+	for _, r := range ranges {
+		rs.lo, rs.hi = r.Lo, r.Hi
+		p, err := ix.postingQuery(q, rs, parent)
+		if err != nil {
+			return nil, err
+		}
+		post = append(post, p...)
+	}
+	logDetail(ix.Logger, ix.Verbose, "posting query", "files", len(post))
+	span.SetAttr("files", len(post))
+	span.End()
+	now = time.Now()
+	st.Query += now.Sub(start)
+	start = now
+
+	span = trace.Start(opt.Trace, "names")
+	names := make([]string, 0, len(post))
+	skipped := 0
+	statFilter := ix.HasStats() && (opt.MaxSize > 0 || !opt.ModifiedAfter.IsZero())
+	statted := 0
+	for _, fileID := range post {
+		if skip[fileID] {
+			skipped++
+			continue
+		}
+		if statFilter {
+			st, err := ix.FileStat(fileID)
+			if err != nil {
+				return nil, err
+			}
+			if st != nil && !opt.statMatch(st) {
+				continue
+			}
+			statted++
+		}
+		name, err := ix.Name(fileID)
+		if err != nil {
+			return nil, err
+		}
+		if match != nil && !match(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if skip != nil {
+		logDetail(ix.Logger, ix.Verbose, "class filter", "skipped", skipped)
+	}
+	if statFilter {
+		logDetail(ix.Logger, ix.Verbose, "size and time filter", "files", statted)
+		span.SetAttr("stat", statted)
+	}
+	if match != nil {
+		logDetail(ix.Logger, ix.Verbose, "file filter", "files", len(names))
+		span.SetAttr("file", len(names))
+	}
+	span.End()
+	st.Names += time.Since(start)
+	st.Candidates += len(names)
+	return names, nil
+}
+
+// NameFilter returns a function reporting whether a file name passes
+// the Files and NotFiles filters of opt, or nil if there are none.
+func (opt *SearchOptions) NameFilter() (func(name string) bool, error) {
+	if len(opt.Files) == 0 && len(opt.NotFiles) == 0 {
+		return nil, nil
+	}
+	compile := func(exprs []string) ([]*stdregexp.Regexp, error) {
+		var res []*stdregexp.Regexp
+		for _, expr := range exprs {
+			re, err := stdregexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	files, err := compile(opt.Files)
+	if err != nil {
+		return nil, err
+	}
+	notFiles, err := compile(opt.NotFiles)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		for _, re := range files {
+			if !re.MatchString(name) {
+				return false
+			}
+		}
+		for _, re := range notFiles {
+			if re.MatchString(name) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// repoRanges returns the ranges of IDs of the files in the named
+// repositories, limited to the range [lo, hi).
+func (ix *Index) repoRanges(repos []string, lo, hi uint32) ([]FileRange, error) {
+	all, err := ix.RepoRanges(repos...)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []FileRange
+	n := 0
+	for _, r := range all {
+		if r.Lo < lo {
+			r.Lo = lo
+		}
+		if r.Hi > hi {
+			r.Hi = hi
+		}
+		if r.Lo < r.Hi {
+			ranges = append(ranges, r)
+			n += int(r.Hi - r.Lo)
+		}
+	}
+	logDetail(ix.Logger, ix.Verbose, "repository filter", "files", n)
+	return ranges, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sharded indexes.
+//
+// A sharded index is a set of ordinary index files named file-000,
+// file-001, and so on, that together index a single set of paths.
+// Each file name is assigned to one shard by a hash of the name, and
+// every shard records the full list of indexed paths, so that each
+// shard can be rebuilt or merged independently of the others.
+//
+// A ShardedIndex numbers files across all shards: the files of the
+// first shard come first, then those of the second, and so on.
+//
+// Parts are shards written to be merged into one index, as by a build
+// farm, each machine indexing the files of one part. Part i of n of an
+// index file is named file.part-00i-of-00n, so that the parts of one
+// index can be collected from several machines into a directory and
+// checked for completeness before they are merged by MergeN.
+
+// ShardFile returns the name of shard i of the sharded index file.
+func ShardFile(file string, i int) string {
+	return fmt.Sprintf("%s-%03d", file, i)
+}
+
+// NumShards returns the number of shards of the sharded index file,
+// or 0 if there is no sharded index by that name.
+func NumShards(file string) int {
+	n := 0
+	for {
+		if _, err := os.Stat(ShardFile(file, n)); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// ShardOf returns the shard, out of n, to which the file with the given
+// name belongs.
+func ShardOf(name string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(n))
+}
+
+// PartFile returns the name of part i of n of the index file.
+func PartFile(file string, i, n int) string {
+	return fmt.Sprintf("%s.part-%03d-of-%03d", file, i, n)
+}
+
+// parsePartFile returns the index file, part number, and number of
+// parts named by the part file name, as returned by PartFile.
+func parsePartFile(name string) (file string, i, n int, ok bool) {
+	j := strings.LastIndex(name, ".part-")
+	if j < 0 {
+		return "", 0, 0, false
+	}
+	is, ns, _ := strings.Cut(name[j+len(".part-"):], "-of-")
+	i, err1 := strconv.Atoi(is)
+	n, err2 := strconv.Atoi(ns)
+	if err1 != nil || err2 != nil || i < 0 || i >= n || PartFile(name[:j], i, n) != name {
+		return "", 0, 0, false
+	}
+	return name[:j], i, n, true
+}
+
+// PartFiles returns the part files of one index in the directory dir,
+// in order by part number. It returns an error if dir holds parts of
+// more than one index or split more than one way, or if any are missing.
+func PartFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var parts []string
+	var base string
+	for _, e := range entries {
+		file, i, n, ok := parsePartFile(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		if parts == nil {
+			base = file
+			parts = make([]string, n)
+		}
+		if file != base || n != len(parts) {
+			return nil, fmt.Errorf("%s: parts of different indexes: %s and %s", dir, PartFile(base, 0, len(parts)), e.Name())
+		}
+		parts[i] = filepath.Join(dir, e.Name())
+	}
+	if parts == nil {
+		return nil, fmt.Errorf("%s: no index parts", dir)
+	}
+	var missing []string
+	for i, p := range parts {
+		if p == "" {
+			missing = append(missing, PartFile(base, i, len(parts)))
+		}
+	}
+	if missing != nil {
+		return nil, fmt.Errorf("%s: missing index parts %s", dir, strings.Join(missing, ", "))
+	}
+	return parts, nil
+}
+
+// A ShardedIndex presents the shards of a sharded index as one index.
+type ShardedIndex struct {
+	Shards []*Index
+	base   []uint32 // file ID of the first file in each shard
+}
+
+// OpenSharded opens the sharded index file.
+func OpenSharded(file string) (*ShardedIndex, error) {
+	n := NumShards(file)
+	if n == 0 {
+		return nil, fmt.Errorf("%s: no index shards", file)
+	}
+	s := &ShardedIndex{}
+	base := uint32(0)
+	for i := 0; i < n; i++ {
+		ix, err := Open(ShardFile(file, i))
+		if err != nil {
+			return nil, err
+		}
+		s.Shards = append(s.Shards, ix)
+		s.base = append(s.base, base)
+		base += uint32(ix.numName)
+	}
+	return s, nil
+}
+
+// Close closes all the shards.
+func (s *ShardedIndex) Close() error {
+	var err error
+	for _, ix := range s.Shards {
+		if cerr := ix.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NumNames returns the number of file names in all shards.
+func (s *ShardedIndex) NumNames() int {
+	n := 0
+	for _, ix := range s.Shards {
+		n += ix.numName
+	}
+	return n
+}
+
+// Paths returns the list of indexed paths.
+func (s *ShardedIndex) Paths() ([]string, error) {
+	return s.Shards[0].Paths()
+}
+
+// Shard returns the shard holding the file with the given ID and the
+// file's ID within that shard.
+func (s *ShardedIndex) Shard(fileID uint32) (*Index, uint32, error) {
+	i := sort.Search(len(s.base), func(i int) bool { return s.base[i] > fileID }) - 1
+	if i < 0 || fileID-s.base[i] >= uint32(s.Shards[i].numName) {
+		return nil, 0, fmt.Errorf("file ID %d out of range", fileID)
+	}
+	return s.Shards[i], fileID - s.base[i], nil
+}
+
+// Name returns the name corresponding to the given file ID.
+func (s *ShardedIndex) Name(fileID uint32) (string, error) {
+	ix, id, err := s.Shard(fileID)
+	if err != nil {
+		return "", err
+	}
+	return ix.Name(id)
+}
+
+// PostingQuery runs q against every shard concurrently and returns
+// the combined list of matching file IDs.
+func (s *ShardedIndex) PostingQuery(q *Query) ([]uint32, error) {
+	type result struct {
+		list []uint32
+		err  error
+	}
+	results := make([]chan result, len(s.Shards))
+	for i, ix := range s.Shards {
+		results[i] = make(chan result, 1)
+		go func(ix *Index, c chan<- result) {
+			list, err := ix.PostingQuery(q)
+			c <- result{list, err}
+		}(ix, results[i])
+	}
+	var post []uint32
+	var err error
+	for i, c := range results {
+		r := <-c
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+			}
+			continue
+		}
+		for _, id := range r.list {
+			post = append(post, s.base[i]+id)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return post, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestShardedIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index")
+
+	const n = 3
+	shardFiles := make([]map[string]string, n)
+	for i := range shardFiles {
+		shardFiles[i] = make(map[string]string)
+	}
+	for name, data := range mergeFiles1 {
+		shardFiles[ShardOf(name, n)][name] = data
+	}
+	for i, files := range shardFiles {
+		buildIndex(t, ShardFile(file, i), mergePaths1, files)
+	}
+
+	if got := NumShards(file); got != n {
+		t.Fatalf("NumShards = %d, want %d", got, n)
+	}
+	s, err := OpenSharded(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.NumNames(); got != len(mergeFiles1) {
+		t.Errorf("NumNames = %d, want %d", got, len(mergeFiles1))
+	}
+
+	for _, tt := range []struct {
+		q    *Query
+		want []string
+	}{
+		{&Query{Op: QAnd, Trigram: []string{"now"}}, []string{"/b/xx", "/c/de"}},
+		{&Query{Op: QOr, Trigram: []string{"wor", "all"}}, []string{"/a/x", "/a/y", "/b/xy", "/c/ab"}},
+		{&Query{Op: QAnd, Trigram: []string{"xyz"}}, nil},
+	} {
+		post, err := s.PostingQuery(tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, id := range post {
+			name, err := s.Name(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) != len(tt.want) {
+			t.Errorf("PostingQuery(%v) = %v, want %v", tt.q, names, tt.want)
+			continue
+		}
+		for i := range names {
+			if names[i] != tt.want[i] {
+				t.Errorf("PostingQuery(%v) = %v, want %v", tt.q, names, tt.want)
+				break
+			}
+		}
+	}
+
+	if _, err := s.Name(uint32(len(mergeFiles1))); err == nil {
+		t.Errorf("Name(%d) succeeded, want error", len(mergeFiles1))
+	}
+}
+
+func TestPartFiles(t *testing.T) {
+	dir := t.TempDir()
+	touch := func(name string) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name := PartFile("ix", 2, 12); name != "ix.part-002-of-012" {
+		t.Errorf("PartFile(ix, 2, 12) = %q", name)
+	}
+	if _, err := PartFiles(dir); err == nil {
+		t.Errorf("PartFiles(empty) succeeded")
+	}
+	touch("ix.part-002-of-003")
+	touch("ix.part-000-of-003")
+	touch("ix.part-3-of-3")
+	touch("ix.lock")
+	if _, err := PartFiles(dir); err == nil || !strings.Contains(err.Error(), "missing index parts ix.part-001-of-003") {
+		t.Errorf("PartFiles(missing part) = %v, want missing part", err)
+	}
+	touch("ix.part-001-of-003")
+	parts, err := PartFiles(dir)
+	want := []string{
+		filepath.Join(dir, "ix.part-000-of-003"),
+		filepath.Join(dir, "ix.part-001-of-003"),
+		filepath.Join(dir, "ix.part-002-of-003"),
+	}
+	if err != nil || !slices.Equal(parts, want) {
+		t.Errorf("PartFiles = %q, %v, want %q", parts, err, want)
+	}
+	touch("ix.part-000-of-002")
+	if _, err := PartFiles(dir); err == nil {
+		t.Errorf("PartFiles(parts split two ways) succeeded")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"fmt"
+
+	"github.com/andrewarchi/codesearch/lang"
+)
+
+// A SkipKind is a kind of problem that makes a Writer skip a file,
+// judging that it is not text or, for SkipClass, not wanted.
+// A file skipped for SkipBadGzip is skipped whatever OnSkip returns.
+type SkipKind int
+
+const (
+	SkipInvalidUTF8     SkipKind = iota + 1 // the file contains an invalid UTF-8 sequence
+	SkipFileTooLong                         // the file is longer than 1 GB
+	SkipLineTooLong                         // the file has a line longer than 2000 bytes
+	SkipTooManyTrigrams                     // the file has more than 20000 distinct trigrams
+	SkipClass                               // the file is of a class in Writer.SkipClasses
+	SkipBadGzip                             // the file is gzip-compressed but corrupt, with Writer.Gunzip
+)
+
+// A SkipReason describes why a Writer skipped a file.
+type SkipReason struct {
+	Kind     SkipKind
+	Line     int        // line of the problem, for SkipInvalidUTF8 and SkipLineTooLong
+	Trigrams int        // distinct trigrams in the file, for SkipTooManyTrigrams
+	Class    lang.Class // class of the file, for SkipClass
+}
+
+// String returns the reason as logged and printed by cindex,
+// such as "line 12 too long (over 2000 bytes)".
+func (r SkipReason) String() string {
+	switch r.Kind {
+	case SkipInvalidUTF8:
+		return fmt.Sprintf("invalid UTF-8 on line %d", r.Line)
+	case SkipFileTooLong:
+		return fmt.Sprintf("file too long (over %d bytes)", maxFileLen)
+	case SkipLineTooLong:
+		return fmt.Sprintf("line %d too long (over %d bytes)", r.Line, maxLineLen)
+	case SkipTooManyTrigrams:
+		return fmt.Sprintf("too many trigrams (%d), probably not text", r.Trigrams)
+	case SkipClass:
+		return r.Class.String() + " file"
+	case SkipBadGzip:
+		return "corrupt gzip data"
+	}
+	return fmt.Sprintf("SkipKind(%d)", r.Kind)
+}
+
+// skip reports whether to skip the file with the given name for the
+// reason given, as decided by ix.OnSkip.
+func (ix *Writer) skip(name string, reason *SkipReason) bool {
+	return ix.OnSkip == nil || ix.OnSkip(name, *reason)
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andrewarchi/codesearch/lang"
+)
+
+// SQL export.
+//
+// ExportSQL writes an index as SQL statements that create and fill
+// these tables, for loading into SQLite with the sqlite3 command and
+// querying with any SQL tool:
+//
+//	paths(path TEXT)                                   indexed paths
+//	files(id INTEGER, name TEXT, dir TEXT, lang TEXT)  indexed files
+//	trigrams(id INTEGER, trigram BLOB, text TEXT, count INTEGER)
+//	postings(trigram INTEGER, file INTEGER)            trigram ID, file ID
+//
+// The files table gives each file's directory, for grouping, and its
+// language, or NULL if unknown. The trigrams table gives each trigram
+// as bytes and, if they are valid UTF-8, as text, along with the number
+// of files containing it. For example, to list the most common
+// trigrams:
+//
+//	SELECT text, count FROM trigrams ORDER BY count DESC LIMIT 10;
+//
+// or the directories holding the most files:
+//
+//	SELECT dir, count(*) FROM files GROUP BY dir ORDER BY 2 DESC LIMIT 10;
+
+const sqlSchema = `CREATE TABLE paths (path TEXT PRIMARY KEY);
+CREATE TABLE files (id INTEGER PRIMARY KEY, name TEXT NOT NULL, dir TEXT NOT NULL, lang TEXT);
+CREATE TABLE trigrams (id INTEGER PRIMARY KEY, trigram BLOB NOT NULL UNIQUE, text TEXT, count INTEGER NOT NULL);
+CREATE TABLE postings (trigram INTEGER NOT NULL, file INTEGER NOT NULL, PRIMARY KEY (trigram, file)) WITHOUT ROWID;
+`
+
+// sqlIndexes are created after the tables are filled, which is faster
+// than maintaining them row by row.
+const sqlIndexes = `CREATE INDEX files_dir ON files (dir);
+CREATE INDEX postings_file ON postings (file, trigram);
+`
+
+// sqlBatch is the number of rows inserted by each INSERT statement.
+const sqlBatch = 500
+
+// ExportSQL writes to w SQL statements creating tables holding the
+// index, as described above.
+func (ix *Index) ExportSQL(w io.Writer) error {
+	if err := ix.acquire(); err != nil {
+		return err
+	}
+	defer ix.release()
+	bw := bufio.NewWriter(w)
+	ins := sqlInserter{w: bw}
+	bw.WriteString("BEGIN TRANSACTION;\n")
+	bw.WriteString(sqlSchema)
+
+	paths, err := ix.Paths()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		ins.row("paths", sqlString(p))
+	}
+	ins.end()
+
+	for id := uint32(0); id < uint32(ix.numName); id++ {
+		name, err := ix.Name(id)
+		if err != nil {
+			return err
+		}
+		l, err := ix.Lang(id)
+		if err != nil {
+			return err
+		}
+		langName := "NULL"
+		if l != lang.Unknown {
+			langName = sqlString(l.String())
+		}
+		ins.row("files", strconv.FormatUint(uint64(id), 10), sqlString(name), sqlString(path.Dir(name)), langName)
+	}
+	ins.end()
+
+	n := ix.NumTrigrams()
+	for i := 0; i < n; i++ {
+		info, err := ix.TrigramAt(i)
+		if err != nil {
+			return err
+		}
+		t := string([]byte{byte(info.Trigram >> 16), byte(info.Trigram >> 8), byte(info.Trigram)})
+		text := "NULL"
+		if utf8.ValidString(t) && !strings.Contains(t, "\x00") {
+			text = sqlString(t)
+		}
+		ins.row("trigrams", strconv.Itoa(i), "X'"+hex.EncodeToString([]byte(t))+"'", text, strconv.Itoa(info.Count))
+	}
+	ins.end()
+
+	for i := 0; i < n; i++ {
+		info, err := ix.TrigramAt(i)
+		if err != nil {
+			return err
+		}
+		files, err := ix.PostingList(info.Trigram)
+		if err != nil {
+			return err
+		}
+		tid := strconv.Itoa(i)
+		for _, id := range files {
+			ins.row("postings", tid, strconv.FormatUint(uint64(id), 10))
+		}
+	}
+	ins.end()
+
+	bw.WriteString(sqlIndexes)
+	bw.WriteString("COMMIT;\n")
+	return bw.Flush()
+}
+
+// An sqlInserter writes rows as multi-row INSERT statements.
+type sqlInserter struct {
+	w     *bufio.Writer
+	table string
+	n     int // rows in the current statement
+}
+
+// row writes a row of SQL values to the table.
+func (s *sqlInserter) row(table string, values ...string) {
+	if s.n > 0 && (table != s.table || s.n >= sqlBatch) {
+		s.end()
+	}
+	if s.n == 0 {
+		s.table = table
+		s.w.WriteString("INSERT INTO " + table + " VALUES\n(")
+	} else {
+		s.w.WriteString(",\n(")
+	}
+	for i, v := range values {
+		if i > 0 {
+			s.w.WriteString(", ")
+		}
+		s.w.WriteString(v)
+	}
+	s.w.WriteString(")")
+	s.n++
+}
+
+// end ends the current INSERT statement, if any.
+func (s *sqlInserter) end() {
+	if s.n > 0 {
+		s.w.WriteString(";\n")
+		s.n = 0
+	}
+}
+
+// sqlString returns s as an SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportSQL(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(t, out, []string{"/src"}, exportFiles)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ix.ExportSQL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	sql := buf.String()
+	for _, want := range []string{
+		"INSERT INTO paths VALUES\n('/src');\n",
+		"(0, '/src/a/main.go', '/src/a', 'go')",
+		"(3, '/src/b/été', '/src/b', NULL)",
+		"X'6d6169', 'mai', 3)",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("ExportSQL output lacks %q:\n%s", want, sql)
+		}
+	}
+
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	db := filepath.Join(t.TempDir(), "db")
+	cmd := exec.Command(sqlite, db)
+	cmd.Stdin = strings.NewReader(sql)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sqlite3: %v\n%s", err, out)
+	}
+	query := `SELECT f.name FROM postings p JOIN trigrams t ON t.id = p.trigram JOIN files f ON f.id = p.file WHERE t.text = 'mai' ORDER BY f.name;`
+	got, err := exec.Command(sqlite, db, query).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/src/a/main.go\n/src/a/notes\n/src/b/util.py\n"
+	if string(got) != want {
+		t.Errorf("files containing mai = %q, want %q", got, want)
+	}
+}
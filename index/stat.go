@@ -0,0 +1,134 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// File sizes and modification times.
+//
+// An index may record the size and modification time of each file as
+// it was when indexed, so that tools can tell which files have changed
+// since (see cindex -verify) and filter searches by them without
+// looking up every file. The "stat" section holds, for each file, in
+// order, its size in bytes and its modification time in nanoseconds
+// since the Unix epoch, each as an 8-byte big-endian number. A time of
+// 0 means that both are unknown, as for a file added by Writer.Add
+// from a reader that cannot say. Merging keeps the entry of each file
+// from the index that provided it.
+
+// statEntrySize is the size of a "stat" section entry.
+const statEntrySize = 16
+
+// A FileStat is the size and modification time of an indexed file
+// when it was indexed.
+type FileStat struct {
+	Size    int64     // size in bytes, as on disk
+	ModTime time.Time // modification time
+}
+
+// A statReader is a reader of a file that can look the file up,
+// such as an *os.File.
+type statReader interface {
+	Stat() (fs.FileInfo, error)
+}
+
+// fileStat returns the FileStat of fi, or nil if fi is nil.
+func fileStat(fi fs.FileInfo) *FileStat {
+	if fi == nil {
+		return nil
+	}
+	return &FileStat{Size: fi.Size(), ModTime: fi.ModTime()}
+}
+
+// writeStat writes the "stat" section entry recording st,
+// which may be nil if unknown, to b.
+func writeStat(b *bufWriter, st *FileStat) error {
+	var buf [statEntrySize]byte
+	if st != nil && !st.ModTime.IsZero() {
+		binary.BigEndian.PutUint64(buf[:], uint64(st.Size))
+		binary.BigEndian.PutUint64(buf[8:], uint64(st.ModTime.UnixNano()))
+	}
+	return b.write(buf[:])
+}
+
+// HasStats reports whether the index records the sizes and modification
+// times of its files, as a Writer does for the files it looks up. Even
+// then, those of some files may be unknown.
+func (ix *Index) HasStats() bool {
+	_, ok := ix.sections["stat"]
+	return ok
+}
+
+// FileStat returns the size and modification time of the file with
+// the given ID when it was indexed, or nil if they are unknown, as for
+// an index that does not record them.
+func (ix *Index) FileStat(fileID uint32) (*FileStat, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	if fileID >= uint32(ix.numName) {
+		return nil, fmt.Errorf("file ID %d out of range", fileID)
+	}
+	s, ok := ix.sections["stat"]
+	if !ok {
+		return nil, nil
+	}
+	if int(s.size) != ix.numName*statEntrySize {
+		return nil, ix.corrupt("stat", s.off, ErrMalformed)
+	}
+	e, err := ix.sectionSlice("stat", fileID*statEntrySize, statEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	ns := int64(binary.BigEndian.Uint64(e[8:]))
+	if ns == 0 {
+		return nil, nil
+	}
+	return &FileStat{Size: int64(binary.BigEndian.Uint64(e)), ModTime: time.Unix(0, ns)}, nil
+}
+
+// UnstattedNames returns the names of the files whose sizes and
+// modification times the index does not record, in index order: all of
+// them, if the index records none.
+func (ix *Index) UnstattedNames() ([]string, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	if !ix.HasStats() {
+		return ix.Names()
+	}
+	var names []string
+	for id := 0; id < ix.numName; id++ {
+		st, err := ix.FileStat(uint32(id))
+		if err != nil {
+			return nil, err
+		}
+		if st != nil {
+			continue
+		}
+		name, err := ix.Name(uint32(id))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// statMatch reports whether a file of which st was recorded passes
+// the MaxSize and ModifiedAfter filters of opt.
+func (opt *SearchOptions) statMatch(st *FileStat) bool {
+	if opt.MaxSize > 0 && st.Size > opt.MaxSize {
+		return false
+	}
+	return opt.ModifiedAfter.IsZero() || st.ModTime.After(opt.ModifiedAfter)
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStat(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1600000000, 123456789)
+	var files []string
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		file := filepath.Join(src, name)
+		if err := os.WriteFile(file, []byte("package "+name[:1]+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	// a.go is added by AddFile and b.go by AddFiles, which read them
+	// from the file system; c.go is added from a reader of its text.
+	old := filepath.Join(dir, "old")
+	w, err := Create(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.AddPaths([]string{src})
+	if err := w.AddFile(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AddFiles(files[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(files[2], strings.NewReader("package c\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	none := filepath.Join(dir, "none")
+	buildIndex(t, none, []string{"/x"}, map[string]string{"/x/y": "hello world"})
+	merged := filepath.Join(dir, "merged")
+	if err := Merge(merged, none, old); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if ix, err := Open(merged); err != nil {
+		t.Fatal(err)
+	} else {
+		err := ix.Export(&dump)
+		ix.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	imported := filepath.Join(dir, "imported")
+	if err := Import(imported, &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	known := &FileStat{Size: int64(len("package a\n")), ModTime: mtime}
+	for _, tt := range []struct {
+		file  string
+		stats []*FileStat
+	}{
+		{old, []*FileStat{known, known, nil}},
+		{none, []*FileStat{nil}},
+		{merged, []*FileStat{known, known, nil, nil}},
+		{imported, []*FileStat{known, known, nil, nil}},
+	} {
+		ix, err := Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		if has := ix.HasStats(); has != (tt.file != none) {
+			t.Errorf("%s: HasStats() = %v", filepath.Base(tt.file), has)
+		}
+		for id, want := range tt.stats {
+			st, err := ix.FileStat(uint32(id))
+			if err != nil || (st == nil) != (want == nil) || st != nil && (st.Size != want.Size || !st.ModTime.Equal(want.ModTime)) {
+				t.Errorf("%s: FileStat(%d) = %+v, %v, want %+v", filepath.Base(tt.file), id, st, err, want)
+			}
+		}
+		if _, err := ix.Verify(); err != nil {
+			t.Errorf("%s: Verify: %v", filepath.Base(tt.file), err)
+		}
+	}
+
+	// Searches filter the files by their recorded sizes and times,
+	// letting through c.go, whose are unknown.
+	ix, err := Open(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if names, err := ix.UnstattedNames(); err != nil || !reflect.DeepEqual(names, files[2:]) {
+		t.Errorf("UnstattedNames() = %q, %v, want %q", names, err, files[2:])
+	}
+	for _, tt := range []struct {
+		opt  SearchOptions
+		want []string
+	}{
+		{SearchOptions{MaxSize: known.Size}, files},
+		{SearchOptions{MaxSize: known.Size - 1}, files[2:]},
+		{SearchOptions{ModifiedAfter: mtime.Add(-time.Second)}, files},
+		{SearchOptions{ModifiedAfter: mtime}, files[2:]},
+	} {
+		names, err := ix.Search(&Query{Op: QAll}, &tt.opt)
+		if err != nil || !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("Search with %+v = %q, %v, want %q", tt.opt, names, err, tt.want)
+		}
+	}
+}
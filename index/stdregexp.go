@@ -0,0 +1,40 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	stdregexp "regexp"
+	"regexp/syntax"
+
+	"github.com/andrewarchi/codesearch/regexp"
+)
+
+// CompileSyntax returns the Query for the parsed regular expression re,
+// which selects the files that might match, and a Regexp that finds the
+// matches in them, as used by Grep. It lets programs that already parse
+// regular expressions with package regexp/syntax search an index.
+//
+// The Regexp matches the text of a file as re would: unless re sets the
+// (?m) flag, ^ and $ match only at the start and end of the file.
+// For an index with quadgrams, RegexpQuadQuery(re) is more selective
+// than the Query returned.
+func CompileSyntax(re *syntax.Regexp) (*Query, *regexp.Regexp, error) {
+	m, err := regexp.CompileSyntax(re)
+	if err != nil {
+		return nil, nil, err
+	}
+	return RegexpQuery(re), m, nil
+}
+
+// CompileStd is like CompileSyntax for a regular expression compiled by
+// the standard library's regexp package. It parses the source text of
+// re with the flags used by regexp.Compile.
+func CompileStd(re *stdregexp.Regexp) (*Query, *regexp.Regexp, error) {
+	sre, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return CompileSyntax(sre)
+}
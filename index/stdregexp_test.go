@@ -0,0 +1,55 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"path/filepath"
+	stdregexp "regexp"
+	"slices"
+	"testing"
+)
+
+func TestCompileStd(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(t, out, nil, postFiles)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expr := range []string{
+		`Search`,
+		`(?i)google code`,
+		`Code (Search|Project)`,
+		`^Google Web`,
+		`Hosting$`,
+		`Web$`,
+		`(?m)^Google`,
+	} {
+		std := stdregexp.MustCompile(expr)
+		q, re, err := CompileStd(std)
+		if err != nil {
+			t.Errorf("CompileStd(%#q): %v", expr, err)
+			continue
+		}
+		post, err := ix.PostingQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id := 0; id < ix.NumNames(); id++ {
+			name, err := ix.Name(uint32(id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			text := postFiles[name]
+			want := std.MatchString(text)
+			if want && !slices.Contains(post, uint32(id)) {
+				t.Errorf("CompileStd(%#q): query %v omits %s", expr, q, name)
+			}
+			if got := re.MatchString(text, true, true) >= 0; got != want {
+				t.Errorf("CompileStd(%#q): match %q = %v, want %v", expr, text, got, want)
+			}
+		}
+	}
+}
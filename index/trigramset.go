@@ -0,0 +1,75 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+// A trigramSet is a set of trigrams, which a Writer fills for each file.
+//
+// It is like a sparse.Set, but tracks membership in a bitmap of all
+// 1<<24 trigrams, which at 2 MB stays mostly in cache, rather than in
+// a 64 MB array of indexes into the list of members, which does not.
+// Adding a trigram is the innermost step of indexing, so this makes a
+// large difference. Reset clears only the bits of the members, so its
+// cost is proportional to the size of the set, as for a sparse.Set.
+type trigramSet struct {
+	bits  []uint64
+	dense []uint32
+}
+
+func newTrigramSet() *trigramSet {
+	return &trigramSet{bits: make([]uint64, 1<<24/64)}
+}
+
+// Add adds t to the set if it is not already there.
+func (s *trigramSet) Add(t uint32) {
+	w, b := t>>6, uint64(1)<<(t&63)
+	if s.bits[w]&b != 0 {
+		return
+	}
+	s.bits[w] |= b
+	s.dense = append(s.dense, t)
+}
+
+// addBytes adds the trigrams ending at each byte of data, where tv
+// holds the two bytes before data, and returns the last trigram.
+//
+// Whether a trigram is new is unpredictable, so rather than branch on
+// it, addBytes always stores the trigram at the end of the list and
+// extends the list by one only if the trigram was new.
+func (s *trigramSet) addBytes(tv uint32, data []byte) uint32 {
+	n := len(s.dense)
+	if cap(s.dense)-n < len(data) {
+		s.dense = append(s.dense[:n], make([]uint32, len(data))...)
+	}
+	dense := s.dense[:cap(s.dense)]
+	bits := s.bits[:1<<24/64]
+	for _, c := range data {
+		tv = (tv<<8 | uint32(c)) & (1<<24 - 1)
+		w, b := tv>>6, tv&63
+		old := bits[w]
+		bits[w] = old | 1<<b
+		dense[n] = tv
+		n += int(old>>b&1 ^ 1)
+	}
+	s.dense = dense[:n]
+	return tv
+}
+
+// Reset empties the set.
+func (s *trigramSet) Reset() {
+	for _, t := range s.dense {
+		s.bits[t>>6] = 0
+	}
+	s.dense = s.dense[:0]
+}
+
+// Dense returns the trigrams in the set, in the order they were added.
+func (s *trigramSet) Dense() []uint32 {
+	return s.dense
+}
+
+// Len returns the number of trigrams in the set.
+func (s *trigramSet) Len() int {
+	return len(s.dense)
+}
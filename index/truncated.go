@@ -0,0 +1,104 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Truncated files.
+//
+// A Writer with HeadBytes set indexes only the start of a longer file,
+// so that a large log or data file can still be found by its header
+// rather than being skipped. The "truncated" section lists the IDs of
+// the files indexed only in part, in increasing order, each as a 4-byte
+// big-endian number. A search may miss matches beyond the indexed start
+// of such a file, since the file is not a candidate unless its start
+// has the trigrams of the query. Merging keeps the mark of each file
+// from the index that provided it.
+
+// truncatedSection returns a temporary file in dir holding the
+// "truncated" section listing ids, or nil if there are none.
+func truncatedSection(dir string, ids []uint32) (*bufWriter, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	b, err := bufCreateTemp(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if err := b.writeUint32(id); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// TruncatedFiles returns the sorted IDs of the files of which only the
+// start was indexed, as by Writer.HeadBytes.
+func (ix *Index) TruncatedFiles() ([]uint32, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	d, err := ix.truncatedData()
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for i := 0; i < len(d); i += 4 {
+		id := binary.BigEndian.Uint32(d[i:])
+		if id >= uint32(ix.numName) || len(ids) > 0 && id <= ids[len(ids)-1] {
+			return nil, ix.corrupt("truncated", ix.sections["truncated"].off+uint32(i), ErrMalformed)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Truncated reports whether only the start of the file with the given
+// ID was indexed, as by Writer.HeadBytes.
+func (ix *Index) Truncated(fileID uint32) (bool, error) {
+	if err := ix.acquire(); err != nil {
+		return false, err
+	}
+	defer ix.release()
+	d, err := ix.truncatedData()
+	if err != nil {
+		return false, err
+	}
+	n := len(d) / 4
+	i := sort.Search(n, func(i int) bool {
+		return binary.BigEndian.Uint32(d[4*i:]) >= fileID
+	})
+	return i < n && binary.BigEndian.Uint32(d[4*i:]) == fileID, nil
+}
+
+// truncatedSet returns the IDs of the truncated files of ix, as a set.
+func truncatedSet(ix *Index) (map[uint32]bool, error) {
+	ids, err := ix.TruncatedFiles()
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[uint32]bool)
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set, nil
+}
+
+// truncatedData returns the "truncated" section, or nil if there is none.
+func (ix *Index) truncatedData() ([]byte, error) {
+	s, ok := ix.sections["truncated"]
+	if !ok {
+		return nil, nil
+	}
+	if s.size%4 != 0 {
+		return nil, ix.corrupt("truncated", s.off, ErrMalformed)
+	}
+	return ix.sectionSlice("truncated", 0, -1)
+}
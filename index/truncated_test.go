@@ -0,0 +1,95 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTruncated(t *testing.T) {
+	dir := t.TempDir()
+	head := func(ix *Writer) { ix.HeadBytes = 100 }
+	header := "timestamp level message\n"
+	old := filepath.Join(dir, "old")
+	buildFlushIndex(t, old, []string{"/a"}, false, map[string]string{
+		"/a/big":   header + strings.Repeat("filler line\n", 100) + "needle\n",
+		"/a/exact": strings.Repeat("x", 99) + "\n",
+		"/a/small": "needle\n",
+	}, head)
+	update := filepath.Join(dir, "update")
+	buildFlushIndex(t, update, []string{"/b"}, false, map[string]string{
+		"/b/log": header + strings.Repeat("more filler\n", 100),
+	}, head)
+	merged := filepath.Join(dir, "merged")
+	if err := Merge(merged, old, update); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	imported := filepath.Join(dir, "imported")
+	if ix, err := Open(merged); err != nil {
+		t.Fatal(err)
+	} else {
+		err := ix.Export(&dump)
+		ix.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Import(imported, &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		file      string
+		truncated []uint32
+	}{
+		{old, []uint32{0}},
+		{update, []uint32{0}},
+		{merged, []uint32{0, 3}},
+		{imported, []uint32{0, 3}},
+	} {
+		ix, err := Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		ids, err := ix.TruncatedFiles()
+		if err != nil || !slices.Equal(ids, tt.truncated) {
+			t.Errorf("%s: TruncatedFiles() = %v, %v, want %v", filepath.Base(tt.file), ids, err, tt.truncated)
+		}
+		for id := uint32(0); id < uint32(ix.NumNames()); id++ {
+			want := slices.Contains(tt.truncated, id)
+			if cut, err := ix.Truncated(id); cut != want || err != nil {
+				t.Errorf("%s: Truncated(%d) = %v, %v, want %v", filepath.Base(tt.file), id, cut, err, want)
+			}
+		}
+		if _, err := ix.Verify(); err != nil {
+			t.Errorf("%s: Verify: %v", filepath.Base(tt.file), err)
+		}
+	}
+
+	// Only the start of /a/big is indexed.
+	ix, err := Open(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	for _, tt := range []struct {
+		trigrams []string
+		want     []string
+	}{
+		{[]string{"nee", "eed", "dle"}, []string{"/a/small"}},
+		{[]string{"tim", "sta", "amp"}, []string{"/a/big"}},
+	} {
+		names, err := ix.Search(&Query{Op: QAnd, Trigram: tt.trigrams}, nil)
+		if err != nil || !slices.Equal(names, tt.want) {
+			t.Errorf("Search(%q) = %v, %v, want %v", tt.trigrams, names, err, tt.want)
+		}
+	}
+}
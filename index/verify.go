@@ -0,0 +1,150 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// VerifyStats counts the parts of an index checked by Verify.
+type VerifyStats struct {
+	Files     int   // file names
+	Trigrams  int   // trigram posting lists
+	Quadgrams int   // quadgram posting lists
+	Postings  int64 // entries in all posting lists
+}
+
+// Verify reads all of ix, checking that it is consistent: the indexed
+// paths, exclude patterns, repositories, and normalization can be
+// read; the file names can be read and are in increasing order; the
+// language and stat sections have an entry for each file; the
+// truncated, gzipped, and classified files are listed in order and in
+// range; and each posting list, for trigrams and quadgrams, is listed
+// in order, lies within the index, begins with its own gram, and
+// decodes to the number of file IDs recorded for it, in increasing
+// order and in range, matching its skip entries, if any. It returns the
+// first problem found, usually an *IndexError, along with counts of the
+// parts of ix checked until then.
+//
+// Verify checks only the index itself, not the files it describes.
+func (ix *Index) Verify() (*VerifyStats, error) {
+	if err := ix.acquire(); err != nil {
+		return nil, err
+	}
+	defer ix.release()
+	st := new(VerifyStats)
+	if _, err := ix.Paths(); err != nil {
+		return st, err
+	}
+	if _, err := ix.Excludes(); err != nil {
+		return st, err
+	}
+	if _, err := ix.Repos(); err != nil {
+		return st, err
+	}
+	if _, err := ix.Normalization(); err != nil {
+		return st, err
+	}
+
+	var prev []byte
+	for i := 0; i < ix.numName; i++ {
+		name, err := ix.NameBytes(uint32(i))
+		if err != nil {
+			return st, err
+		}
+		if i > 0 && bytes.Compare(prev, name) >= 0 {
+			return st, ix.corrupt("name index", ix.nameIndex+4*uint32(i), ErrMalformed)
+		}
+		prev = append(prev[:0], name...)
+		st.Files++
+	}
+	if s, ok := ix.sections["lang"]; ok && int(s.size) != ix.numName {
+		return st, ix.corrupt("lang", s.off, ErrMalformed)
+	}
+	if s, ok := ix.sections["stat"]; ok && int(s.size) != ix.numName*statEntrySize {
+		return st, ix.corrupt("stat", s.off, ErrMalformed)
+	}
+	if _, err := ix.TruncatedFiles(); err != nil {
+		return st, err
+	}
+	if _, err := ix.GzippedFiles(); err != nil {
+		return st, err
+	}
+	if _, err := ix.FileClasses(); err != nil {
+		return st, err
+	}
+
+	for i, n := 0, ix.NumTrigrams(); i < n; i++ {
+		info, err := ix.TrigramAt(i)
+		if err != nil {
+			return st, err
+		}
+		entry := ix.postIndex + uint32(i)*postEntrySize
+		if i > 0 {
+			if prev, _ := ix.TrigramAt(i - 1); prev.Trigram >= info.Trigram {
+				return st, ix.corrupt("posting list index", entry, ErrMalformed)
+			}
+		}
+		head, err := ix.slice(ix.postData+info.Offset, 3)
+		if err != nil {
+			return st, ix.inSection("posting list", err)
+		}
+		if t := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2]); t != info.Trigram {
+			return st, ix.corrupt("posting list", ix.postData+info.Offset, ErrMalformed)
+		}
+		list, err := ix.PostingList(info.Trigram)
+		if err != nil {
+			return st, err
+		}
+		if err := ix.verifySkips(info.Trigram, list, ix.postData+info.Offset+3); err != nil {
+			return st, err
+		}
+		st.Trigrams++
+		st.Postings += int64(len(list))
+	}
+
+	s := ix.sections["quad"]
+	for i, n := 0, ix.numQuad(); i < n; i++ {
+		quad, count, offset, err := ix.quadAt(i)
+		if err != nil {
+			return st, err
+		}
+		if i > 0 {
+			if prev, _, _, _ := ix.quadAt(i - 1); prev >= quad {
+				return st, ix.corrupt("quadindex", uint32(i*quadEntrySize), ErrMalformed)
+			}
+		}
+		head, err := ix.sectionSlice("quad", offset, 4)
+		if err != nil {
+			return st, err
+		}
+		if binary.BigEndian.Uint32(head) != quad {
+			return st, ix.corrupt("quad", s.off+offset, ErrMalformed)
+		}
+		d, err := ix.quadList(int(count), offset)
+		if err != nil {
+			return st, err
+		}
+		r := postReader{
+			ix:      ix,
+			section: "quad",
+			count:   int(count),
+			offset:  offset,
+			pos:     s.off + offset + 4,
+			start:   s.off + offset + 4,
+			fileID:  ^uint32(0),
+			d:       d,
+		}
+		r.setRestriction(nil)
+		list, err := r.list()
+		if err != nil {
+			return st, err
+		}
+		st.Quadgrams++
+		st.Postings += int64(len(list))
+	}
+	return st, nil
+}
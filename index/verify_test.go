@@ -0,0 +1,95 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	buildIndex(t, plain, nil, postFiles)
+	quad := filepath.Join(dir, "quad")
+	buildQuadIndex(t, quad, mergePaths1, false, mergeFiles1)
+
+	for _, file := range []string{plain, quad} {
+		ix, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := ix.Verify()
+		if err != nil {
+			t.Fatalf("%s: Verify: %v", file, err)
+		}
+		if st.Files != ix.NumNames() || st.Trigrams != ix.NumTrigrams() || st.Quadgrams != ix.numQuad() {
+			t.Errorf("%s: Verify = %+v, want %d files, %d trigrams, %d quadgrams", file, st, ix.NumNames(), ix.NumTrigrams(), ix.numQuad())
+		}
+		var postings int64
+		for i := 0; i < ix.NumTrigrams(); i++ {
+			info, _ := ix.TrigramAt(i)
+			postings += int64(info.Count)
+		}
+		if file == plain && st.Postings != postings {
+			t.Errorf("%s: Verify counted %d postings, want %d", file, st.Postings, postings)
+		}
+		if file == quad && st.Quadgrams == 0 {
+			t.Errorf("%s: Verify found no quadgrams", file)
+		}
+	}
+
+	// Corrupt the header of a posting list, which searches never read.
+	data, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sea, err := ix.findList(tri('S', 'e', 'a'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := slices.Clone(data)
+	bad[ix.postData+sea] ^= 0xff
+	file := filepath.Join(dir, "bad")
+	if err := os.WriteFile(file, bad, 0666); err != nil {
+		t.Fatal(err)
+	}
+	ix, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.PostingList(tri('S', 'e', 'a')); err != nil {
+		t.Fatalf("PostingList of bad index: %v", err)
+	}
+	var e *IndexError
+	if _, err := ix.Verify(); !errors.As(err, &e) || e.Section != "posting list" || !errors.Is(err, ErrMalformed) {
+		t.Errorf("Verify of bad index = %v, want malformed posting list", err)
+	}
+
+	// OpenStrict refuses it.
+	if ix, err := OpenStrict(file); ix != nil || !errors.As(err, &e) || e.Section != "posting list" {
+		t.Errorf("OpenStrict of bad index = %v, %v, want malformed posting list", ix, err)
+	}
+	ix, err = OpenStrict(plain)
+	if err != nil {
+		t.Fatalf("OpenStrict: %v", err)
+	}
+	ix.Close()
+
+	// So does a strict Daemon.
+	if err := new(Daemon).Open(file); err != nil {
+		t.Errorf("Daemon.Open of bad index: %v", err)
+	}
+	if err := (&Daemon{Strict: true}).Open(file); !errors.As(err, &e) {
+		t.Errorf("strict Daemon.Open of bad index = %v, want malformed posting list", err)
+	}
+}
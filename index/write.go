@@ -5,14 +5,27 @@
 package index
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"os"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 
-	"github.com/andrewarchi/codesearch/sparse"
+	"github.com/andrewarchi/codesearch/charset"
+	"github.com/andrewarchi/codesearch/lang"
+	"github.com/andrewarchi/codesearch/norm"
 )
 
 // Index writing. See read.go for details of on-disk format.
@@ -32,54 +45,180 @@ import (
 // But we have not implemented that.
 
 // A Writer creates an on-disk index corresponding to a set of files.
+// Separate Writers may be used concurrently, but a single Writer
+// must not be used from more than one goroutine at a time.
 type Writer struct {
-	LogSkip bool // log information about skipped files
-	Verbose bool // log status using package log
-
-	trigram *sparse.Set // trigrams for the current file
-	buf     [8]byte     // scratch buffer
-
-	paths []string
+	LogSkip   bool         // log information about skipped files
+	Verbose   bool         // log details of indexing
+	Logger    *slog.Logger // if nil, slog.Default()
+	Quadgrams bool         // also index quadgrams (experimental)
+
+	// PostMem is the memory, in bytes, for buffering posting entries
+	// before they are sorted and flushed to a temporary file. Sorting
+	// takes as much again, and indexing quadgrams uses a second buffer
+	// of the same size. If PostMem is 0, the Writer uses 64 MB.
+	// It must be set before the first call to Add.
+	PostMem int64
+
+	// TempDir is the directory for temporary files, which together
+	// can grow as large as the index itself. If TempDir is empty,
+	// the Writer uses the default directory for temporary files
+	// (see os.TempDir). It must be set before the first call to Add.
+	TempDir string
+
+	// CompressTemp causes the Writer to compress the posting entries
+	// it flushes to temporary files, trading some time for disk space.
+	// It must be set before the first call to Add.
+	CompressTemp bool
+
+	// Normalize is the Unicode normalization applied to the text of
+	// each file before indexing it, recorded in the index so that
+	// searches can apply it too (see Index.Normalization).
+	// It must be set before the first call to Add.
+	Normalize norm.Mode
+
+	// OnSkip, if non-nil, is called when Add finds that a file is not
+	// text and reports whether to skip it. If OnSkip returns false, the
+	// file is indexed anyway, and any further problems with it are
+	// ignored. If OnSkip is nil, every such file is skipped.
+	OnSkip func(name string, reason SkipReason) bool
+
+	// LongLines causes the Writer to index files with lines longer
+	// than 2000 bytes, such as minified JavaScript or generated data,
+	// which it otherwise skips. If LongLineBytes is positive, only the
+	// first LongLineBytes bytes of each line, but at least 2000, are
+	// indexed, keeping down the number of distinct trigrams in such
+	// files, which may otherwise cause them to be skipped anyway.
+	LongLines     bool
+	LongLineBytes int
+
+	// HeadBytes, if positive, causes the Writer to index only the
+	// first HeadBytes bytes of each longer file, recording it as
+	// truncated (see Index.Truncated), rather than all of it or,
+	// for a file over 1 GB, none of it. The bytes counted are those
+	// of the text after decoding and normalization.
+	HeadBytes int64
+
+	// Gunzip causes the Writer to index the decompressed text of each
+	// file compressed with gzip, as recognized by its magic number,
+	// recording it as gzipped (see Index.Gzipped) so that searches
+	// decompress it too. Otherwise such files are skipped as binary.
+	// The name of the file less a .gz suffix is used to detect its
+	// language and class.
+	Gunzip bool
+
+	// Extractors lists the Extractors converting files of formats that
+	// are not plain text into text to index (see Extractor).
+	// The first to handle a file's name is applied to it.
+	Extractors []Extractor
+
+	// Classify causes the Writer to record the class of each file, as
+	// judged by lang.Classify from its name and start, so that searches
+	// can leave out generated, minified, and vendored files (see
+	// Index.Class).
+	Classify bool
+
+	// SkipClasses lists the classes of files to skip, as decided by
+	// OnSkip, with a SkipReason of kind SkipClass. If it is non-empty,
+	// the classes of the files indexed are recorded as by Classify.
+	SkipClasses []lang.Class
+
+	// Metadata holds key/value pairs recorded in the index to describe
+	// how it was built, such as the tool and flags used (see
+	// Index.Metadata). Neither keys nor values may contain NUL bytes.
+	Metadata map[string]string
+
+	trigram *trigramSet // trigrams for the current file
+	cut     bool        // the current file was cut short by HeadBytes
+	gzip    bool        // the current file was decompressed by Gunzip
+	class   lang.Class  // class of the current file, if classifying
+
+	paths    []string
+	excludes []string
+	repos    []Repo
+	start    time.Time // when indexing began, recorded as the build time
 
 	nameData   *bufWriter // temp file holding list of names
 	nameLen    uint32     // number of bytes written to nameData
 	nameIndex  *bufWriter // temp file holding name index
 	numName    int        // number of names written
+	langData   *bufWriter // temp file holding language of each name
+	statData   *bufWriter // temp file holding size and mtime of each name
+	stats      bool       // the size and mtime of some file are known
+	truncated  []uint32   // IDs of the files cut short by HeadBytes
+	gzipped    []uint32   // IDs of the files decompressed by Gunzip
+	classes    []FileClass
 	totalBytes int64
 
 	post      []postEntry // list of (trigram, file#) pairs
 	postFile  []*os.File  // flushed post entries
 	postIndex *bufWriter  // temp file holding posting list index
 
+	quad     []uint32    // quadgrams for the current file
+	quadPost []postEntry // list of (quadgram, file#) pairs
+	quadFile []*os.File  // flushed quadgram post entries
+
+	gitRepo    string                  // repository whose history is indexed
+	gitPaths   []string                // paths in git trees, by path ID
+	gitPathID  map[string]uint32       // path ID of each path
+	gitTrees   *bufWriter              // temp file holding tree file lists
+	gitTreeOff map[string]uint32       // offset of each tree in gitTrees
+	gitCommits [][commitEntrySize]byte // commit hash and tree offset
+
+	sort       postSorter // scratch space for sorting post entries
+	mergeParts int        // if positive, parts of the final merge, for testing
+
 	inbuf []byte     // input buffer
 	main  *bufWriter // main index file
 }
 
 const npost = 64 << 20 / 8 // 64 MB worth of post entries
 
+// postCap returns the number of post entries to buffer in memory.
+func (ix *Writer) postCap() int {
+	if ix.PostMem <= 0 {
+		return npost
+	}
+	n := ix.PostMem / 8
+	if n < 1024 {
+		n = 1024
+	}
+	if int64(int(n)) != n {
+		n = 1<<31 - 1
+	}
+	return int(n)
+}
+
 // Create returns a new Writer that will write the index to file.
 func Create(file string) (*Writer, error) {
 	w := &Writer{
-		trigram: sparse.NewSet(1 << 24),
-		post:    make([]postEntry, 0, npost),
+		trigram: newTrigramSet(),
 		inbuf:   make([]byte, 16384),
+		start:   time.Now(),
 	}
 	var err error
-	if w.nameData, err = bufCreate(""); err != nil {
-		return nil, err
-	}
-	if w.nameIndex, err = bufCreate(""); err != nil {
-		return nil, err
-	}
-	if w.postIndex, err = bufCreate(""); err != nil {
-		return nil, err
-	}
 	if w.main, err = bufCreate(file); err != nil {
 		return nil, err
 	}
 	return w, nil
 }
 
+// createTemp creates those of the Writer's temporary files
+// that do not exist yet. They are created on first use,
+// so that setting TempDir after Create takes effect.
+func (ix *Writer) createTemp() error {
+	for _, b := range []**bufWriter{&ix.nameData, &ix.nameIndex, &ix.langData, &ix.statData, &ix.postIndex} {
+		if *b != nil {
+			continue
+		}
+		var err error
+		if *b, err = bufCreateTemp(ix.TempDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // A postEntry is an in-memory (trigram, file#) pair.
 type postEntry uint64
 
@@ -111,8 +250,15 @@ func (ix *Writer) AddPaths(paths []string) {
 	ix.paths = append(ix.paths, paths...)
 }
 
+// AddExcludes adds the given patterns to the index's list of exclude
+// patterns. The index only records the patterns, for tools that update
+// the index to apply again; the Writer does not interpret them.
+func (ix *Writer) AddExcludes(patterns []string) {
+	ix.excludes = append(ix.excludes, patterns...)
+}
+
 // AddFile adds the file with the given name (opened using os.Open)
-// to the index. It logs errors using package log.
+// to the index.
 func (ix *Writer) AddFile(name string) error {
 	f, err := os.Open(name)
 	if err != nil {
@@ -123,97 +269,428 @@ func (ix *Writer) AddFile(name string) error {
 }
 
 // Add adds the file f to the index under the given name.
-// It logs errors using package log.
+// If f is not text, Add skips it, as decided by OnSkip, returning nil,
+// and logs the reason, as a detail shown if LogSkip is set.
+//
+// A file in UTF-16, with a byte order mark, or in a single-byte encoding
+// such as Latin-1 is transcoded to UTF-8 before indexing, as detected
+// by charset.Sniff, so that searches decoding it the same way find it.
+//
+// If f has a Stat method, as an *os.File does, the size and
+// modification time it reports are recorded (see Index.FileStat).
 func (ix *Writer) Add(name string, f io.Reader) error {
+	var st *FileStat
+	if s, ok := f.(statReader); ok {
+		if fi, err := s.Stat(); err == nil {
+			st = fileStat(fi)
+		}
+	}
+	return ix.add(name, f, st)
+}
+
+// add is like Add but records st as the size and modification time
+// of the file, or records them as unknown if st is nil.
+func (ix *Writer) add(name string, f io.Reader, st *FileStat) error {
+	n, langID, skip, err := ix.scanText(name, f)
+	if err != nil {
+		return err
+	}
+	if skip != nil {
+		logDetail(ix.Logger, ix.LogSkip, "skipped", "file", name, "reason", skip.String())
+		return nil
+	}
+	ix.totalBytes += n
+
+	logDetail(ix.Logger, ix.Verbose, "add", "file", name, "bytes", n, "trigrams", ix.trigram.Len())
+
+	fileID, err := ix.addName(name)
+	if err != nil {
+		return err
+	}
+	if err := ix.langData.writeByte(byte(langID)); err != nil {
+		return err
+	}
+	if err := writeStat(ix.statData, st); err != nil {
+		return err
+	}
+	ix.stats = ix.stats || st != nil
+	if ix.cut {
+		ix.truncated = append(ix.truncated, fileID)
+	}
+	if ix.gzip {
+		ix.gzipped = append(ix.gzipped, fileID)
+	}
+	if ix.class != lang.Normal {
+		ix.classes = append(ix.classes, FileClass{fileID, ix.class})
+	}
+	if ix.post == nil {
+		ix.post = make([]postEntry, 0, ix.postCap())
+	}
+	for _, trigram := range ix.trigram.Dense() {
+		if len(ix.post) >= cap(ix.post) {
+			if err := ix.flushPost(); err != nil {
+				return err
+			}
+		}
+		ix.post = append(ix.post, makePostEntry(trigram, fileID))
+	}
+	if ix.Quadgrams {
+		ix.compactQuad()
+		if ix.quadPost == nil {
+			ix.quadPost = make([]postEntry, 0, ix.postCap())
+		}
+		for _, quad := range ix.quad {
+			if len(ix.quadPost) >= cap(ix.quadPost) {
+				if err := ix.flushQuad(); err != nil {
+					return err
+				}
+			}
+			ix.quadPost = append(ix.quadPost, makePostEntry(quad, fileID))
+		}
+	}
+	return nil
+}
+
+// scanText is like scan but first converts f with the first of
+// ix.Extractors to handle it, if any, decompresses it if it is gzipped
+// and ix.Gunzip is set, leaving ix.gzip set if so, decodes it to UTF-8,
+// as detected by charset.Sniff, and normalizes it as set by
+// ix.Normalize.
+func (ix *Writer) scanText(name string, f io.Reader) (n int64, langID lang.ID, skip *SkipReason, err error) {
+	if e := ix.extractor(name); e != nil {
+		if f, err = e.Extract(f); err != nil {
+			return 0, 0, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if c, ok := f.(io.Closer); ok {
+			defer c.Close()
+		}
+	}
+	ix.gzip = false
+	if ix.Gunzip {
+		f, ix.gzip, err = charset.Gunzip(f)
+	}
+	var r io.Reader
+	if err == nil {
+		r, err = charset.NewReader(f, charset.Auto)
+	}
+	if err == nil {
+		n, langID, skip, err = ix.scan(name, norm.NewReader(r, ix.Normalize))
+	} else {
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	if ix.Gunzip && isGzipError(err) {
+		// The file is skipped whatever OnSkip says:
+		// there is no more text to index.
+		skip := &SkipReason{Kind: SkipBadGzip}
+		ix.skip(name, skip)
+		return 0, 0, skip, nil
+	}
+	return n, langID, skip, err
+}
+
+// isGzipError reports whether err is an error decompressing a
+// corrupt or truncated gzip stream.
+func isGzipError(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, charset.ErrTruncatedGzip) || errors.As(err, &corrupt)
+}
+
+// scan reads the file f with the given name, collecting its trigrams
+// and, if ix.Quadgrams is set, its quadgrams. It returns the size and
+// language of the file or, if the file is to be skipped, as decided by
+// ix.skip, the reason.
+//
+// Each buffer read is first checked with checkChunk, which looks at a
+// word at a time where it can. A buffer that passes is scanned for
+// n-grams by addChunk without further checks. A buffer that fails is
+// rescanned a byte at a time by scanSlow to find the first problem,
+// so that the reason reported is the same either way. Reading stops
+// after ix.HeadBytes bytes, if set, leaving ix.cut set if there were
+// more. Once a file is
+// to be indexed despite a problem, no more checks are made. If only
+// the start of each long line is indexed, checkChunk rejects buffers
+// with longer lines, and scanSlow leaves out the rest of each line.
+func (ix *Writer) scan(name string, f io.Reader) (n int64, langID lang.ID, skip *SkipReason, err error) {
 	ix.trigram.Reset()
-	var (
-		c       = byte(0)
-		i       = 0
-		buf     = ix.inbuf[:0]
-		tv      = uint32(0)
-		n       = int64(0)
-		lineLen = 0
-		lineNum = 1
-	)
+	ix.quad = ix.quad[:0]
+	ix.cut = false
+	ix.class = lang.Normal
+	classify := ix.Classify || len(ix.SkipClasses) > 0
+	// The language and class of x.go.gz are those of x.go.
+	typeName := name
+	if ix.gzip {
+		typeName = strings.TrimSuffix(name, ".gz")
+	}
+	if classify {
+		// Classified by name alone, unless the file has content.
+		ix.class = lang.Classify(typeName, nil)
+	}
+	s := ix.newScanState()
+	buf := ix.inbuf[:cap(ix.inbuf)]
+	langID = lang.Detect(typeName, nil)
 	for {
-		tv = (tv << 8) & (1<<24 - 1)
-		if i >= len(buf) {
-			n, err := f.Read(buf[:cap(buf)])
-			if n == 0 {
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-					return fmt.Errorf("%s: %w", name, err)
+		nr, err := f.Read(buf)
+		if nr == 0 {
+			if err != nil {
+				if err == io.EOF {
+					break
 				}
-				return fmt.Errorf("%s: 0-length read", name)
+				return 0, 0, nil, fmt.Errorf("%s: %w", name, err)
 			}
-			buf = buf[:n]
-			i = 0
+			return 0, 0, nil, fmt.Errorf("%s: 0-length read", name)
 		}
-		c = buf[i]
-		i++
-		tv |= uint32(c)
-		if n++; n >= 3 {
-			ix.trigram.Add(tv)
-		}
-		if !validUTF8((tv>>8)&0xFF, tv&0xFF) {
-			if ix.LogSkip {
-				log.Printf("skipped %s:%d: invalid UTF-8\n", name, lineNum)
+		chunk := buf[:nr]
+		if ix.HeadBytes > 0 && s.n+int64(len(chunk)) > ix.HeadBytes {
+			chunk = chunk[:ix.HeadBytes-s.n]
+			ix.cut = true
+			if len(chunk) == 0 {
+				break
 			}
-			return nil
 		}
-		if n > maxFileLen {
-			if ix.LogSkip {
-				log.Printf("skipped %s: file too long (over %d bytes)\n", name, maxFileLen)
+		if s.n == 0 {
+			// Look for a modeline or #! line at the start of the file.
+			langID = lang.Detect(typeName, chunk)
+		}
+		if s.n == 0 && classify {
+			ix.class = lang.Classify(typeName, chunk)
+			if slices.Contains(ix.SkipClasses, ix.class) {
+				skip := &SkipReason{Kind: SkipClass, Class: ix.class}
+				if ix.skip(name, skip) {
+					return 0, 0, skip, nil
+				}
 			}
-			return nil
 		}
-		if lineLen++; lineLen > maxLineLen {
-			if ix.LogSkip {
-				log.Printf("skipped %s:%d: line too long (over %d bytes)\n", name, lineNum, maxLineLen)
+		if (!s.force || s.keep > 0) && !s.checkChunk(chunk) {
+			if skip := ix.scanSlow(name, &s, chunk); skip != nil {
+				return 0, 0, skip, nil
 			}
-			return nil
+		} else {
+			ix.addChunk(&s, chunk)
 		}
-		if c == '\n' {
-			lineLen = 0
-			lineNum++
+		if ix.cut {
+			break
 		}
 	}
-	if ix.trigram.Len() > maxTextTrigrams {
-		if ix.LogSkip {
-			log.Printf("%s: too many trigrams (%d), probably not text, ignoring\n", name, ix.trigram.Len())
+	if !s.force && ix.trigram.Len() > maxTextTrigrams {
+		skip := &SkipReason{Kind: SkipTooManyTrigrams, Trigrams: ix.trigram.Len()}
+		if ix.skip(name, skip) {
+			return 0, 0, skip, nil
 		}
-		return nil
 	}
-	ix.totalBytes += n
+	return s.n, langID, nil, nil
+}
 
-	if ix.Verbose {
-		log.Printf("%d %d %s\n", n, ix.trigram.Len(), name)
+// scanState is the state of scan between buffers.
+type scanState struct {
+	n       int64  // bytes scanned
+	tv      uint32 // last three bytes
+	qv      uint32 // last four bytes
+	lineLen int    // bytes in the current line so far
+	lineNum int
+	force   bool // index the file despite a problem, without checking further
+	maxLine int  // longest line checkChunk accepts
+	keep    int  // if positive, index only the first keep bytes of each line
+}
+
+// newScanState returns the state for scanning the start of a file.
+func (ix *Writer) newScanState() scanState {
+	s := scanState{lineNum: 1, maxLine: maxLineLen}
+	if ix.LongLines {
+		s.maxLine = math.MaxInt
+		if ix.LongLineBytes > 0 {
+			s.keep = max(ix.LongLineBytes, maxLineLen)
+			s.maxLine = s.keep
+		}
 	}
+	return s
+}
 
-	fileID, err := ix.addName(name)
-	if err != nil {
-		return err
+// checkChunk reports whether the bytes in chunk, following those
+// already scanned, keep the file valid for indexing: valid UTF-8 (as
+// judged by validUTF8), no longer than maxFileLen bytes, and with no
+// line longer than s.maxLine bytes. If so, it updates the line count
+// in s; the caller then calls addChunk to update the rest.
+func (s *scanState) checkChunk(chunk []byte) bool {
+	if s.n+int64(len(chunk)) > maxFileLen {
+		return false
 	}
-	for _, trigram := range ix.trigram.Dense() {
-		if len(ix.post) >= cap(ix.post) {
-			if err := ix.flushPost(); err != nil {
-				return err
+
+	// Check consecutive pairs of bytes, starting with the last byte
+	// scanned and the first in chunk. All pairs of ASCII bytes are
+	// valid, so eight bytes at a time can be skipped when they are
+	// all ASCII and valid after the byte before them.
+	prev := uint32(s.tv & 0xFF)
+	i := 0
+	for i < len(chunk) {
+		if i+8 <= len(chunk) && binary.LittleEndian.Uint64(chunk[i:])&0x8080808080808080 == 0 {
+			if !validUTF8(prev, uint32(chunk[i])) {
+				return false
 			}
+			i += 8
+			prev = uint32(chunk[i-1])
+			continue
+		}
+		c := uint32(chunk[i])
+		if !validUTF8(prev, c) {
+			return false
+		}
+		prev = c
+		i++
+	}
+
+	// Check line lengths, counting each newline in its line. Rather
+	// than find every newline, look for the last one within reach of
+	// the start of each line.
+	lineLen := s.lineLen
+	rest := chunk
+	for {
+		limit := max(s.maxLine-lineLen, 0) // a line may already be too long
+		if len(rest) <= limit {
+			if k := bytes.LastIndexByte(rest, '\n'); k >= 0 {
+				lineLen = len(rest) - k - 1
+			} else {
+				lineLen += len(rest)
+			}
+			break
+		}
+		k := bytes.LastIndexByte(rest[:limit], '\n')
+		if k < 0 {
+			return false
+		}
+		rest = rest[k+1:]
+		lineLen = 0
+	}
+	lineNum := s.lineNum + bytes.Count(chunk, []byte{'\n'})
+	s.lineLen, s.lineNum = lineLen, lineNum
+	return true
+}
+
+// addChunk adds the n-grams ending in chunk, which checkChunk accepted.
+func (ix *Writer) addChunk(s *scanState, chunk []byte) {
+	tv := s.tv
+	i := 0
+	// The first two bytes of the file do not end a trigram.
+	for ; i < len(chunk) && s.n+int64(i) < 2; i++ {
+		tv = tv<<8 | uint32(chunk[i])
+	}
+	tv = ix.trigram.addBytes(tv, chunk[i:])
+	if ix.Quadgrams {
+		qv := s.qv
+		i := 0
+		for ; i < len(chunk) && s.n+int64(i) < 3; i++ {
+			qv = qv<<8 | uint32(chunk[i])
+		}
+		for _, c := range chunk[i:] {
+			qv = qv<<8 | uint32(c)
+			ix.addQuad(qv)
+		}
+		s.qv = qv
+	} else {
+		// Keep the last four bytes anyway, as scanSlow does.
+		for _, c := range chunk[max(len(chunk)-4, 0):] {
+			s.qv = s.qv<<8 | uint32(c)
+		}
+	}
+	s.tv = tv & (1<<24 - 1)
+	s.n += int64(len(chunk))
+}
+
+// scanSlow scans chunk of the file with the given name a byte at a
+// time, returning the reason the file is to be skipped, if any.
+func (ix *Writer) scanSlow(name string, s *scanState, chunk []byte) *SkipReason {
+	for _, c := range chunk {
+		s.tv = (s.tv<<8)&(1<<24-1) | uint32(c)
+		s.qv = s.qv<<8 | uint32(c)
+		s.n++
+		if s.keep <= 0 || s.lineLen < s.keep {
+			if s.n >= 3 {
+				ix.trigram.Add(s.tv)
+			}
+			if s.n >= 4 && ix.Quadgrams {
+				ix.addQuad(s.qv)
+			}
+		}
+		if !s.force {
+			var skip *SkipReason
+			switch {
+			case !validUTF8((s.tv>>8)&0xFF, s.tv&0xFF):
+				skip = &SkipReason{Kind: SkipInvalidUTF8, Line: s.lineNum}
+			case s.n > maxFileLen:
+				skip = &SkipReason{Kind: SkipFileTooLong}
+			case s.lineLen+1 > maxLineLen && !ix.LongLines:
+				skip = &SkipReason{Kind: SkipLineTooLong, Line: s.lineNum}
+			}
+			if skip != nil {
+				if ix.skip(name, skip) {
+					return skip
+				}
+				s.force = true
+			}
+		}
+		s.lineLen++
+		if c == '\n' {
+			s.lineLen = 0
+			s.lineNum++
 		}
-		ix.post = append(ix.post, makePostEntry(trigram, fileID))
 	}
 	return nil
 }
 
+// A Checker applies the Writer's tests for text files to files
+// without indexing them.
+type Checker struct {
+	LongLines     bool         // accept files with long lines, as Writer.LongLines
+	LongLineBytes int          // as Writer.LongLineBytes
+	HeadBytes     int64        // as Writer.HeadBytes
+	Gunzip        bool         // as Writer.Gunzip
+	Extractors    []Extractor  // as Writer.Extractors
+	SkipClasses   []lang.Class // as Writer.SkipClasses
+
+	w Writer
+}
+
+// NewChecker returns a new Checker.
+func NewChecker() *Checker {
+	return &Checker{w: Writer{
+		trigram: newTrigramSet(),
+		inbuf:   make([]byte, 16384),
+	}}
+}
+
+// Check reads the file f with the given name and returns the reason
+// a Writer would skip it, or "" if a Writer would index it.
+func (c *Checker) Check(name string, f io.Reader) (string, error) {
+	c.w.LongLines, c.w.LongLineBytes = c.LongLines, c.LongLineBytes
+	c.w.HeadBytes = c.HeadBytes
+	c.w.Gunzip = c.Gunzip
+	c.w.Extractors = c.Extractors
+	c.w.SkipClasses = c.SkipClasses
+	_, _, skip, err := c.w.scanText(name, f)
+	if skip == nil {
+		return "", err
+	}
+	return skip.String(), err
+}
+
+// CheckFile is like Check for the file with the given name
+// (opened using os.Open).
+func (c *Checker) CheckFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return c.Check(name, f)
+}
+
 // Flush flushes the index entry to the target file.
 func (ix *Writer) Flush() error {
 	if _, err := ix.addName(""); err != nil {
 		return err
 	}
 
-	var off [5]uint32
+	var off [6]uint32
 	if err := ix.main.writeString(magic); err != nil {
 		return err
 	}
@@ -231,20 +708,122 @@ func (ix *Writer) Flush() error {
 	}
 	off[1] = ix.main.offset()
 	if err := copyFile(ix.main, ix.nameData); err != nil {
-		return nil
+		return err
 	}
 	off[2] = ix.main.offset()
-	if err := ix.mergePost(ix.main); err != nil {
-		return nil
+	skips, err := newSkipWriter(ix.TempDir)
+	if err != nil {
+		return err
+	}
+	defer skips.remove()
+	if err := ix.mergePost(ix.main, skips); err != nil {
+		return err
 	}
 	off[3] = ix.main.offset()
 	if err := copyFile(ix.main, ix.nameIndex); err != nil {
-		return nil
+		return err
 	}
 	off[4] = ix.main.offset()
 	if err := copyFile(ix.main, ix.postIndex); err != nil {
-		return nil
+		return err
+	}
+	sections := []section{
+		{"lang", ix.langData},
+	}
+	if ix.stats {
+		sections = append(sections, section{"stat", ix.statData})
 	}
+	if len(ix.excludes) > 0 {
+		excludes, err := stringSection(ix.TempDir, ix.excludes)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(excludes.name)
+		sections = append(sections, section{"exclude", excludes})
+	}
+	repos, err := repoSection(ix.TempDir, ix.repos)
+	if err != nil {
+		return err
+	}
+	if repos != nil {
+		defer os.Remove(repos.name)
+		sections = append(sections, section{"repo", repos})
+	}
+	normData, err := normSection(ix.TempDir, ix.Normalize)
+	if err != nil {
+		return err
+	}
+	if normData != nil {
+		defer os.Remove(normData.name)
+		sections = append(sections, section{"norm", normData})
+	}
+	times := make([]time.Time, len(ix.paths))
+	for i := range times {
+		times[i] = ix.start
+	}
+	built, err := builtSection(ix.TempDir, times)
+	if err != nil {
+		return err
+	}
+	if built != nil {
+		defer os.Remove(built.name)
+		sections = append(sections, section{"built", built})
+	}
+	meta, err := metaSection(ix.TempDir, ix.Metadata)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		defer os.Remove(meta.name)
+		sections = append(sections, section{"meta", meta})
+	}
+	truncated, err := truncatedSection(ix.TempDir, ix.truncated)
+	if err != nil {
+		return err
+	}
+	if truncated != nil {
+		defer os.Remove(truncated.name)
+		sections = append(sections, section{"truncated", truncated})
+	}
+	gzipped, err := gzipSection(ix.TempDir, ix.gzipped)
+	if err != nil {
+		return err
+	}
+	if gzipped != nil {
+		defer os.Remove(gzipped.name)
+		sections = append(sections, section{"gzip", gzipped})
+	}
+	classes, err := classSection(ix.TempDir, ix.classes)
+	if err != nil {
+		return err
+	}
+	if classes != nil {
+		defer os.Remove(classes.name)
+		sections = append(sections, section{"class", classes})
+	}
+	if ix.Quadgrams {
+		quadData, quadIndex, err := ix.mergeQuad()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(quadData.name)
+		defer os.Remove(quadIndex.name)
+		sections = append(sections, section{"quad", quadData}, section{"quadindex", quadIndex})
+	}
+	history, err := ix.historySections()
+	if err != nil {
+		return err
+	}
+	for _, s := range history {
+		defer os.Remove(s.data.name)
+	}
+	sections = append(sections, history...)
+	sections = append(sections, skips.sections()...)
+	sectionIndex, err := writeSections(ix.main, sections)
+	if err != nil {
+		return err
+	}
+	off[5] = sectionIndex
 	for _, v := range off {
 		if err := ix.main.writeUint32(v); err != nil {
 			return err
@@ -256,12 +835,19 @@ func (ix *Writer) Flush() error {
 
 	os.Remove(ix.nameData.name)
 	for _, f := range ix.postFile {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	for _, f := range ix.quadFile {
+		f.Close()
 		os.Remove(f.Name())
 	}
 	os.Remove(ix.nameIndex.name)
+	os.Remove(ix.langData.name)
+	os.Remove(ix.statData.name)
 	os.Remove(ix.postIndex.name)
 
-	log.Printf("%d data bytes, %d index bytes", ix.totalBytes, ix.main.offset())
+	loggerOrDefault(ix.Logger).Info("flush", "data_bytes", ix.totalBytes, "index_bytes", ix.main.offset())
 
 	return ix.main.flush()
 }
@@ -280,12 +866,72 @@ func copyFile(dst, src *bufWriter) error {
 	return nil
 }
 
+// A section is a named optional section of the index,
+// buffered in a temporary file until the index is written.
+type section struct {
+	name string
+	data *bufWriter
+}
+
+// stringSection returns a temporary file in dir holding a section
+// listing the strings, each NUL-terminated.
+func stringSection(dir string, list []string) (*bufWriter, error) {
+	b, err := bufCreateTemp(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		if err := b.writeString(s); err != nil {
+			return nil, err
+		}
+		if err := b.writeByte('\x00'); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// writeSections copies the sections to out, followed by the
+// section index. It returns the offset of the section index.
+func writeSections(out *bufWriter, sections []section) (uint32, error) {
+	off := make([]uint32, len(sections)+1)
+	for i, s := range sections {
+		off[i] = out.offset()
+		if err := copyFile(out, s.data); err != nil {
+			return 0, err
+		}
+	}
+	index := out.offset()
+	off[len(sections)] = index
+	for i, s := range sections {
+		if err := out.writeString(s.name); err != nil {
+			return 0, err
+		}
+		if err := out.writeByte('\x00'); err != nil {
+			return 0, err
+		}
+		if err := out.writeUint32(off[i]); err != nil {
+			return 0, err
+		}
+		if err := out.writeUint32(off[i+1] - off[i]); err != nil {
+			return 0, err
+		}
+	}
+	if err := out.writeByte('\x00'); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
 // addName adds the file with the given name to the index.
 // It returns the assigned file ID number.
 func (ix *Writer) addName(name string) (uint32, error) {
 	if strings.Contains(name, "\x00") {
 		return 0, fmt.Errorf("%q: file has NUL byte in name", name)
 	}
+	if err := ix.createTemp(); err != nil {
+		return 0, err
+	}
 
 	if err := ix.nameIndex.writeUint32(ix.nameData.offset()); err != nil {
 		return 0, err
@@ -304,81 +950,116 @@ func (ix *Writer) addName(name string) (uint32, error) {
 // flushPost writes ix.post to a new temporary file and
 // clears the slice.
 func (ix *Writer) flushPost() error {
-	w, err := os.CreateTemp("", "csearch-index")
+	ix.sort.sortPost(ix.post)
+	w, err := ix.writePostFile(ix.post)
 	if err != nil {
 		return err
 	}
-	if ix.Verbose {
-		log.Printf("flush %d entries to %s", len(ix.post), w.Name())
+	ix.post = ix.post[:0]
+	ix.postFile = append(ix.postFile, w)
+	return nil
+}
+
+// writePostFile writes the sorted post entries to a new temporary file,
+// which it returns positioned at the beginning.
+func (ix *Writer) writePostFile(post []postEntry) (*os.File, error) {
+	w, err := os.CreateTemp(ix.TempDir, "csearch-index")
+	if err != nil {
+		return nil, err
+	}
+	logDetail(ix.Logger, ix.Verbose, "flush entries", "entries", len(post), "file", w.Name())
+	if ix.CompressTemp {
+		if err := writeCompressedPost(w, post); err != nil {
+			return nil, err
+		}
+		if _, err := w.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		return w, nil
 	}
-	sortPost(ix.post)
 
-	// Write the raw ix.post array to disk as is.
+	// Write the raw post array to disk as is.
 	// This process is the one reading it back in, so byte order is not a concern.
-	data := (*[npost * 8]byte)(unsafe.Pointer(&ix.post[0]))[:len(ix.post)*8]
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&post[0])), len(post)*8)
 	if n, err := w.Write(data); err != nil || n < len(data) {
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return fmt.Errorf("short write writing %s", w.Name())
+		return nil, fmt.Errorf("short write writing %s", w.Name())
 	}
-
-	ix.post = ix.post[:0]
-	_, err = w.Seek(0, 0)
-	ix.postFile = append(ix.postFile, w)
-	return err
+	if _, err := w.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return w, nil
 }
 
 // mergePost reads the flushed index entries and merges them
-// into posting lists, writing the resulting lists to out.
-func (ix *Writer) mergePost(out *bufWriter) error {
-	var h postHeap
-
-	log.Printf("merge %d files + mem", len(ix.postFile))
+// into posting lists, writing the resulting lists to out
+// and their skip tables to skips.
+func (ix *Writer) mergePost(out *bufWriter, skips *skipWriter) error {
+	ix.sort.sortPost(ix.post)
+	if parts := ix.numMergeParts(); parts > 1 {
+		loggerOrDefault(ix.Logger).Info("merge", "files", len(ix.postFile), "parts", parts)
+		return ix.mergePostParts(out, skips, parts)
+	}
+	loggerOrDefault(ix.Logger).Info("merge", "files", len(ix.postFile))
+	h := postTree{file: ix.main.name}
+	defer h.unmap()
 	for _, f := range ix.postFile {
-		if err := h.addFile(f); err != nil {
+		if err := h.addFile(f, ix.CompressTemp); err != nil {
 			return err
 		}
 	}
-	sortPost(ix.post)
 	h.addMem(ix.post)
+	return writePostLists(&h, out, ix.postIndex, skips, out.offset(), true)
+}
 
-	npost := 0
+// writePostLists writes the posting lists of the entries in h to out,
+// their index entries, with offsets relative to offset base of out, to
+// index, and their skip tables to skips. If end is set, it finishes
+// with the empty list for trigram 1<<24-1 that ends the posting lists.
+func writePostLists(h *postTree, out, index *bufWriter, skips *skipWriter, base uint32, end bool) error {
+	var buf [3]byte
 	e := h.next()
-	offset0 := out.offset()
 	for {
-		npost++
-		offset := out.offset() - offset0
 		trigram := e.trigram()
-		ix.buf[0] = byte(trigram >> 16)
-		ix.buf[1] = byte(trigram >> 8)
-		ix.buf[2] = byte(trigram)
+		if trigram == 1<<24-1 && !end {
+			break
+		}
+		offset := out.offset() - base
+		buf[0] = byte(trigram >> 16)
+		buf[1] = byte(trigram >> 8)
+		buf[2] = byte(trigram)
 
 		// posting list
 		fileID := ^uint32(0)
 		nfile := uint32(0)
-		if err := out.write(ix.buf[:3]); err != nil {
+		if err := out.write(buf[:]); err != nil {
 			return err
 		}
+		skips.list(trigram, out.offset())
 		for ; e.trigram() == trigram && trigram != 1<<24-1; e = h.next() {
 			if err := out.writeUvarint(e.fileID() - fileID); err != nil {
 				return err
 			}
 			fileID = e.fileID()
 			nfile++
+			if err := skips.add(fileID, out.offset()); err != nil {
+				return err
+			}
 		}
 		if err := out.writeUvarint(0); err != nil {
 			return err
 		}
 
 		// index entry
-		if err := ix.postIndex.write(ix.buf[:3]); err != nil {
+		if err := index.write(buf[:]); err != nil {
 			return err
 		}
-		if err := ix.postIndex.writeUint32(nfile); err != nil {
+		if err := index.writeUint32(nfile); err != nil {
 			return err
 		}
-		if err := ix.postIndex.writeUint32(offset); err != nil {
+		if err := index.writeUint32(offset); err != nil {
 			return err
 		}
 
@@ -386,137 +1067,184 @@ func (ix *Writer) mergePost(out *bufWriter) error {
 			break
 		}
 	}
-	return nil
+	return h.err
 }
 
 // A postChunk represents a chunk of post entries flushed to disk or
 // still in memory.
 type postChunk struct {
-	e postEntry   // next entry
-	m []postEntry // remaining entries after e
+	e   postEntry    // next entry
+	m   []postEntry  // remaining entries after e
+	dec *postDecoder // source of further entries, for a compressed chunk
 }
 
 const postBuf = 4096
 
-// A postHeap is a heap (priority queue) of postChunks.
-type postHeap struct {
-	ch []*postChunk
+// A postTree merges sorted postChunks into one sorted sequence of
+// entries, using a tournament tree of losers.
+//
+// With dozens of flushed chunks, most of the time spent merging is in
+// choosing the chunk with the least next entry. A heap does that with
+// up to two comparisons, and a swap, at each level of the heap. A loser
+// tree stores at each internal node the chunk that lost the comparison
+// there, so replacing the winner's entry takes only one comparison per
+// level, against the stored loser, on the path from its leaf to the
+// root, with no comparisons between siblings.
+type postTree struct {
+	ch    []*postChunk
+	key   []postEntry // key[i] is ch[i].e, kept here for locality
+	tree  []int32     // tree[0] is the winner; tree[i] the loser at internal node i
+	built bool
+	file  string      // the index being written, for errors
+	err   error       // first error reading a compressed chunk, or entry out of order
+	maps  []*mmapData // mappings of the files added, for unmap
 }
 
-func (h *postHeap) addFile(f *os.File) error {
+// postDone is the next entry of a chunk that is over.
+// It sorts after every real entry.
+const postDone = ^postEntry(0)
+
+// addFile adds the post entries flushed to f, which are
+// compressed if they were written with Writer.CompressTemp.
+func (h *postTree) addFile(f *os.File, compressed bool) error {
+	if compressed {
+		ch := &postChunk{dec: newPostDecoder(f)}
+		if !h.fill(ch) {
+			return h.err
+		}
+		h.add(ch)
+		return nil
+	}
 	data, err := mmapFile(f)
 	if err != nil {
 		return err
 	}
-	d := data.d
-	m := (*[npost]postEntry)(unsafe.Pointer(&d[0]))[:len(d)/8]
-	h.addMem(m)
+	h.maps = append(h.maps, data)
+	h.addMem(postEntries(data))
 	return nil
 }
 
-func (h *postHeap) addMem(x []postEntry) {
-	h.add(&postChunk{m: x})
+// unmap unmaps the files added to h, once it is no longer needed.
+func (h *postTree) unmap() {
+	for _, m := range h.maps {
+		m.unmap()
+	}
+	h.maps = nil
 }
 
-// step reads the next entry from ch and saves it in ch.e.
-// It returns false if ch is over.
-func (h *postHeap) step(ch *postChunk) bool {
-	old := ch.e
-	m := ch.m
-	if len(m) == 0 {
-		return false
-	}
-	ch.e = postEntry(m[0])
-	m = m[1:]
-	ch.m = m
-	if old >= ch.e {
-		panic("bad sort")
+// postEntries returns the post entries held in the mapped file m.
+func postEntries(m *mmapData) []postEntry {
+	if len(m.d) < 8 {
+		return nil
 	}
-	return true
+	return unsafe.Slice((*postEntry)(unsafe.Pointer(&m.d[0])), len(m.d)/8)
+}
+
+func (h *postTree) addMem(x []postEntry) {
+	h.add(&postChunk{m: x})
 }
 
-// add adds the chunk to the postHeap.
-// All adds must be called before the first call to next.
-func (h *postHeap) add(ch *postChunk) {
+// add adds the chunk to the postTree.
+// All adds must be called before the first call to next or empty.
+func (h *postTree) add(ch *postChunk) {
+	if h.built {
+		panic("postTree.add after next")
+	}
 	if len(ch.m) > 0 {
 		ch.e = ch.m[0]
 		ch.m = ch.m[1:]
-		h.push(ch)
+		h.ch = append(h.ch, ch)
+	}
+}
+
+// build builds the tree from the chunks added. Chunk i is the leaf at
+// node k+i, where k is the number of chunks, and node i has children
+// 2i and 2i+1.
+func (h *postTree) build() {
+	h.built = true
+	k := len(h.ch)
+	if k == 0 {
+		return
+	}
+	h.key = make([]postEntry, k)
+	h.tree = make([]int32, k)
+	winner := make([]int32, 2*k)
+	for i, ch := range h.ch {
+		h.key[i] = ch.e
+		winner[k+i] = int32(i)
+	}
+	for i := k - 1; i >= 1; i-- {
+		a, b := winner[2*i], winner[2*i+1]
+		if h.key[b] < h.key[a] {
+			a, b = b, a
+		}
+		winner[i], h.tree[i] = a, b
+	}
+	h.tree[0] = winner[1]
+	if k == 1 {
+		h.tree[0] = 0
 	}
 }
 
-// empty reports whether the postHeap is empty.
-func (h *postHeap) empty() bool {
-	return len(h.ch) == 0
+// empty reports whether the postTree is empty.
+func (h *postTree) empty() bool {
+	if !h.built {
+		h.build()
+	}
+	return len(h.ch) == 0 || h.key[h.tree[0]] == postDone
 }
 
-// next returns the next entry from the postHeap.
+// next returns the next entry from the postTree.
 // It returns a postEntry with trigram == 1<<24 - 1 if h is empty.
-func (h *postHeap) next() postEntry {
-	if len(h.ch) == 0 {
+// If a chunk's entries are out of order, next records a *MergeError
+// in h.err.
+func (h *postTree) next() postEntry {
+	if h.empty() {
 		return makePostEntry(1<<24-1, 0)
 	}
-	ch := h.ch[0]
+	w := h.tree[0]
+	ch := h.ch[w]
 	e := ch.e
-	m := ch.m
-	if len(m) == 0 {
-		h.pop()
+	if len(ch.m) == 0 && !h.fill(ch) {
+		ch.e = postDone
 	} else {
+		m := ch.m
 		ch.e = m[0]
 		ch.m = m[1:]
-		h.siftDown(0)
-	}
-	return e
-}
-
-func (h *postHeap) pop() *postChunk {
-	ch := h.ch[0]
-	n := len(h.ch) - 1
-	h.ch[0] = h.ch[n]
-	h.ch = h.ch[:n]
-	if n > 1 {
-		h.siftDown(0)
 	}
-	return ch
-}
-
-func (h *postHeap) push(ch *postChunk) {
-	n := len(h.ch)
-	h.ch = append(h.ch, ch)
-	if len(h.ch) >= 2 {
-		h.siftUp(n)
+	if ch.e <= e && h.err == nil {
+		// A chunk out of order would merge into posting lists out of
+		// order, or with files repeated.
+		h.err = &MergeError{File: h.file, Lo: ch.e.fileID(), Hi: ch.e.fileID() + 1, Reason: fmt.Sprintf("bad sort: post entry %#x after %#x", ch.e, e)}
 	}
-}
 
-func (h *postHeap) siftDown(i int) {
-	ch := h.ch
-	for {
-		j1 := 2*i + 1
-		if j1 >= len(ch) {
-			break
-		}
-		j := j1
-		if j2 := j1 + 1; j2 < len(ch) && ch[j1].e >= ch[j2].e {
-			j = j2
+	// Replay the matches on the path from w's leaf to the root.
+	key, tree := h.key, h.tree
+	x := ch.e
+	key[w] = x
+	for i := (int(w) + len(key)) / 2; i > 0; i /= 2 {
+		if l := tree[i]; key[l] < x {
+			tree[i], w = w, l
+			x = key[l]
 		}
-		if ch[i].e < ch[j].e {
-			break
-		}
-		ch[i], ch[j] = ch[j], ch[i]
-		i = j
 	}
+	tree[0] = w
+	return e
 }
 
-func (h *postHeap) siftUp(j int) {
-	ch := h.ch
-	for {
-		i := (j - 1) / 2
-		if i == j || ch[i].e < ch[j].e {
-			break
-		}
-		ch[i], ch[j] = ch[j], ch[i]
-		j = i
+// fill refills ch.m from a compressed chunk.
+// It returns false if ch is over or cannot be read,
+// in which case it records the error in h.err.
+func (h *postTree) fill(ch *postChunk) bool {
+	if ch.dec == nil {
+		return false
+	}
+	m, err := ch.dec.read()
+	if err != nil && h.err == nil {
+		h.err = err
 	}
+	ch.m = m
+	return len(m) > 0
 }
 
 // A bufWriter is a convenience wrapper: a closeable bufio.Writer.
@@ -531,23 +1259,33 @@ type bufWriter struct {
 // corresponding bufWriter. If name is empty, bufCreate uses a
 // temporary file.
 func bufCreate(name string) (*bufWriter, error) {
-	var (
-		f   *os.File
-		err error
-	)
-	if name != "" {
-		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	} else {
-		f, err = os.CreateTemp("", "csearch")
+	if name == "" {
+		return bufCreateTemp("")
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
 	}
+	return newBufWriter(f), nil
+}
+
+// bufCreateTemp creates a new temporary file in dir and returns a
+// corresponding bufWriter. If dir is empty, bufCreateTemp uses the
+// default directory for temporary files.
+func bufCreateTemp(dir string) (*bufWriter, error) {
+	f, err := os.CreateTemp(dir, "csearch")
 	if err != nil {
 		return nil, err
 	}
+	return newBufWriter(f), nil
+}
+
+func newBufWriter(f *os.File) *bufWriter {
 	return &bufWriter{
 		name: f.Name(),
 		buf:  make([]byte, 0, 256<<10),
 		file: f,
-	}, nil
+	}
 }
 
 func (b *bufWriter) write(x []byte) error {
@@ -686,58 +1424,111 @@ func validUTF8(c1, c2 uint32) bool {
 	return false
 }
 
+// A postSorter holds the scratch space for sorting post entries.
+// Each Writer has its own, so that Writers can run concurrently.
+type postSorter struct {
+	tmp     []postEntry
+	n       [][1 << sortK]int // counts, then offsets, for each block of entries
+	workers int               // if positive, overrides GOMAXPROCS, for testing
+}
+
 // sortPost sorts the postentry list.
 // The list is already sorted by file ID (bottom 32 bits)
 // and the top 8 bits are always zero, so there are only
 // 24 bits to sort. Run two rounds of 12-bit radix sort.
 const sortK = 12
 
-var sortTmp []postEntry
-var sortN [1 << sortK]int
+// minSortBlock is the fewest entries for which radixSort
+// starts another goroutine.
+const minSortBlock = 1 << 16
 
-func sortPost(post []postEntry) {
-	if len(post) > len(sortTmp) {
-		sortTmp = make([]postEntry, len(post))
-	}
-	tmp := sortTmp[:len(post)]
+func (s *postSorter) sortPost(post []postEntry) {
+	s.radixSort(post, 24)
+}
 
-	const k = sortK
-	for i := range sortN {
-		sortN[i] = 0
-	}
-	for _, p := range post {
-		r := uintptr(p>>32) & (1<<k - 1)
-		sortN[r]++
-	}
-	tot := 0
-	for i, count := range sortN {
-		sortN[i] = tot
-		tot += count
-	}
-	for _, p := range post {
-		r := uintptr(p>>32) & (1<<k - 1)
-		o := sortN[r]
-		sortN[r]++
-		tmp[o] = p
+// sortQuad sorts a list of quadgram post entries, which, unlike
+// trigram entries, use all 32 bits of the top half.
+func (s *postSorter) sortQuad(post []postEntry) {
+	s.radixSort(post, 32)
+}
+
+// radixSort sorts post, which is already sorted by file ID,
+// by the low bits of the top 32 bits, sortK bits per round.
+//
+// A long list is split into blocks, one per goroutine. In each round,
+// each goroutine counts the digits in its block; the counts give each
+// block its own offset for each digit, after the entries with a
+// smaller digit and those with the same digit in earlier blocks; and
+// each goroutine scatters its block to those offsets. The result is
+// the same, and the sort as stable, as with a single block.
+func (s *postSorter) radixSort(post []postEntry, bits uint) {
+	if len(post) > len(s.tmp) {
+		s.tmp = make([]postEntry, len(post))
 	}
-	tmp, post = post, tmp
+	tmp := s.tmp[:len(post)]
 
-	for i := range sortN {
-		sortN[i] = 0
+	workers := s.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
 	}
-	for _, p := range post {
-		r := uintptr(p>>(32+k)) & (1<<k - 1)
-		sortN[r]++
+	workers = max(min(workers, len(post)/minSortBlock), 1)
+	if len(s.n) < workers {
+		s.n = make([][1 << sortK]int, workers)
 	}
-	tot = 0
-	for i, count := range sortN {
-		sortN[i] = tot
-		tot += count
+	n := s.n[:workers]
+	size := (len(post) + workers - 1) / workers
+
+	const k = sortK
+	src, dst := post, tmp
+	for shift := uint(0); shift < bits; shift += k {
+		forBlocks(workers, func(w int) {
+			c := &n[w]
+			for i := range c {
+				c[i] = 0
+			}
+			for _, p := range src[min(w*size, len(src)):min((w+1)*size, len(src))] {
+				r := uintptr(p>>(32+shift)) & (1<<k - 1)
+				c[r]++
+			}
+		})
+		tot := 0
+		for r := 0; r < 1<<k; r++ {
+			for w := range n {
+				count := n[w][r]
+				n[w][r] = tot
+				tot += count
+			}
+		}
+		forBlocks(workers, func(w int) {
+			c := &n[w]
+			for _, p := range src[min(w*size, len(src)):min((w+1)*size, len(src))] {
+				r := uintptr(p>>(32+shift)) & (1<<k - 1)
+				o := c[r]
+				c[r]++
+				dst[o] = p
+			}
+		})
+		src, dst = dst, src
 	}
-	for _, p := range post {
-		r := uintptr(p>>(32+k)) & (1<<k - 1)
-		o := sortN[r]
-		sortN[r]++
-		tmp[o] = p
+	if len(post) > 0 && &src[0] != &post[0] {
+		copy(post, src)
 	}
 }
+
+// forBlocks calls f(w) for each w in [0, workers), concurrently,
+// and waits for the calls to return.
+func forBlocks(workers int, f func(w int)) {
+	if workers == 1 {
+		f(0)
+		return
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			f(w)
+		}(w)
+	}
+	wg.Wait()
+}
@@ -6,12 +6,26 @@ package index
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
+// testBuildTime is the build time recorded in test indexes,
+// so that indexes built separately can be compared byte for byte.
+var testBuildTime = time.Unix(1600000000, 0)
+
 var trivialFiles = map[string]string{
 	"f0":       "\n\n",
 	"file1":    "\na\n",
@@ -23,7 +37,7 @@ var trivialFiles = map[string]string{
 
 var trivialIndex = join(
 	// header
-	"csearch index 1\n",
+	"csearch index 2\n",
 
 	// list of paths
 	"\x00",
@@ -74,12 +88,20 @@ var trivialIndex = join(
 	"zw\n", u32(1), u32(5+6+5+5+5+6+6+5+5+5),
 	"\xff\xff\xff", u32(0), u32(5+6+5+5+5+6+6+5+5+5+5),
 
+	// lang section
+	"\x00\x00\x00\x00\x00\x00",
+
+	// section index
+	"lang\x00", u32(16+1+38+62+28+132), u32(6),
+	"\x00",
+
 	// trailer
 	u32(16),
 	u32(16+1),
 	u32(16+1+38),
 	u32(16+1+38+62),
 	u32(16+1+38+62+28),
+	u32(16+1+38+62+28+132+6),
 
 	"\ncsearch trailr\n",
 )
@@ -114,11 +136,19 @@ func fileList(list ...uint32) string {
 	return string(buf)
 }
 
-func buildFlushIndex(t *testing.T, out string, paths []string, doFlush bool, fileData map[string]string) {
+// buildFlushIndex writes to out an index of the files in fileData,
+// flushing their post entries to disk first if doFlush is set.
+// If setup is not nil, it is called to configure the Writer before
+// any paths or files are added.
+func buildFlushIndex(t testing.TB, out string, paths []string, doFlush bool, fileData map[string]string, setup func(*Writer)) {
 	ix, err := Create(out)
 	if err != nil {
 		t.Fatal(err)
 	}
+	ix.start = testBuildTime
+	if setup != nil {
+		setup(ix)
+	}
 	ix.AddPaths(paths)
 	var files []string
 	for name := range fileData {
@@ -126,23 +156,27 @@ func buildFlushIndex(t *testing.T, out string, paths []string, doFlush bool, fil
 	}
 	sort.Strings(files)
 	for _, name := range files {
-		ix.Add(name, strings.NewReader(fileData[name]))
+		if err := ix.Add(name, strings.NewReader(fileData[name])); err != nil {
+			t.Fatal(err)
+		}
 	}
 	if doFlush {
 		ix.flushPost()
 	}
-	ix.Flush()
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
 }
 
-func buildIndex(t *testing.T, name string, paths []string, fileData map[string]string) {
-	buildFlushIndex(t, name, paths, false, fileData)
+func buildIndex(t testing.TB, name string, paths []string, fileData map[string]string) {
+	buildFlushIndex(t, name, paths, false, fileData, nil)
 }
 
 func testTrivialWrite(t *testing.T, doFlush bool) {
 	f, _ := os.CreateTemp("", "index-test")
 	defer os.Remove(f.Name())
 	out := f.Name()
-	buildFlushIndex(t, out, nil, doFlush, trivialFiles)
+	buildFlushIndex(t, out, nil, doFlush, trivialFiles, nil)
 
 	data, err := os.ReadFile(out)
 	if err != nil {
@@ -166,18 +200,634 @@ func TestTrivialWriteDisk(t *testing.T) {
 	testTrivialWrite(t, true)
 }
 
-func TestHeap(t *testing.T) {
-	h := &postHeap{}
+func TestPostTree(t *testing.T) {
+	h := &postTree{}
 	es := []postEntry{7, 4, 3, 2, 4}
 	for _, e := range es {
 		h.addMem([]postEntry{e})
 	}
 	if len(h.ch) != len(es) {
-		t.Fatalf("wrong heap size: %d, want %d", len(h.ch), len(es))
+		t.Fatalf("wrong tree size: %d, want %d", len(h.ch), len(es))
 	}
 	for a, b := h.next(), h.next(); b.trigram() != (1<<24 - 1); a, b = b, h.next() {
 		if a > b {
 			t.Fatalf("%d should <= %d", a, b)
 		}
 	}
+
+	// Chunks of different lengths, including empty ones,
+	// merge into the sorted union of their entries.
+	for k := 0; k <= 9; k++ {
+		h := &postTree{}
+		var want []postEntry
+		for i := 0; i < k; i++ {
+			var m []postEntry
+			for j := 0; j < i*i%7; j++ {
+				e := makePostEntry(uint32(j*5+i%3), uint32(i))
+				m = append(m, e)
+				want = append(want, e)
+			}
+			h.addMem(m)
+		}
+		slices.Sort(want)
+		var got []postEntry
+		for !h.empty() {
+			got = append(got, h.next())
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%d chunks: merged %v, want %v", k, got, want)
+		}
+		if e := h.next(); e.trigram() != 1<<24-1 {
+			t.Errorf("%d chunks: next after end = %#x", k, e)
+		}
+	}
+
+	// A chunk out of order, or repeating an entry, is inconsistent.
+	for _, m := range [][]postEntry{{1, 3, 2}, {1, 2, 2}} {
+		h := &postTree{file: "out"}
+		h.addMem([]postEntry{0, 4})
+		h.addMem(m)
+		for !h.empty() {
+			h.next()
+		}
+		var e *MergeError
+		if !errors.Is(h.err, ErrInconsistent) || !errors.As(h.err, &e) || e.File != "out" || e.Lo != 2 {
+			t.Errorf("merging %v: err = %v, want MergeError for file 2", m, h.err)
+		}
+	}
+}
+
+func TestSortPostBlocks(t *testing.T) {
+	// Enough entries to sort in several blocks concurrently,
+	// including a short last block.
+	n := 3*minSortBlock + 1000
+	var post []postEntry
+	for i := 0; i < n; i++ {
+		post = append(post, makePostEntry(uint32(i*7919)%(1<<24), uint32(i)))
+	}
+	want := slices.Clone(post)
+	slices.Sort(want)
+	for _, workers := range []int{1, 3, 4} {
+		got := slices.Clone(post)
+		s := postSorter{workers: workers}
+		s.sortPost(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("sortPost with %d workers: not sorted", workers)
+		}
+	}
+}
+
+func BenchmarkPostTree(b *testing.B) {
+	// Dozens of flushed chunks, each holding entries for its own
+	// files across a range of trigrams, as from a large index.
+	const chunks, n = 48, 20000
+	m := make([][]postEntry, chunks)
+	for i := range m {
+		for j := 0; j < n; j++ {
+			m[i] = append(m[i], makePostEntry(uint32(j*7919%(1<<20)), uint32(i*n+j)))
+		}
+		slices.Sort(m[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var h postTree
+		for _, x := range m {
+			h.addMem(x)
+		}
+		for !h.empty() {
+			h.next()
+		}
+	}
+}
+
+func TestPostMem(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 500; i++ {
+		files[fmt.Sprintf("/f/%03d", i)] = fmt.Sprintf("file %d says %x\n", i, i*i*7919)
+	}
+	// The last index is merged in parts, concurrently.
+	var data [3][]byte
+	for i, mem := range []int64{0, 1, 1} {
+		f, _ := os.CreateTemp("", "index-test")
+		out := f.Name()
+		f.Close()
+		defer os.Remove(out)
+		ix, err := Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.start = testBuildTime
+		ix.PostMem = mem
+		if i == 2 {
+			ix.mergeParts = 5
+		}
+		ix.AddPaths([]string{"/f"})
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ix.Add(name, strings.NewReader(files[name]))
+		}
+		if mem != 0 && len(ix.postFile) == 0 {
+			t.Errorf("PostMem=%d: no post entries flushed", mem)
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if data[i], err = os.ReadFile(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(data[0], data[1]) {
+		t.Errorf("index written with small PostMem differs")
+	}
+	if !bytes.Equal(data[0], data[2]) {
+		t.Errorf("index merged in parts differs")
+	}
+}
+
+func TestCompressTemp(t *testing.T) {
+	var names []string
+	for i := 0; i < 500; i++ {
+		names = append(names, fmt.Sprintf("/f/%03d", i))
+	}
+	var data [2][]byte
+	for i, compress := range []bool{false, true} {
+		f, _ := os.CreateTemp("", "index-test")
+		out := f.Name()
+		f.Close()
+		defer os.Remove(out)
+		ix, err := Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		ix.start = testBuildTime
+		ix.TempDir = dir
+		ix.CompressTemp = compress
+		ix.Quadgrams = true
+		ix.PostMem = 1
+		ix.AddPaths([]string{"/f"})
+		for i, name := range names {
+			ix.Add(name, strings.NewReader(fmt.Sprintf("file %d says %x\n", i, i*i*7919)))
+		}
+		if len(ix.postFile) == 0 || len(ix.quadFile) == 0 {
+			t.Fatalf("CompressTemp=%v: no post entries flushed", compress)
+		}
+		for _, f := range append(ix.postFile, ix.quadFile...) {
+			if filepath.Dir(f.Name()) != dir {
+				t.Errorf("CompressTemp=%v: temporary file %s not in TempDir", compress, f.Name())
+			}
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if left, _ := os.ReadDir(dir); len(left) != 0 {
+			t.Errorf("CompressTemp=%v: %d temporary files left in TempDir", compress, len(left))
+		}
+		if data[i], err = os.ReadFile(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(data[0], data[1]) {
+		t.Errorf("index written with CompressTemp differs")
+	}
+}
+
+func TestCompressTempCorrupt(t *testing.T) {
+	// A damaged compressed temporary file, of trigram or of quadgram
+	// entries, makes Flush fail rather than write a short index.
+	for _, quad := range []bool{false, true} {
+		out := filepath.Join(t.TempDir(), "index")
+		ix, err := Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.TempDir = t.TempDir()
+		ix.CompressTemp = true
+		ix.Quadgrams = true
+		ix.PostMem = 1
+		ix.AddPaths([]string{"/f"})
+		for i := 0; i < 500; i++ {
+			ix.Add(fmt.Sprintf("/f/%03d", i), strings.NewReader(fmt.Sprintf("file %d says %x\n", i, i*i*7919)))
+		}
+		files := ix.postFile
+		if quad {
+			files = ix.quadFile
+		}
+		if len(files) == 0 {
+			t.Fatalf("quad=%v: no entries flushed", quad)
+		}
+		f := files[0]
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(bytes.Repeat([]byte{0x5a}, 16), fi.Size()/2); err != nil {
+			t.Fatal(err)
+		}
+		if err := ix.Flush(); err == nil || !strings.Contains(err.Error(), f.Name()) {
+			t.Errorf("quad=%v: Flush = %v, want error reading %s", quad, err, f.Name())
+		}
+	}
+}
+
+func TestFlushInconsistent(t *testing.T) {
+	// Post entries flushed out of order, as by a bug or a damaged
+	// temporary file, make Flush fail, in one part or in several.
+	for _, parts := range []int{1, 3} {
+		out := filepath.Join(t.TempDir(), "index")
+		ix, err := Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.PostMem = 1
+		ix.mergeParts = parts
+		ix.AddPaths([]string{"/f"})
+		for i := 0; i < 500; i++ {
+			ix.Add(fmt.Sprintf("/f/%03d", i), strings.NewReader(fmt.Sprintf("file %d says %x\n", i, i*i*7919)))
+		}
+		if len(ix.postFile) == 0 {
+			t.Fatal("no post entries flushed")
+		}
+		f := ix.postFile[0]
+		var buf [16]byte
+		if _, err := f.ReadAt(buf[:], 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(append(buf[8:], buf[:8]...), 0); err != nil {
+			t.Fatal(err)
+		}
+		err = ix.Flush()
+		var me *MergeError
+		if !errors.Is(err, ErrInconsistent) || !errors.As(err, &me) {
+			t.Errorf("%d parts: Flush = %v, want MergeError", parts, err)
+		}
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	const n = 4
+	build := func(out string, k int) {
+		ix, err := Create(out)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ix.Quadgrams = true
+		ix.PostMem = 1
+		for i := 0; i < 200; i++ {
+			ix.Add(fmt.Sprintf("/f/%03d", i), strings.NewReader(fmt.Sprintf("file %d of %d says %x\n", i, k, i*i*7919+k)))
+		}
+		if err := ix.Flush(); err != nil {
+			t.Error(err)
+		}
+	}
+	var want, have [n]string
+	for k := 0; k < n; k++ {
+		want[k] = filepath.Join(t.TempDir(), "want")
+		have[k] = filepath.Join(t.TempDir(), "have")
+		build(want[k], k)
+	}
+	var wg sync.WaitGroup
+	for k := 0; k < n; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			build(have[k], k)
+		}(k)
+	}
+	wg.Wait()
+	for k := 0; k < n; k++ {
+		data1, err1 := os.ReadFile(want[k])
+		data2, err2 := os.ReadFile(have[k])
+		if err1 != nil || err2 != nil {
+			t.Fatal(err1, err2)
+		}
+		if !bytes.Equal(data1, data2) {
+			t.Errorf("index %d written concurrently differs", k)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := []string{"a", "b", "\n", "é", "\xff", "\xe2\x82", "\x00", " "}
+	inputs := []string{
+		"",
+		"a",
+		"ab",
+		"abc",
+		strings.Repeat("x", maxLineLen) + "\n",
+		strings.Repeat("x", maxLineLen-1) + "\n" + strings.Repeat("y", maxLineLen),
+		strings.Repeat("x", maxLineLen+1),
+		strings.Repeat("ab\n", 20000),
+		strings.Repeat("ab\n", 20000) + "\xff",
+		strings.Repeat("héllo wörld\n", 3000),
+		strings.Repeat("z", 5000) + "\n" + strings.Repeat("ab", 3000),
+		strings.Repeat("héllo", 1000) + "\xff",
+	}
+	for i := 0; i < 200; i++ {
+		var b strings.Builder
+		for j := rng.Intn(40000); j > 0; j-- {
+			if rng.Intn(1000) == 0 {
+				b.WriteString(alphabet[rng.Intn(len(alphabet))])
+			} else {
+				b.WriteString(alphabet[rng.Intn(3)])
+			}
+		}
+		inputs = append(inputs, b.String())
+	}
+	ix := &Writer{trigram: newTrigramSet(), inbuf: make([]byte, 16384)}
+	for _, long := range []int{-1, 0, 2500} {
+		ix.LongLines, ix.LongLineBytes = long >= 0, long
+		for _, quad := range []bool{false, true} {
+			ix.Quadgrams = quad
+			for i, in := range inputs {
+				// Scan a byte at a time, for comparison.
+				ix.trigram.Reset()
+				ix.quad = ix.quad[:0]
+				s := ix.newScanState()
+				wantSkip := skipString(ix.scanSlow("x", &s, []byte(in)))
+				wantN := s.n
+				wantTri := append([]uint32(nil), ix.trigram.Dense()...)
+				ix.compactQuad()
+				wantQuad := append([]uint32(nil), ix.quad...)
+				if wantSkip == "" && len(wantTri) > maxTextTrigrams {
+					wantSkip = fmt.Sprintf("too many trigrams (%d), probably not text", len(wantTri))
+				}
+
+				for _, r := range []io.Reader{strings.NewReader(in), iotest.HalfReader(strings.NewReader(in))} {
+					n, _, reason, err := ix.scan("x", r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if skip := skipString(reason); skip != wantSkip {
+						t.Errorf("#%d: scan: skip %q, want %q", i, skip, wantSkip)
+						continue
+					}
+					if reason != nil {
+						continue
+					}
+					ix.compactQuad()
+					if n != wantN || !slices.Equal(ix.trigram.Dense(), wantTri) || !slices.Equal(ix.quad, wantQuad) {
+						t.Errorf("#%d: scan: different n-grams than byte at a time", i)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestScanChunks(t *testing.T) {
+	// Feeding a file in chunks of many sizes, some shorter than an
+	// n-gram, leaves the same state after each chunk as scanning it a
+	// byte at a time, so that scanSlow can take over at any chunk.
+	in := []byte(strings.Repeat("héllo, wörld\n", 50))
+	for _, quad := range []bool{false, true} {
+		ix := &Writer{trigram: newTrigramSet(), Quadgrams: quad}
+		s, slow := ix.newScanState(), ix.newScanState()
+		for i, size := 0, 1; i < len(in); size = size%7 + 1 {
+			chunk := in[i:min(i+size, len(in))]
+			i += len(chunk)
+			if !s.checkChunk(chunk) {
+				t.Fatalf("checkChunk(%q) = false", chunk)
+			}
+			ix.addChunk(&s, chunk)
+			if skip := ix.scanSlow("x", &slow, chunk); skip != nil {
+				t.Fatal(skip)
+			}
+			if s != slow {
+				t.Fatalf("Quadgrams=%v: after %d bytes, state %+v, want %+v", quad, i, s, slow)
+			}
+		}
+	}
+}
+
+func TestLongLines(t *testing.T) {
+	long := "needle" + strings.Repeat("x", 3994) + "haystack" + strings.Repeat("y", 992) + "\nshort\n"
+	short := strings.Repeat("x", 1990) + "haystack" + strings.Repeat("y", 100) + "\nshort\n"
+	for _, tt := range []struct {
+		in        string
+		longLines bool
+		bytes     int
+		want      []string // trigrams indexed, or nil if skipped
+		missing   []string // trigrams not indexed
+	}{
+		{long, false, 0, nil, nil},
+		{long, true, 0, []string{"nee", "hay", "sho"}, nil},
+		{long, true, 3000, []string{"nee", "sho"}, []string{"hay"}},
+		{short, true, 100, []string{"hay", "sho"}, nil}, // at least 2000 bytes
+	} {
+		ix := &Writer{trigram: newTrigramSet(), inbuf: make([]byte, 1024), LongLines: tt.longLines, LongLineBytes: tt.bytes}
+		n, _, skip, err := ix.scan("x", strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.want == nil {
+			if skip == nil || skip.Kind != SkipLineTooLong {
+				t.Errorf("LongLines=%v: skip = %v, want line too long", tt.longLines, skip)
+			}
+			continue
+		}
+		if skip != nil || n != int64(len(tt.in)) {
+			t.Errorf("LongLines=%v, LongLineBytes=%d: scan = %d, %v, want %d, nil", tt.longLines, tt.bytes, n, skip, len(tt.in))
+			continue
+		}
+		has := make(map[uint32]bool)
+		for _, tri := range ix.trigram.Dense() {
+			has[tri] = true
+		}
+		for _, s := range tt.want {
+			if !has[uint32(s[0])<<16|uint32(s[1])<<8|uint32(s[2])] {
+				t.Errorf("LongLineBytes=%d: trigram %q not indexed", tt.bytes, s)
+			}
+		}
+		for _, s := range tt.missing {
+			if has[uint32(s[0])<<16|uint32(s[1])<<8|uint32(s[2])] {
+				t.Errorf("LongLineBytes=%d: trigram %q indexed beyond limit", tt.bytes, s)
+			}
+		}
+	}
+}
+
+// skipString returns the string form of r, or "" if r is nil.
+func skipString(r *SkipReason) string {
+	if r == nil {
+		return ""
+	}
+	return r.String()
+}
+
+func BenchmarkScan(b *testing.B) {
+	// Index this package's source files.
+	names, _ := filepath.Glob("*.go")
+	var files [][]byte
+	size := 0
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		files = append(files, data)
+		size += len(data)
+	}
+	ix := &Writer{
+		trigram: newTrigramSet(),
+		inbuf:   make([]byte, 16384),
+	}
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, data := range files {
+			if _, _, skip, err := ix.scan(names[j], bytes.NewReader(data)); skip != nil || err != nil {
+				b.Fatal(names[j], skip, err)
+			}
+		}
+	}
+}
+
+func TestAddFiles(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("f%03d", i))
+		data := fmt.Sprintf("file %d says %x\n", i, i*i*7919)
+		if i == 50 {
+			// Larger than readAheadMax, so read as it is indexed.
+			data = strings.Repeat(data, readAheadMax/len(data)+1)
+		}
+		if err := os.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	var data [2][]byte
+	for i := range data {
+		out := filepath.Join(dir, fmt.Sprintf("index%d", i))
+		ix, err := Create(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			for _, name := range names {
+				if err := ix.AddFile(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+		} else {
+			if n, err := ix.AddFiles(names); n != len(names) || err != nil {
+				t.Fatalf("AddFiles = %d, %v, want %d, nil", n, err, len(names))
+			}
+		}
+		if err := ix.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if data[i], err = os.ReadFile(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(data[0], data[1]) {
+		t.Errorf("index written with AddFiles differs")
+	}
+
+	ix, err := Create(filepath.Join(dir, "index2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := append(names[:10:10], filepath.Join(dir, "missing"))
+	missing = append(missing, names[10:]...)
+	if n, err := ix.AddFiles(missing); n != 10 || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("AddFiles with missing file = %d, %v, want 10, not exist error", n, err)
+	}
+}
+
+var encodedFiles = map[string]string{
+	"utf8":    "café crème\n",
+	"utf16le": "\xff\xfec\x00a\x00f\x00\xe9\x00\n\x00",
+	"utf16be": "\xfe\xff\x00c\x00a\x00f\x00\xe9\x00\n",
+	"latin1":  "caf\xe9 cr\xe8me\n",
+	"binary":  "caf\xe9\x00\n",
+}
+
+func TestAddEncoded(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "index")
+	buildIndex(t, out, nil, encodedFiles)
+	ix, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ix.NumNames(); n != 4 {
+		t.Errorf("NumNames() = %d, want 4 (binary skipped)", n)
+	}
+	// Files are added in sorted order: latin1, utf16be, utf16le, utf8.
+	q := &Query{Op: QAnd, Trigram: []string{"af\xc3", "f\xc3\xa9"}}
+	post, err := ix.PostingQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{0, 1, 2, 3}; !equalList(post, want) {
+		t.Errorf("PostingQuery(café) = %v, want %v", post, want)
+	}
+
+	c := NewChecker()
+	if skip, err := c.Check("utf16le", strings.NewReader(encodedFiles["utf16le"])); skip != "" || err != nil {
+		t.Errorf("Check(utf16le) = %q, %v, want \"\", nil", skip, err)
+	}
+	if skip, err := c.Check("binary", strings.NewReader(encodedFiles["binary"])); skip == "" || err != nil {
+		t.Errorf("Check(binary) = %q, %v, want a reason", skip, err)
+	}
+}
+
+func TestOnSkip(t *testing.T) {
+	files := map[string]string{
+		"/a/binary": "needle\n\x00\xff\n",
+		"/a/long":   strings.Repeat("x", maxLineLen+1) + "\nneedle\n\x00\xff\n",
+		"/a/text":   "needle\n",
+	}
+	out := filepath.Join(t.TempDir(), "index")
+	ix, err := Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var skipped []string
+	var reasons []SkipReason
+	ix.OnSkip = func(name string, reason SkipReason) bool {
+		skipped = append(skipped, name)
+		reasons = append(reasons, reason)
+		return reason.Kind != SkipLineTooLong // index long lines anyway
+	}
+	for _, name := range []string{"/a/binary", "/a/long", "/a/text"} {
+		if err := ix.Add(name, strings.NewReader(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The problems after the first in /a/long are not reported.
+	wantReasons := []SkipReason{{Kind: SkipInvalidUTF8, Line: 2}, {Kind: SkipLineTooLong, Line: 1}}
+	if want := []string{"/a/binary", "/a/long"}; !slices.Equal(skipped, want) || !slices.Equal(reasons, wantReasons) {
+		t.Errorf("OnSkip called for %v, %v, want %v, %v", skipped, reasons, want, wantReasons)
+	}
+	if s, want := reasons[1].String(), "line 1 too long (over 2000 bytes)"; s != want {
+		t.Errorf("reason = %q, want %q", s, want)
+	}
+
+	r, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	names, err := r.Search(&Query{Op: QAnd, Trigram: []string{"nee", "eed", "dle"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/a/long", "/a/text"}; !slices.Equal(names, want) {
+		t.Errorf("Search(needle) = %v, want %v", names, want)
+	}
 }
@@ -0,0 +1,256 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed indexes.
+//
+// An index may be stored compressed, in the zstd seekable format:
+// the index is split into blocks of zstdBlockSize bytes, each compressed
+// as a separate zstd frame, and the frames are followed by a seek table
+// in a skippable frame:
+//
+//	"\x5e\x2a\x4d\x18" [4]
+//	size of the rest of the frame [4]
+//	for each block:
+//		compressed size [4]
+//		decompressed size [4]
+//	number of blocks [4]
+//	descriptor [1]
+//	"\xb1\xea\x92\x8f" [4]
+//
+// All integers in the seek table are little-endian, as in zstd itself.
+// Any zstd decompressor restores the plain index, skipping the seek table.
+// Open recognizes a compressed index by its leading zstd frame and uses
+// the seek table to decompress only the blocks it reads, keeping the most
+// recently used zstdCacheBlocks of them in memory.
+
+const (
+	zstdBlockSize   = 64 << 10
+	zstdCacheBlocks = 256
+
+	zstdFrameMagic     = "\x28\xb5\x2f\xfd"
+	zstdSkippableMagic = 0x184d2a5e
+	zstdSeekableMagic  = 0x8f92eab1
+	zstdSeekFooterSize = 4 + 1 + 4
+	zstdChecksumFlag   = 1 << 7
+)
+
+// IsCompressed reports whether the named index file is compressed.
+func IsCompressed(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var buf [len(zstdFrameMagic)]byte
+	_, err = io.ReadFull(f, buf[:])
+	return err == nil && string(buf[:]) == zstdFrameMagic
+}
+
+// Compress writes a compressed copy of the index file src to dst.
+func Compress(dst, src string) error {
+	return compressFile(dst, src, zstdBlockSize)
+}
+
+func compressFile(dst, src string, blockSize int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	defer enc.Close()
+
+	out := bufio.NewWriter(f)
+	var table []byte
+	buf := make([]byte, blockSize)
+	var frame []byte
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			frame = enc.EncodeAll(buf[:n], frame[:0])
+			if _, err := out.Write(frame); err != nil {
+				return err
+			}
+			table = binary.LittleEndian.AppendUint32(table, uint32(len(frame)))
+			table = binary.LittleEndian.AppendUint32(table, uint32(n))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	numBlocks := uint32(len(table) / 8)
+	var hdr []byte
+	hdr = binary.LittleEndian.AppendUint32(hdr, zstdSkippableMagic)
+	hdr = binary.LittleEndian.AppendUint32(hdr, uint32(len(table)+zstdSeekFooterSize))
+	table = binary.LittleEndian.AppendUint32(table, numBlocks)
+	table = append(table, 0)
+	table = binary.LittleEndian.AppendUint32(table, zstdSeekableMagic)
+	if _, err := out.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := out.Write(table); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// zstdData is index data decompressed on demand from a compressed index.
+type zstdData struct {
+	raw   indexData
+	dec   *zstd.Decoder
+	cache *blockCache
+	coff  []int // offset of each compressed block in raw, plus end
+	doff  []int // offset of each decompressed block, plus total size
+}
+
+// isZstd reports whether data begins with a zstd frame.
+func isZstd(data indexData) bool {
+	if data.size() < len(zstdFrameMagic) {
+		return false
+	}
+	b, err := data.slice(0, len(zstdFrameMagic))
+	return err == nil && string(b) == zstdFrameMagic
+}
+
+func newZstdData(raw indexData) (*zstdData, error) {
+	size := raw.size()
+	if size < 8+zstdSeekFooterSize {
+		return nil, &IndexError{Section: "seek table", Err: ErrTruncated}
+	}
+	footer, err := raw.slice(size-zstdSeekFooterSize, zstdSeekFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != zstdSeekableMagic {
+		return nil, fmt.Errorf("compressed index has no seek table")
+	}
+	numBlocks := int(binary.LittleEndian.Uint32(footer))
+	entrySize := 8
+	switch footer[4] {
+	case 0:
+	case zstdChecksumFlag:
+		entrySize = 12
+	default:
+		return nil, &IndexError{Section: "seek table", Offset: int64(size - zstdSeekFooterSize), Err: ErrMalformed}
+	}
+	if numBlocks > (size-8-zstdSeekFooterSize)/entrySize {
+		return nil, &IndexError{Section: "seek table", Offset: int64(size - zstdSeekFooterSize), Err: ErrTruncated}
+	}
+	tableSize := numBlocks * entrySize
+	start := size - zstdSeekFooterSize - tableSize - 8
+	hdr, err := raw.slice(start, 8+tableSize)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(hdr) != zstdSkippableMagic ||
+		int(binary.LittleEndian.Uint32(hdr[4:])) != tableSize+zstdSeekFooterSize {
+		return nil, &IndexError{Section: "seek table", Offset: int64(start), Err: ErrMalformed}
+	}
+	z := &zstdData{
+		raw:   raw,
+		cache: newBlockCache(zstdCacheBlocks),
+		coff:  make([]int, numBlocks+1),
+		doff:  make([]int, numBlocks+1),
+	}
+	table := hdr[8:]
+	for i := 0; i < numBlocks; i++ {
+		e := table[i*entrySize:]
+		z.coff[i+1] = z.coff[i] + int(binary.LittleEndian.Uint32(e))
+		z.doff[i+1] = z.doff[i] + int(binary.LittleEndian.Uint32(e[4:]))
+	}
+	if z.coff[numBlocks] != start {
+		return nil, &IndexError{Section: "seek table", Offset: int64(start), Err: ErrMalformed}
+	}
+	z.dec, err = zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *zstdData) size() int {
+	return z.doff[len(z.doff)-1]
+}
+
+func (z *zstdData) close() error {
+	z.dec.Close()
+	return z.raw.close()
+}
+
+// block returns decompressed block i.
+func (z *zstdData) block(i int) ([]byte, error) {
+	if b := z.cache.get(i); b != nil {
+		return b, nil
+	}
+	c, err := z.raw.slice(z.coff[i], z.coff[i+1]-z.coff[i])
+	if err != nil {
+		return nil, err
+	}
+	n := z.doff[i+1] - z.doff[i]
+	b, err := z.dec.DecodeAll(c, make([]byte, 0, n))
+	if err != nil {
+		return nil, &IndexError{Section: "compressed block", Offset: int64(z.coff[i]), Err: err}
+	}
+	if len(b) != n {
+		return nil, &IndexError{Section: "compressed block", Offset: int64(z.coff[i]), Err: ErrMalformed}
+	}
+	z.cache.add(i, b)
+	return b, nil
+}
+
+func (z *zstdData) slice(off, n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	i := sort.Search(len(z.doff)-1, func(i int) bool { return z.doff[i+1] > off })
+	b, err := z.block(i)
+	if err != nil {
+		return nil, err
+	}
+	lo := off - z.doff[i]
+	if lo+n <= len(b) {
+		return b[lo : lo+n], nil
+	}
+	buf := make([]byte, 0, n)
+	buf = append(buf, b[lo:]...)
+	for len(buf) < n {
+		i++
+		b, err := z.block(i)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > n-len(buf) {
+			b = b[:n-len(buf)]
+		}
+		buf = append(buf, b...)
+	}
+	return buf, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package index
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompress(t *testing.T) {
+	tempFile := func() string {
+		f, err := os.CreateTemp("", "index-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return f.Name()
+	}
+	out := tempFile()
+	defer os.Remove(out)
+	buildQuadIndex(t, out, mergePaths1, false, mergeFiles1)
+	plain, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsCompressed(out) {
+		t.Errorf("IsCompressed(plain) = true")
+	}
+
+	for _, blockSize := range []int{5, 100, zstdBlockSize} {
+		zout := tempFile()
+		defer os.Remove(zout)
+		if err := compressFile(zout, out, blockSize); err != nil {
+			t.Fatal(err)
+		}
+		if !IsCompressed(zout) {
+			t.Errorf("blockSize %d: IsCompressed = false", blockSize)
+		}
+
+		// Any zstd decoder restores the plain index.
+		data, err := os.ReadFile(zout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, _ := zstd.NewReader(nil)
+		d, err := dec.DecodeAll(data, nil)
+		dec.Close()
+		if err != nil {
+			t.Fatalf("blockSize %d: DecodeAll: %v", blockSize, err)
+		}
+		if !bytes.Equal(d, plain) {
+			t.Fatalf("blockSize %d: decompressed index differs", blockSize)
+		}
+
+		ix, err := Open(zout)
+		if err != nil {
+			t.Fatalf("blockSize %d: %v", blockSize, err)
+		}
+		names, err := ix.Names()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := local.Names()
+		if len(names) != len(want) {
+			t.Fatalf("blockSize %d: Names() = %v, want %v", blockSize, names, want)
+		}
+		for i := range names {
+			if names[i] != want[i] {
+				t.Fatalf("blockSize %d: Names() = %v, want %v", blockSize, names, want)
+			}
+		}
+		for _, q := range []*Query{
+			{Op: QAnd, Trigram: []string{"now"}},
+			{Op: QOr, Trigram: []string{"wor", "all"}},
+			{Op: QAnd, Trigram: []string{"pota", "toes"}},
+		} {
+			have, err := ix.PostingQuery(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := local.PostingQuery(q)
+			if !equalList(have, want) {
+				t.Errorf("blockSize %d: PostingQuery(%v) = %v, want %v", blockSize, q, have, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cli holds code shared by the codesearch commands.
+package cli
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// FlagSet reports whether the named flag was given on the command line.
+func FlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// LogLevel defines the -loglevel flag and returns the level it sets,
+// slog.LevelInfo by default.
+func LogLevel() *slog.Level {
+	l := new(slog.Level)
+	flag.TextVar(l, "loglevel", slog.LevelInfo, "log messages at `level` debug, info, warn, or error and above")
+	return l
+}
+
+// An IndexList is a flag.Value accumulating comma-separated paths,
+// for an -index flag that may be repeated.
+type IndexList []string
+
+func (l *IndexList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *IndexList) Set(s string) error {
+	for _, path := range strings.Split(s, ",") {
+		if path != "" {
+			*l = append(*l, path)
+		}
+	}
+	return nil
+}
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,25 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestIndexList(t *testing.T) {
+	var l IndexList
+	for _, s := range []string{"a", "b,c", ",d,,"} {
+		if err := l.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"a", "b", "c", "d"}; !slices.Equal(l, want) {
+		t.Errorf("IndexList = %q, want %q", l, want)
+	}
+	if s, want := l.String(), "a,b,c,d"; s != want {
+		t.Errorf("String() = %q, want %q", s, want)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import "testing"
+
+func TestSize(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want Size
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1234", 1234, true},
+		{"100k", 100 << 10, true},
+		{"1M", 1 << 20, true},
+		{"2G", 2 << 30, true},
+		{"", 0, false},
+		{"k", 0, false},
+		{"-1", 0, false},
+		{"1.5M", 0, false},
+		{"1T", 0, false},
+		{"9999999999G", 0, false},
+	} {
+		var v Size
+		err := v.Set(tt.s)
+		if (err == nil) != tt.ok || err == nil && v != tt.want {
+			t.Errorf("Set(%q) = %v, %v, want %v, ok=%v", tt.s, v, err, tt.want, tt.ok)
+		}
+	}
+}
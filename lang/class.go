@@ -0,0 +1,141 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lang
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// A Class is a kind of file that searches often leave out as noise:
+// code generated by a tool, minified code, or vendored copies of code
+// from elsewhere. Classes are stored in the index, so the values of
+// existing classes must never change.
+type Class uint8
+
+const (
+	Normal    Class = iota // none of the others
+	Generated              // written by a tool, such as protoc or stringer
+	Minified               // compressed for delivery, such as x.min.js
+	Vendored               // copied from another project, such as under vendor/
+)
+
+var classNames = []string{"normal", "generated", "minified", "vendored"}
+
+// String returns the name of the class.
+func (c Class) String() string {
+	if int(c) < len(classNames) {
+		return classNames[c]
+	}
+	return "normal"
+}
+
+// LookupClass returns the class with the given name, such as
+// "generated". Names are case-insensitive.
+func LookupClass(name string) (Class, bool) {
+	for i, n := range classNames {
+		if strings.EqualFold(n, name) {
+			return Class(i), true
+		}
+	}
+	return Normal, false
+}
+
+// vendorDirs are the names of directories holding vendored code.
+var vendorDirs = map[string]bool{
+	"vendor":           true,
+	"node_modules":     true,
+	"third_party":      true,
+	"bower_components": true,
+}
+
+// generatedSuffixes end the names of files that are always generated.
+var generatedSuffixes = []string{".pb.go", ".pb.gw.go", ".pb.cc", ".pb.h", "_pb2.py", "_pb2_grpc.py"}
+
+// generatedFiles are the base names of lock files written by package
+// managers.
+var generatedFiles = map[string]bool{
+	"package-lock.json": true,
+	"yarn.lock":         true,
+	"pnpm-lock.yaml":    true,
+	"Cargo.lock":        true,
+	"poetry.lock":       true,
+	"go.sum":            true,
+}
+
+// headerLen is the length of the start of a file that Classify searches
+// for a comment marking it as generated.
+const headerLen = 4096
+
+// Classify returns the class of the file with the given name and
+// leading content, which may be nil. The name is consulted first: a
+// file in a directory named vendor, node_modules, third_party, or
+// bower_components is vendored; a file named like x.min.js or x.min.css
+// is minified; and protocol buffer output, such as x.pb.go, and lock
+// files, such as package-lock.json, are generated. Then a file is
+// generated if a line near its start has "@generated" or has both
+// "generated", in any case, and "DO NOT EDIT", as in Go's convention
+//
+//	// Code generated by stringer; DO NOT EDIT.
+//
+// and a JavaScript or CSS file is minified if its lines average more
+// than 500 bytes.
+func Classify(name string, data []byte) Class {
+	slash := filepath.ToSlash(name)
+	dir, base := "", slash
+	if i := strings.LastIndex(slash, "/"); i >= 0 {
+		dir, base = slash[:i], slash[i+1:]
+	}
+	for _, elem := range strings.Split(dir, "/") {
+		if vendorDirs[elem] {
+			return Vendored
+		}
+	}
+	if generatedFiles[base] {
+		return Generated
+	}
+	for _, suffix := range generatedSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return Generated
+		}
+	}
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	minifiable := ext == ".js" || ext == ".mjs" || ext == ".css"
+	if minifiable && (strings.HasSuffix(stem, ".min") || strings.HasSuffix(stem, "-min")) {
+		return Minified
+	}
+	if isGenerated(data) {
+		return Generated
+	}
+	if minifiable && len(data) >= 1000 && bytes.Count(data, []byte("\n"))*500 < len(data) {
+		return Minified
+	}
+	return Normal
+}
+
+// isGenerated reports whether a line at the start of data marks the
+// file as generated.
+func isGenerated(data []byte) bool {
+	if len(data) > headerLen {
+		data = data[:headerLen]
+	}
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		if bytes.Contains(line, []byte("@generated")) {
+			return true
+		}
+		if bytes.Contains(line, []byte("DO NOT EDIT")) && bytes.Contains(bytes.ToLower(line), []byte("generated")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lang
+
+import (
+	"strings"
+	"testing"
+)
+
+var classifyTests = []struct {
+	name  string
+	data  string
+	class string
+}{
+	{"main.go", "package main\n", "normal"},
+	{"/src/vendor/github.com/x/y.go", "", "vendored"},
+	{"web/node_modules/left-pad/index.js", "", "vendored"},
+	{"/src/vendor.go", "", "normal"},
+	{"api/x.pb.go", "", "generated"},
+	{"api/x_pb2.py", "", "generated"},
+	{"web/package-lock.json", "{}\n", "generated"},
+	{"x_string.go", "// Code generated by \"stringer -type=X\"; DO NOT EDIT.\n\npackage x\n", "generated"},
+	{"lib.c", "/*\n * Copyright\n */\n// Generated by tool. DO NOT EDIT!\n", "generated"},
+	{"Foo.java", "/**\n * @generated\n */\n", "generated"},
+	{"notes.md", "Do not edit the generated files.\n", "normal"},
+	{"x.go", "// DO NOT EDIT this file by hand.\n", "normal"},
+	{"static/app.min.js", "", "minified"},
+	{"static/app-min.css", "", "minified"},
+	{"static/app.js", "var a=1;" + strings.Repeat("b(),", 300) + "\n", "minified"},
+	{"static/app.js", strings.Repeat("var a = 1;\n", 200), "normal"},
+	{"data.json", strings.Repeat("1,", 1000), "normal"},
+}
+
+func TestClassify(t *testing.T) {
+	for _, tt := range classifyTests {
+		if got := Classify(tt.name, []byte(tt.data)).String(); got != tt.class {
+			t.Errorf("Classify(%q, %.40q) = %s, want %s", tt.name, tt.data, got, tt.class)
+		}
+	}
+}
+
+func TestLookupClass(t *testing.T) {
+	for _, c := range []Class{Normal, Generated, Minified, Vendored} {
+		if c2, ok := LookupClass(strings.ToUpper(c.String())); !ok || c2 != c {
+			t.Errorf("LookupClass(%q) = %v, %v", c.String(), c2, ok)
+		}
+	}
+	if _, ok := LookupClass("handwritten"); ok {
+		t.Error("LookupClass(handwritten) succeeded")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package lang identifies the language of source files by file name,
+// extension, interpreter line, and editor modeline.
+package lang
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// An ID identifies a language. IDs are stored in the index, so the
+// values of existing languages must never change; new languages are
+// only ever appended.
+type ID uint8
+
+// Unknown is the ID of files whose language could not be determined.
+const Unknown ID = 0
+
+type language struct {
+	name    string   // lower-case name, as accepted by Lookup
+	exts    []string // file extensions, including the leading dot
+	files   []string // exact base names
+	interps []string // interpreters named on a #! line
+	modes   []string // Emacs modes and Vim filetypes, besides name
+}
+
+// langs is indexed by ID.
+var langs = []language{
+	{name: "unknown"},
+	{name: "assembly", exts: []string{".s", ".S", ".asm"}, modes: []string{"asm", "nasm"}},
+	{name: "c", exts: []string{".c", ".h"}},
+	{name: "cpp", exts: []string{".cc", ".cpp", ".cxx", ".c++", ".hh", ".hpp", ".hxx"}, modes: []string{"c++"}},
+	{name: "csharp", exts: []string{".cs"}, modes: []string{"cs"}},
+	{name: "css", exts: []string{".css"}},
+	{name: "go", exts: []string{".go"}},
+	{name: "html", exts: []string{".html", ".htm"}},
+	{name: "java", exts: []string{".java"}},
+	{name: "javascript", exts: []string{".js", ".mjs", ".cjs", ".jsx"}, interps: []string{"node", "nodejs"}, modes: []string{"js", "js2"}},
+	{name: "json", exts: []string{".json"}},
+	{name: "kotlin", exts: []string{".kt", ".kts"}},
+	{name: "lua", exts: []string{".lua"}, interps: []string{"lua"}},
+	{name: "make", exts: []string{".mk", ".mak"}, files: []string{"Makefile", "makefile", "GNUmakefile"}, interps: []string{"make"}, modes: []string{"makefile", "makefile-gmake"}},
+	{name: "markdown", exts: []string{".md", ".markdown"}},
+	{name: "objc", exts: []string{".m", ".mm"}, modes: []string{"objective-c"}},
+	{name: "perl", exts: []string{".pl", ".pm"}, interps: []string{"perl"}, modes: []string{"cperl"}},
+	{name: "php", exts: []string{".php"}, interps: []string{"php"}},
+	{name: "protobuf", exts: []string{".proto"}, modes: []string{"proto"}},
+	{name: "python", exts: []string{".py", ".pyi"}, interps: []string{"python"}},
+	{name: "ruby", exts: []string{".rb"}, files: []string{"Rakefile", "Gemfile"}, interps: []string{"ruby"}},
+	{name: "rust", exts: []string{".rs"}},
+	{name: "scala", exts: []string{".scala"}, interps: []string{"scala"}},
+	{name: "shell", exts: []string{".sh", ".bash", ".zsh", ".ksh"}, interps: []string{"sh", "bash", "zsh", "ksh", "dash"}, modes: []string{"sh", "bash", "zsh", "shell-script"}},
+	{name: "sql", exts: []string{".sql"}},
+	{name: "swift", exts: []string{".swift"}},
+	{name: "tcl", exts: []string{".tcl"}, interps: []string{"tclsh", "wish"}},
+	{name: "typescript", exts: []string{".ts", ".tsx"}},
+	{name: "xml", exts: []string{".xml", ".xsd", ".xsl"}, modes: []string{"nxml"}},
+	{name: "yaml", exts: []string{".yaml", ".yml"}},
+	{name: "dockerfile", files: []string{"Dockerfile"}},
+	{name: "awk", exts: []string{".awk"}, interps: []string{"awk", "gawk", "mawk"}},
+}
+
+var (
+	byName   = make(map[string]ID)
+	byExt    = make(map[string]ID)
+	byFile   = make(map[string]ID)
+	byInterp = make(map[string]ID)
+	byMode   = make(map[string]ID)
+)
+
+func init() {
+	for i, l := range langs {
+		id := ID(i)
+		byName[l.name] = id
+		for _, ext := range l.exts {
+			byExt[ext] = id
+		}
+		for _, file := range l.files {
+			byFile[file] = id
+		}
+		for _, interp := range l.interps {
+			byInterp[interp] = id
+		}
+		byMode[l.name] = id
+		for _, mode := range l.modes {
+			byMode[mode] = id
+		}
+	}
+}
+
+// String returns the name of the language.
+func (id ID) String() string {
+	if int(id) < len(langs) {
+		return langs[id].name
+	}
+	return "unknown"
+}
+
+// Lookup returns the ID of the language with the given name.
+// Names are case-insensitive.
+func Lookup(name string) (ID, bool) {
+	id, ok := byName[strings.ToLower(name)]
+	return id, ok
+}
+
+// Names returns the names of all known languages.
+func Names() []string {
+	names := make([]string, 0, len(langs)-1)
+	for _, l := range langs[1:] {
+		names = append(names, l.name)
+	}
+	return names
+}
+
+// Detect returns the language of the file with the given name and
+// leading content, which may be nil. An Emacs or Vim modeline near
+// the start of the content, such as
+//
+//	# -*- mode: python -*-
+//	/* vim: set ft=cpp: */
+//
+// names the language, overriding the name, as it does in those
+// editors. Otherwise the name is consulted, and then the content is
+// examined for a #! interpreter line.
+func Detect(name string, data []byte) ID {
+	if id := detectModeline(data); id != Unknown {
+		return id
+	}
+	base := filepath.Base(name)
+	if id, ok := byFile[base]; ok {
+		return id
+	}
+	if id, ok := byExt[filepath.Ext(base)]; ok {
+		return id
+	}
+	return detectShebang(data)
+}
+
+// detectShebang returns the language of the interpreter named on
+// a leading #! line in data.
+func detectShebang(data []byte) ID {
+	if !bytes.HasPrefix(data, []byte("#!")) {
+		return Unknown
+	}
+	line := data[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return Unknown
+	}
+	interp := filepath.Base(fields[0])
+	if interp == "env" {
+		// #!/usr/bin/env [-S] [NAME=value...] interp
+		interp = ""
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "-") || strings.Contains(f, "=") {
+				continue
+			}
+			interp = filepath.Base(f)
+			break
+		}
+	}
+	// Strip version suffixes such as python3 or python2.7.
+	interp = strings.TrimRight(interp, "0123456789.")
+	return byInterp[interp]
+}
+
+// modelineLines is the number of lines at the start of a file searched
+// for a Vim modeline, as Vim does by default.
+const modelineLines = 5
+
+var (
+	emacsModeline = regexp.MustCompile(`-\*-\s*(.*?)\s*-\*-`)
+	vimModeline   = regexp.MustCompile(`(?:^|\s)(?:vi|vim|ex):(?:.*?[\s:])?(?:ft|filetype|syn|syntax)=([\w+#-]+)`)
+)
+
+// detectModeline returns the language named by an Emacs modeline on the
+// first line of data, or the second after a #! line, or by a Vim
+// modeline on one of its first lines.
+func detectModeline(data []byte) ID {
+	shebang := bytes.HasPrefix(data, []byte("#!"))
+	for i := 0; i < modelineLines && len(data) > 0; i++ {
+		line := data
+		if j := bytes.IndexByte(data, '\n'); j >= 0 {
+			line, data = data[:j], data[j+1:]
+		} else {
+			data = nil
+		}
+		if i == 0 || i == 1 && shebang {
+			if m := emacsModeline.FindSubmatch(line); m != nil {
+				if id := byMode[emacsMode(string(m[1]))]; id != Unknown {
+					return id
+				}
+			}
+		}
+		if m := vimModeline.FindSubmatch(line); m != nil {
+			if id := byMode[strings.ToLower(string(m[1]))]; id != Unknown {
+				return id
+			}
+		}
+	}
+	return Unknown
+}
+
+// emacsMode returns the mode set by the variables of an Emacs modeline,
+// either a mode alone, as in -*- C++ -*-, or a list of variables, as in
+// -*- mode: python; coding: utf-8 -*-.
+func emacsMode(vars string) string {
+	if !strings.Contains(vars, ":") {
+		return strings.ToLower(vars)
+	}
+	for _, v := range strings.Split(vars, ";") {
+		name, value, _ := strings.Cut(v, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "mode") {
+			return strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lang
+
+import "testing"
+
+var detectTests = []struct {
+	name string
+	data string
+	lang string
+}{
+	{"main.go", "", "go"},
+	{"/src/x/Makefile", "", "make"},
+	{"lib.h", "", "c"},
+	{"run", "#!/bin/sh\necho hi\n", "shell"},
+	{"run", "#! /usr/bin/env python3\n", "python"},
+	{"run", "#!/usr/bin/env -S perl -w\n", "perl"},
+	{"run", "#!/usr/local/bin/python2.7", "python"},
+	{"tool.py", "#!/bin/sh\n", "python"},
+	{"README", "hello\n", "unknown"},
+	{"run", "#!\n", "unknown"},
+	{"run", "#!/bin/sh\n# -*- mode: python; coding: utf-8 -*-\n", "python"},
+	{"lib.h", "// -*- C++ -*-\n", "cpp"},
+	{"lib.h", "/* -*- mode: c++; indent-tabs-mode: nil -*- */\n", "cpp"},
+	{"x.txt", "a\n-*- python -*-\n", "unknown"},
+	{"BUILD", "# vim: set ft=python:\n", "python"},
+	{"script", "#!/bin/sh\n\n\n# vim:ft=zsh\n", "shell"},
+	{"script", "1\n2\n3\n4\n5\n# vim: ft=ruby\n", "unknown"},
+	{"x.conf", "# vi: set ts=4 filetype=yaml :\n", "yaml"},
+	{"x.go", "// vim: ft=klingon\n", "go"},
+	{"notes", "vim is set to ft=python\n", "unknown"},
+}
+
+func TestDetect(t *testing.T) {
+	for _, tt := range detectTests {
+		if got := Detect(tt.name, []byte(tt.data)).String(); got != tt.lang {
+			t.Errorf("Detect(%q, %q) = %s, want %s", tt.name, tt.data, got, tt.lang)
+		}
+	}
+}
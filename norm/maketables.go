@@ -0,0 +1,246 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build ignore
+
+// Maketables writes tables.go from the Unicode Character Database:
+//
+//	go run maketables.go -output tables.go
+//
+// The -url flag names the directory holding UnicodeData.txt and
+// DerivedNormalizationProps.txt, on the web or in the local file system.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const version = "14.0.0"
+
+var (
+	url    = flag.String("url", "https://www.unicode.org/Public/"+version+"/ucd/", "directory of the Unicode Character Database")
+	output = flag.String("output", "", "write the tables to this file instead of standard output")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("maketables: ")
+	flag.Parse()
+
+	// UnicodeData.txt fields: code point; name; general category;
+	// canonical combining class; bidi class; decomposition; ...
+	ccc := make(map[rune]int)
+	decomp := make(map[rune][]rune) // canonical decompositions, one level
+	err := readLines("UnicodeData.txt", func(line string) error {
+		f := strings.Split(line, ";")
+		if len(f) < 6 {
+			return fmt.Errorf("malformed line %q", line)
+		}
+		r, err := parseRune(f[0])
+		if err != nil {
+			return err
+		}
+		if f[3] != "0" {
+			n, err := strconv.Atoi(f[3])
+			if err != nil {
+				return err
+			}
+			ccc[r] = n
+		}
+		if f[5] != "" && !strings.HasPrefix(f[5], "<") {
+			for _, s := range strings.Fields(f[5]) {
+				d, err := parseRune(s)
+				if err != nil {
+					return err
+				}
+				decomp[r] = append(decomp[r], d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	excluded := make(map[rune]bool)
+	err = readLines("DerivedNormalizationProps.txt", func(line string) error {
+		f := strings.Split(line, ";")
+		if len(f) < 2 || strings.TrimSpace(f[1]) != "Full_Composition_Exclusion" {
+			return nil
+		}
+		lo, hi, err := parseRange(strings.TrimSpace(f[0]))
+		if err != nil {
+			return err
+		}
+		for r := lo; r <= hi; r++ {
+			excluded[r] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by maketables.go from Unicode %s; DO NOT EDIT.\n\n", version)
+	fmt.Fprintf(&b, "package norm\n\n")
+	fmt.Fprintf(&b, "// UnicodeVersion is the version of Unicode the tables are from.\n")
+	fmt.Fprintf(&b, "const UnicodeVersion = %q\n\n", version)
+
+	var runes []rune
+	for r := range ccc {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	fmt.Fprintf(&b, "// combiningClasses lists the runes whose canonical combining\n")
+	fmt.Fprintf(&b, "// class is not 0, as sorted ranges.\n")
+	fmt.Fprintf(&b, "var combiningClasses = []classRange{\n")
+	for i := 0; i < len(runes); {
+		j := i + 1
+		for j < len(runes) && runes[j] == runes[j-1]+1 && ccc[runes[j]] == ccc[runes[i]] {
+			j++
+		}
+		fmt.Fprintf(&b, "\t{%#04x, %#04x, %d},\n", runes[i], runes[j-1], ccc[runes[i]])
+		i = j
+	}
+	fmt.Fprintf(&b, "}\n\n")
+
+	runes = runes[:0]
+	for r := range decomp {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	var full func(r rune) []rune
+	full = func(r rune) []rune {
+		d, ok := decomp[r]
+		if !ok {
+			return []rune{r}
+		}
+		var out []rune
+		for _, r := range d {
+			out = append(out, full(r)...)
+		}
+		return out
+	}
+	fmt.Fprintf(&b, "// decompositions maps each rune with a canonical decomposition\n")
+	fmt.Fprintf(&b, "// to its full decomposition, not yet in canonical order.\n")
+	fmt.Fprintf(&b, "var decompositions = map[rune]string{\n")
+	for _, r := range runes {
+		fmt.Fprintf(&b, "\t%#04x: %s,\n", r, quote(full(r)))
+	}
+	fmt.Fprintf(&b, "}\n\n")
+
+	fmt.Fprintf(&b, "// compositions maps each pair of runes that NFC composes\n")
+	fmt.Fprintf(&b, "// to the rune composed.\n")
+	fmt.Fprintf(&b, "var compositions = map[[2]rune]rune{\n")
+	for _, r := range runes {
+		if d := decomp[r]; len(d) == 2 && !excluded[r] {
+			fmt.Fprintf(&b, "\t{%#04x, %#04x}: %#04x,\n", d[0], d[1], r)
+		}
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *output == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*output, src, 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readLines calls fn for each line of the named file in the database,
+// omitting comments and blank lines.
+func readLines(name string, fn func(line string) error) error {
+	var r io.Reader
+	if strings.HasPrefix(*url, "http://") || strings.HasPrefix(*url, "https://") {
+		resp, err := http.Get(*url + name)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s%s: %s", *url, name, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(filepath.Join(*url, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return s.Err()
+}
+
+func parseRune(s string) (rune, error) {
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid code point %q", s)
+	}
+	return rune(n), nil
+}
+
+// parseRange parses a code point or range of code points, like 0340..0341.
+func parseRange(s string) (lo, hi rune, err error) {
+	i := strings.Index(s, "..")
+	if i < 0 {
+		lo, err = parseRune(s)
+		return lo, lo, err
+	}
+	if lo, err = parseRune(s[:i]); err != nil {
+		return 0, 0, err
+	}
+	hi, err = parseRune(s[i+2:])
+	return lo, hi, err
+}
+
+// quote returns a Go string literal holding the runes,
+// escaping any that are not ASCII.
+func quote(rs []rune) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range rs {
+		switch {
+		case r < 0x80 && r != '"' && r != '\\':
+			b.WriteRune(r)
+		case r <= 0xFFFF:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			fmt.Fprintf(&b, `\U%08X`, r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package norm normalizes Unicode text to NFC, optionally removing
+// diacritical marks first, so that text typed with composed characters,
+// such as U+00E9 (é), matches text typed with combining marks, such as
+// U+0065 U+0301 (e and a combining acute accent), and vice versa.
+//
+// The index and the search must normalize text the same way: an index
+// records the Mode used to build it (see index.Writer.Normalize), and
+// a search of the index applies the same Mode to both the pattern and
+// the files it reads.
+package norm
+
+//go:generate go run maketables.go -output tables.go
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Mode says how to normalize text.
+type Mode int
+
+const (
+	None  Mode = iota // leave text unchanged
+	NFC               // normalize to Unicode normalization form C
+	Strip             // remove nonspacing marks (category Mn), such as accents, then NFC
+)
+
+var names = []string{
+	None:  "none",
+	NFC:   "nfc",
+	Strip: "strip",
+}
+
+// String returns the name of the mode, as accepted by Set.
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(names) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return names[m]
+}
+
+// Set sets the mode from its name, for use as a flag.Value.
+func (m *Mode) Set(s string) error {
+	for i, name := range names {
+		if s == name {
+			*m = Mode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown normalization %q; want none, nfc, or strip", s)
+}
+
+// Normalize returns s normalized.
+func (m Mode) Normalize(s string) string {
+	if m.quick([]byte(s)) {
+		return s
+	}
+	return string(m.Append(nil, []byte(s)))
+}
+
+// Append appends src, normalized, to dst and returns the result.
+// Bytes of src that are not valid UTF-8 are copied unchanged.
+func (m Mode) Append(dst, src []byte) []byte {
+	if m.quick(src) {
+		return append(dst, src...)
+	}
+	var seg []rune // decomposed segment not yet composed
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRune(src[i:])
+		i += size
+		if r == utf8.RuneError && size == 1 {
+			dst = appendRunes(dst, compose(seg))
+			seg = seg[:0]
+			dst = append(dst, src[i-1])
+			continue
+		}
+		if r < utf8.RuneSelf {
+			// ASCII begins a new segment: nothing before it
+			// composes with it or with anything after it.
+			dst = appendRunes(dst, compose(seg))
+			seg = append(seg[:0], r)
+			continue
+		}
+		seg = m.decompose(seg, r)
+	}
+	return appendRunes(dst, compose(seg))
+}
+
+// quick reports whether normalizing b would leave it unchanged,
+// judging only by a quick look.
+func (m Mode) quick(b []byte) bool {
+	switch m {
+	case NFC:
+		// Text made only of runes below U+0300, whose UTF-8
+		// encodings are the ones using only bytes below 0xCC,
+		// is in NFC.
+		for _, c := range b {
+			if c >= 0xCC {
+				return false
+			}
+		}
+	case Strip:
+		for _, c := range b {
+			if c >= utf8.RuneSelf {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Hangul syllables are composed algorithmically.
+const (
+	hangulBase = 0xAC00
+	hangulL    = 0x1100
+	hangulV    = 0x1161
+	hangulT    = 0x11A7
+	hangulLN   = 19
+	hangulVN   = 21
+	hangulTN   = 28
+	hangulN    = hangulLN * hangulVN * hangulTN
+)
+
+// decompose appends to seg the full canonical decomposition of r,
+// keeping the nonspacing marks in seg in canonical order.
+// In Strip mode, it omits nonspacing marks.
+func (m Mode) decompose(seg []rune, r rune) []rune {
+	if s := r - hangulBase; 0 <= s && s < hangulN {
+		seg = append(seg, hangulL+s/(hangulVN*hangulTN), hangulV+s%(hangulVN*hangulTN)/hangulTN)
+		if t := s % hangulTN; t != 0 {
+			seg = append(seg, hangulT+t)
+		}
+		return seg
+	}
+	d, ok := decompositions[r]
+	if !ok {
+		return m.appendOrdered(seg, r)
+	}
+	for _, r := range d {
+		seg = m.appendOrdered(seg, r)
+	}
+	return seg
+}
+
+// appendOrdered appends r to seg, moving it before any nonspacing
+// marks at the end of seg with a higher combining class.
+func (m Mode) appendOrdered(seg []rune, r rune) []rune {
+	if m == Strip && unicode.Is(unicode.Mn, r) {
+		return seg
+	}
+	seg = append(seg, r)
+	c := combiningClass(r)
+	if c == 0 {
+		return seg
+	}
+	i := len(seg) - 1
+	for ; i > 0 && combiningClass(seg[i-1]) > c; i-- {
+		seg[i] = seg[i-1]
+	}
+	seg[i] = r
+	return seg
+}
+
+// compose composes the canonically decomposed and ordered runes
+// in seg, in place, and returns the result.
+func compose(seg []rune) []rune {
+	if len(seg) < 2 {
+		return seg
+	}
+	starter := 0
+	last := 256 // combining class of the last rune kept; 256 blocks
+	if combiningClass(seg[0]) == 0 {
+		last = 0
+	}
+	n := 1
+	for _, r := range seg[1:] {
+		c := int(combiningClass(r))
+		if last < c || last == 0 {
+			if p, ok := composePair(seg[starter], r); ok {
+				seg[starter] = p
+				continue
+			}
+		}
+		if c == 0 {
+			starter = n
+		}
+		last = c
+		seg[n] = r
+		n++
+	}
+	return seg[:n]
+}
+
+// composePair returns the rune composed of a and b, if any.
+func composePair(a, b rune) (rune, bool) {
+	if l, v := a-hangulL, b-hangulV; 0 <= l && l < hangulLN && 0 <= v && v < hangulVN {
+		return hangulBase + (l*hangulVN+v)*hangulTN, true
+	}
+	if s, t := a-hangulBase, b-hangulT; 0 <= s && s < hangulN && s%hangulTN == 0 && 0 < t && t < hangulTN {
+		return a + t, true
+	}
+	p, ok := compositions[[2]rune{a, b}]
+	return p, ok
+}
+
+// A classRange gives the canonical combining class of the runes lo through hi.
+type classRange struct {
+	lo, hi rune
+	class  uint8
+}
+
+// combiningClass returns the canonical combining class of r.
+func combiningClass(r rune) uint8 {
+	if r < 0x300 {
+		return 0
+	}
+	i := sort.Search(len(combiningClasses), func(i int) bool { return combiningClasses[i].hi >= r })
+	if i < len(combiningClasses) && combiningClasses[i].lo <= r {
+		return combiningClasses[i].class
+	}
+	return 0
+}
+
+func appendRunes(dst []byte, rs []rune) []byte {
+	var b [utf8.UTFMax]byte
+	for _, r := range rs {
+		n := utf8.EncodeRune(b[:], r)
+		dst = append(dst, b[:n]...)
+	}
+	return dst
+}
+
+// NewReader returns a reader of the text read from r, normalized.
+func NewReader(r io.Reader, m Mode) io.Reader {
+	if m == None {
+		return r
+	}
+	return &reader{r: r, m: m, in: make([]byte, 0, readerBuf)}
+}
+
+// readerBuf is the size of a reader's input buffer.
+const readerBuf = 64 << 10
+
+// A reader normalizes text read from r.
+type reader struct {
+	r   io.Reader
+	m   Mode
+	in  []byte // input not yet normalized
+	out []byte // normalized text not yet read
+	buf []byte // storage for out
+	err error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 && r.err == nil {
+		old := len(r.in)
+		n, err := r.r.Read(r.in[old:cap(r.in)])
+		r.in = r.in[:len(r.in)+n]
+		r.err = err
+		// Normalize the input up to the start of the last rune
+		// below U+0300, which nothing before it composes with,
+		// keeping the rest for later. Only the bytes just read
+		// can hold such a rune, other than the first.
+		end := len(r.in)
+		if err == nil {
+			end = lastBoundary(r.in, old)
+			if end == 0 && len(r.in) == cap(r.in) {
+				// No boundary in a full buffer:
+				// split at the last rune.
+				end = len(r.in) - 1
+				for end > 0 && !utf8.RuneStart(r.in[end]) {
+					end--
+				}
+			}
+		}
+		r.out = r.m.Append(r.buf[:0], r.in[:end])
+		r.buf = r.out
+		r.in = r.in[:copy(r.in, r.in[end:])]
+	}
+	if len(r.out) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// lastBoundary returns the offset in b of the last rune below U+0300
+// starting at or after from, or 0 if there is none after the first.
+func lastBoundary(b []byte, from int) int {
+	if from < 1 {
+		from = 1
+	}
+	for i := len(b) - 1; i >= from; i-- {
+		if c := b[i]; c < utf8.RuneSelf || 0xC0 <= c && c < 0xCC {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package norm
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var normTests = []struct {
+	mode Mode
+	in   string
+	out  string
+}{
+	{None, "cafe\u0301", "cafe\u0301"},
+	{NFC, "", ""},
+	{NFC, "hello, world\n", "hello, world\n"},
+	{NFC, "caf\u00e9", "caf\u00e9"},
+	{NFC, "cafe\u0301", "caf\u00e9"},
+	{NFC, "A\u030a", "\u00c5"},
+	{NFC, "\u212b", "\u00c5"},                   // singleton: ANGSTROM SIGN
+	{NFC, "\u2126", "\u03a9"},                   // singleton: OHM SIGN
+	{NFC, "\u0915\u093c", "\u0915\u093c"},       // composition exclusion
+	{NFC, "\u0958", "\u0915\u093c"},             // composition exclusion
+	{NFC, "q\u0307\u0323", "q\u0323\u0307"},     // canonical order
+	{NFC, "d\u0307\u0323", "\u1e0d\u0307"},      // reordered, then composed
+	{NFC, "\u1e0b\u0323", "\u1e0d\u0307"},       // decomposed, reordered, composed
+	{NFC, "a\u0328\u0301", "\u0105\u0301"},      // composed in order
+	{NFC, "e\u0301\u0301", "\u00e9\u0301"},      // second mark blocked
+	{NFC, "\u0301e", "\u0301e"},                 // leading mark
+	{NFC, "\u1100\u1161", "\uac00"},             // Hangul LV
+	{NFC, "\u1100\u1161\u11a8", "\uac01"},       // Hangul LVT
+	{NFC, "\uac00\u11a8", "\uac01"},             // Hangul LV+T
+	{NFC, "\uac01", "\uac01"},                   // Hangul LVT
+	{NFC, "\xffe\u0301\xff", "\xff\u00e9\xff"},  // invalid UTF-8
+	{NFC, "\U0001d15e", "\U0001d157\U0001d165"}, // excluded
+	{Strip, "caf\u00e9 cre\u0300me", "cafe creme"},
+	{Strip, "\u00c5ngstro\u0308m", "Angstrom"},
+	{Strip, "\u212b", "A"},
+	{Strip, "\uac01", "\uac01"},
+	{Strip, "na\u00efve\n", "naive\n"},
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tt := range normTests {
+		if out := tt.mode.Normalize(tt.in); out != tt.out {
+			t.Errorf("%v.Normalize(%+q) = %+q, want %+q", tt.mode, tt.in, out, tt.out)
+		}
+		if out := tt.mode.Append([]byte("x"), []byte(tt.in)); string(out) != "x"+tt.out {
+			t.Errorf("%v.Append(x, %+q) = %+q, want %+q", tt.mode, tt.in, out, "x"+tt.out)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	var in, want strings.Builder
+	for in.Len() < 3*readerBuf {
+		for _, tt := range normTests {
+			if tt.mode == NFC {
+				in.WriteString(tt.in)
+				want.WriteString(tt.out)
+			}
+		}
+	}
+	// A long line with no rune below U+0300 fills the buffer.
+	in.WriteString(strings.Repeat("一", readerBuf))
+	want.WriteString(strings.Repeat("一", readerBuf))
+
+	for _, r := range []io.Reader{
+		strings.NewReader(in.String()),
+		iotest.OneByteReader(strings.NewReader(in.String())),
+		iotest.HalfReader(strings.NewReader(in.String())),
+	} {
+		out, err := io.ReadAll(NewReader(r, NFC))
+		if err != nil || string(out) != want.String() {
+			t.Errorf("reading normalized text: %d bytes, %v, want %d bytes", len(out), err, want.Len())
+		}
+	}
+}
+
+func TestModeFlag(t *testing.T) {
+	for m := None; m <= Strip; m++ {
+		var m2 Mode = -1
+		if err := m2.Set(m.String()); err != nil || m2 != m {
+			t.Errorf("Set(%q) = %v, %v, want %v", m.String(), m2, err, m)
+		}
+	}
+	var m Mode
+	if err := m.Set("nfkc"); err == nil {
+		t.Error("Set(nfkc) succeeded")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rank scores files matching a search and selects the best of
+// them, so that a search with many matching files can show the most
+// relevant few instead of all of them.
+package rank
+
+import (
+	"container/heap"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andrewarchi/codesearch/regexp"
+)
+
+// Weights are the weights of the components of a file's score.
+// Each component is between 0 and 1.
+type Weights struct {
+	Density float64 // matching lines per kilobyte, d/(d+1)
+	Name    float64 // 1 if the regexp matches the file's base name
+	Depth   float64 // 1/(1+n) for a file n directories deep
+	Recency float64 // 1/2 for each HalfLife since the file was modified
+}
+
+// DefaultWeights are the weights used by a Ranker with zero Weights.
+var DefaultWeights = Weights{
+	Density: 1,
+	Name:    1,
+	Depth:   0.25,
+	Recency: 0.5,
+}
+
+// DefaultHalfLife is the half-life used by a Ranker with zero HalfLife.
+const DefaultHalfLife = 30 * 24 * time.Hour
+
+// A Result is a scored file.
+type Result struct {
+	Name    string
+	Matches int // number of matching lines
+	Size    int64
+	ModTime time.Time
+	Score   float64
+}
+
+// A Ranker scores files by how well they match Regexp.
+type Ranker struct {
+	Regexp   *regexp.Regexp
+	Weights  Weights       // if zero, DefaultWeights
+	HalfLife time.Duration // if zero, DefaultHalfLife
+	Now      time.Time     // time for recency; if zero, time.Now()
+
+	grep regexp.Grep
+}
+
+// Score reads the named file and returns its score.
+// A file without matches scores 0.
+func (r *Ranker) Score(name string) (Result, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return Result{}, err
+	}
+	r.grep.Regexp = r.Regexp
+	r.grep.Total = true
+	r.grep.Stdout = io.Discard
+	r.grep.Stderr = io.Discard
+	r.grep.Count = 0
+	r.grep.Reader(f, name)
+	res := Result{
+		Name:    name,
+		Matches: r.grep.Count,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if res.Matches > 0 {
+		res.Score = r.score(res)
+	}
+	return res, nil
+}
+
+func (r *Ranker) score(res Result) float64 {
+	w := r.Weights
+	if w == (Weights{}) {
+		w = DefaultWeights
+	}
+	halfLife := r.HalfLife
+	if halfLife == 0 {
+		halfLife = DefaultHalfLife
+	}
+	now := r.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	kb := math.Max(1, float64(res.Size)/1024)
+	d := float64(res.Matches) / kb
+	score := w.Density * d / (d + 1)
+	if r.Regexp.MatchString(filepath.Base(res.Name), true, true) >= 0 {
+		score += w.Name
+	}
+	depth := strings.Count(filepath.ToSlash(filepath.Clean(res.Name)), "/")
+	score += w.Depth / float64(1+depth)
+	if age := now.Sub(res.ModTime); age > 0 {
+		score += w.Recency * math.Exp2(-float64(age)/float64(halfLife))
+	} else {
+		score += w.Recency
+	}
+	return score
+}
+
+// Top scores the named files and returns the k with the highest scores,
+// best first. Files without matches and files that cannot be read are
+// left out. Files with equal scores are ordered by name.
+func (r *Ranker) Top(names []string, k int) []Result {
+	if k <= 0 {
+		return nil
+	}
+	var h resultHeap
+	for _, name := range names {
+		res, err := r.Score(name)
+		if err != nil || res.Matches == 0 {
+			continue
+		}
+		if len(h) < k {
+			heap.Push(&h, res)
+		} else if better(res, h[0]) {
+			h[0] = res
+			heap.Fix(&h, 0)
+		}
+	}
+	top := make([]Result, len(h))
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(&h).(Result)
+	}
+	return top
+}
+
+// better reports whether a ranks before b.
+func better(a, b Result) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.Name < b.Name
+}
+
+// A resultHeap is a min-heap of results, worst first.
+type resultHeap []Result
+
+func (h resultHeap) Len() int           { return len(h) }
+func (h resultHeap) Less(i, j int) bool { return better(h[j], h[i]) }
+func (h resultHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *resultHeap) Push(x any)        { *h = append(*h, x.(Result)) }
+
+func (h *resultHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
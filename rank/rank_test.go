@@ -0,0 +1,69 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rank
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewarchi/codesearch/regexp"
+)
+
+func TestTop(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []struct {
+		name    string
+		data    string
+		modTime time.Time
+	}{
+		{"sparse.txt", "foo\n" + strings.Repeat("filler line\n", 1000), now},
+		{"foo.txt", "foo\n", now},
+		{"dense.txt", "foo\nfoo\nfoo\n", now},
+		{"old.txt", "foo\nfoo\nfoo\n", now.Add(-365 * 24 * time.Hour)},
+		{"none.txt", "bar\n", now},
+	}
+	var names []string
+	for _, f := range files {
+		name := filepath.Join(dir, f.name)
+		if err := os.WriteFile(name, []byte(f.data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	names = append(names, filepath.Join(dir, "missing.txt"))
+
+	re, err := regexp.Compile("(?m)foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Ranker{Regexp: re, Now: now}
+	want := []string{"foo.txt", "dense.txt", "old.txt", "sparse.txt"}
+	for k := 0; k <= len(want)+1; k++ {
+		top := r.Top(names, k)
+		var got []string
+		for _, res := range top {
+			got = append(got, filepath.Base(res.Name))
+		}
+		w := want[:min(k, len(want))]
+		if strings.Join(got, " ") != strings.Join(w, " ") {
+			t.Errorf("Top(%d) = %v, want %v", k, got, w)
+		}
+	}
+
+	res, err := r.Score(filepath.Join(dir, "dense.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Matches != 3 || res.Size != 12 || !res.ModTime.Equal(now) {
+		t.Errorf("Score(dense.txt) = %+v", res)
+	}
+}
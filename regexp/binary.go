@@ -0,0 +1,86 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regexp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// A BinaryFiles is a policy for searching binary files, which Grep
+// recognizes by a NUL byte in their first binarySniffLen bytes.
+type BinaryFiles int
+
+const (
+	// BinaryReport searches binary files, but instead of printing
+	// their matching lines, prints "Binary file NAME matches".
+	// Output that does not print lines, such as with L or C, is
+	// unaffected.
+	BinaryReport BinaryFiles = iota
+
+	// BinarySkip treats binary files as not matching.
+	BinarySkip
+
+	// BinaryText searches binary files like any other files.
+	BinaryText
+)
+
+// binarySniffLen is the length of the prefix of a file that Grep
+// examines to decide whether it is binary.
+const binarySniffLen = 32 << 10
+
+var binaryNames = []string{
+	BinaryReport: "binary",
+	BinarySkip:   "without-match",
+	BinaryText:   "text",
+}
+
+// String returns the name of the policy, as used by grep's
+// --binary-files flag: binary, without-match, or text.
+func (b BinaryFiles) String() string {
+	if b < 0 || int(b) >= len(binaryNames) {
+		return fmt.Sprintf("BinaryFiles(%d)", int(b))
+	}
+	return binaryNames[b]
+}
+
+// Set sets the policy from its name, for use as a flag.Value.
+func (b *BinaryFiles) Set(s string) error {
+	for i, name := range binaryNames {
+		if s == name {
+			*b = BinaryFiles(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown binary files policy %q; want binary, without-match, or text", s)
+}
+
+// A binaryFlag is a boolean flag setting a BinaryFiles policy,
+// like grep's -a and -I.
+type binaryFlag struct {
+	b      *BinaryFiles
+	policy BinaryFiles
+}
+
+func (f binaryFlag) IsBoolFlag() bool { return true }
+
+func (f binaryFlag) String() string {
+	return "false"
+}
+
+func (f binaryFlag) Set(s string) error {
+	if s == "true" {
+		*f.b = f.policy
+	}
+	return nil
+}
+
+// isBinary reports whether data, the start of a file, looks binary.
+func isBinary(data []byte) bool {
+	if len(data) > binarySniffLen {
+		data = data[:binarySniffLen]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
@@ -7,14 +7,21 @@ package regexp
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"regexp/syntax"
 	"sort"
+	"strconv"
+	"text/template"
+	"unicode/utf8"
 
+	"github.com/andrewarchi/codesearch/charset"
+	"github.com/andrewarchi/codesearch/norm"
 	"github.com/andrewarchi/codesearch/sparse"
+	"github.com/andrewarchi/codesearch/trace"
 )
 
 // A matcher holds the state for running regular expression search.
@@ -354,26 +361,224 @@ type Grep struct {
 	Stdout io.Writer // output target
 	Stderr io.Writer // error target
 
-	L bool // L flag - print file names only
-	C bool // C flag - print count of matches
-	N bool // N flag - print line numbers
-	H bool // H flag - do not print file names
-	Z bool // Z flag - delimit file names with NUL instead of LF
+	L     bool // L flag - print file names only
+	C     bool // C flag - print count of matches
+	Total bool // total flag - count matches, for printing Count at the end
+	N     bool // N flag - print line numbers
+	B     bool // B flag - print the byte offset of each matching line
+	V     bool // V flag - select the lines that do not match
+	Q     bool // Q flag - print nothing, and stop at the first match
+	H     bool // H flag - do not print file names
+	Z     bool // Z flag - terminate file names with NUL in L and C output
+
+	// AllOf, if non-empty, restricts the search to files with a match
+	// of each of these regexps, which are read in full to check them
+	// before any of their lines are printed.
+	AllOf []*Regexp
+
+	// SameLine, if non-empty, restricts the lines selected to those
+	// matching each of these regexps as well as Regexp, in any order.
+	// With V, the lines not matching them all are selected.
+	SameLine []*Regexp
+
+	// BinaryFiles says how to search binary files.
+	BinaryFiles BinaryFiles
+
+	// Encoding is the encoding of the files searched, which are decoded
+	// to UTF-8 before matching. The default, charset.Auto, detects the
+	// encoding of each file as index.Writer does, by charset.Sniff.
+	Encoding charset.Encoding
+
+	// Normalize is the Unicode normalization applied to the files
+	// searched, after decoding, before matching. The regexp should be
+	// compiled from a pattern normalized the same way.
+	Normalize norm.Mode
+
+	// Gunzip causes files compressed with gzip, as recognized by their
+	// magic number, to be decompressed before decoding, as zgrep does.
+	// Byte offsets count bytes of the decompressed text.
+	Gunzip bool
+
+	// Heading causes matching lines to be grouped under a heading line
+	// naming their file, with line numbers and a blank line between files.
+	Heading bool
+
+	Label string // if non-empty, printed with a colon before each file name
+
+	// Truncate, if positive, is the most bytes of each matching line
+	// printed: a longer line is cut down to about that many bytes around
+	// the start of the match, with "..." marking the text left out, so
+	// that a match in minified code does not flood the output. The lines
+	// passed to Func or printed by JSON and Format are not truncated.
+	Truncate int
+
+	// JSON causes each matching line to be printed as a Match
+	// encoded as a JSON object, one per line.
+	JSON bool
+
+	// Vimgrep causes each match to be printed on a line of its own
+	// as path:line:column:text, where column is the byte offset of
+	// the match in the line, counting from 1, as Vim's :vimgrep and
+	// ripgrep --vimgrep print it. The label, if any, is left out, since
+	// it would make the path unusable. This format is stable.
+	Vimgrep bool
+
+	// Format, if non-nil, is executed with each matching line,
+	// as a *Match, to print it, followed by a newline.
+	Format *template.Template
+
+	// Func, if non-nil, is called with each matching line
+	// instead of printing it.
+	Func func(*Match)
+
+	// Trace, if non-nil, is the span under which each file searched
+	// is traced, with the number of bytes read from it.
+	Trace trace.Span
 
 	Match bool
+	Count int // number of matching lines counted with C or Total
 
-	buf []byte
+	buf    []byte
+	headed bool // whether a heading has been printed
+}
+
+// A Match describes a matching line, as passed to Grep.Func
+// or printed by Grep.JSON and Grep.Format.
+//
+// Spans and Groups locate text in the line both by byte offsets and by
+// columns counting runes, so that editors can highlight exactly the
+// text matched. The JSON encoding of a Match is stable: later versions
+// may add fields but will not rename, remove, or reinterpret these.
+type Match struct {
+	Path   string  `json:"path"`
+	Label  string  `json:"label,omitempty"`
+	Line   int     `json:"line"`             // line number, counting from 1
+	Offset int64   `json:"offset"`           // byte offset of the start of the line
+	Text   string  `json:"text"`             // the line, without its newline
+	Binary bool    `json:"binary,omitempty"` // the file is binary; Text is empty
+	Spans  []Span  `json:"spans,omitempty"`  // matches of the regexp in Text; none with V
+	Groups []Group `json:"groups,omitempty"` // named capture groups of the first match in Text
 }
 
 func (g *Grep) AddFlags() {
 	flag.BoolVar(&g.L, "l", false, "list matching files only")
 	flag.BoolVar(&g.C, "c", false, "print match counts only")
+	flag.BoolVar(&g.Total, "total", false, "print the total match count")
 	flag.BoolVar(&g.N, "n", false, "show line numbers")
+	flag.BoolVar(&g.B, "b", false, "show the byte offset of each matching line")
+	flag.BoolVar(&g.V, "v", false, "select non-matching lines")
+	flag.BoolVar(&g.Q, "q", false, "print nothing; exit 0 at the first match")
 	flag.BoolVar(&g.H, "h", false, "omit file names")
 	flag.BoolVar(&g.Z, "0", false, "null delimit file names")
+	flag.BoolVar(&g.Z, "null", false, "null delimit file names (same as -0)")
+	flag.Var(&g.BinaryFiles, "binary-files", "search binary files as `type` binary, without-match, or text")
+	flag.Var(binaryFlag{&g.BinaryFiles, BinaryText}, "a", "search binary files as text")
+	flag.Var(binaryFlag{&g.BinaryFiles, BinarySkip}, "I", "skip binary files")
+	flag.Var(&g.Encoding, "encoding", "decode files from `enc` auto, utf-8, utf-16, utf-16le, utf-16be, latin1, or windows-1252")
+	flag.BoolVar(&g.JSON, "json", false, "print each matching line as a JSON object")
+	flag.BoolVar(&g.Vimgrep, "vimgrep", false, "print each match as path:line:column:text")
+	flag.Var(formatFlag{&g.Format}, "format", "print each matching line using the Go template `tmpl`, applied to a Match")
+	flag.BoolVar(&g.Heading, "heading", false, "group matches under a heading for each file (default true on a terminal)")
+	flag.IntVar(&g.Truncate, "truncate", 0, "print at most about `n` bytes of each matching line, around the match")
+}
+
+// A formatFlag is a flag parsing a Grep.Format template.
+type formatFlag struct {
+	t **template.Template
+}
+
+func (f formatFlag) String() string {
+	if f.t == nil || *f.t == nil {
+		return ""
+	}
+	return (*f.t).Root.String()
+}
+
+func (f formatFlag) Set(s string) error {
+	t, err := template.New("format").Parse(s)
+	if err != nil {
+		return err
+	}
+	*f.t = t
+	return nil
+}
+
+// truncate returns line, a line to print, cut down to g.Truncate bytes
+// around the start of the match, not counting its newline, and marked
+// with "..." where text was left out. A line that fits is returned as
+// is; one that is cut loses its newline.
+func (g *Grep) truncate(line []byte) []byte {
+	text := bytes.TrimSuffix(line, nl)
+	if len(text) <= g.Truncate {
+		return line
+	}
+	start := 0
+	if !g.V {
+		if loc := g.Regexp.matchIndex(text); loc != nil {
+			// Show a little of the text before the match.
+			start = min(max(loc[0]-g.Truncate/4, 0), len(text)-g.Truncate)
+		}
+	}
+	end := start + g.Truncate
+	for start > 0 && start < end && !utf8.RuneStart(text[start]) {
+		start++
+	}
+	for end < len(text) && end > start && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	var b []byte
+	if start > 0 {
+		b = append(b, "..."...)
+	}
+	b = append(b, text[start:end]...)
+	if end < len(text) {
+		b = append(b, "..."...)
+	}
+	return b
+}
+
+// emitMatch passes m to g.Func, or prints it using g.Format, for
+// g.Vimgrep, or as JSON.
+func (g *Grep) emitMatch(m *Match) {
+	if g.Func != nil {
+		g.Func(m)
+		return
+	}
+	if g.Format != nil {
+		var b bytes.Buffer
+		if err := g.Format.Execute(&b, m); err != nil {
+			fmt.Fprintf(g.Stderr, "%s: %v\n", m.Path, err)
+			return
+		}
+		b.WriteByte('\n')
+		g.Stdout.Write(b.Bytes())
+		return
+	}
+	if g.Vimgrep {
+		switch {
+		case m.Binary:
+			fmt.Fprintf(g.Stdout, "Binary file %s matches\n", m.Path)
+		case len(m.Spans) == 0:
+			// A line not matching, selected by V.
+			fmt.Fprintf(g.Stdout, "%s:%d:1:%s\n", m.Path, m.Line, m.Text)
+		}
+		for _, s := range m.Spans {
+			fmt.Fprintf(g.Stdout, "%s:%d:%d:%s\n", m.Path, m.Line, s.Start+1, m.Text)
+		}
+		return
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		fmt.Fprintf(g.Stderr, "%s: %v\n", m.Path, err)
+		return
+	}
+	g.Stdout.Write(append(b, '\n'))
 }
 
 func (g *Grep) File(name string) {
+	if g.Q && g.Match {
+		return
+	}
 	f, err := os.Open(name)
 	if err != nil {
 		fmt.Fprintf(g.Stderr, "%s\n", err)
@@ -383,8 +588,117 @@ func (g *Grep) File(name string) {
 	g.Reader(f, name)
 }
 
+// Parallel calls search(c, i) for each i in [0, count), where c is a
+// copy of g with its own regexps and its own output buffers, running up
+// to n calls at once. It prints the output of the calls in order and
+// accumulates their Match and Count in g, so that the result is as if
+// search(g, i) had been called for each i in turn. Parallel makes the
+// calls one at a time, with g itself, if n is 1 or less, or if g.Q or
+// g.Func is set, since those depend on the order of the matches.
+func (g *Grep) Parallel(n, count int, search func(g *Grep, i int)) {
+	if n <= 1 || g.Q || g.Func != nil {
+		for i := 0; i < count; i++ {
+			search(g, i)
+		}
+		return
+	}
+	base := *g
+	base.Match, base.Count = false, 0
+	base.buf, base.headed = nil, false
+
+	type result struct {
+		out, err bytes.Buffer
+		g        Grep
+	}
+	done := make([]chan *result, count)
+	for i := range done {
+		done[i] = make(chan *result, 1)
+	}
+	// The results buffered, waiting to be printed, and the searches in
+	// progress together number at most n.
+	slots := make(chan bool, n)
+	next := make(chan int)
+	go func() {
+		for i := 0; i < count; i++ {
+			slots <- true
+			next <- i
+		}
+		close(next)
+	}()
+	for w := 0; w < min(n, count); w++ {
+		wg := base.clone()
+		go func() {
+			for i := range next {
+				r := new(result)
+				r.g = *wg
+				r.g.Stdout, r.g.Stderr = &r.out, &r.err
+				search(&r.g, i)
+				wg.buf = r.g.buf
+				done[i] <- r
+			}
+		}()
+	}
+	for _, c := range done {
+		r := <-c
+		<-slots
+		if r.g.headed && g.headed {
+			fmt.Fprintf(g.Stdout, "\n")
+		}
+		g.Stdout.Write(r.out.Bytes())
+		g.Stderr.Write(r.err.Bytes())
+		g.Match = g.Match || r.g.Match
+		g.Count += r.g.Count
+		g.headed = g.headed || r.g.headed
+	}
+}
+
+// clone returns a copy of g with copies of its regexps, for use by
+// another goroutine.
+func (g *Grep) clone() *Grep {
+	c := *g
+	if g.Regexp != nil {
+		c.Regexp = g.Regexp.clone()
+	}
+	c.AllOf = cloneAll(g.AllOf)
+	c.SameLine = cloneAll(g.SameLine)
+	return &c
+}
+
+func cloneAll(res []*Regexp) []*Regexp {
+	if res == nil {
+		return nil
+	}
+	c := make([]*Regexp, len(res))
+	for i, re := range res {
+		c[i] = re.clone()
+	}
+	return c
+}
+
 var nl = []byte{'\n'}
 
+// matchSameLine reports whether line matches each of g.SameLine.
+func (g *Grep) matchSameLine(line []byte) bool {
+	for _, re := range g.SameLine {
+		if re.Match(line, true, true) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// A countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
 func countNL(b []byte) int {
 	n := 0
 	for {
@@ -399,24 +713,168 @@ func countNL(b []byte) int {
 }
 
 func (g *Grep) Reader(r io.Reader, name string) {
+	if g.Q && g.Match {
+		// Quiet: the answer is already known.
+		return
+	}
+	if g.Trace != nil {
+		span := g.Trace.Start("grep")
+		span.SetAttr("path", name)
+		cr := &countReader{r: r}
+		r = cr
+		defer func() {
+			span.SetAttr("bytes", cr.n)
+			span.End()
+		}()
+	}
+	if g.Gunzip {
+		var err error
+		if r, _, err = charset.Gunzip(r); err != nil {
+			fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
+			return
+		}
+	}
+	r, err := charset.NewReader(r, g.Encoding)
+	if err != nil {
+		fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
+		return
+	}
+	r = norm.NewReader(r, g.Normalize)
+	if len(g.AllOf) > 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			fmt.Fprintf(g.Stderr, "%s: %v\n", name, err)
+			return
+		}
+		for _, re := range g.AllOf {
+			if re.Match(data, true, true) < 0 {
+				return
+			}
+		}
+		r = bytes.NewReader(data)
+	}
 	if g.buf == nil {
 		g.buf = make([]byte, 1<<20)
 	}
+	counting := g.C || g.Total
+	structured := g.JSON || g.Vimgrep || g.Format != nil || g.Func != nil
 	var (
+		path        = name
 		buf         = g.buf[:0]
-		needLineNum = g.N
+		needLineNum = (g.N || structured) && !counting
 		lineNum     = 1
+		offset      int64 // offset of buf in the input
 		count       = 0
 		prefix      = ""
 		beginText   = true
 		endText     = false
+		binary      = false // report binary file matches without printing lines
 	)
+	if g.Label != "" {
+		name = g.Label + ":" + name
+		prefix = g.Label + ":"
+	}
 	if !g.H {
 		prefix = name + ":"
 	}
+	heading := g.Heading && !g.H && !g.L && !counting && !structured
+	if heading {
+		prefix = ""
+		needLineNum = true
+	}
+	// emit prints or counts the line buf[lineStart:lineEnd], which is
+	// line number lineNum, and reports whether to stop reading, as when
+	// only the file name is wanted.
+	emit := func(lineStart, lineEnd int) bool {
+		g.Match = true
+		if g.Q {
+			return true
+		}
+		if g.L {
+			if g.Z {
+				fmt.Fprintf(g.Stdout, "%s\x00", name)
+			} else {
+				fmt.Fprintf(g.Stdout, "%s\n", name)
+			}
+			return true
+		}
+		if counting {
+			count++
+			return false
+		}
+		if structured {
+			m := &Match{
+				Path:   path,
+				Label:  g.Label,
+				Line:   lineNum,
+				Offset: offset + int64(lineStart),
+				Binary: binary,
+			}
+			if !binary {
+				line := bytes.TrimSuffix(buf[lineStart:lineEnd], nl)
+				m.Text = string(line)
+				if !g.V {
+					m.Spans = g.Regexp.spans(line)
+					m.Groups = g.Regexp.groups(line)
+				}
+			}
+			g.emitMatch(m)
+			return binary
+		}
+		if binary {
+			fmt.Fprintf(g.Stdout, "Binary file %s matches\n", name)
+			return true
+		}
+		line := buf[lineStart:lineEnd]
+		if g.Truncate > 0 {
+			line = g.truncate(line)
+		}
+		nl := ""
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			nl = "\n"
+		}
+		if heading {
+			if g.headed {
+				fmt.Fprintf(g.Stdout, "\n")
+			}
+			fmt.Fprintf(g.Stdout, "%s\n", name)
+			g.headed = true
+			heading = false
+		}
+		pos := ""
+		if needLineNum {
+			pos = strconv.Itoa(lineNum) + ":"
+		}
+		if g.B {
+			pos += strconv.FormatInt(offset+int64(lineStart), 10) + ":"
+		}
+		fmt.Fprintf(g.Stdout, "%s%s%s%s", prefix, pos, line, nl)
+		return false
+	}
+	// emitLines emits each of the lines in buf[start:end], for -v.
+	emitLines := func(start, end int) bool {
+		for start < end {
+			lineEnd := end
+			if i := bytes.IndexByte(buf[start:end], '\n'); i >= 0 {
+				lineEnd = start + i + 1
+			}
+			if emit(start, lineEnd) {
+				return true
+			}
+			lineNum++
+			start = lineEnd
+		}
+		return false
+	}
 	for {
 		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
 		buf = buf[:len(buf)+n]
+		if offset == 0 && g.BinaryFiles != BinaryText && isBinary(buf) {
+			if g.BinaryFiles == BinarySkip {
+				return
+			}
+			binary = true
+		}
 		end := len(buf)
 		if err == nil {
 			i := bytes.LastIndex(buf, nl)
@@ -433,44 +891,60 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			if m1 < chunkStart {
 				break
 			}
-			g.Match = true
-			if g.L {
-				if g.Z {
-					fmt.Fprintf(g.Stdout, "%s\x00", name)
-				} else {
-					fmt.Fprintf(g.Stdout, "%s\n", name)
-				}
-				return
-			}
-			lineStart := bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
 			lineEnd := m1 + 1
 			if lineEnd > end {
 				lineEnd = end
 			}
+			if len(g.SameLine) > 0 {
+				lineStart := bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
+				if !g.matchSameLine(buf[lineStart:lineEnd]) {
+					// Not a match after all.
+					if g.V {
+						if emitLines(chunkStart, lineEnd) {
+							return
+						}
+					} else if needLineNum {
+						lineNum += countNL(buf[chunkStart:lineEnd])
+					}
+					chunkStart = lineEnd
+					continue
+				}
+			}
+			if counting && !g.V && !g.L && !g.Q {
+				g.Match = true
+				count++
+				chunkStart = lineEnd
+				continue
+			}
+			lineStart := bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
+			if g.V {
+				// Emit the lines before the match and skip the matching line.
+				if emitLines(chunkStart, lineStart) {
+					return
+				}
+				lineNum++
+				chunkStart = lineEnd
+				continue
+			}
 			if needLineNum {
 				lineNum += countNL(buf[chunkStart:lineStart])
 			}
-			line := buf[lineStart:lineEnd]
-			nl := ""
-			if len(line) == 0 || line[len(line)-1] != '\n' {
-				nl = "\n"
-			}
-			switch {
-			case g.C:
-				count++
-			case g.N:
-				fmt.Fprintf(g.Stdout, "%s%d:%s%s", prefix, lineNum, line, nl)
-			default:
-				fmt.Fprintf(g.Stdout, "%s%s%s", prefix, line, nl)
+			if emit(lineStart, lineEnd) {
+				return
 			}
 			if needLineNum {
 				lineNum++
 			}
 			chunkStart = lineEnd
 		}
-		if needLineNum && err == nil {
+		if g.V {
+			if emitLines(chunkStart, end) {
+				return
+			}
+		} else if needLineNum && err == nil {
 			lineNum += countNL(buf[chunkStart:end])
 		}
+		offset += int64(end)
 		n = copy(buf, buf[end:])
 		buf = buf[:n]
 		if len(buf) == 0 && err != nil {
@@ -480,7 +954,12 @@ func (g *Grep) Reader(r io.Reader, name string) {
 			break
 		}
 	}
-	if g.C && count > 0 {
-		fmt.Fprintf(g.Stdout, "%s: %d\n", name, count)
+	g.Count += count
+	if g.C && count > 0 && !g.Q {
+		if g.Z && !g.H {
+			// The name ends in NUL rather than a colon.
+			prefix = name + "\x00"
+		}
+		fmt.Fprintf(g.Stdout, "%s%d\n", prefix, count)
 	}
 }
@@ -6,7 +6,12 @@
 // use in grep-like programs.
 package regexp
 
-import "regexp/syntax"
+import (
+	stdregexp "regexp"
+	"regexp/syntax"
+	"sync"
+	"unicode/utf8"
+)
 
 func bug() {
 	panic("codesearch/regexp: internal error")
@@ -18,6 +23,10 @@ type Regexp struct {
 	Syntax *syntax.Regexp
 	expr   string // original expression
 	m      matcher
+
+	named   bool              // whether the regexp has named capture groups
+	std     *stdregexp.Regexp // for locating matches and their groups, once needed
+	stdOnce sync.Once         // sets std
 }
 
 // String returns the source text used to compile the regular expression.
@@ -39,6 +48,27 @@ func CompileFlags(expr string, flags syntax.Flags) (*Regexp, error) {
 	if err != nil {
 		return nil, err
 	}
+	return compile(re, expr)
+}
+
+// CompileSyntax returns a Regexp matching the parsed regular
+// expression re, for programs that already parse regular expressions
+// with package regexp/syntax. The Regexp's String method returns
+// re.String().
+func CompileSyntax(re *syntax.Regexp) (*Regexp, error) {
+	return compile(re, re.String())
+}
+
+// clone returns a copy of re with its own matching state.
+func (re *Regexp) clone() *Regexp {
+	c, err := compile(re.Syntax, re.expr)
+	if err != nil {
+		bug()
+	}
+	return c
+}
+
+func compile(re *syntax.Regexp, expr string) (*Regexp, error) {
 	sre := re.Simplify()
 	prog, err := syntax.Compile(sre)
 	if err != nil {
@@ -50,6 +80,7 @@ func CompileFlags(expr string, flags syntax.Flags) (*Regexp, error) {
 	r := &Regexp{
 		Syntax: re,
 		expr:   expr,
+		named:  hasNamedGroup(re),
 	}
 	if err := r.m.init(prog); err != nil {
 		return nil, err
@@ -64,3 +95,109 @@ func (r *Regexp) Match(b []byte, beginText, endText bool) (end int) {
 func (r *Regexp) MatchString(s string, beginText, endText bool) (end int) {
 	return r.m.matchString(s, beginText, endText)
 }
+
+// A Group is the text matched by a named capture group, (?P<name>re),
+// in a Match.
+type Group struct {
+	Name        string `json:"name"`
+	Text        string `json:"text"`
+	Start       int    `json:"start"`        // byte offset of Text in the line, or -1 if the group matched nothing
+	End         int    `json:"end"`          // byte offset of the end of Text in the line, or -1
+	StartColumn int    `json:"start_column"` // offset of Text in the line in runes, or -1
+	EndColumn   int    `json:"end_column"`   // offset of the end of Text in the line in runes, or -1
+}
+
+// A Span is a match of the regexp in the line of a Match.
+type Span struct {
+	Text        string `json:"text"`
+	Start       int    `json:"start"`        // byte offset of Text in the line
+	End         int    `json:"end"`          // byte offset of the end of Text in the line
+	StartColumn int    `json:"start_column"` // offset of Text in the line in runes
+	EndColumn   int    `json:"end_column"`   // offset of the end of Text in the line in runes
+}
+
+// spans returns the matches of r in line, leftmost first, as the
+// standard library's regexp package finds them.
+func (r *Regexp) spans(line []byte) []Span {
+	std := r.stdRegexp()
+	if std == nil {
+		return nil
+	}
+	var spans []Span
+	for _, m := range std.FindAllIndex(line, -1) {
+		spans = append(spans, Span{
+			Text:        string(line[m[0]:m[1]]),
+			Start:       m[0],
+			End:         m[1],
+			StartColumn: utf8.RuneCount(line[:m[0]]),
+			EndColumn:   utf8.RuneCount(line[:m[1]]),
+		})
+	}
+	return spans
+}
+
+// groups returns the named capture groups of the leftmost match of r
+// in line, or nil if r has none or does not match line by itself.
+// The matcher finds only where matches end, so the groups come from
+// the standard library's regexp package instead, run only on the
+// lines already known to match.
+func (r *Regexp) groups(line []byte) []Group {
+	if !r.named {
+		return nil
+	}
+	std := r.stdRegexp()
+	if std == nil {
+		return nil
+	}
+	m := std.FindSubmatchIndex(line)
+	if m == nil {
+		return nil
+	}
+	var groups []Group
+	for i, name := range std.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		g := Group{Name: name, Start: m[2*i], End: m[2*i+1], StartColumn: -1, EndColumn: -1}
+		if g.Start >= 0 {
+			g.Text = string(line[g.Start:g.End])
+			g.StartColumn = utf8.RuneCount(line[:g.Start])
+			g.EndColumn = utf8.RuneCount(line[:g.End])
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// matchIndex returns the start and end of the leftmost match of r in
+// line, as groups finds it, or nil if r does not match line by itself.
+func (r *Regexp) matchIndex(line []byte) []int {
+	std := r.stdRegexp()
+	if std == nil {
+		return nil
+	}
+	return std.FindIndex(line)
+}
+
+// stdRegexp returns r compiled by the standard library's regexp
+// package, compiling it on first use, or nil if that fails. Unlike the
+// rest of r, it is safe to call from several goroutines at once.
+func (r *Regexp) stdRegexp() *stdregexp.Regexp {
+	r.stdOnce.Do(func() {
+		r.std, _ = stdregexp.Compile(r.Syntax.String())
+	})
+	return r.std
+}
+
+// hasNamedGroup reports whether re has a named capture group.
+func hasNamedGroup(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpCapture && re.Name != "" {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasNamedGroup(sub) {
+			return true
+		}
+	}
+	return false
+}
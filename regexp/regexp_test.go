@@ -6,9 +6,16 @@ package regexp
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"reflect"
+	"regexp/syntax"
 	"strings"
 	"testing"
+	"text/template"
+
+	"github.com/andrewarchi/codesearch/charset"
+	"github.com/andrewarchi/codesearch/norm"
 )
 
 var nstateTests = []struct {
@@ -119,6 +126,10 @@ var matchTests = []struct {
 	{`\B`, "xx yy", []int{1}},
 	{`(?im)^[abc]+$`, "abcABC", []int{1}},
 	{`(?im)^[α]+$`, "αΑ", []int{1}},
+	{`(?i)kelvin`, "\u212aelvin", []int{1}},
+	{`(?i)\x{212a}elvin`, "KELVIN", []int{1}},
+	{`(?i)σας`, "ΣΑΣ", []int{1}},
+	{`(?i)caf[é]`, "CAFÉ", []int{1}},
 	{`[Aa]BC`, "abc", nil},
 	{`[Aa]bc`, "abc", []int{1}},
 
@@ -162,6 +173,23 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+func TestCompileSyntax(t *testing.T) {
+	for _, tt := range matchTests {
+		sre, err := syntax.Parse("(?m)"+tt.re, syntax.Perl)
+		if err != nil {
+			continue
+		}
+		re, err := CompileSyntax(sre)
+		if err != nil {
+			t.Errorf("CompileSyntax(%#q): %v", tt.re, err)
+			continue
+		}
+		if lines := grep(re, []byte(tt.s)); !reflect.DeepEqual(lines, tt.m) {
+			t.Errorf("grep(%#q, %q) = %v, want %v", tt.re, tt.s, lines, tt.m)
+		}
+	}
+}
+
 func grep(re *Regexp, b []byte) []int {
 	var m []int
 	lineno := 1
@@ -189,16 +217,70 @@ func grep(re *Regexp, b []byte) []int {
 }
 
 var grepTests = []struct {
-	re  string
-	s   string
-	out string
-	err string
-	g   Grep
+	re    string
+	s     string
+	out   string
+	err   string
+	g     Grep
+	count int
 }{
 	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input:abc\ninput:ghalloo\n"},
 	{re: `x.*y`, s: "xay\nxa\ny\n", out: "input:xay\n"},
+	{re: `a+`, s: "abc\ndef\n", out: "ix:input:abc\n", g: Grep{Label: "ix"}},
+	{re: `a+`, s: "abc\ndef\n", out: "ix:abc\n", g: Grep{Label: "ix", H: true}},
+	{re: `a+`, s: "abc\ndef\n", out: "ix:input\n", g: Grep{Label: "ix", L: true}},
+	{re: `a`, s: "abc\nxyz\naaa\n", out: "input:2\n", g: Grep{C: true}, count: 2},
+	{re: `a`, s: "abc\nxyz\naaa\n", out: "2\n", g: Grep{C: true, H: true}, count: 2},
+	{re: `a`, s: "abc\nxyz\naaa\n", out: "ix:input:2\n", g: Grep{C: true, Label: "ix"}, count: 2},
+	{re: `a`, s: "abc\nxyz\naaa\n", out: "", g: Grep{Total: true}, count: 2},
+	{re: `q`, s: "abc\nxyz\naaa\n", out: "", g: Grep{C: true}},
+	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input\n1:abc\n3:ghalloo\n", g: Grep{Heading: true}},
+	{re: `a+`, s: "abc\ndef\n", out: "ix:input\n1:abc\n", g: Grep{Heading: true, Label: "ix"}},
+	{re: `a+`, s: "abc\ndef\n", out: "abc\n", g: Grep{Heading: true, H: true}},
+	{re: `a+`, s: "abc\ndef\n", out: "input:1\n", g: Grep{Heading: true, C: true}, count: 1},
+	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input:0:abc\ninput:8:ghalloo\n", g: Grep{B: true}},
+	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input:1:0:abc\ninput:3:8:ghalloo\n", g: Grep{B: true, N: true}},
+	{re: `a+`, s: "abc\ndef\nghalloo\n", out: "input\n1:0:abc\n3:8:ghalloo\n", g: Grep{B: true, Heading: true}},
+	{re: `é`, s: "abc\nxyz\nthé", out: "8:thé\n", g: Grep{B: true, H: true}},
+	{re: `a+`, s: "abc\ndef\nghalloo\nxyz", out: "input:def\ninput:xyz\n", g: Grep{V: true}},
+	{re: `a+`, s: "abc\ndef\nghalloo\nxyz\n", out: "2:4:def\n4:16:xyz\n", g: Grep{V: true, N: true, B: true, H: true}},
+	{re: `a+`, s: "abc\ndef\nghalloo\nxyz\n", out: "input:2\n", g: Grep{V: true, C: true}, count: 2},
+	{re: `a+`, s: "abc\ndef\n", out: "input\n", g: Grep{V: true, L: true}},
+	{re: `.`, s: "abc\ndef\n", out: "", g: Grep{V: true, L: true}},
+	{re: `a+`, s: "\nabc\n\n", out: "input\n1:\n3:\n", g: Grep{V: true, Heading: true}},
+	{re: `a+`, s: "abc\ndef\n", out: "", g: Grep{Q: true}},
+	{re: `a+`, s: "abc\ndef\n", out: "input\x00", g: Grep{L: true, Z: true}},
+	{re: `a`, s: "abc\nxyz\naaa\n", out: "input\x002\n", g: Grep{C: true, Z: true}, count: 2},
+	{re: `a`, s: "abc\nxyz\naaa\n", out: "ix:input\x002\n", g: Grep{C: true, Z: true, Label: "ix"}, count: 2},
+	{re: `a`, s: "abc\nxyz\naaa\n", out: "2\n", g: Grep{C: true, Z: true, H: true}, count: 2},
+	{re: `a+`, s: "abc\x00\ndef\n", out: "Binary file input matches\n"},
+	{re: `a+`, s: "abc\x00\ndef\n", out: "Binary file ix:input matches\n", g: Grep{Label: "ix", Heading: true}},
+	{re: `a+`, s: "abc\x00\ndef\n", out: "input\n", g: Grep{L: true}},
+	{re: `a+`, s: "abc\x00\naaa\n", out: "input:2\n", g: Grep{C: true}, count: 2},
+	{re: `q`, s: "abc\x00\ndef\n", out: ""},
+	{re: `a+`, s: "abc\x00\ndef\n", out: "", g: Grep{BinaryFiles: BinarySkip}},
+	{re: `a+`, s: "abc\x00\ndef\n", out: "", g: Grep{BinaryFiles: BinarySkip, C: true}},
+	{re: `a+`, s: "abc\x00\ndef\n", out: "input:abc\x00\n", g: Grep{BinaryFiles: BinaryText}},
+	{re: `a+`, s: "abc\ndef\n", out: "", g: Grep{Q: true, C: true, L: true}},
+	{re: `é+`, s: "\xff\xfea\x00b\x00\n\x00\xe9\x00\n\x00", out: "input:é\n"},
+	{re: `é+`, s: "\xfe\xff\x00a\x00\n\x00\xe9\x00\n", out: "input:2:é\n", g: Grep{N: true}},
+	{re: `é+`, s: "\xef\xbb\xbfé\n", out: "input:0:é\n", g: Grep{B: true}},
+	{re: `é+`, s: "a\x00\xe9\x00", out: "input:aé\n", g: Grep{Encoding: charset.UTF16LE}},
+	{re: `é+`, s: "abc\nth\xe9\n", out: "input:thé\n", g: Grep{Encoding: charset.Latin1}},
+	{re: `é+`, s: "abc\nth\xe9\n", out: "", g: Grep{Encoding: charset.UTF8}},
+	{re: "caf\u00e9", s: "cafe\u0301\n", out: "", g: Grep{}},
+	{re: "caf\u00e9", s: "cafe\u0301\ncaf\u00e9\n", out: "input:caf\u00e9\ninput:caf\u00e9\n", g: Grep{Normalize: norm.NFC}},
+	{re: "cafe", s: "caf\u00e9\ncafe\u0301\n", out: "input:cafe\ninput:cafe\n", g: Grep{Normalize: norm.Strip}},
+	{re: `“q”`, s: "abc\n\x93q\x94\n", out: "input:“q”\n"},
+	{re: `d+`, s: gzipped, out: "input:4:def\n", g: Grep{Gunzip: true, B: true}},
+	{re: `d+`, s: gzipped, out: ""},
+	{re: `d+`, s: "abc\ndef\n", out: "input:def\n", g: Grep{Gunzip: true}},
+	{re: `d+`, s: gzipped[:20], out: "", err: "input: gzip: unexpected end of data\n", g: Grep{Gunzip: true}},
 }
 
+// gzipped is "abc\ndef\n" compressed with gzip.
+const gzipped = "\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\x03\x4b\x4c\x4a\xe6\x4a\x49\x4d\xe3\x02\x00\x75\x0b\xb0\x88\x08\x00\x00\x00"
+
 func TestGrep(t *testing.T) {
 	for i, tt := range grepTests {
 		re, err := Compile("(?m)" + tt.re)
@@ -215,5 +297,284 @@ func TestGrep(t *testing.T) {
 		if out.String() != tt.out || errb.String() != tt.err {
 			t.Errorf("#%d: grep(%#q, %q) = %q, %q, want %q, %q", i, tt.re, tt.s, out.String(), errb.String(), tt.out, tt.err)
 		}
+		if g.Count != tt.count {
+			t.Errorf("#%d: grep(%#q, %q) counted %d, want %d", i, tt.re, tt.s, g.Count, tt.count)
+		}
+	}
+}
+
+func TestGrepHeading(t *testing.T) {
+	re, err := Compile("(?m)a+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, Heading: true}
+	g.Reader(strings.NewReader("abc\n"), "f1")
+	g.Reader(strings.NewReader("xyz\n"), "f2")
+	g.Reader(strings.NewReader("xyz\nbca\n"), "f3")
+	want := "f1\n1:abc\n\nf3\n2:bca\n"
+	if out.String() != want {
+		t.Errorf("grep with headings = %q, want %q", out.String(), want)
+	}
+}
+
+func TestGrepParallel(t *testing.T) {
+	var names, texts []string
+	for i := 0; i < 100; i++ {
+		names = append(names, fmt.Sprintf("f%d", i))
+		texts = append(texts, strings.Repeat(fmt.Sprintf("line %d\n", i), i%7))
+	}
+	for _, tt := range []struct {
+		re   string
+		opts func(g *Grep)
+	}{
+		{`(?m)^line [0-9]*3$`, func(g *Grep) { g.N = true }},
+		{`(?m)^line [0-9]*3$`, func(g *Grep) { g.Heading = true }},
+		{`(?m)^line [0-9]*[39]$`, func(g *Grep) { g.C = true; g.Total = true }},
+		{`(?m)^line [0-9]*[39]$`, func(g *Grep) { g.L = true }},
+		{`(?m)^line 4$`, func(g *Grep) { g.V = true }},
+		{`(?m)nowhere`, func(g *Grep) {}},
+	} {
+		re, err := Compile(tt.re)
+		if err != nil {
+			t.Fatal(err)
+		}
+		grep := func(n int) (string, bool, int) {
+			var out bytes.Buffer
+			g := &Grep{Regexp: re, Stdout: &out, Stderr: &out}
+			tt.opts(g)
+			g.Parallel(n, len(names), func(g *Grep, i int) {
+				g.Reader(strings.NewReader(texts[i]), names[i])
+			})
+			return out.String(), g.Match, g.Count
+		}
+		out1, match1, count1 := grep(1)
+		for _, n := range []int{2, 8, 200} {
+			out, match, count := grep(n)
+			if out != out1 || match != match1 || count != count1 {
+				t.Errorf("%#q: Parallel(%d) = %q, %v, %d, want %q, %v, %d", tt.re, n, out, match, count, out1, match1, count1)
+			}
+		}
+	}
+}
+
+func TestGrepTruncate(t *testing.T) {
+	long := strings.Repeat("a", 50) + "needle" + strings.Repeat("b", 50)
+	for _, tt := range []struct {
+		re  string
+		s   string
+		g   Grep
+		out string
+	}{
+		{`needle`, "short needle\n", Grep{Truncate: 20}, "short needle\n"},
+		{`needle`, long + "\n", Grep{Truncate: 20}, "...aaaaaneedlebbbbbbbbb...\n"},
+		{`needle`, long, Grep{Truncate: 20, N: true}, "1:...aaaaaneedlebbbbbbbbb...\n"},
+		{`a+n`, long + "\n", Grep{Truncate: 20}, strings.Repeat("a", 20) + "...\n"},
+		{`b$`, long + "\n", Grep{Truncate: 20}, "..." + strings.Repeat("b", 20) + "\n"},
+		{`x`, long + "\n", Grep{Truncate: 20, V: true}, strings.Repeat("a", 20) + "...\n"},
+		{`é`, strings.Repeat("é", 30) + "\n", Grep{Truncate: 9}, "éééé...\n"},
+		{`needle`, long + "\n", Grep{Truncate: 20, JSON: true}, `{"path":"input","line":1,"offset":0,"text":"` + long + `","spans":[{"text":"needle","start":50,"end":56,"start_column":50,"end_column":56}]}` + "\n"},
+	} {
+		re, err := Compile("(?m)" + tt.re)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		g := tt.g
+		g.Regexp, g.Stdout, g.Stderr, g.H = re, &out, &out, true
+		g.Reader(strings.NewReader(tt.s), "input")
+		if out.String() != tt.out {
+			t.Errorf("grep -truncate %d %#q = %q, want %q", tt.g.Truncate, tt.re, out.String(), tt.out)
+		}
+	}
+}
+
+func TestGrepOffset(t *testing.T) {
+	// The input spans several reads into the 1 MB buffer.
+	input := strings.Repeat("x\n", 1<<20) + "needle\n" + strings.Repeat("y\n", 1<<20) + "needle\n"
+	re, err := Compile("(?m)needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, B: true, N: true, H: true}
+	g.Reader(strings.NewReader(input), "input")
+	want := fmt.Sprintf("%d:%d:needle\n%d:%d:needle\n", 1<<20+1, 2<<20, 2<<20+2, 4<<20+7)
+	if out.String() != want {
+		t.Errorf("grep -b -n = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	g = Grep{Regexp: re, Stdout: &out, Stderr: &out, V: true, C: true, H: true}
+	g.Reader(strings.NewReader(input), "input")
+	if want := fmt.Sprintf("%d\n", 2<<20); out.String() != want {
+		t.Errorf("grep -v -c = %q, want %q", out.String(), want)
+	}
+}
+
+func TestGrepAllOf(t *testing.T) {
+	compile := func(expr string) *Regexp {
+		re, err := Compile("(?m)" + expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return re
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: compile(`uses|calls`), Stdout: &out, Stderr: &out, N: true}
+	g.AllOf = []*Regexp{compile(`uses`), compile(`calls`)}
+	g.Reader(strings.NewReader("uses x\nother\ncalls y\n"), "f1")
+	g.Reader(strings.NewReader("uses x\n"), "f2")
+	g.Reader(strings.NewReader("calls y\ncalls z\n"), "f3")
+	want := "f1:1:uses x\nf1:3:calls y\n"
+	if out.String() != want {
+		t.Errorf("grep with AllOf = %q, want %q", out.String(), want)
+	}
+}
+
+func TestGrepSameLine(t *testing.T) {
+	compile := func(expr string) *Regexp {
+		re, err := Compile("(?m)" + expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return re
+	}
+	input := "foo bar\nfoo\nbar\nbar, then foo\nfoo\n"
+	for _, tt := range []struct {
+		g   Grep
+		out string
+	}{
+		{Grep{N: true}, "1:foo bar\n4:bar, then foo\n"},
+		{Grep{C: true}, "2\n"},
+		{Grep{N: true, V: true}, "2:foo\n3:bar\n5:foo\n"},
+	} {
+		var out bytes.Buffer
+		g := tt.g
+		g.Regexp, g.Stdout, g.Stderr, g.H = compile(`foo`), &out, &out, true
+		g.SameLine = []*Regexp{compile(`bar`)}
+		g.Reader(strings.NewReader(input), "input")
+		if out.String() != tt.out {
+			t.Errorf("grep %+v with SameLine = %q, want %q", tt.g, out.String(), tt.out)
+		}
+	}
+}
+
+// failReader fails the test if it is read.
+type failReader struct{ t *testing.T }
+
+func (r failReader) Read([]byte) (int, error) {
+	r.t.Error("quiet grep read input after a match")
+	return 0, io.EOF
+}
+
+func TestGrepQuiet(t *testing.T) {
+	re, err := Compile("(?m)a+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, Q: true, N: true}
+	g.Reader(strings.NewReader("xyz\n"), "f1")
+	if g.Match {
+		t.Fatal("quiet grep matched xyz")
+	}
+	g.Reader(strings.NewReader("abc\n"), "f2")
+	g.Reader(failReader{t}, "f3")
+	if !g.Match || out.Len() != 0 {
+		t.Errorf("quiet grep: Match = %v, output %q, want true, no output", g.Match, out.String())
+	}
+}
+
+func TestGrepJSON(t *testing.T) {
+	re, err := Compile(`(?m)(?P<key>\w+)=(?P<val>\d+)?`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, JSON: true}
+	g.Reader(strings.NewReader("x\n  a=1\nb=\n"), "f")
+	want := `{"path":"f","line":2,"offset":2,"text":"  a=1","spans":[{"text":"a=1","start":2,"end":5,"start_column":2,"end_column":5}],"groups":[{"name":"key","text":"a","start":2,"end":3,"start_column":2,"end_column":3},{"name":"val","text":"1","start":4,"end":5,"start_column":4,"end_column":5}]}
+{"path":"f","line":3,"offset":8,"text":"b=","spans":[{"text":"b=","start":0,"end":2,"start_column":0,"end_column":2}],"groups":[{"name":"key","text":"b","start":0,"end":1,"start_column":0,"end_column":1},{"name":"val","text":"","start":-1,"end":-1,"start_column":-1,"end_column":-1}]}
+`
+	if out.String() != want {
+		t.Errorf("grep -json = %s, want %s", out.String(), want)
+	}
+
+	var ms []*Match
+	g = Grep{Regexp: re, Stdout: &out, Stderr: &out, Func: func(m *Match) { ms = append(ms, m) }}
+	g.Reader(strings.NewReader("\x00key=42\n"), "bin")
+	if len(ms) != 1 || !ms[0].Binary || ms[0].Text != "" || ms[0].Groups != nil {
+		t.Errorf("grep binary file with Func = %+v, want one binary match", ms)
+	}
+}
+
+func TestGrepSpans(t *testing.T) {
+	re, err := Compile(`(?m)(?P<word>é+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ms []*Match
+	g := Grep{Regexp: re, Func: func(m *Match) { ms = append(ms, m) }}
+	g.Reader(strings.NewReader("café, éé\n"), "f")
+	want := []Span{
+		{Text: "é", Start: 3, End: 5, StartColumn: 3, EndColumn: 4},
+		{Text: "éé", Start: 7, End: 11, StartColumn: 6, EndColumn: 8},
+	}
+	if len(ms) != 1 || !reflect.DeepEqual(ms[0].Spans, want) {
+		t.Fatalf("grep spans = %+v, want one match with spans %+v", ms, want)
+	}
+	if g := ms[0].Groups; len(g) != 1 || g[0].StartColumn != 3 || g[0].EndColumn != 4 {
+		t.Errorf("grep groups = %+v, want word at columns 3 to 4", g)
+	}
+}
+
+func TestGrepVimgrep(t *testing.T) {
+	re, err := Compile(`(?m)é+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, Vimgrep: true, Label: "ix"}
+	g.Reader(strings.NewReader("x\ncafé, éé\n"), "f")
+	g.Reader(strings.NewReader("\x00é\n"), "bin")
+	want := "f:2:4:café, éé\nf:2:8:café, éé\nBinary file bin matches\n"
+	if out.String() != want {
+		t.Errorf("grep -vimgrep = %q, want %q", out.String(), want)
+	}
+}
+
+func TestGrepFormat(t *testing.T) {
+	re, err := Compile(`(?m)(?P<key>\w+)=`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var format *template.Template
+	if err := (formatFlag{&format}).Set(`{{.Path}}:{{.Line}}: {{.Text}}{{range .Groups}} [{{.Name}}={{.Text}}]{{end}}`); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	g := Grep{Regexp: re, Stdout: &out, Stderr: &out, Format: format}
+	g.Reader(strings.NewReader("x\na=1\n"), "f")
+	if want := "f:2: a=1 [key=a]\n"; out.String() != want {
+		t.Errorf("grep -format = %q, want %q", out.String(), want)
+	}
+
+	if err := (formatFlag{&format}).Set(`{{.Path`); err == nil {
+		t.Error("Set accepted unterminated template")
+	}
+}
+
+func TestBinaryFilesFlag(t *testing.T) {
+	for _, b := range []BinaryFiles{BinaryReport, BinarySkip, BinaryText} {
+		var b2 BinaryFiles = -1
+		if err := b2.Set(b.String()); err != nil || b2 != b {
+			t.Errorf("Set(%q) = %v, %v, want %v", b.String(), b2, err, b)
+		}
+	}
+	var b BinaryFiles
+	if err := b.Set("binary-ish"); err == nil {
+		t.Error("Set(binary-ish) succeeded")
 	}
 }
@@ -0,0 +1,149 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package trace defines hooks for tracing searches.
+//
+// Searches record spans, timed and nested operations with attributes,
+// through the Span interface, so that an operator can see where a slow
+// search spends its time. The interface is small enough to implement
+// with any tracing system, such as OpenTelemetry, without this module
+// depending on one: an adapter's Span wraps the system's span and its
+// context, and its Start starts a child span in that context. The
+// package also provides Writer, a Tracer that prints each finished
+// trace as an indented tree, for debugging.
+//
+// The instrumented operations take a parent Span, such as the
+// Trace field of index.SearchOptions or regexp.Grep, and do no
+// tracing if it is nil.
+package trace
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Tracer starts traces.
+type Tracer interface {
+	// Start starts a root span with the given name.
+	Start(name string) Span
+}
+
+// A Span is an operation being traced.
+// Its methods may be called concurrently.
+type Span interface {
+	// Start starts a child span of the span with the given name.
+	Start(name string) Span
+
+	// SetAttr records an attribute of the span,
+	// such as the number of files found.
+	SetAttr(key string, value interface{})
+
+	// End ends the span. The span must not be used afterward.
+	End()
+}
+
+// Start starts a child span of parent with the given name,
+// or returns a Span that does nothing if parent is nil.
+func Start(parent Span, name string) Span {
+	if parent == nil {
+		return nop{}
+	}
+	return parent.Start(name)
+}
+
+// nop is a Span that does nothing.
+type nop struct{}
+
+func (nop) Start(string) Span           { return nop{} }
+func (nop) SetAttr(string, interface{}) {}
+func (nop) End()                        {}
+
+// Writer is a Tracer that writes each trace to W when its root span
+// ends, as one line per span, indented by depth, giving the span's
+// name, duration, and attributes:
+//
+//	search 1.2ms index=/home/rsc/.csearchindex
+//	  filter 15µs
+//	  query 1.1ms query="abc" files=12
+type Writer struct {
+	W io.Writer
+
+	mu sync.Mutex // serializes writes to W
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{W: w}
+}
+
+// Start starts a root span.
+func (w *Writer) Start(name string) Span {
+	return &span{w: w, name: name, start: time.Now()}
+}
+
+// A span is a Span started by a Writer.
+type span struct {
+	w        *Writer
+	parent   *span
+	name     string
+	start    time.Time
+	mu       sync.Mutex
+	dur      time.Duration
+	attrs    []string
+	children []*span
+}
+
+func (s *span) Start(name string) Span {
+	c := &span{w: s.w, parent: s, name: name, start: time.Now()}
+	s.mu.Lock()
+	s.children = append(s.children, c)
+	s.mu.Unlock()
+	return c
+}
+
+func (s *span) SetAttr(key string, value interface{}) {
+	var v string
+	if str, ok := value.(string); ok {
+		v = fmt.Sprintf("%q", str)
+		if !strings.ContainsAny(str, " \t\n\"=") && str != "" {
+			v = str
+		}
+	} else {
+		v = fmt.Sprint(value)
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, key+"="+v)
+	s.mu.Unlock()
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	s.dur = time.Since(s.start)
+	s.mu.Unlock()
+	if s.parent != nil {
+		return
+	}
+	var b strings.Builder
+	s.write(&b, 0)
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	io.WriteString(s.w.W, b.String())
+}
+
+// write writes s and its children to b, indented by depth.
+func (s *span) write(b *strings.Builder, depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(b, "%s%s %v", strings.Repeat("  ", depth), s.name, s.dur)
+	for _, a := range s.attrs {
+		fmt.Fprintf(b, " %s", a)
+	}
+	b.WriteString("\n")
+	for _, c := range s.children {
+		c.write(b, depth+1)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var b strings.Builder
+	root := NewWriter(&b).Start("search")
+	root.SetAttr("index", "/home/rsc/.csearchindex")
+	q := root.Start("query")
+	q.SetAttr("query", "abc def")
+	q.SetAttr("files", 12)
+	Start(q, "postingQuery").End()
+	q.End()
+	root.Start("names").End()
+	if b.Len() != 0 {
+		t.Fatalf("trace written before root span ended:\n%s", b.String())
+	}
+	root.End()
+
+	// Replace durations, which vary.
+	got := regexp.MustCompile(`(?m)^( *\w+) \S+`).ReplaceAllString(b.String(), "$1 D")
+	want := `search D index=/home/rsc/.csearchindex
+  query D query="abc def" files=12
+    postingQuery D
+  names D
+`
+	if got != want {
+		t.Errorf("trace:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStartNil(t *testing.T) {
+	sp := Start(nil, "search")
+	sp.SetAttr("files", 1)
+	Start(sp, "query").End()
+	sp.End()
+}
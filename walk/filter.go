@@ -0,0 +1,126 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walk
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+)
+
+// File filters.
+//
+// A Walker decides which entries of a directory to walk by consulting
+// a chain of filters: those of the Filters, Include, Exclude, and
+// MaxFileSize options, in the order the options were given, followed,
+// for a Walker created by NewGitignoreWalker without the NoGitignore
+// option, by the gitignore filter, which also honors .hgignore and
+// .svnignore files. The first filter with a decision other than
+// Continue decides; if every filter continues, the entry is walked.
+// Filters are not consulted for the root of a walk.
+
+// GitignoreReason is the reason given to the OnSkip function for an
+// entry excluded by a .gitignore file.
+const GitignoreReason = "excluded by gitignore"
+
+// A Decision is the verdict of a FileFilter on a file or directory.
+type Decision int
+
+const (
+	Continue Decision = iota // no opinion: consult the next filter
+	Accept                   // walk the entry, skipping later filters
+	Skip                     // skip the file, or the directory and its contents
+)
+
+// A FileFilter decides whether a Walker walks a file or directory.
+type FileFilter interface {
+	Match(path string, d fs.DirEntry) Decision
+}
+
+// A FilterFunc is a function used as a FileFilter.
+type FilterFunc func(path string, d fs.DirEntry) Decision
+
+// Match returns f(path, d).
+func (f FilterFunc) Match(path string, d fs.DirEntry) Decision {
+	return f(path, d)
+}
+
+// A Reasoner is a FileFilter that can explain why it skipped an entry.
+type Reasoner interface {
+	FileFilter
+	Reason(path string, d fs.DirEntry) string
+}
+
+// OnSkip returns an Option that causes a Walker to call fn for each
+// file or directory that its filters skip, with the reason it was
+// skipped. The reason is given by the filter if it is a Reasoner.
+func OnSkip(fn func(path string, reason string)) Option {
+	return func(w *gitignoreWalker) {
+		w.onSkip = fn
+	}
+}
+
+// Filters returns an Option that adds the filters to a Walker.
+func Filters(filters ...FileFilter) Option {
+	return func(w *gitignoreWalker) {
+		w.filters = append(w.filters, filters...)
+	}
+}
+
+// SizeFilter returns a FileFilter that skips files larger than n bytes.
+// If n is 0, it continues for every file.
+func SizeFilter(n int64) FileFilter {
+	return sizeFilter(n)
+}
+
+type sizeFilter int64
+
+func (n sizeFilter) Match(path string, d fs.DirEntry) Decision {
+	if n <= 0 || !d.Type().IsRegular() {
+		return Continue
+	}
+	if info, err := d.Info(); err == nil && info.Size() > int64(n) {
+		return Skip
+	}
+	return Continue
+}
+
+func (n sizeFilter) Reason(path string, d fs.DirEntry) string {
+	return fmt.Sprintf("larger than %d bytes", int64(n))
+}
+
+// filter runs the filter chain for the entry d with the given path,
+// which splits into pathSplit.
+func (w *gitignoreWalker) filter(path string, pathSplit []string, d fs.DirEntry) Decision {
+	for _, f := range w.filters {
+		dec := f.Match(path, d)
+		if dec == Skip && w.onSkip != nil {
+			reason := "excluded by filter"
+			if r, ok := f.(Reasoner); ok {
+				reason = r.Reason(path, d)
+			}
+			w.onSkip(path, reason)
+		}
+		if dec != Continue {
+			return dec
+		}
+	}
+	reason := ""
+	if w.m != nil && w.m.Match(pathSplit, d.IsDir()) {
+		reason = GitignoreReason
+	} else {
+		reason = w.ignored(pathSplit)
+	}
+	if reason != "" {
+		if w.onSkip != nil {
+			w.onSkip(path, reason)
+		} else {
+			// TODO log only on -logskip
+			log.Printf("skipped %s: %s\n", path, reason)
+		}
+		return Skip
+	}
+	return Continue
+}
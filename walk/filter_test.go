@@ -0,0 +1,62 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walk
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.txt", "big.go", "keep/c.txt", "skip/d.go"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		data := "x"
+		if strings.HasPrefix(name, "big") {
+			data = strings.Repeat("x", 100)
+		}
+		if err := os.WriteFile(file, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keep := FilterFunc(func(path string, d fs.DirEntry) Decision {
+		if filepath.Base(filepath.Dir(path)) == "keep" {
+			return Accept
+		}
+		return Continue
+	})
+	w := NewWalker(
+		Filters(keep),
+		Include("*.go"),
+		Exclude("skip"),
+		MaxFileSize(10),
+	)
+	var have []string
+	err := w.Walk(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			have = append(have, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.go", "keep/c.txt"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("walked %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walk
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Glob filters.
+//
+// Include and Exclude filter the walk by glob patterns, matched against
+// slash-separated paths relative to the root of the walk. Pattern
+// elements are matched as by path.Match, and an element ** matches any
+// number of path elements, including none. A pattern with no slash,
+// such as *.go, matches the last element of a path, anywhere in the tree.
+// Since ** matches no elements, vendor/** matches the directory vendor
+// itself, so that excluding it skips the directory without reading it.
+
+// Include returns an Option that restricts the walk to files matching
+// at least one of the patterns. Directories are walked regardless.
+func Include(patterns ...string) Option {
+	return func(w *gitignoreWalker) {
+		w.filters = append(w.filters, &globFilter{w: w, globs: compileGlobs(patterns), include: true})
+	}
+}
+
+// Exclude returns an Option that skips files and directories matching
+// any of the patterns.
+func Exclude(patterns ...string) Option {
+	return func(w *gitignoreWalker) {
+		w.filters = append(w.filters, &globFilter{w: w, globs: compileGlobs(patterns)})
+	}
+}
+
+// A globFilter is the FileFilter for Include or Exclude.
+type globFilter struct {
+	w       *gitignoreWalker // for the root of the walk
+	globs   []glob
+	include bool
+}
+
+func (f *globFilter) Reason(path string, d fs.DirEntry) string {
+	if f.include {
+		return "not matched by include patterns"
+	}
+	rel, _ := filepath.Rel(f.w.root, path)
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	for _, g := range f.globs {
+		if g.match(elems) {
+			return "excluded by " + g.pattern
+		}
+	}
+	return "excluded"
+}
+
+func (f *globFilter) Match(path string, d fs.DirEntry) Decision {
+	if f.include && d.IsDir() {
+		return Continue
+	}
+	rel, err := filepath.Rel(f.w.root, path)
+	if err != nil {
+		return Continue
+	}
+	if matchAny(f.globs, strings.Split(filepath.ToSlash(rel), "/")) != f.include {
+		return Skip
+	}
+	return Continue
+}
+
+// CheckGlob reports whether pattern is a well-formed glob pattern.
+func CheckGlob(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// A glob is a compiled glob pattern.
+type glob struct {
+	pattern string
+	elems   []string
+	base    bool // match only the last path element
+}
+
+func compileGlobs(patterns []string) []glob {
+	var globs []glob
+	for _, p := range patterns {
+		p = strings.TrimPrefix(p, "/")
+		globs = append(globs, glob{
+			pattern: p,
+			elems:   strings.Split(p, "/"),
+			base:    !strings.Contains(p, "/"),
+		})
+	}
+	return globs
+}
+
+// match reports whether g matches the path with the given elements.
+func (g glob) match(elems []string) bool {
+	if g.base {
+		if len(elems) == 0 {
+			return false
+		}
+		elems = elems[len(elems)-1:]
+	}
+	return matchElems(g.elems, elems)
+}
+
+func matchElems(pat, elems []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pat, elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], elems[0]); !ok {
+			return false
+		}
+		pat, elems = pat[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// matchAny reports whether any of globs matches the path elements.
+func matchAny(globs []glob, elems []string) bool {
+	for _, g := range globs {
+		if g.match(elems) {
+			return true
+		}
+	}
+	return false
+}
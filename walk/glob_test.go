@@ -0,0 +1,41 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walk
+
+import (
+	"strings"
+	"testing"
+)
+
+var globTests = []struct {
+	pattern string
+	path    string
+	match   bool
+}{
+	{"*.go", "main.go", true},
+	{"*.go", "cmd/cindex/cindex.go", true},
+	{"*.go", "cmd/cindex", false},
+	{"vendor/**", "vendor", true},
+	{"vendor/**", "vendor/a/b.go", true},
+	{"vendor/**", "x/vendor/b.go", false},
+	{"**/vendor/**", "x/vendor/b.go", true},
+	{"**/testdata", "testdata", true},
+	{"**/testdata", "a/b/testdata", true},
+	{"**/testdata", "a/b/testdata/x", false},
+	{"/cmd/*/*.go", "cmd/cindex/cindex.go", true},
+	{"cmd/*.go", "cmd/cindex/cindex.go", false},
+	{"a/**/b/*.c", "a/x/y/b/z.c", true},
+	{"a/**/b/*.c", "a/b/z.c", true},
+	{"a/**/b/*.c", "a/b/z.h", false},
+}
+
+func TestGlob(t *testing.T) {
+	for _, tt := range globTests {
+		g := compileGlobs([]string{tt.pattern})[0]
+		if m := g.match(strings.Split(tt.path, "/")); m != tt.match {
+			t.Errorf("glob %q match %q = %v, want %v", tt.pattern, tt.path, m, tt.match)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package walk
+
+import "io/fs"
+
+// A fileKey identifies a file. It is unavailable on this system.
+type fileKey struct{}
+
+const haveFileKeys = false
+
+func keyOf(info fs.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
@@ -0,0 +1,302 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Mercurial and Subversion ignore files.
+//
+// Besides .gitignore files, a Walker created by NewGitignoreWalker
+// honors the .hgignore and .svnignore files in the tree, so that
+// checkouts of other version control systems are walked without the
+// noise they ignore.
+//
+// An .hgignore file is read as Mercurial reads it: its patterns are
+// matched against paths relative to the directory holding it. Text
+// after an unescaped # is a comment. A line "syntax: glob" or
+// "syntax: regexp" sets the syntax of the lines after it, which is
+// regexp at first, and a pattern may override it with a prefix re:,
+// glob:, rootglob:, or path:. A regexp, in Go syntax, matches a path
+// if it matches any part of it. A glob matches a path if it matches
+// the path from any directory down, a rootglob only if it matches the
+// whole path. In a glob, * and ? do not match a slash, ** matches any
+// number of path elements, and {a,b} matches either a or b. A path:
+// pattern matches the path it names. The include: and subinclude:
+// prefixes are not supported.
+//
+// An .svnignore file holds the patterns of a directory's svn:ignore
+// property, as given to svn propset svn:ignore -F .svnignore: one glob
+// per line, which matches the names of the files and directories
+// directly in the directory holding it.
+
+// HgignoreReason and SvnignoreReason are the reasons given to the
+// OnSkip function for an entry excluded by an .hgignore or .svnignore
+// file.
+const (
+	HgignoreReason  = "excluded by hgignore"
+	SvnignoreReason = "excluded by svnignore"
+)
+
+// An ignorePattern is a pattern read from an .hgignore or .svnignore
+// file.
+type ignorePattern struct {
+	reason string
+	dir    []string // the directory holding the ignore file
+	match  func(elems []string) bool
+}
+
+// matches reports whether p matches the path that splits into
+// pathSplit, which must be under p.dir.
+func (p *ignorePattern) matches(pathSplit []string) bool {
+	if len(pathSplit) <= len(p.dir) {
+		return false
+	}
+	return p.match(pathSplit[len(p.dir):])
+}
+
+// hgPrefixes maps the prefixes of .hgignore patterns to their syntax.
+var hgPrefixes = map[string]string{
+	"re":       "regexp",
+	"regexp":   "regexp",
+	"relre":    "regexp",
+	"glob":     "glob",
+	"relglob":  "glob",
+	"rootglob": "rootglob",
+	"path":     "path",
+	"relpath":  "path",
+}
+
+// parseHgignore parses the .hgignore file data in the directory dir.
+// It returns the patterns it could parse and the first error, if any,
+// which begins with its line number.
+func parseHgignore(data []byte, dir []string) ([]*ignorePattern, error) {
+	var ps []*ignorePattern
+	var first error
+	syntax := "regexp"
+	s := bufio.NewScanner(bytes.NewReader(data))
+	n := 1
+	for ; s.Scan(); n++ {
+		line := stripHgComment(s.Text())
+		if line == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "syntax:"); ok {
+			rest = strings.TrimSpace(rest)
+			if hgPrefixes[rest] == "" || hgPrefixes[rest] == "path" {
+				if first == nil {
+					first = fmt.Errorf("%d: unknown syntax %q", n, rest)
+				}
+				continue
+			}
+			syntax = hgPrefixes[rest]
+			continue
+		}
+		lineSyntax := syntax
+		if prefix, rest, ok := strings.Cut(line, ":"); ok {
+			if hgPrefixes[prefix] != "" {
+				lineSyntax, line = hgPrefixes[prefix], rest
+			} else if prefix == "include" || prefix == "subinclude" {
+				if first == nil {
+					first = fmt.Errorf("%d: %s is not supported", n, prefix)
+				}
+				continue
+			}
+		}
+		match, err := compileHgPattern(lineSyntax, line)
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("%d: %v", n, err)
+			}
+			continue
+		}
+		ps = append(ps, &ignorePattern{reason: HgignoreReason, dir: dir, match: match})
+	}
+	if err := s.Err(); err != nil && first == nil {
+		first = fmt.Errorf("%d: %v", n, err)
+	}
+	return ps, first
+}
+
+// stripHgComment removes the comment and trailing space from an
+// .hgignore line and unescapes \#.
+func stripHgComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] != '\\') {
+			line = line[:i]
+			break
+		}
+	}
+	line = strings.ReplaceAll(line, `\#`, "#")
+	return strings.TrimRight(line, " \t\r")
+}
+
+// compileHgPattern compiles an .hgignore pattern in the given syntax
+// into a function matching slash-separated path elements.
+func compileHgPattern(syntax, pattern string) (func(elems []string) bool, error) {
+	switch syntax {
+	case "regexp":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(elems []string) bool {
+			return re.MatchString(strings.Join(elems, "/"))
+		}, nil
+	case "path":
+		want := strings.Split(strings.Trim(pattern, "/"), "/")
+		return func(elems []string) bool {
+			return slices.Equal(elems, want)
+		}, nil
+	}
+	var globs [][]string
+	for _, p := range expandBraces(pattern) {
+		if err := CheckGlob(strings.ReplaceAll(p, "**", "*")); err != nil {
+			return nil, err
+		}
+		globs = append(globs, strings.Split(strings.Trim(p, "/"), "/"))
+	}
+	rooted := syntax == "rootglob"
+	return func(elems []string) bool {
+		for _, g := range globs {
+			for i := 0; i < len(elems); i++ {
+				if matchElems(g, elems[i:]) {
+					return true
+				}
+				if rooted {
+					break
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// expandBraces expands the alternatives {a,b} of a glob pattern into
+// the patterns they stand for. Braces may nest.
+func expandBraces(pattern string) []string {
+	start := strings.IndexByte(pattern, '{')
+	if start < 0 {
+		return []string{pattern}
+	}
+	depth := 0
+	var alts []string
+	last := start + 1
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alts = append(alts, pattern[last:i])
+				last = i + 1
+			}
+		case '}':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			alts = append(alts, pattern[last:i])
+			var out []string
+			for _, alt := range alts {
+				for _, rest := range expandBraces(alt + pattern[i+1:]) {
+					out = append(out, pattern[:start]+rest)
+				}
+			}
+			return out
+		}
+	}
+	// An unclosed brace is literal.
+	return []string{pattern}
+}
+
+// parseSvnignore parses the .svnignore file data in the directory dir.
+// It returns the patterns it could parse and the first error, if any.
+func parseSvnignore(data []byte, dir []string) ([]*ignorePattern, error) {
+	var ps []*ignorePattern
+	var first error
+	s := bufio.NewScanner(bytes.NewReader(data))
+	n := 1
+	for ; s.Scan(); n++ {
+		pattern := strings.TrimSpace(s.Text())
+		if pattern == "" {
+			continue
+		}
+		if err := CheckGlob(pattern); err != nil {
+			if first == nil {
+				first = fmt.Errorf("%d: %v", n, err)
+			}
+			continue
+		}
+		ps = append(ps, &ignorePattern{
+			reason: SvnignoreReason,
+			dir:    dir,
+			match: func(elems []string) bool {
+				if len(elems) != 1 {
+					return false
+				}
+				ok, _ := path.Match(pattern, elems[0])
+				return ok
+			},
+		})
+	}
+	if err := s.Err(); err != nil && first == nil {
+		first = fmt.Errorf("%d: %v", n, err)
+	}
+	return ps, first
+}
+
+// readHgignore reads the .hgignore file in the given directory, if it
+// exists.
+func (w *gitignoreWalker) readHgignore(path string, pathSplit []string) error {
+	return w.readIgnore(path, pathSplit, ".hgignore", parseHgignore)
+}
+
+// readSvnignore reads the .svnignore file in the given directory, if
+// it exists.
+func (w *gitignoreWalker) readSvnignore(path string, pathSplit []string) error {
+	return w.readIgnore(path, pathSplit, ".svnignore", parseSvnignore)
+}
+
+func (w *gitignoreWalker) readIgnore(path string, pathSplit []string, name string, parse func([]byte, []string) ([]*ignorePattern, error)) error {
+	file := filepath.Join(path, name)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			err = nil
+		}
+		return err
+	}
+	// The patterns are kept while walking the directory, and pathSplit
+	// is reused, so they need a copy.
+	ps, err := parse(data, append([]string(nil), pathSplit...))
+	w.ignores = append(w.ignores, ps...)
+	if err != nil {
+		return fmt.Errorf("%s:%v", file, err)
+	}
+	return nil
+}
+
+// ignored returns the reason an .hgignore or .svnignore pattern
+// excludes the path that splits into pathSplit, or "" if none does.
+func (w *gitignoreWalker) ignored(pathSplit []string) string {
+	for _, p := range w.ignores {
+		if p.matches(pathSplit) {
+			return p.reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walk
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var hgignoreTests = []struct {
+	file  string
+	path  string
+	match bool
+}{
+	{`\.orig$`, "a/b.orig", true},
+	{`\.orig$`, "a/b.orig.go", false},
+	{`^build$`, "build", true},
+	{`^build$`, "src/build", false},
+	{"syntax: glob\n*.o", "x.o", true},
+	{"syntax: glob\n*.o", "a/b/x.o", true},
+	{"syntax: glob\n*.o", "x.oo", false},
+	{"syntax: glob\nout/*.js", "web/out/a.js", true},
+	{"syntax: glob\nout/*.js", "out/sub/a.js", false},
+	{"syntax: glob\nout/**/*.js", "out/sub/a.js", true},
+	{"syntax: glob\n*.{pyc,pyo}", "m/x.pyo", true},
+	{"syntax: glob\n*.{pyc,pyo}", "m/x.py", false},
+	{"syntax: glob\nre:^gen/", "gen/x", true},
+	{"syntax: glob\nre:^gen/", "src/gen/x", false},
+	{"rootglob:*.log", "x.log", true},
+	{"rootglob:*.log", "a/x.log", false},
+	{"syntax: rootglob\ndist", "dist", true},
+	{"syntax: rootglob\ndist", "a/dist", false},
+	{"path:a/b", "a/b", true},
+	{"path:a/b", "c/a/b", false},
+	{`foo\#bar # comment`, "foo#bar", true},
+	{"# only a comment\n\n", "x", false},
+}
+
+func TestParseHgignore(t *testing.T) {
+	for _, tt := range hgignoreTests {
+		ps, err := parseHgignore([]byte(tt.file), nil)
+		if err != nil {
+			t.Errorf("parseHgignore(%q): %v", tt.file, err)
+			continue
+		}
+		match := false
+		for _, p := range ps {
+			if p.matches(strings.Split(tt.path, "/")) {
+				match = true
+			}
+		}
+		if match != tt.match {
+			t.Errorf("parseHgignore(%q) matches %q = %v, want %v", tt.file, tt.path, match, tt.match)
+		}
+	}
+
+	for _, file := range []string{
+		"a(",
+		"syntax: glob\n[",
+		"syntax: path",
+		"include:other",
+	} {
+		if _, err := parseHgignore([]byte(file), nil); err == nil {
+			t.Errorf("parseHgignore(%q) succeeded, want error", file)
+		}
+	}
+
+	// Valid lines are kept despite errors.
+	ps, err := parseHgignore([]byte("good\nbad(\n"), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "2: ") || len(ps) != 1 {
+		t.Errorf("parseHgignore = %d patterns, %v, want 1, error on line 2", len(ps), err)
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.go", []string{"*.go"}},
+		{"*.{c,h}", []string{"*.c", "*.h"}},
+		{"{a,b}/{c,d}", []string{"a/c", "a/d", "b/c", "b/d"}},
+		{"x{a,{b,c}}", []string{"xa", "xb", "xc"}},
+		{"x{a", []string{"x{a"}},
+	} {
+		if got := expandBraces(tt.pattern); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandBraces(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestVCSIgnore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".hgignore":          "syntax: glob\n*.orig\nre:^out/\n",
+		"a.go":               "x",
+		"a.go.orig":          "x",
+		"out/b.js":           "x",
+		"src/out/c.js":       "x",
+		"src/.svnignore":     "*.tmp\nbin\n",
+		"src/d.tmp":          "x",
+		"src/e.go":           "x",
+		"src/bin/f":          "x",
+		"src/sub/g.tmp":      "x",
+		"src/sub/bin/h":      "x",
+		"other/.hgignore":    "^local$\n",
+		"other/local":        "x",
+		"other/not/local":    "x",
+		"other/x.orig":       "x",
+		"sibling/local":      "x",
+		"sibling/.svnignore": "",
+	}
+	for name, data := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	skipped := make(map[string]string)
+	w, err := NewGitignoreWalker(LocalGitignore(), OnSkip(func(path, reason string) {
+		rel, _ := filepath.Rel(dir, path)
+		skipped[filepath.ToSlash(rel)] = reason
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	err = w.Walk(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !strings.Contains(path, "ignore") {
+			rel, _ := filepath.Rel(dir, path)
+			have = append(have, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.go", "other/not/local", "sibling/local", "src/e.go", "src/out/c.js", "src/sub/bin/h", "src/sub/g.tmp"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("walked %q, want %q", have, want)
+	}
+	wantSkipped := map[string]string{
+		"a.go.orig":    HgignoreReason,
+		"out/b.js":     HgignoreReason,
+		"other/local":  HgignoreReason,
+		"other/x.orig": HgignoreReason,
+		"src/bin":      SvnignoreReason,
+		"src/d.tmp":    SvnignoreReason,
+	}
+	if !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("skipped %q, want %q", skipped, wantSkipped)
+	}
+
+	// NoGitignore walks them all.
+	w, err = NewGitignoreWalker(NoGitignore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	err = w.Walk(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil || n != len(files) {
+		t.Errorf("NoGitignore walked %d files, %v, want %d", n, err, len(files))
+	}
+}
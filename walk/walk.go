@@ -8,7 +8,6 @@ import (
 	"bufio"
 	"errors"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -34,23 +33,113 @@ type Walker interface {
 	Walk(root string, fn Func) error
 }
 
+// An Option configures a Walker.
+type Option func(*gitignoreWalker)
+
+// FollowSymlinks returns an Option that causes a Walker to follow
+// symbolic links, walking linked directories as if they were in the
+// tree and reporting linked files as the files they refer to. Each
+// directory is walked at most once per call to Walk, which breaks
+// cycles. On systems where the identity of a directory cannot be
+// determined, links to directories are not followed.
+func FollowSymlinks() Option {
+	return func(w *gitignoreWalker) {
+		w.follow = true
+	}
+}
+
+// MaxDepth returns an Option that limits the walk to n levels of
+// directories below the root: the entries of the root are at depth 1.
+// If n is 0, there is no limit.
+func MaxDepth(n int) Option {
+	return func(w *gitignoreWalker) {
+		w.maxDepth = n
+	}
+}
+
+// NoGitignore returns an Option that causes a Walker created by
+// NewGitignoreWalker to walk the files excluded by gitignore,
+// .hgignore, and .svnignore files, as one created by NewWalker does,
+// so that ignored files such as generated code can be indexed. Its
+// other options still apply.
+func NoGitignore() Option {
+	return func(w *gitignoreWalker) {
+		w.ignore = ignoreNone
+	}
+}
+
+// LocalGitignore returns an Option that causes a Walker created by
+// NewGitignoreWalker to honor only the .gitignore files in the tree
+// walked, and its .hgignore and .svnignore files, not the global and
+// system gitignore files named by ~/.gitconfig and /etc/gitconfig.
+func LocalGitignore() Option {
+	return func(w *gitignoreWalker) {
+		w.ignore = ignoreLocal
+	}
+}
+
+// MaxFileSize returns an Option that skips files larger than n bytes.
+// If n is 0, there is no limit.
+func MaxFileSize(n int64) Option {
+	return Filters(SizeFilter(n))
+}
+
 type walker struct{}
 
-func NewWalker() Walker { return walker{} }
+func NewWalker(opts ...Option) Walker {
+	if len(opts) == 0 {
+		return walker{}
+	}
+	var w gitignoreWalker
+	for _, opt := range opts {
+		opt(&w)
+	}
+	return &w
+}
 
 func (w walker) Walk(root string, fn Func) error {
 	return filepath.WalkDir(root, fn)
 }
 
+// A gitignoreWalker walks a tree, skipping files excluded by gitignore
+// files if m is non-nil.
 type gitignoreWalker struct {
-	ps []gitignore.Pattern
-	m  gitignore.Matcher
+	ps      []gitignore.Pattern
+	m       gitignore.Matcher
+	ignores []*ignorePattern // from .hgignore and .svnignore files
+
+	follow  bool
+	visited map[fileKey]bool // directories walked, if following links
+
+	filters  []FileFilter
+	onSkip   func(path, reason string)
+	root     string
+	rootLen  int // number of elements in the root path
+	maxDepth int
+	ignore   ignoreMode
 }
 
-func NewGitignoreWalker() (Walker, error) {
+// An ignoreMode says which gitignore files a gitignoreWalker honors.
+type ignoreMode int
+
+const (
+	ignoreAll   ignoreMode = iota // local, global, and system
+	ignoreLocal                   // only those in the tree
+	ignoreNone
+)
+
+func NewGitignoreWalker(opts ...Option) (Walker, error) {
 	var w gitignoreWalker
-	if err := w.loadGlobalGitignore(); err != nil {
-		return nil, err
+	for _, opt := range opts {
+		opt(&w)
+	}
+	switch w.ignore {
+	case ignoreAll:
+		if err := w.loadGlobalGitignore(); err != nil {
+			return nil, err
+		}
+	case ignoreLocal:
+		w.m = gitignore.NewMatcher(nil)
 	}
 	return &w, nil
 }
@@ -64,6 +153,12 @@ func (w *gitignoreWalker) walk(path string, pathSplit []string, d fs.DirEntry, w
 		}
 		return err
 	}
+	if w.follow && !w.visit(d) {
+		return nil
+	}
+	if w.maxDepth > 0 && len(pathSplit)-w.rootLen >= w.maxDepth {
+		return nil
+	}
 
 	dirs, err := os.ReadDir(path)
 	if err != nil {
@@ -73,12 +168,15 @@ func (w *gitignoreWalker) walk(path string, pathSplit []string, d fs.DirEntry, w
 		}
 	}
 
-	l := len(w.ps)
-	err = w.readGitignore(path, pathSplit)
-	if err != nil {
-		// Third call, to report readGitignore error.
-		if err := walkFn(path, d, err); err != nil {
-			return err
+	l, li := len(w.ps), len(w.ignores)
+	if w.m != nil {
+		for _, read := range []func(string, []string) error{w.readGitignore, w.readHgignore, w.readSvnignore} {
+			if err := read(path, pathSplit); err != nil {
+				// Third call, to report an error reading an ignore file.
+				if err := walkFn(path, d, err); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -86,9 +184,12 @@ func (w *gitignoreWalker) walk(path string, pathSplit []string, d fs.DirEntry, w
 		name := d1.Name()
 		path1 := filepath.Join(path, name)
 		pathSplit1 := append(pathSplit, name)
-		if w.m.Match(pathSplit1, d1.IsDir()) {
-			// TODO log only on -logskip
-			log.Printf("skipped %s: excluded by gitignore\n", path1)
+		if w.follow && d1.Type()&fs.ModeSymlink != 0 {
+			if info, err := os.Stat(path1); err == nil && (haveFileKeys || !info.IsDir()) {
+				d1 = &statDirEntry{info}
+			}
+		}
+		if w.filter(path1, pathSplit1, d1) == Skip {
 			continue
 		}
 		if err := w.walk(path1, pathSplit1, d1, walkFn); err != nil {
@@ -103,6 +204,7 @@ func (w *gitignoreWalker) walk(path string, pathSplit []string, d fs.DirEntry, w
 	// already checks whether a file is within scope of a gitignore, but
 	// this saves extra checks when many gitignores have been read.
 	w.ps = w.ps[:l]
+	w.ignores = w.ignores[:li]
 	return nil
 }
 
@@ -119,11 +221,19 @@ func (w *gitignoreWalker) walk(path string, pathSplit []string, d fs.DirEntry, w
 // Walk does not follow symbolic links found in directories,
 // but if root itself is a symbolic link, its target will be walked.
 func (w *gitignoreWalker) Walk(root string, fn Func) error {
-	info, err := os.Lstat(root)
+	stat := os.Lstat
+	if w.follow {
+		stat = os.Stat
+		w.visited = make(map[fileKey]bool)
+	}
+	info, err := stat(root)
 	if err != nil {
 		err = fn(root, nil, err)
 	} else {
-		err = w.walk(root, split(root), &statDirEntry{info}, fn)
+		rootSplit := split(root)
+		w.root = root
+		w.rootLen = len(rootSplit)
+		err = w.walk(root, rootSplit, &statDirEntry{info}, fn)
 	}
 	if err == SkipDir {
 		return nil
@@ -131,6 +241,24 @@ func (w *gitignoreWalker) Walk(root string, fn Func) error {
 	return err
 }
 
+// visit records the directory d as walked. It reports whether d had not
+// been walked before, so that it should be walked now.
+func (w *gitignoreWalker) visit(d fs.DirEntry) bool {
+	info, err := d.Info()
+	if err != nil {
+		return true
+	}
+	key, ok := keyOf(info)
+	if !ok {
+		return true
+	}
+	if w.visited[key] {
+		return false
+	}
+	w.visited[key] = true
+	return true
+}
+
 type statDirEntry struct {
 	info fs.FileInfo
 }
@@ -0,0 +1,73 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package walk
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGitignoreOptions(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".gitignore":         "*.pb.go\n",
+		"a.go":               "x",
+		"a.pb.go":            "x",
+		"sub/.gitignore":     "# comment\ngen/\n",
+		"sub/b.go":           "x",
+		"sub/gen/c.go":       "x",
+		"sub/gen/d.pb.go":    "x",
+		"other/gen/e.go":     "x",
+		"other/gen/f.pb.txt": "x",
+	}
+	for name, data := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	local := []string{".gitignore", "a.go", "other/gen/e.go", "other/gen/f.pb.txt", "sub/.gitignore", "sub/b.go"}
+	all := []string{".gitignore", "a.go", "a.pb.go", "other/gen/e.go", "other/gen/f.pb.txt", "sub/.gitignore", "sub/b.go", "sub/gen/c.go", "sub/gen/d.pb.go"}
+	for _, tt := range []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{"LocalGitignore", []Option{LocalGitignore()}, local},
+		{"NoGitignore", []Option{NoGitignore()}, all},
+		{"NoGitignore with filters", []Option{NoGitignore(), Exclude("gen")}, []string{".gitignore", "a.go", "a.pb.go", "sub/.gitignore", "sub/b.go"}},
+	} {
+		// OnSkip keeps the gitignore filter from logging.
+		opts := append(tt.opts, OnSkip(func(path, reason string) {}))
+		w, err := NewGitignoreWalker(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		err = w.Walk(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				rel, _ := filepath.Rel(dir, path)
+				have = append(have, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%s: walked %q, want %q", tt.name, have, tt.want)
+		}
+	}
+}